@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maxnilz/feed/errors"
+)
+
+const (
+	// The actions of the links in the mails.
+	ActionRead        = "read"
+	ActionStar        = "star"
+	ActionMute        = "mute"
+	ActionPause       = "pause"
+	ActionUnsubscribe = "unsubscribe"
+
+	defaultLinkTTL = 90 * 24 * time.Hour
+	maxPauseDays   = 365
+)
+
+// linkSigner signs the action links with HMAC-SHA256, a link carries its
+// expiry & is valid for the action & the arguments it's signed for only.
+type linkSigner struct {
+	baseURL string
+	secret  []byte
+	ttl     time.Duration
+}
+
+// newLinkSigner returns nil if the links can't be served, i.e., either
+// the base url of the server or the link secret is missing.
+func newLinkSigner(cfg Config) *linkSigner {
+	if cfg.Server.BaseURL == "" || cfg.Server.LinkSecret == "" {
+		return nil
+	}
+	ttl := cfg.Server.LinkTTL
+	if ttl <= 0 {
+		ttl = defaultLinkTTL
+	}
+	return &linkSigner{baseURL: strings.TrimRight(cfg.Server.BaseURL, "/"), secret: []byte(cfg.Server.LinkSecret), ttl: ttl}
+}
+
+// actionLink is the action a link is signed for, the site & the id of
+// the item are set by the item actions, the site by mute, & the days by
+// pause.
+type actionLink struct {
+	Action     string
+	Subscriber string
+	Site       string
+	Id         string
+	Days       int
+	Expires    time.Time
+}
+
+func (l actionLink) values() url.Values {
+	v := url.Values{"s": {l.Subscriber}, "exp": {strconv.FormatInt(l.Expires.Unix(), 10)}}
+	if l.Site != "" {
+		v.Set("site", l.Site)
+	}
+	if l.Id != "" {
+		v.Set("id", l.Id)
+	}
+	if l.Days > 0 {
+		v.Set("days", strconv.Itoa(l.Days))
+	}
+	return v
+}
+
+func (s *linkSigner) sign(l actionLink) string {
+	mac := hmac.New(sha256.New, s.secret)
+	for _, v := range []string{l.Action, l.Subscriber, l.Site, l.Id, strconv.Itoa(l.Days), strconv.FormatInt(l.Expires.Unix(), 10)} {
+		mac.Write([]byte(v))
+		mac.Write([]byte{0})
+	}
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *linkSigner) url(l actionLink, now time.Time) string {
+	l.Expires = now.Add(s.ttl)
+	v := l.values()
+	v.Set("sig", s.sign(l))
+	return fmt.Sprintf("%s/actions/%s?%s", s.baseURL, l.Action, v.Encode())
+}
+
+// verify returns the action the link is signed for, the expired links
+// are rejected as FailedPrecondition.
+func (s *linkSigner) verify(action string, q url.Values, now time.Time) (actionLink, error) {
+	l := actionLink{Action: action, Subscriber: q.Get("s"), Site: q.Get("site"), Id: q.Get("id")}
+	exp, err := strconv.ParseInt(q.Get("exp"), 10, 64)
+	if err != nil {
+		return l, errors.Newf(errors.NotFound, err, "invalid link")
+	}
+	l.Expires = time.Unix(exp, 0)
+	if days := q.Get("days"); days != "" {
+		if l.Days, err = strconv.Atoi(days); err != nil {
+			return l, errors.Newf(errors.NotFound, err, "invalid link")
+		}
+	}
+	if !hmac.Equal([]byte(q.Get("sig")), []byte(s.sign(l))) {
+		return l, errors.Newf(errors.NotFound, nil, "invalid link")
+	}
+	if now.After(l.Expires) {
+		return l, errors.Newf(errors.FailedPrecondition, nil, "the link is expired")
+	}
+	return l, nil
+}
+
+// mailLinks builds the action links in the mails of a subscriber.
+type mailLinks struct {
+	signer     *linkSigner
+	subscriber string
+}
+
+// newMailLinks returns nil if the links are disabled.
+func newMailLinks(cfg Config, subscriber Subscriber) *mailLinks {
+	signer := newLinkSigner(cfg)
+	if signer == nil {
+		return nil
+	}
+	return &mailLinks{signer: signer, subscriber: subscriber.Name}
+}
+
+func (m *mailLinks) item(feed *Feed, action string) string {
+	return m.signer.url(actionLink{Action: action, Subscriber: m.subscriber, Site: feed.SiteURL, Id: feed.Id}, time.Now())
+}
+
+func (m *mailLinks) mute(siteURL string) string {
+	return m.signer.url(actionLink{Action: ActionMute, Subscriber: m.subscriber, Site: siteURL}, time.Now())
+}
+
+func (m *mailLinks) pause(days int) string {
+	return m.signer.url(actionLink{Action: ActionPause, Subscriber: m.subscriber, Days: days}, time.Now())
+}
+
+func (m *mailLinks) unsubscribe() string {
+	return m.signer.url(actionLink{Action: ActionUnsubscribe, Subscriber: m.subscriber}, time.Now())
+}
+
+// Actions serves the signed action links in the mails at /actions/<action>.
+// The actions ask for a confirmation on GET & are run on POST, so that
+// they're not triggered by the link scanners. The POST to the unsubscribe
+// link is the RFC 8058 one-click unsubscription.
+type Actions struct {
+	signer      *linkSigner
+	subscribers *Subscribers
+	items       *Items
+	storage     Storage
+	scheduler   *Scheduler
+	logger      Logger
+}
+
+func NewActions(cfg Config, subscribers *Subscribers, storage Storage, items *Items, logger Logger) *Actions {
+	return &Actions{
+		signer:      newLinkSigner(cfg),
+		subscribers: subscribers,
+		items:       items,
+		storage:     storage,
+		logger:      logger,
+	}
+}
+
+// SetScheduler makes the unsubscription remove the jobs of the subscriber
+// from the scheduler.
+func (a *Actions) SetScheduler(scheduler *Scheduler) {
+	a.scheduler = scheduler
+}
+
+func (a *Actions) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if a.signer == nil {
+		http.NotFound(w, r)
+		return
+	}
+	action := strings.TrimPrefix(r.URL.Path, "/actions/")
+	l, err := a.signer.verify(action, r.URL.Query(), time.Now())
+	if err != nil {
+		a.writePage(w, err, "")
+		return
+	}
+	subscriber, ok := a.subscribers.Get(l.Subscriber)
+	if !ok {
+		a.writePage(w, errors.Newf(errors.NotFound, nil, "subscriber %s not found", l.Subscriber), "")
+		return
+	}
+	ctx := r.Context()
+	var done string
+	switch action {
+	case ActionRead, ActionStar:
+		change, confirm := ItemChange{Read: boolPtr(true)}, "Mark the item as read?"
+		if action == ActionStar {
+			change, confirm = ItemChange{Starred: boolPtr(true)}, "Star the item?"
+		}
+		if r.Method == http.MethodGet {
+			a.writeConfirm(w, r, confirm)
+			return
+		}
+		var it *Item
+		if it, err = a.items.UpdateByGuid(ctx, l.Subscriber, l.Site, l.Id, change); err == nil {
+			done = fmt.Sprintf("%s: <a href=\"%s\">%s</a>", map[string]string{ActionRead: "Marked as read", ActionStar: "Starred"}[action],
+				html.EscapeString(it.Link), html.EscapeString(it.Title))
+		}
+	case ActionMute, ActionPause, ActionUnsubscribe:
+		var change SubscriptionChange
+		var confirm string
+		switch action {
+		case ActionMute:
+			name := siteNames(subscriber.Sites)[l.Site]
+			if name == "" {
+				name = l.Site
+			}
+			change.MuteSites = []string{l.Site}
+			confirm, done = "Stop fetching "+name+"?", "Muted "+name+"."
+		case ActionPause:
+			if l.Days <= 0 || l.Days > maxPauseDays {
+				err = errors.Newf(errors.InvalidArgument, nil, "invalid pause days %d", l.Days)
+				break
+			}
+			until := time.Now().Add(time.Duration(l.Days) * 24 * time.Hour)
+			change.PausedUntil = &until
+			confirm = fmt.Sprintf("Pause the feeds for %d days?", l.Days)
+			done = "Paused until " + until.Format("Mon, 02 Jan 2006") + "."
+		case ActionUnsubscribe:
+			change.Unsubscribed = boolPtr(true)
+			confirm, done = "Unsubscribe "+subscriber.Email+"?", "Unsubscribed "+subscriber.Email+"."
+		}
+		if err != nil {
+			break
+		}
+		if r.Method == http.MethodGet {
+			a.writeConfirm(w, r, html.EscapeString(confirm))
+			return
+		}
+		err = a.updateSubscription(ctx, subscriber.Email, change)
+		// The subscriber is kept, so that it can be resubscribed, while
+		// its jobs are removed, the state stops the runs in progress.
+		if err == nil && action == ActionUnsubscribe && a.scheduler != nil {
+			a.scheduler.Remove(subscriber.Name)
+			a.scheduler.Remove(subscriber.Name + digestJobSuffix)
+		}
+		if err == nil {
+			a.logger.Info("subscription changed", "subscriber", subscriber.Name, "action", action)
+			done = html.EscapeString(done)
+		}
+	default:
+		err = errors.Newf(errors.NotFound, nil, "unknown action %q", action)
+	}
+	a.writePage(w, err, done)
+}
+
+func (a *Actions) updateSubscription(ctx context.Context, email string, change SubscriptionChange) error {
+	ses, err := a.storage.NewAutoSession(ctx)
+	if err != nil {
+		return err
+	}
+	return a.storage.UpdateSubscriptionState(ses, email, change, time.Now())
+}
+
+// writePage writes the result of the action as a html page, the message
+// is html.
+func (a *Actions) writePage(w http.ResponseWriter, err error, msg string) {
+	status := http.StatusOK
+	if err != nil {
+		status = httpStatus(err)
+		msg = html.EscapeString(errors.Message(err))
+		switch status {
+		case http.StatusInternalServerError:
+			a.logger.Error(err, "run link action failed")
+			msg = http.StatusText(status)
+		case http.StatusConflict:
+			// The expired links are gone.
+			status = http.StatusGone
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_, _ = fmt.Fprintf(w, "<!DOCTYPE html><html><body><p>%s</p></body></html>", msg)
+}
+
+func (a *Actions) writeConfirm(w http.ResponseWriter, r *http.Request, msg string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = fmt.Fprintf(w, "<!DOCTYPE html><html><body><form method=\"post\" action=\"%s\"><p>%s</p>"+
+		"<button type=\"submit\">Confirm</button></form></body></html>", html.EscapeString(r.URL.RequestURI()), msg)
+}
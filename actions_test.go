@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestActions(t *testing.T) {
+	s := newTestSQLite(t)
+	subscriber := Subscriber{
+		Name:     "foo",
+		Email:    "foo@example.com",
+		Schedule: "* * * * *",
+		Sites:    []Site{{Name: "site 0", URL: "https://site0.com/index.rss"}},
+	}
+	cfg := Config{
+		Server:      ServerConfig{BaseURL: "https://feeds.example.com", LinkSecret: "s3cr3t"},
+		MailSender:  MailSender{SmtpServer: "smtp.example.com:587", SenderAddr: "sender@example.com", Password: "password"},
+		Subscribers: []Subscriber{subscriber},
+	}
+	feeds := makeTestFeeds("foo@example.com", 1, 2, "hello")
+	ctx := context.Background()
+	ses, _ := s.NewAutoSession(ctx)
+	if err := s.SaveFeeds(ses, feeds.List...); err != nil {
+		t.Fatal(err)
+	}
+	subscribers, err := LoadSubscribers(ctx, cfg, s, DiscardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduler := NewScheduler(nil, DiscardLogger)
+	for _, name := range []string{subscriber.Name, subscriber.Name + digestJobSuffix, "bar"} {
+		if _, err := scheduler.Schedule("* * * * *", funcJob{name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server, err := NewServer(cfg, DiscardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions := NewActions(cfg, subscribers, s, NewItems(subscribers, s, DiscardLogger), DiscardLogger)
+	actions.SetScheduler(scheduler)
+	server.Handle("/actions/", actions)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	notifiers, err := NewNotifiers(cfg, DiscardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := notifiers.Compose("foo@example.com", feeds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := mail.ReadMessage(bytes.NewReader(msgs[0].Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Header.Get("List-Unsubscribe-Post") != "List-Unsubscribe=One-Click" ||
+		!strings.HasPrefix(m.Header.Get("List-Unsubscribe"), "<https://feeds.example.com/actions/unsubscribe?") {
+		t.Fatalf("expected the one-click unsubscription headers, got %v", m.Header)
+	}
+	links := make(map[string][]string)
+	for _, match := range regexp.MustCompile(`href="https://feeds\.example\.com(/actions/(\w+)\?[^"]+)"`).FindAllSubmatch(msgs[0].Body, -1) {
+		links[string(match[2])] = append(links[string(match[2])], ts.URL+html.UnescapeString(string(match[1])))
+	}
+	if len(links[ActionRead]) != 2 || len(links[ActionStar]) != 2 || len(links[ActionMute]) != 1 ||
+		len(links[ActionPause]) != 2 || len(links[ActionUnsubscribe]) != 1 {
+		t.Fatalf("unexpected links: %v", links)
+	}
+	do := func(method, link string) (int, string) {
+		var resp *http.Response
+		var err error
+		if method == http.MethodPost {
+			resp, err = http.Post(link, "application/x-www-form-urlencoded", strings.NewReader("List-Unsubscribe=One-Click"))
+		} else {
+			resp, err = http.Get(link)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var buf bytes.Buffer
+		_, _ = buf.ReadFrom(resp.Body)
+		return resp.StatusCode, buf.String()
+	}
+
+	// The item actions ask for a confirmation on GET too, & are run on
+	// POST.
+	if status, body := do(http.MethodGet, links[ActionRead][1]); status != http.StatusOK || !strings.Contains(body, `method="post"`) {
+		t.Fatalf("expected the confirmation, got %d %s", status, body)
+	}
+	if n := countAckedFeeds(t, s); n != 0 {
+		t.Fatalf("expected no acked feed before the confirmation, got %d", n)
+	}
+	if status, _ := do(http.MethodPost, links[ActionRead][1]); status != http.StatusOK {
+		t.Fatalf("expected 200, got %d", status)
+	}
+	if n := countAckedFeeds(t, s); n != 1 {
+		t.Fatalf("expected 1 acked feed, got %d", n)
+	}
+	// The tampered & expired links are rejected.
+	u, _ := url.Parse(links[ActionRead][0])
+	q := u.Query()
+	q.Set("id", feeds.List[1].Id)
+	u.RawQuery = q.Encode()
+	if status, _ := do(http.MethodGet, u.String()); status != http.StatusNotFound {
+		t.Fatalf("expected 404 of a tampered link, got %d", status)
+	}
+	signer := newLinkSigner(cfg)
+	expired := signer.url(actionLink{Action: ActionRead, Subscriber: "foo", Site: feeds.List[0].SiteURL, Id: feeds.List[0].Id},
+		time.Now().Add(-defaultLinkTTL-time.Minute))
+	if status, _ := do(http.MethodGet, strings.Replace(expired, "https://feeds.example.com", ts.URL, 1)); status != http.StatusGone {
+		t.Fatalf("expected 410 of an expired link, got %d", status)
+	}
+
+	// The subscription actions ask for a confirmation on GET.
+	if status, body := do(http.MethodGet, links[ActionMute][0]); status != http.StatusOK || !strings.Contains(body, `method="post"`) {
+		t.Fatalf("expected the confirmation, got %d %s", status, body)
+	}
+	state, _ := s.GetSubscriptionState(ses, "foo@example.com")
+	if len(state.MutedSites) != 0 {
+		t.Fatalf("expected no muted site before the confirmation, got %v", state.MutedSites)
+	}
+	do(http.MethodPost, links[ActionMute][0])
+	do(http.MethodPost, links[ActionPause][0])
+	state, _ = s.GetSubscriptionState(ses, "foo@example.com")
+	if !state.Muted("https://site0.com/index.rss") || state.Active(time.Now()) || !state.Active(time.Now().Add(8*24*time.Hour)) {
+		t.Fatalf("expected the muted site & the pause, got %+v", state)
+	}
+	if status, _ := do(http.MethodPost, links[ActionUnsubscribe][0]); status != http.StatusOK {
+		t.Fatalf("expected 200, got %d", status)
+	}
+	state, _ = s.GetSubscriptionState(ses, "foo@example.com")
+	if state.UnsubscribedAt.IsZero() || state.Active(time.Now().Add(8*24*time.Hour)) {
+		t.Fatalf("expected unsubscribed, got %+v", state)
+	}
+	// The jobs of the subscriber are removed, while the subscriber is
+	// kept along with its settings.
+	if entries := scheduler.Entries(); len(entries) != 1 || entries[0].Name != "bar" {
+		t.Fatalf("expected the jobs of the subscriber removed, got %+v", entries)
+	}
+	if stored, err := s.GetSubscribers(ses); err != nil || len(stored) != 1 || len(stored[0].Sites) != 1 {
+		t.Fatalf("expected the subscriber kept, got %+v %v", stored, err)
+	}
+	if status, _ := do(http.MethodPost, links[ActionUnsubscribe][0]); status != http.StatusOK {
+		t.Fatalf("expected the unsubscription idempotent, got %d", status)
+	}
+
+	// The worker of the unsubscribed subscriber fetches nothing.
+	var hits int
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { hits++ }))
+	defer site.Close()
+	subscriber.Sites = []Site{{Name: "site", URL: site.URL}}
+	w, err := NewWorker(subscriber, s, notifiers, NewOutbox(cfg, s, notifiers, DiscardLogger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Run(ctx); err != nil || hits != 0 {
+		t.Fatalf("expected no fetch, got %d hits: %v", hits, err)
+	}
+	if pending, err := s.GetMessages(ses, MessagePending, 10); err != nil || len(pending) != 0 {
+		t.Fatalf("expected no notification queued, got %d: %v", len(pending), err)
+	}
+
+}
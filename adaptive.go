@@ -0,0 +1,239 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	ext "github.com/mmcdole/gofeed/extensions"
+	"github.com/mmcdole/gofeed/rss"
+)
+
+const (
+	defaultMinPollInterval = 5 * time.Minute
+	defaultMaxPollInterval = 24 * time.Hour
+	// pollTick is how often the due site urls are checked at most, the
+	// urls due while a fetch is in progress are fetched by the next one.
+	pollTick = time.Minute
+	// pollHistory is the number of the latest items the publishing
+	// frequency is derived from.
+	pollHistory = 10
+)
+
+// poller keeps the polling states of the site urls of a subscriber which
+// are polled adaptively. It's the schedule of the fetches as well, which
+// are due whenever a url is due.
+type poller struct {
+	min, max  time.Duration
+	endpoints []string
+
+	mu    sync.Mutex
+	polls map[string]*EndpointPoll
+}
+
+func newPoller(cfg *AdaptivePolling, endpoints []string, polls []*EndpointPoll) *poller {
+	p := &poller{
+		min:       time.Duration(cfg.MinInterval),
+		max:       time.Duration(cfg.MaxInterval),
+		endpoints: endpoints,
+	}
+	if p.min <= 0 {
+		p.min = defaultMinPollInterval
+	}
+	if p.max <= 0 {
+		p.max = defaultMaxPollInterval
+	}
+	p.reset(polls)
+	return p
+}
+
+// reset replaces the polling states, the intervals are bounded by the
+// settings, which may have changed since the states were saved.
+func (p *poller) reset(polls []*EndpointPoll) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.polls = make(map[string]*EndpointPoll)
+	for _, poll := range polls {
+		switch {
+		case poll.Interval > p.max:
+			poll.NextFetchAt = poll.NextFetchAt.Add(p.max - poll.Interval)
+			poll.Interval = p.max
+		case poll.Interval < p.min:
+			poll.NextFetchAt = poll.NextFetchAt.Add(p.min - poll.Interval)
+			poll.Interval = p.min
+		}
+		p.polls[poll.Endpoint] = poll
+	}
+}
+
+// Next returns the time the earliest url is due after t, the urls never
+// polled are due right away.
+func (p *poller) Next(t time.Time) time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	next := t.Add(p.max)
+	for _, endpoint := range p.endpoints {
+		poll, ok := p.polls[endpoint]
+		if !ok {
+			next = t
+			break
+		}
+		if poll.NextFetchAt.Before(next) {
+			next = poll.NextFetchAt
+		}
+	}
+	if tick := t.Add(pollTick); next.Before(tick) {
+		return tick
+	}
+	return next
+}
+
+// due reports whether the url is due to poll at the time.
+func (p *poller) due(endpoint string, now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	poll, ok := p.polls[endpoint]
+	return !ok || !now.Before(poll.NextFetchAt)
+}
+
+// update sets the interval of the url & returns the state to save, the
+// interval is kept if it's zero, e.g., the fetch failed.
+func (p *poller) update(email, endpoint string, interval time.Duration, now time.Time) *EndpointPoll {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	poll, ok := p.polls[endpoint]
+	if !ok {
+		poll = &EndpointPoll{Email: email, Endpoint: endpoint, Interval: p.min}
+		p.polls[endpoint] = poll
+	}
+	if interval > 0 {
+		poll.Interval = interval
+	}
+	poll.NextFetchAt = now.Add(poll.Interval)
+	out := *poll
+	return &out
+}
+
+// interval returns the interval to poll the url by the times of the
+// latest items & the hints of the publisher, bounded by the settings.
+func (p *poller) interval(feed *gofeed.Feed, header http.Header, now time.Time) time.Duration {
+	var times []time.Time
+	for _, it := range feed.Items {
+		if it.UpdatedParsed != nil {
+			times = append(times, *it.UpdatedParsed)
+		} else if it.PublishedParsed != nil {
+			times = append(times, *it.PublishedParsed)
+		}
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].After(times[j]) })
+	if len(times) > pollHistory {
+		times = times[:pollHistory]
+	}
+	// A feed without the history is polled rarely unless it's hinted.
+	interval := p.max
+	if n := len(times); n >= 2 {
+		gap := times[0].Sub(times[n-1]) / time.Duration(n-1)
+		// The feed slows down if nothing is published for longer than
+		// usual.
+		if since := now.Sub(times[0]); since > gap {
+			gap = since
+		}
+		// Poll twice as often as the items are published, so that an item
+		// is picked up in half of the gap on average.
+		interval = gap / 2
+	}
+	// The publisher asks not to poll more often.
+	if hint := pollHint(feed, header); hint > interval {
+		interval = hint
+	}
+	if interval < p.min {
+		interval = p.min
+	}
+	if interval > p.max {
+		interval = p.max
+	}
+	return interval
+}
+
+var syUpdatePeriods = map[string]time.Duration{
+	"hourly":  time.Hour,
+	"daily":   24 * time.Hour,
+	"weekly":  7 * 24 * time.Hour,
+	"monthly": 30 * 24 * time.Hour,
+	"yearly":  365 * 24 * time.Hour,
+}
+
+// pollHint returns the longest of the ttl of the rss, the update period
+// of the syndication module & the max-age of the response.
+func pollHint(feed *gofeed.Feed, header http.Header) time.Duration {
+	var hint time.Duration
+	longer := func(d time.Duration) {
+		if d > hint {
+			hint = d
+		}
+	}
+	if ttl, err := strconv.Atoi(feed.Custom[rssTTL]); err == nil {
+		longer(time.Duration(ttl) * time.Minute)
+	}
+	if sy := feed.Extensions["sy"]; sy != nil {
+		if period, ok := syUpdatePeriods[strings.TrimSpace(extensionValue(sy, "updatePeriod"))]; ok {
+			frequency, err := strconv.Atoi(strings.TrimSpace(extensionValue(sy, "updateFrequency")))
+			if err != nil || frequency <= 0 {
+				frequency = 1
+			}
+			longer(period / time.Duration(frequency))
+		}
+	}
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.TrimSpace(directive)
+		if strings.HasPrefix(directive, "max-age=") {
+			if age, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age=")); err == nil {
+				longer(time.Duration(age) * time.Second)
+			}
+		}
+	}
+	return hint
+}
+
+func extensionValue(extensions map[string][]ext.Extension, name string) string {
+	if values := extensions[name]; len(values) > 0 {
+		return values[0].Value
+	}
+	return ""
+}
+
+// rssTTL is the custom field of the parsed feeds the ttl of the rss is
+// kept in.
+const rssTTL = "ttl"
+
+// rssTranslator keeps the ttl of the rss in the custom fields of the
+// feed, which is dropped by the default translator.
+type rssTranslator struct {
+	gofeed.DefaultRSSTranslator
+}
+
+func (t *rssTranslator) Translate(feed interface{}) (*gofeed.Feed, error) {
+	out, err := t.DefaultRSSTranslator.Translate(feed)
+	if err != nil {
+		return nil, err
+	}
+	if f, ok := feed.(*rss.Feed); ok && f.TTL != "" {
+		if out.Custom == nil {
+			out.Custom = make(map[string]string)
+		}
+		out.Custom[rssTTL] = strings.TrimSpace(f.TTL)
+	}
+	return out, nil
+}
+
+// newFeedParser returns the parser of the feeds which keeps the ttl of
+// the rss.
+func newFeedParser() *gofeed.Parser {
+	fp := gofeed.NewParser()
+	fp.RSSTranslator = &rssTranslator{}
+	return fp
+}
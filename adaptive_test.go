@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	ext "github.com/mmcdole/gofeed/extensions"
+)
+
+func TestPollInterval(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	// n items published every gap, the latest one ago.
+	feedOf := func(n int, gap, ago time.Duration) *gofeed.Feed {
+		feed := &gofeed.Feed{}
+		for i := 0; i < n; i++ {
+			at := now.Add(-ago - time.Duration(i)*gap)
+			feed.Items = append(feed.Items, &gofeed.Item{PublishedParsed: &at})
+		}
+		return feed
+	}
+	ttl := feedOf(5, time.Hour, 0)
+	ttl.Custom = map[string]string{rssTTL: "120"}
+	sy := feedOf(5, time.Hour, 0)
+	sy.Extensions = ext.Extensions{"sy": {
+		"updatePeriod":    {{Value: "daily"}},
+		"updateFrequency": {{Value: "4"}},
+	}}
+	p := newPoller(&AdaptivePolling{}, nil, nil)
+	for _, tt := range []struct {
+		name     string
+		feed     *gofeed.Feed
+		header   http.Header
+		expected time.Duration
+	}{
+		{"hourly", feedOf(20, time.Hour, 10*time.Minute), nil, 30 * time.Minute},
+		{"quiet for long", feedOf(5, time.Hour, 10*time.Hour), nil, 5 * time.Hour},
+		{"too frequent", feedOf(5, time.Minute, 0), nil, defaultMinPollInterval},
+		{"too rare", feedOf(5, 7*24*time.Hour, 0), nil, defaultMaxPollInterval},
+		{"no history", feedOf(1, 0, 0), nil, defaultMaxPollInterval},
+		{"ttl", ttl, nil, 2 * time.Hour},
+		{"sy", sy, nil, 6 * time.Hour},
+		{"max-age", feedOf(5, time.Hour, 0), http.Header{"Cache-Control": {"public, max-age=7200"}}, 2 * time.Hour},
+	} {
+		if got := p.interval(tt.feed, tt.header, now); got != tt.expected {
+			t.Fatalf("%s: expect interval %v, got %v", tt.name, tt.expected, got)
+		}
+	}
+
+	// the ttl of the rss is kept by the parser.
+	feed, err := newFeedParser().ParseString(`<?xml version="1.0"?><rss version="2.0"><channel><title>foo</title><ttl>60</ttl></channel></rss>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := pollHint(feed, http.Header{}); got != time.Hour {
+		t.Fatalf("expect the ttl hint of an hour, got %v", got)
+	}
+}
+
+func TestWorkerAdaptive(t *testing.T) {
+	var fetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		var items strings.Builder
+		// an item every 2 hours, the latest one just published.
+		now := time.Now().UTC()
+		for i := 0; i < 5; i++ {
+			items.WriteString(fmt.Sprintf(`<item><guid>%d</guid><title>post %d</title><pubDate>%s</pubDate></item>`,
+				i, i, now.Add(-time.Duration(i)*2*time.Hour).Format(time.RFC1123Z)))
+		}
+		_, _ = fmt.Fprintf(w, `<?xml version="1.0"?><rss version="2.0"><channel><title>foo</title>%s</channel></rss>`, items.String())
+	}))
+	defer server.Close()
+
+	subscriber := Subscriber{
+		Name:      "foo",
+		Email:     "foo@example.com",
+		Sites:     []Site{{Name: "Foo", URL: server.URL}},
+		Adaptive:  &AdaptivePolling{MinInterval: Duration(time.Minute)},
+		Notifiers: []NotifierConfig{{Type: NotifierMaildir, Path: filepath.Join(t.TempDir(), "Maildir")}},
+	}
+	if err := validateSubscriber(Config{}, subscriber); err != nil {
+		t.Fatalf("expect the schedule optional if polled adaptively, got %v", err)
+	}
+	cfg := Config{Subscribers: []Subscriber{subscriber}}
+	s := newTestSQLite(t)
+	notifiers, err := NewNotifiers(cfg, DiscardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outbox := NewOutbox(cfg, s, notifiers, DiscardLogger)
+	w, err := NewWorker(subscriber, s, notifiers, outbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if next := w.Schedule().Next(now); !next.Equal(now.Add(pollTick)) {
+		t.Fatalf("expect the url never polled due at the next tick, got %v", next)
+	}
+
+	// the url isn't fetched again until it's due.
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err = w.Run(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fetches != 1 {
+		t.Fatalf("expect the url fetched once, got %d", fetches)
+	}
+	ses, _ := s.NewAutoSession(ctx)
+	polls, err := s.GetEndpointPolls(ses, subscriber.Email)
+	if err != nil || len(polls) != 1 || polls[0].Interval != time.Hour {
+		t.Fatalf("expect the url polled hourly, got %v %v", polls, err)
+	}
+	due := polls[0].NextFetchAt
+
+	// the state is restored by the worker of the next start.
+	w, err = NewWorker(subscriber, s, notifiers, outbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next := w.Schedule().Next(now); !next.Equal(due) {
+		t.Fatalf("expect the fetch due at %v, got %v", due, next)
+	}
+	if w.poller.due(server.URL, due.Add(-time.Second)) || !w.poller.due(server.URL, due) {
+		t.Fatal("unexpected due of the url")
+	}
+
+	// the rescheduled fetches pick the states saved meanwhile up, e.g.,
+	// by another replica, rather than keep the spec overridden.
+	scheduler := NewScheduler(s, DiscardLogger)
+	if _, err = scheduler.ScheduleJob("", w, JobOptions{Schedule: w.Schedule()}); err != nil {
+		t.Fatal(err)
+	}
+	due = due.Add(10 * time.Minute)
+	if err = s.SaveEndpointPoll(ses, &EndpointPoll{Email: subscriber.Email, Endpoint: server.URL, Interval: time.Hour, NextFetchAt: due}); err != nil {
+		t.Fatal(err)
+	}
+	if err = scheduler.Reschedule("foo", ""); err != nil {
+		t.Fatal(err)
+	}
+	if next := scheduler.jobs[0].Schedule.Next(now); !next.Equal(due) {
+		t.Fatalf("expect the rescheduled fetch due at %v, got %v", due, next)
+	}
+
+	// the bounds changed apply to the states saved, e.g., on an update of
+	// the subscriber.
+	subscriber.Adaptive = &AdaptivePolling{MinInterval: Duration(time.Minute), MaxInterval: Duration(30 * time.Minute)}
+	if w, err = NewWorker(subscriber, s, notifiers, outbox); err != nil {
+		t.Fatal(err)
+	}
+	if poll := w.poller.polls[server.URL]; poll.Interval != 30*time.Minute || !poll.NextFetchAt.Equal(due.Add(-30*time.Minute)) {
+		t.Fatalf("expect the url polled by the max interval, got %+v", poll)
+	}
+
+	for _, adaptive := range []AdaptivePolling{
+		{MinInterval: Duration(-time.Minute)},
+		{MinInterval: Duration(2 * time.Hour), MaxInterval: Duration(time.Hour)},
+	} {
+		subscriber.Adaptive = &adaptive
+		if err = validateSubscriber(Config{}, subscriber); err == nil {
+			t.Fatalf("expect invalid adaptive polling %+v", adaptive)
+		}
+	}
+	// the api takes the intervals as duration strings.
+	var adaptive AdaptivePolling
+	if err = json.Unmarshal([]byte(`{"minInterval":"15m","maxInterval":"12h"}`), &adaptive); err != nil {
+		t.Fatal(err)
+	}
+	if adaptive.MinInterval != Duration(15*time.Minute) || adaptive.MaxInterval != Duration(12*time.Hour) {
+		t.Fatalf("unexpected adaptive polling %+v", adaptive)
+	}
+}
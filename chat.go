@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/maxnilz/feed/errors"
+)
+
+func validateWebhookURL(nc NotifierConfig) error {
+	if nc.URL == "" {
+		return errors.Newf(errors.InvalidArgument, nil, "webhook url is required")
+	}
+	u, err := url.Parse(nc.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return errors.Newf(errors.InvalidArgument, err, "invalid webhook url")
+	}
+	return nil
+}
+
+// Slack incoming webhook with Block Kit, refer to
+// https://api.slack.com/reference/block-kit/blocks
+const (
+	slackMaxBlocks     = 50
+	slackMaxTextLen    = 3000
+	slackMaxHeaderLen  = 150
+	slackMaxItemLength = 1000
+)
+
+type slackNotifier struct {
+	url    string
+	logger Logger
+}
+
+func newSlackNotifier(nc NotifierConfig, logger Logger) (Notifier, error) {
+	if err := validateWebhookURL(nc); err != nil {
+		return nil, err
+	}
+	return &slackNotifier{url: nc.URL, logger: logger}, nil
+}
+
+func (n *slackNotifier) Compose(feeds Feeds) ([]*Message, error) {
+	return composeDigest(feeds, subject, func() digestBuilder { return &slackBuilder{} })
+}
+
+func (n *slackNotifier) Send(ctx context.Context, msg *Message) error {
+	n.logger.Info("Send RSS feeds notification to slack", "email", msg.Email, "feeds", len(msg.Feeds))
+	return postJSON(ctx, n.url, nil, msg.Body)
+}
+
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type slackBlock struct {
+	Type string     `json:"type"`
+	Text *slackText `json:"text,omitempty"`
+}
+
+type slackBuilder struct {
+	site   string
+	blocks []slackBlock
+}
+
+// slackEscape escapes the control characters of slack mrkdwn.
+var slackEscape = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+func (b *slackBuilder) add(site string, feed *Feed) bool {
+	n := 1
+	if site != b.site {
+		n++
+	}
+	if len(b.blocks)+n > slackMaxBlocks {
+		return false
+	}
+	if site != b.site {
+		header := truncate(fmt.Sprintf("New posts from %s", site), slackMaxHeaderLen)
+		b.blocks = append(b.blocks, slackBlock{Type: "header", Text: &slackText{Type: "plain_text", Text: header}})
+		b.site = site
+	}
+	title := slackEscape.Replace(truncate(feed.Title, slackMaxItemLength))
+	text := fmt.Sprintf("*<%s|%s>*\n%s", feed.Link, title, slackEscape.Replace(itemTime(feed)))
+	b.blocks = append(b.blocks, slackBlock{
+		Type: "section",
+		Text: &slackText{Type: "mrkdwn", Text: truncate(text, slackMaxTextLen)},
+	})
+	return true
+}
+
+func (b *slackBuilder) build() ([]byte, error) {
+	return json.Marshal(struct {
+		Text   string       `json:"text"`
+		Blocks []slackBlock `json:"blocks"`
+	}{subject, b.blocks})
+}
+
+// Discord webhook with embeds, refer to
+// https://discord.com/developers/docs/resources/channel#embed-object-embed-limits
+const (
+	discordMaxEmbeds         = 10
+	discordMaxTitleLen       = 256
+	discordMaxDescriptionLen = 4096
+	discordMaxTotalLen       = 6000
+	discordMaxItemLen        = 1000
+	discordColor             = 0xf26522
+)
+
+type discordNotifier struct {
+	url    string
+	logger Logger
+}
+
+func newDiscordNotifier(nc NotifierConfig, logger Logger) (Notifier, error) {
+	if err := validateWebhookURL(nc); err != nil {
+		return nil, err
+	}
+	return &discordNotifier{url: nc.URL, logger: logger}, nil
+}
+
+func (n *discordNotifier) Compose(feeds Feeds) ([]*Message, error) {
+	return composeDigest(feeds, subject, func() digestBuilder { return &discordBuilder{} })
+}
+
+func (n *discordNotifier) Send(ctx context.Context, msg *Message) error {
+	n.logger.Info("Send RSS feeds notification to discord", "email", msg.Email, "feeds", len(msg.Feeds))
+	return postJSON(ctx, n.url, nil, msg.Body)
+}
+
+type discordEmbed struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Color       int    `json:"color"`
+}
+
+type discordBuilder struct {
+	site   string
+	embeds []*discordEmbed
+	total  int
+}
+
+var discordEscape = strings.NewReplacer("[", "\\[", "]", "\\]", "*", "\\*", "_", "\\_", "`", "\\`")
+
+func (b *discordBuilder) add(site string, feed *Feed) bool {
+	title := discordEscape.Replace(truncate(feed.Title, discordMaxItemLen))
+	line := fmt.Sprintf("[%s](%s) %s\n", title, feed.Link, itemTime(feed))
+	line = truncate(line, discordMaxItemLen*2)
+	size := len([]rune(line))
+
+	var last *discordEmbed
+	if len(b.embeds) > 0 {
+		last = b.embeds[len(b.embeds)-1]
+	}
+	if last != nil && site == b.site && len([]rune(last.Description))+size <= discordMaxDescriptionLen {
+		if b.total+size > discordMaxTotalLen {
+			return false
+		}
+		last.Description += line
+		b.total += size
+		return true
+	}
+	header := truncate(fmt.Sprintf("New posts from %s", site), discordMaxTitleLen)
+	cost := len([]rune(header)) + size
+	if len(b.embeds) == discordMaxEmbeds || (len(b.embeds) > 0 && b.total+cost > discordMaxTotalLen) {
+		return false
+	}
+	b.embeds = append(b.embeds, &discordEmbed{Title: header, Description: line, Color: discordColor})
+	b.site = site
+	b.total += cost
+	return true
+}
+
+func (b *discordBuilder) build() ([]byte, error) {
+	return json.Marshal(struct {
+		Embeds []*discordEmbed `json:"embeds"`
+	}{b.embeds})
+}
+
+// Microsoft Teams incoming webhook with adaptive cards, refer to
+// https://learn.microsoft.com/en-us/microsoftteams/platform/webhooks-and-connectors/how-to/connectors-using
+const (
+	// teamsMaxPayloadLen is a bit less than the 28KB limit of the
+	// message size to leave room for the envelope.
+	teamsMaxPayloadLen = 25 * 1024
+	teamsMaxItemLen    = 1000
+)
+
+type teamsNotifier struct {
+	url    string
+	logger Logger
+}
+
+func newTeamsNotifier(nc NotifierConfig, logger Logger) (Notifier, error) {
+	if err := validateWebhookURL(nc); err != nil {
+		return nil, err
+	}
+	return &teamsNotifier{url: nc.URL, logger: logger}, nil
+}
+
+func (n *teamsNotifier) Compose(feeds Feeds) ([]*Message, error) {
+	return composeDigest(feeds, subject, func() digestBuilder { return &teamsBuilder{} })
+}
+
+func (n *teamsNotifier) Send(ctx context.Context, msg *Message) error {
+	n.logger.Info("Send RSS feeds notification to teams", "email", msg.Email, "feeds", len(msg.Feeds))
+	return postJSON(ctx, n.url, nil, msg.Body)
+}
+
+type teamsTextBlock struct {
+	Type      string `json:"type"`
+	Text      string `json:"text"`
+	Wrap      bool   `json:"wrap"`
+	Weight    string `json:"weight,omitempty"`
+	Size      string `json:"size,omitempty"`
+	Separator bool   `json:"separator,omitempty"`
+	IsSubtle  bool   `json:"isSubtle,omitempty"`
+}
+
+type teamsBuilder struct {
+	site string
+	body []teamsTextBlock
+	size int
+}
+
+func (b *teamsBuilder) add(site string, feed *Feed) bool {
+	var blocks []teamsTextBlock
+	if site != b.site {
+		blocks = append(blocks, teamsTextBlock{
+			Type: "TextBlock", Text: fmt.Sprintf("New posts from %s", site),
+			Wrap: true, Weight: "Bolder", Size: "Medium", Separator: len(b.body) > 0,
+		})
+	}
+	title := truncate(feed.Title, teamsMaxItemLen)
+	blocks = append(blocks, teamsTextBlock{
+		Type: "TextBlock", Text: fmt.Sprintf("[%s](%s)  \n%s", title, feed.Link, itemTime(feed)), Wrap: true,
+	})
+	size := 0
+	for _, it := range blocks {
+		data, _ := json.Marshal(it)
+		size += len(data) + 1
+	}
+	if len(b.body) > 0 && b.size+size > teamsMaxPayloadLen {
+		return false
+	}
+	b.body = append(b.body, blocks...)
+	b.site = site
+	b.size += size
+	return true
+}
+
+func (b *teamsBuilder) build() ([]byte, error) {
+	type card struct {
+		Schema  string           `json:"$schema"`
+		Type    string           `json:"type"`
+		Version string           `json:"version"`
+		Body    []teamsTextBlock `json:"body"`
+	}
+	type attachment struct {
+		ContentType string `json:"contentType"`
+		Content     card   `json:"content"`
+	}
+	return json.Marshal(struct {
+		Type        string       `json:"type"`
+		Attachments []attachment `json:"attachments"`
+	}{
+		Type: "message",
+		Attachments: []attachment{{
+			ContentType: "application/vnd.microsoft.card.adaptive",
+			Content: card{
+				Schema:  "http://adaptivecards.io/schemas/adaptive-card.json",
+				Type:    "AdaptiveCard",
+				Version: "1.4",
+				Body:    b.body,
+			},
+		}},
+	})
+}
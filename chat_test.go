@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// webhookRecorder is a stand-in of the chat webhooks which records the
+// received payloads by path.
+type webhookRecorder struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	payloads map[string][][]byte
+	status   int
+}
+
+func newWebhookRecorder(t *testing.T) *webhookRecorder {
+	r := &webhookRecorder{payloads: make(map[string][][]byte), status: http.StatusOK}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if req.Method != http.MethodPost || req.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.payloads[req.URL.Path] = append(r.payloads[req.URL.Path], body)
+		w.WriteHeader(r.status)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *webhookRecorder) Payloads(path string) [][]byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.payloads[path]
+}
+
+func makeTestFeeds(email Email, sites, perSite int, title string) Feeds {
+	var feeds Feeds
+	for i := 0; i < sites; i++ {
+		for j := 0; j < perSite; j++ {
+			feeds.Append(&Feed{
+				Id:          fmt.Sprintf("%d-%d", i, j),
+				Email:       email,
+				SiteURL:     fmt.Sprintf("https://site%d.com/index.rss", i),
+				SiteName:    fmt.Sprintf("site %d", i),
+				Title:       fmt.Sprintf("%s %d-%d", title, i, j),
+				Link:        fmt.Sprintf("https://site%d.com/%d", i, j),
+				PublishedAt: "2023-07-22 07:00:00",
+			})
+		}
+	}
+	return feeds
+}
+
+// checkSplit checks that every feed is in exactly one message.
+func checkSplit(t *testing.T, feeds Feeds, msgs []*Message) {
+	t.Helper()
+	seen := make(map[string]int)
+	for _, msg := range msgs {
+		for _, f := range msg.Feeds {
+			seen[f.Id]++
+		}
+	}
+	for _, f := range feeds.List {
+		if seen[f.Id] != 1 {
+			t.Fatalf("feed %s is in %d messages", f.Id, seen[f.Id])
+		}
+	}
+}
+
+func TestSlackCompose(t *testing.T) {
+	n, err := newSlackNotifier(NotifierConfig{Type: NotifierSlack, URL: "https://hooks.slack.com/x"}, DiscardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	feeds := makeTestFeeds("a@example.com", 2, 30, "<b>hello</b> & bye")
+	msgs, err := n.Compose(feeds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(msgs))
+	}
+	checkSplit(t, feeds, msgs)
+	for _, msg := range msgs {
+		var payload struct {
+			Blocks []slackBlock `json:"blocks"`
+		}
+		if err = json.Unmarshal(msg.Body, &payload); err != nil {
+			t.Fatal(err)
+		}
+		if len(payload.Blocks) > slackMaxBlocks || payload.Blocks[0].Type != "header" {
+			t.Fatalf("unexpected blocks: %d, first %s", len(payload.Blocks), payload.Blocks[0].Type)
+		}
+		if !strings.Contains(payload.Blocks[1].Text.Text, "&lt;b&gt;hello&lt;/b&gt; &amp; bye") {
+			t.Fatalf("expected escaped title, got %s", payload.Blocks[1].Text.Text)
+		}
+	}
+}
+
+func TestDiscordCompose(t *testing.T) {
+	n, err := newDiscordNotifier(NotifierConfig{Type: NotifierDiscord, URL: "https://discord.com/x"}, DiscardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	feeds := makeTestFeeds("a@example.com", 12, 5, strings.Repeat("a long title ", 20))
+	msgs, err := n.Compose(feeds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) < 2 {
+		t.Fatalf("expected the digest to be split, got %d message", len(msgs))
+	}
+	checkSplit(t, feeds, msgs)
+	for _, msg := range msgs {
+		var payload struct {
+			Embeds []discordEmbed `json:"embeds"`
+		}
+		if err = json.Unmarshal(msg.Body, &payload); err != nil {
+			t.Fatal(err)
+		}
+		total := 0
+		for _, e := range payload.Embeds {
+			if len([]rune(e.Description)) > discordMaxDescriptionLen {
+				t.Fatalf("embed description too long: %d", len(e.Description))
+			}
+			total += len([]rune(e.Title)) + len([]rune(e.Description))
+		}
+		if len(payload.Embeds) > discordMaxEmbeds || total > discordMaxTotalLen {
+			t.Fatalf("message exceeds the limits, embeds: %d, total: %d", len(payload.Embeds), total)
+		}
+	}
+}
+
+func TestTeamsCompose(t *testing.T) {
+	n, err := newTeamsNotifier(NotifierConfig{Type: NotifierTeams, URL: "https://outlook.office.com/x"}, DiscardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	feeds := makeTestFeeds("a@example.com", 3, 100, strings.Repeat("title ", 20))
+	msgs, err := n.Compose(feeds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) < 2 {
+		t.Fatalf("expected the digest to be split, got %d message", len(msgs))
+	}
+	checkSplit(t, feeds, msgs)
+	for _, msg := range msgs {
+		if len(msg.Body) > 28*1024 {
+			t.Fatalf("message too large: %d", len(msg.Body))
+		}
+		if !strings.Contains(string(msg.Body), "application/vnd.microsoft.card.adaptive") {
+			t.Fatalf("expected adaptive card, got %s", msg.Body)
+		}
+	}
+}
+
+func TestChatNotifiers(t *testing.T) {
+	recorder := newWebhookRecorder(t)
+	cfg := Config{Subscribers: []Subscriber{{
+		Name:  "foo",
+		Email: "foo@example.com",
+		Notifiers: []NotifierConfig{
+			{Type: NotifierSlack, URL: recorder.URL + "/slack"},
+			{Type: NotifierDiscord, URL: recorder.URL + "/discord"},
+			{Name: "team", Type: NotifierTeams, URL: recorder.URL + "/teams"},
+		},
+	}}}
+	notifiers, err := NewNotifiers(cfg, DiscardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	feeds := makeTestFeeds("foo@example.com", 1, 2, "hello")
+	msgs, err := notifiers.Compose("foo@example.com", feeds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 3 {
+		t.Fatalf("expected 3 messages, got %d", len(msgs))
+	}
+	ctx := context.Background()
+	for _, msg := range msgs {
+		if err = notifiers.Send(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range []string{"/slack", "/discord", "/teams"} {
+		if got := len(recorder.Payloads(path)); got != 1 {
+			t.Fatalf("expected 1 payload posted to %s, got %d", path, got)
+		}
+	}
+
+	recorder.mu.Lock()
+	recorder.status = http.StatusTooManyRequests
+	recorder.mu.Unlock()
+	if err = notifiers.Send(ctx, msgs[0]); err == nil {
+		t.Fatal("expected non-2xx response to fail the delivery")
+	}
+
+	msgs[0].Notifier = "unknown"
+	if err = notifiers.Send(ctx, msgs[0]); err == nil {
+		t.Fatal("expected unknown notifier to fail the delivery")
+	}
+}
+
+func TestNewNotifiersInvalid(t *testing.T) {
+	for i, nc := range []NotifierConfig{
+		{Type: "pigeon"},
+		{Type: NotifierSlack},
+		{Type: NotifierDiscord, URL: "ftp://example.com"},
+	} {
+		cfg := Config{Subscribers: []Subscriber{{Name: "foo", Email: "foo@example.com", Notifiers: []NotifierConfig{nc}}}}
+		if _, err := NewNotifiers(cfg, DiscardLogger); err == nil {
+			t.Errorf("case %d: expected invalid notifier error", i)
+		}
+	}
+}
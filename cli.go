@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maxnilz/feed/errors"
+)
+
+const usage = `Usage:
+  feed [-config config.yaml] [-verbose]               start the daemon
+  feed [-config config.yaml] outbox list [state]      list recent outbox messages, state is one of pending, sent & dead
+  feed [-config config.yaml] outbox retry <id>        move a dead message back to pending
+  feed [-config config.yaml] export [-format rss|atom|json] [-group group] [-page n] [-limit n] <subscriber>
+                                                      print the saved feeds of the subscriber or its site group
+  feed [-config config.yaml] items [-state unread|read|starred|archived|all] [-site url] [-tag tag] [-limit n] <subscriber>
+                                                      list the items of the subscriber with the reading state
+  feed [-config config.yaml] mark [-read|-unread] [-star|-unstar] [-archive|-unarchive] [-tag tag] [-untag tag] <subscriber> <seq>...
+                                                      change the reading state of the items
+  feed [-config config.yaml] hash-password            read a password from stdin & print the hash to sign in the web reader
+  feed [-config config.yaml] runs list [-job name] [-subscriber name] [-outcome ok|failed|timeout] [-limit n]
+                                                      list recent runs of the scheduled jobs
+  feed [-config config.yaml] runs show <id>           print the details of a run, e.g., the errors of the sites
+  feed [-config config.yaml] runs prune <age>         delete the runs older than the age, e.g., 720h
+  feed [-config config.yaml] jobs run [name]          run the job, e.g., a subscriber, or all the jobs right away in the
+                                                      running daemon through the control socket`
+
+const listLimit = 50
+
+// commands are the one-shot commands which run against the configured
+// storage rather than starting the daemon.
+type commands struct {
+	outbox    *Outbox
+	publisher *Publisher
+	items     *Items
+	runs      *Runs
+	// socket is the control socket of the running daemon, which the jobs
+	// command talks to.
+	socket string
+	stdin  io.Reader
+}
+
+func (c *commands) run(ctx context.Context, w io.Writer, args []string) error {
+	switch args[0] {
+	case "outbox":
+		return runOutboxCommand(ctx, w, c.outbox, args[1:])
+	case "export":
+		return runExportCommand(ctx, w, c.publisher, args[1:])
+	case "items":
+		return runItemsCommand(ctx, w, c.items, args[1:])
+	case "mark":
+		return runMarkCommand(ctx, w, c.items, args[1:])
+	case "hash-password":
+		return runHashPasswordCommand(w, c.stdin)
+	case "runs":
+		return runRunsCommand(ctx, w, c.runs, args[1:])
+	case "jobs":
+		return runJobsCommand(ctx, w, c.socket, args[1:])
+	default:
+		return errors.Newf(errors.InvalidArgument, nil, "unknown command %q\n%s", args[0], usage)
+	}
+}
+
+func runExportCommand(ctx context.Context, w io.Writer, publisher *Publisher, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	var req PublishRequest
+	fs.StringVar(&req.Format, "format", FormatRSS, "feed format")
+	fs.StringVar(&req.Group, "group", "", "site group")
+	fs.IntVar(&req.Page, "page", 1, "page number")
+	fs.IntVar(&req.Limit, "limit", defaultPageSize, "items per page")
+	if err := fs.Parse(args); err != nil {
+		return errors.Newf(errors.InvalidArgument, err, "invalid export command\n%s", usage)
+	}
+	if fs.NArg() != 1 {
+		return errors.Newf(errors.InvalidArgument, nil, "missing subscriber\n%s", usage)
+	}
+	req.Subscriber = fs.Arg(0)
+	out, err := publisher.Publish(ctx, req)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out.Body)
+	return err
+}
+
+func runItemsCommand(ctx context.Context, w io.Writer, items *Items, args []string) error {
+	fs := flag.NewFlagSet("items", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	var req ItemListRequest
+	fs.StringVar(&req.State, "state", ItemStateUnread, "item state")
+	fs.StringVar(&req.Site, "site", "", "site url")
+	fs.StringVar(&req.Tag, "tag", "", "item tag")
+	fs.IntVar(&req.Limit, "limit", listLimit, "number of items")
+	if err := fs.Parse(args); err != nil {
+		return errors.Newf(errors.InvalidArgument, err, "invalid items command\n%s", usage)
+	}
+	if fs.NArg() != 1 {
+		return errors.Newf(errors.InvalidArgument, nil, "missing subscriber\n%s", usage)
+	}
+	req.Subscriber = fs.Arg(0)
+	list, err := items.List(ctx, req)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprint(w, formatItems(list))
+	return err
+}
+
+func runMarkCommand(ctx context.Context, w io.Writer, items *Items, args []string) error {
+	fs := flag.NewFlagSet("mark", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	var change ItemChange
+	var read, unread, star, unstar, archive, unarchive bool
+	fs.BoolVar(&read, "read", false, "mark as read")
+	fs.BoolVar(&unread, "unread", false, "mark as unread")
+	fs.BoolVar(&star, "star", false, "star")
+	fs.BoolVar(&unstar, "unstar", false, "unstar")
+	fs.BoolVar(&archive, "archive", false, "archive")
+	fs.BoolVar(&unarchive, "unarchive", false, "unarchive")
+	fs.Func("tag", "tag to put on", func(tag string) error { change.AddTags = append(change.AddTags, tag); return nil })
+	fs.Func("untag", "tag to take off", func(tag string) error { change.RemoveTags = append(change.RemoveTags, tag); return nil })
+	if err := fs.Parse(args); err != nil {
+		return errors.Newf(errors.InvalidArgument, err, "invalid mark command\n%s", usage)
+	}
+	if fs.NArg() < 2 {
+		return errors.Newf(errors.InvalidArgument, nil, "missing subscriber or items\n%s", usage)
+	}
+	for _, v := range []struct {
+		on, off bool
+		to      **bool
+	}{{read, unread, &change.Read}, {star, unstar, &change.Starred}, {archive, unarchive, &change.Archived}} {
+		if v.on && v.off {
+			return errors.Newf(errors.InvalidArgument, nil, "conflicting mark flags\n%s", usage)
+		}
+		if v.on || v.off {
+			*v.to = boolPtr(v.on)
+		}
+	}
+	var seqs []int64
+	for _, arg := range fs.Args()[1:] {
+		seq, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return errors.Newf(errors.InvalidArgument, err, "invalid item seq %q", arg)
+		}
+		seqs = append(seqs, seq)
+	}
+	if err := items.Update(ctx, fs.Arg(0), seqs, change); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%d items updated\n", len(seqs))
+	return err
+}
+
+func runHashPasswordCommand(w io.Writer, r io.Reader) error {
+	password, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return errors.Newf(errors.InvalidArgument, err, "read password failed")
+	}
+	hash, err := newPasswordHash(strings.TrimRight(password, "\r\n"))
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, hash)
+	return err
+}
+
+func runOutboxCommand(ctx context.Context, w io.Writer, outbox *Outbox, args []string) error {
+	if len(args) == 0 {
+		return errors.Newf(errors.InvalidArgument, nil, "missing outbox command\n%s", usage)
+	}
+	switch args[0] {
+	case "list":
+		var state MessageState
+		if len(args) > 1 {
+			state = MessageState(args[1])
+		}
+		switch state {
+		case "", MessagePending, MessageSent, MessageDead:
+		default:
+			return errors.Newf(errors.InvalidArgument, nil, "invalid message state %q", state)
+		}
+		msgs, err := outbox.List(ctx, state, listLimit)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprint(w, formatMessages(msgs))
+		return err
+	case "retry":
+		if len(args) < 2 {
+			return errors.Newf(errors.InvalidArgument, nil, "missing message id\n%s", usage)
+		}
+		id, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return errors.Newf(errors.InvalidArgument, err, "invalid message id %q", args[1])
+		}
+		if err = outbox.Retry(ctx, id); err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "message %d is pending\n", id)
+		return err
+	default:
+		return errors.Newf(errors.InvalidArgument, nil, "unknown outbox command %q\n%s", args[0], usage)
+	}
+}
+
+func runRunsCommand(ctx context.Context, w io.Writer, runs *Runs, args []string) error {
+	if len(args) == 0 {
+		return errors.Newf(errors.InvalidArgument, nil, "missing runs command\n%s", usage)
+	}
+	switch args[0] {
+	case "list":
+		fs := flag.NewFlagSet("runs list", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		var query JobRunQuery
+		fs.StringVar(&query.Job, "job", "", "job name")
+		fs.StringVar(&query.Subscriber, "subscriber", "", "subscriber name")
+		fs.StringVar(&query.Outcome, "outcome", "", "run outcome")
+		fs.IntVar(&query.Limit, "limit", listLimit, "number of runs")
+		if err := fs.Parse(args[1:]); err != nil {
+			return errors.Newf(errors.InvalidArgument, err, "invalid runs command\n%s", usage)
+		}
+		list, err := runs.List(ctx, query)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprint(w, formatRuns(list))
+		return err
+	case "show":
+		if len(args) < 2 {
+			return errors.Newf(errors.InvalidArgument, nil, "missing run id\n%s", usage)
+		}
+		id, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return errors.Newf(errors.InvalidArgument, err, "invalid run id %q", args[1])
+		}
+		run, err := runs.Get(ctx, id)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprint(w, formatRun(run))
+		return err
+	case "prune":
+		if len(args) < 2 {
+			return errors.Newf(errors.InvalidArgument, nil, "missing age\n%s", usage)
+		}
+		age, err := time.ParseDuration(args[1])
+		if err != nil {
+			return errors.Newf(errors.InvalidArgument, err, "invalid age %q", args[1])
+		}
+		n, err := runs.Prune(ctx, age)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%d runs deleted\n", n)
+		return err
+	default:
+		return errors.Newf(errors.InvalidArgument, nil, "unknown runs command %q\n%s", args[0], usage)
+	}
+}
+
+func runJobsCommand(ctx context.Context, w io.Writer, socket string, args []string) error {
+	if len(args) == 0 || args[0] != "run" {
+		return errors.Newf(errors.InvalidArgument, nil, "unknown jobs command\n%s", usage)
+	}
+	if len(args) > 2 {
+		return errors.Newf(errors.InvalidArgument, nil, "too many jobs\n%s", usage)
+	}
+	var name string
+	if len(args) == 2 {
+		name = args[1]
+	}
+	triggers, err := triggerJobs(ctx, socket, name)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprint(w, formatJobTriggers(triggers))
+	return err
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestDuration(t *testing.T) {
+	var subscriber Subscriber
+	if err := yaml.Unmarshal([]byte("maxRunDuration: 10m"), &subscriber); err != nil {
+		t.Fatal(err)
+	}
+	if subscriber.MaxRunDuration != Duration(10*time.Minute) {
+		t.Fatalf("unexpected duration %v", time.Duration(subscriber.MaxRunDuration))
+	}
+	out, err := json.Marshal(subscriber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(out); got != `{"maxRunDuration":"10m0s"}` {
+		t.Fatalf("unexpected json %s", got)
+	}
+
+	// the subscribers saved with the nanoseconds are still read.
+	for _, in := range []string{`{"maxRunDuration":"10m"}`, `{"maxRunDuration":600000000000}`} {
+		subscriber = Subscriber{}
+		if err = json.Unmarshal([]byte(in), &subscriber); err != nil {
+			t.Fatal(err)
+		}
+		if subscriber.MaxRunDuration != Duration(10*time.Minute) {
+			t.Fatalf("unexpected duration of %s: %v", in, time.Duration(subscriber.MaxRunDuration))
+		}
+	}
+	if err = json.Unmarshal([]byte(`{"maxRunDuration":"ten minutes"}`), &subscriber); err == nil {
+		t.Fatal("expect invalid duration")
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/maxnilz/feed/errors"
+)
+
+const (
+	// leaderLease is the name of the lease the replicas campaign for.
+	leaderLease     = "leader"
+	defaultLeaseTTL = 30 * time.Second
+)
+
+type leaseKey struct{}
+
+// Elector elects the leader among the replicas sharing the storage by a
+// lease, only the leader runs the jobs & flushes the outbox. The leader
+// renews the lease periodically, another replica takes it over once it
+// expires, e.g., the leader is dead. A nil elector is always the leader.
+type Elector struct {
+	storage Storage
+	id      string
+	ttl     time.Duration
+	logger  Logger
+
+	mu sync.Mutex
+	// lease is the lease held, it's nil if the replica is not the leader.
+	lease  *Lease
+	waiter sync.WaitGroup
+}
+
+// NewElector returns nil if the leader election is not enabled.
+func NewElector(cfg Config, storage Storage, logger Logger) *Elector {
+	if !cfg.Election.Enabled {
+		return nil
+	}
+	e := &Elector{storage: storage, id: cfg.Election.Id, ttl: cfg.Election.LeaseTTL, logger: logger}
+	if e.id == "" {
+		hostname, _ := os.Hostname()
+		e.id = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+	if e.ttl <= 0 {
+		e.ttl = defaultLeaseTTL
+	}
+	return e
+}
+
+// Start campaigns for the lease until the context is done, the lease is
+// released then so that another replica takes over right away. The first
+// campaign is done before it returns.
+func (e *Elector) Start(ctx context.Context) {
+	if e == nil {
+		return
+	}
+	e.campaign(ctx)
+	e.waiter.Add(1)
+	go func() {
+		defer e.waiter.Done()
+		ticker := time.NewTicker(e.ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				e.campaign(ctx)
+			case <-ctx.Done():
+				e.release()
+				return
+			}
+		}
+	}()
+}
+
+func (e *Elector) Stop() {
+	if e == nil {
+		return
+	}
+	e.waiter.Wait()
+}
+
+// Lead confirms the leadership by renewing the lease, it returns the
+// lease held if the replica is the leader.
+func (e *Elector) Lead(ctx context.Context) (*Lease, bool) {
+	if e == nil {
+		return nil, true
+	}
+	lease := e.campaign(ctx)
+	return lease, lease != nil
+}
+
+// Leading reports whether the replica is the leader by the lease held,
+// without renewing it.
+func (e *Elector) Leading() bool {
+	_, ok := e.held()
+	return ok
+}
+
+// held returns the lease held if the replica is the leader, without
+// renewing it.
+func (e *Elector) held() (*Lease, bool) {
+	if e == nil {
+		return nil, true
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.lease != nil && time.Now().Before(e.lease.ExpiresAt) {
+		return e.lease, true
+	}
+	return nil, false
+}
+
+// campaign acquires or renews the lease & returns it, or nil if another
+// replica holds it.
+func (e *Elector) campaign(ctx context.Context) *Lease {
+	now := time.Now()
+	lease := &Lease{Name: leaderLease, Holder: e.id, ExpiresAt: now.Add(e.ttl)}
+	ses, err := e.storage.NewAutoSession(ctx)
+	if err == nil {
+		err = e.storage.AcquireLease(ses, lease, now)
+	}
+	if err != nil {
+		// The replica steps down if the lease can't be renewed, since
+		// another one may take it over once it expires.
+		if errors.Code(err) != errors.FailedPrecondition {
+			e.logger.Error(err, "campaign for leader failed", "replica", e.id)
+		}
+		lease = nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	switch {
+	case lease != nil && (e.lease == nil || e.lease.Token != lease.Token):
+		e.logger.Info("elected as leader", "replica", e.id, "token", lease.Token)
+	case lease == nil && e.lease != nil:
+		e.logger.Info("stepped down as leader", "replica", e.id)
+	}
+	e.lease = lease
+	return lease
+}
+
+func (e *Elector) release() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.lease == nil {
+		return
+	}
+	e.lease = nil
+	ses, err := e.storage.NewAutoSession(context.Background())
+	if err == nil {
+		err = e.storage.ReleaseLease(ses, leaderLease, e.id)
+	}
+	if err != nil {
+		e.logger.Error(err, "release leader lease failed", "replica", e.id)
+	}
+}
+
+func withLease(ctx context.Context, lease *Lease) context.Context {
+	if lease == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, leaseKey{}, lease)
+}
+
+// fence checks in the session that the lease the job is run under, if
+// any, is still held, so that a former leader, e.g., resumed after a long
+// pause, doesn't write after another replica has taken over.
+func fence(ctx context.Context, storage Storage, ses Session) error {
+	lease, ok := ctx.Value(leaseKey{}).(*Lease)
+	if !ok {
+		return nil
+	}
+	current, err := storage.GetLease(ses, lease.Name)
+	if err != nil {
+		return err
+	}
+	if current.Holder != lease.Holder || current.Token != lease.Token || !time.Now().Before(current.ExpiresAt) {
+		return errors.Newf(errors.FailedPrecondition, nil, "lease %s is lost, token %d", lease.Name, lease.Token)
+	}
+	return nil
+}
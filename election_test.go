@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/maxnilz/feed/errors"
+)
+
+func TestElector(t *testing.T) {
+	// two replicas share the same sqlite db.
+	dbfile := filepath.Join(t.TempDir(), "feed.db")
+	newReplica := func(id string) (*sqllite, *Elector) {
+		s, err := newSQLite(dbfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		cfg := Config{Election: ElectionConfig{Enabled: true, Id: id, LeaseTTL: 300 * time.Millisecond}}
+		return s, NewElector(cfg, s, DiscardLogger)
+	}
+	s1, e1 := newReplica("r1")
+	s2, e2 := newReplica("r2")
+	if NewElector(Config{}, s1, DiscardLogger) != nil {
+		t.Fatal("expect no elector if the election is disabled")
+	}
+
+	ctx := context.Background()
+	lease1, ok := e1.Lead(ctx)
+	if !ok || lease1.Token != 1 || !e1.Leading() {
+		t.Fatalf("expect r1 elected, got %+v", lease1)
+	}
+	if _, ok = e2.Lead(ctx); ok || e2.Leading() {
+		t.Fatal("expect r2 not elected while r1 holds the lease")
+	}
+
+	// only the leader runs the job tick.
+	var runs int32
+	job := funcJob{name: "foo", fn: func(ctx context.Context) error {
+		atomic.AddInt32(&runs, 1)
+		return nil
+	}}
+	for _, it := range []struct {
+		s *sqllite
+		e *Elector
+	}{{s1, e1}, {s2, e2}} {
+		scheduler := NewScheduler(it.s, DiscardLogger)
+		scheduler.SetElector(it.e)
+		if _, err := scheduler.Schedule("0 0 1 1 *", job); err != nil {
+			t.Fatal(err)
+		}
+		scheduler.Lock()
+		scheduler.startJob(ctx, scheduler.jobs[0], time.Now(), "")
+		scheduler.Unlock()
+		scheduler.Stop()
+	}
+	if runs != 1 {
+		t.Fatalf("expect the job run once, got %d", runs)
+	}
+	ses, _ := s1.NewAutoSession(ctx)
+	list, err := s1.GetJobRuns(ses, JobRunQuery{Job: "foo"})
+	if err != nil || len(list) != 1 {
+		t.Fatalf("expect one run recorded, got %d %v", len(list), err)
+	}
+
+	// r1 dies without renewing the lease, r2 takes over once it expires.
+	time.Sleep(350 * time.Millisecond)
+	lease2, ok := e2.Lead(ctx)
+	if !ok || lease2.Token != 2 {
+		t.Fatalf("expect r2 elected after failover, got %+v", lease2)
+	}
+	if err = fence(withLease(ctx, lease1), s1, ses); errors.Code(err) != errors.FailedPrecondition {
+		t.Fatalf("expect the former leader fenced off, got %v", err)
+	}
+	if err = fence(withLease(ctx, lease2), s1, ses); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok = e1.Lead(ctx); ok {
+		t.Fatal("expect r1 not elected while r2 holds the lease")
+	}
+
+	// the lease is released on the stop, so r1 takes over right away.
+	ctx2, cancel := context.WithCancel(ctx)
+	e2.Start(ctx2)
+	cancel()
+	e2.Stop()
+	if lease1, ok = e1.Lead(ctx); !ok || lease1.Token != 3 {
+		t.Fatalf("expect r1 elected after r2 stopped, got %+v", lease1)
+	}
+}
+
+func TestFencedWrites(t *testing.T) {
+	s := newTestSQLite(t)
+	ctx := context.Background()
+	ses, _ := s.NewAutoSession(ctx)
+	// r1 is the leader, r2 takes over once the lease of r1 expires.
+	now := time.Now()
+	stale := &Lease{Name: leaderLease, Holder: "r1", ExpiresAt: now.Add(time.Minute)}
+	if err := s.AcquireLease(ses, stale, now); err != nil {
+		t.Fatal(err)
+	}
+	current := &Lease{Name: leaderLease, Holder: "r2", ExpiresAt: now.Add(3 * time.Minute)}
+	if err := s.AcquireLease(ses, current, now.Add(2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	staleCtx, currentCtx := withLease(ctx, stale), withLease(ctx, current)
+
+	// the former leader neither sends nor acks the messages.
+	mailbox := &fakeMailbox{}
+	outbox := NewOutbox(Config{}, s, newTestNotifiers(mailbox, "a@example.com"), DiscardLogger)
+	var feeds Feeds
+	feeds.Append(&Feed{Id: "1", Email: "a@example.com", SiteURL: "https://foo.com/index.rss", SiteName: "foo"})
+	msgs, _ := mailbox.Compose(feeds)
+	if err := s.SaveFeeds(ses, feeds.List...); err != nil {
+		t.Fatal(err)
+	}
+	if err := outbox.Enqueue(ses, msgs...); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := outbox.Deliver(staleCtx, msgs...); errors.Code(err) != errors.FailedPrecondition {
+		t.Fatalf("expect the delivery fenced off, got %v", err)
+	}
+	if err := outbox.Flush(staleCtx); errors.Code(err) != errors.FailedPrecondition {
+		t.Fatalf("expect the flush fenced off, got %v", err)
+	}
+	if len(mailbox.sent) != 0 || countAckedFeeds(t, s) != 0 {
+		t.Fatalf("expect nothing sent by the former leader, got %d", len(mailbox.sent))
+	}
+	if err := outbox.Flush(currentCtx); err != nil || len(mailbox.sent) != 1 || countAckedFeeds(t, s) != 1 {
+		t.Fatalf("expect the message sent by the leader, got %d %v", len(mailbox.sent), err)
+	}
+
+	// the former leader doesn't hold the feeds fetched for the digest.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `<?xml version="1.0"?><rss version="2.0"><channel><title>foo</title>
+<item><guid>1</guid><title>post</title><pubDate>Sat, 22 Jul 2023 07:00:00 +0000</pubDate></item></channel></rss>`)
+	}))
+	defer server.Close()
+	subscriber := Subscriber{Name: "bar", Email: "bar@example.com", Sites: []Site{{Name: "Bar", URL: server.URL}}, DigestSchedule: "0 8 * * *"}
+	worker, err := NewWorker(subscriber, s, newTestNotifiers(mailbox, "bar@example.com"), outbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = worker.Run(staleCtx); errors.Code(err) != errors.FailedPrecondition {
+		t.Fatalf("expect the held feeds fenced off, got %v", err)
+	}
+	if pending, _ := s.GetPendingFeeds(ses, subscriber.Email); len(pending) != 0 {
+		t.Fatalf("expect no feeds held by the former leader, got %d", len(pending))
+	}
+	if err = worker.Run(currentCtx); err != nil {
+		t.Fatal(err)
+	}
+	if pending, _ := s.GetPendingFeeds(ses, subscriber.Email); len(pending) != 1 {
+		t.Fatalf("expect the feeds held by the leader, got %d", len(pending))
+	}
+}
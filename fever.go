@@ -0,0 +1,318 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maxnilz/feed/errors"
+)
+
+const (
+	feverAPIVersion = 3
+	// feverPageSize is the number of items the Fever api returns per call.
+	feverPageSize = 50
+)
+
+// Fever serves the Fever compatible api, refer to
+// https://github.com/dasmurphy/tinytinyrss-fever-plugin/blob/master/fever-api.md
+// The api key of a subscriber is md5("<email>:<reader password>").
+type Fever struct {
+	subscribers *Subscribers
+	storage     Storage
+	logger      Logger
+}
+
+func NewFever(subscribers *Subscribers, storage Storage, logger Logger) *Fever {
+	return &Fever{subscribers: subscribers, storage: storage, logger: logger}
+}
+
+func feverAPIKey(email, password string) string {
+	sum := md5.Sum([]byte(strings.ToLower(email) + ":" + password))
+	return hex.EncodeToString(sum[:])
+}
+
+func (f *Fever) authenticate(key string) (*readerAccount, bool) {
+	key = strings.ToLower(key)
+	for _, subscriber := range f.subscribers.List() {
+		if subscriber.ReaderPassword == "" {
+			continue
+		}
+		expected := feverAPIKey(subscriber.Email, subscriber.ReaderPassword)
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(key)) == 1 {
+			return newReaderAccount(subscriber), true
+		}
+	}
+	return nil, false
+}
+
+// ServeHTTP serves the api at /fever/?api, the api key is posted as the
+// api_key form value, the rest of the arguments are either in the query
+// or in the form.
+func (f *Fever) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, f.logger, errors.Newf(errors.InvalidArgument, err, "invalid form"))
+		return
+	}
+	if _, ok := r.Form["api"]; !ok {
+		writeError(w, f.logger, errors.Newf(errors.NotFound, nil, "not found"))
+		return
+	}
+	resp := map[string]interface{}{"api_version": feverAPIVersion, "auth": 0}
+	a, ok := f.authenticate(r.Form.Get("api_key"))
+	if !ok {
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+	resp["auth"] = 1
+	if err := f.serve(r, a, resp); err != nil {
+		writeError(w, f.logger, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (f *Fever) serve(r *http.Request, a *readerAccount, resp map[string]interface{}) error {
+	ctx := r.Context()
+	has := func(name string) bool {
+		_, ok := r.Form[name]
+		return ok
+	}
+	// Mark first, so that the ids listed below reflect the change.
+	if has("mark") {
+		if err := f.mark(r, a); err != nil {
+			return err
+		}
+	}
+
+	ses, err := f.storage.NewAutoSession(ctx)
+	if err != nil {
+		return err
+	}
+	latest := a.query(nil)
+	latest.Desc, latest.Limit = true, 1
+	refs, err := f.storage.GetItemRefs(ses, latest)
+	if err != nil {
+		return err
+	}
+	var lastRefreshed int64
+	if len(refs) > 0 {
+		lastRefreshed = refs[0].SavedAt.Unix()
+	}
+	resp["last_refreshed_on_time"] = lastRefreshed
+
+	if has("groups") || has("feeds") {
+		resp["feeds_groups"] = f.feedsGroups(a)
+	}
+	if has("groups") {
+		groups := []map[string]interface{}{}
+		for _, g := range a.groups() {
+			groups = append(groups, map[string]interface{}{"id": readerId(g), "title": g})
+		}
+		resp["groups"] = groups
+	}
+	if has("feeds") {
+		feeds := []map[string]interface{}{}
+		for _, feed := range a.feeds {
+			feeds = append(feeds, map[string]interface{}{
+				"id":                   feed.Id,
+				"favicon_id":           0,
+				"title":                feed.Title,
+				"url":                  feed.URL,
+				"site_url":             feed.URL,
+				"is_spark":             0,
+				"last_updated_on_time": lastRefreshed,
+			})
+		}
+		resp["feeds"] = feeds
+	}
+	if has("favicons") {
+		resp["favicons"] = []interface{}{}
+	}
+	if has("links") {
+		resp["links"] = []interface{}{}
+	}
+	if has("items") {
+		if err = f.items(r, ses, a, resp); err != nil {
+			return err
+		}
+	}
+	unread, saved := a.query(nil), a.query(nil)
+	unread.Read, saved.Starred = boolPtr(false), boolPtr(true)
+	for _, v := range []struct {
+		name  string
+		query ItemQuery
+	}{{"unread_item_ids", unread}, {"saved_item_ids", saved}} {
+		if !has(v.name) {
+			continue
+		}
+		refs, err := f.storage.GetItemRefs(ses, v.query)
+		if err != nil {
+			return err
+		}
+		ids := make([]string, 0, len(refs))
+		for _, ref := range refs {
+			ids = append(ids, strconv.FormatInt(ref.Seq, 10))
+		}
+		resp[v.name] = strings.Join(ids, ",")
+	}
+	return nil
+}
+
+func (f *Fever) feedsGroups(a *readerAccount) []map[string]interface{} {
+	feedsGroups := []map[string]interface{}{}
+	for _, g := range a.groups() {
+		var ids []string
+		for _, feed := range a.feeds {
+			if feed.Group == g {
+				ids = append(ids, strconv.FormatInt(feed.Id, 10))
+			}
+		}
+		feedsGroups = append(feedsGroups, map[string]interface{}{"group_id": readerId(g), "feed_ids": strings.Join(ids, ",")})
+	}
+	return feedsGroups
+}
+
+func (f *Fever) items(r *http.Request, ses Session, a *readerAccount, resp map[string]interface{}) error {
+	query := a.query(nil)
+	total, err := f.storage.GetItemRefs(ses, query)
+	if err != nil {
+		return err
+	}
+	resp["total_items"] = len(total)
+
+	query.Limit = feverPageSize
+	if s := r.Form.Get("with_ids"); s != "" {
+		ids, err := parseIds(s)
+		if err != nil {
+			return err
+		}
+		if len(ids) > feverPageSize {
+			ids = ids[:feverPageSize]
+		}
+		query.Seqs = ids
+	} else if s := r.Form.Get("max_id"); s != "" {
+		if query.MaxSeq, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return errors.Newf(errors.InvalidArgument, err, "invalid max_id %q", s)
+		}
+		query.Desc = true
+	} else if s := r.Form.Get("since_id"); s != "" {
+		if query.MinSeq, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return errors.Newf(errors.InvalidArgument, err, "invalid since_id %q", s)
+		}
+	}
+	items, err := f.storage.GetItems(ses, query)
+	if err != nil {
+		return err
+	}
+	list := []map[string]interface{}{}
+	for _, it := range items {
+		content := it.Content
+		if content == "" {
+			content = it.Description
+		}
+		created := it.SavedAt
+		if published, ok := parseFeedTime(it.PublishedAt); ok {
+			created = published
+		}
+		list = append(list, map[string]interface{}{
+			"id":              it.Seq,
+			"feed_id":         a.feedsByURL[it.SiteURL].Id,
+			"title":           it.Title,
+			"author":          it.Author,
+			"html":            content,
+			"url":             it.Link,
+			"is_saved":        boolInt(it.Starred),
+			"is_read":         boolInt(it.Read),
+			"created_on_time": created.Unix(),
+		})
+	}
+	resp["items"] = list
+	return nil
+}
+
+// mark changes the state of an item, or marks the items of a feed or a
+// group as read, the group 0 is all the feeds.
+func (f *Fever) mark(r *http.Request, a *readerAccount) error {
+	id, err := strconv.ParseInt(r.Form.Get("id"), 10, 64)
+	if err != nil {
+		return errors.Newf(errors.InvalidArgument, err, "invalid id %q", r.Form.Get("id"))
+	}
+	var change ItemChange
+	switch as := r.Form.Get("as"); as {
+	case "read":
+		change.Read = boolPtr(true)
+	case "unread":
+		change.Read = boolPtr(false)
+	case "saved":
+		change.Starred = boolPtr(true)
+	case "unsaved":
+		change.Starred = boolPtr(false)
+	default:
+		return errors.Newf(errors.InvalidArgument, nil, "invalid mark as %q", as)
+	}
+
+	query := a.query(nil)
+	switch mark := r.Form.Get("mark"); mark {
+	case "item":
+		query.Seqs = []int64{id}
+	case "feed", "group":
+		if change.Read == nil || !*change.Read {
+			return errors.Newf(errors.InvalidArgument, nil, "a %s can only be marked as read", mark)
+		}
+		if mark == "feed" {
+			feed, ok := a.feedsById[id]
+			if !ok {
+				return errors.Newf(errors.NotFound, nil, "feed %d not found", id)
+			}
+			query.Sites = []string{feed.URL}
+		} else if id != 0 {
+			query.Sites = nil
+			for _, g := range a.groups() {
+				if readerId(g) == id {
+					query.Sites = a.siteURLs(g)
+				}
+			}
+			if len(query.Sites) == 0 {
+				return errors.Newf(errors.NotFound, nil, "group %d not found", id)
+			}
+		}
+		query.Read = boolPtr(false)
+		if s := r.Form.Get("before"); s != "" {
+			before, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return errors.Newf(errors.InvalidArgument, err, "invalid before %q", s)
+			}
+			query.SavedBefore = time.Unix(before+1, 0)
+		}
+	default:
+		return errors.Newf(errors.InvalidArgument, nil, "invalid mark %q", mark)
+	}
+	return markItems(r.Context(), f.storage, query, change)
+}
+
+func parseIds(s string) ([]int64, error) {
+	var ids []int64
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, errors.Newf(errors.InvalidArgument, err, "invalid id %q", v)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func boolInt(v bool) int {
+	if v {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maxnilz/feed/errors"
+)
+
+const (
+	greaderReadingList = "user/-/state/com.google/reading-list"
+	greaderRead        = "user/-/state/com.google/read"
+	greaderStarred     = "user/-/state/com.google/starred"
+	greaderLabelPrefix = "user/-/label/"
+	greaderFeedPrefix  = "feed/"
+	greaderItemPrefix  = "tag:google.com,2005:reader/item/"
+
+	greaderPageSize    = 20
+	greaderMaxPageSize = 1000
+)
+
+// GReader serves the subset of the Google Reader api the sync clients use,
+// refer to https://feedhq.readthedocs.io/en/latest/api/index.html
+// The subscriber signs in with the email & the reader password at
+// accounts/ClientLogin, the subscriptions are read only.
+type GReader struct {
+	subscribers *Subscribers
+	storage     Storage
+	logger      Logger
+}
+
+func NewGReader(subscribers *Subscribers, storage Storage, logger Logger) *GReader {
+	return &GReader{subscribers: subscribers, storage: storage, logger: logger}
+}
+
+// account returns the account of the subscriber by the email, if it's
+// allowed in the api.
+func (g *GReader) account(email string) (*readerAccount, bool) {
+	subscriber, ok := g.subscribers.GetByEmail(email)
+	if !ok || subscriber.ReaderPassword == "" {
+		return nil, false
+	}
+	return newReaderAccount(subscriber), true
+}
+
+// greaderAuthToken returns the stateless auth token of the account,
+// which is revoked by changing the password.
+func greaderAuthToken(email, password string) string {
+	email = strings.ToLower(email)
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write([]byte(email))
+	return email + "/" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (g *GReader) authenticate(r *http.Request) (*readerAccount, bool) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "GoogleLogin auth=") {
+		return nil, false
+	}
+	token := strings.TrimPrefix(auth, "GoogleLogin auth=")
+	email, _, _ := strings.Cut(token, "/")
+	a, ok := g.account(email)
+	if !ok {
+		return nil, false
+	}
+	expected := greaderAuthToken(email, a.subscriber.ReaderPassword)
+	return a, subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+// ServeHTTP serves the api at /greader/accounts/ClientLogin &
+// /greader/reader/api/0/*.
+func (g *GReader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, g.logger, errors.Newf(errors.InvalidArgument, err, "invalid form"))
+		return
+	}
+	p := strings.TrimPrefix(r.URL.Path, "/greader/")
+	if p == "accounts/ClientLogin" {
+		g.login(w, r)
+		return
+	}
+	endpoint, ok := strings.CutPrefix(p, "reader/api/0/")
+	if !ok {
+		writeError(w, g.logger, errors.Newf(errors.NotFound, nil, "not found"))
+		return
+	}
+	a, ok := g.authenticate(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var err error
+	switch {
+	case endpoint == "token":
+		// The edits are authenticated by the header, so the token is not
+		// checked, it's served for the clients which require one.
+		token := greaderAuthToken(a.subscriber.Email, a.subscriber.ReaderPassword)
+		writeText(w, token[len(token)-32:])
+	case endpoint == "user-info":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"userId":        strconv.FormatInt(readerId(a.subscriber.Email), 10),
+			"userName":      a.subscriber.Name,
+			"userProfileId": strconv.FormatInt(readerId(a.subscriber.Email), 10),
+			"userEmail":     a.subscriber.Email,
+		})
+	case endpoint == "subscription/list":
+		g.subscriptions(w, a)
+	case endpoint == "tag/list":
+		tags := []map[string]string{{"id": greaderStarred}}
+		for _, group := range a.groups() {
+			tags = append(tags, map[string]string{"id": greaderLabelPrefix + group, "type": "folder"})
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"tags": tags})
+	case endpoint == "unread-count":
+		err = g.unreadCount(w, r, a)
+	case endpoint == "stream/items/ids":
+		err = g.itemIds(w, r, a)
+	case endpoint == "stream/items/contents":
+		err = g.itemContents(w, r, a)
+	case strings.HasPrefix(endpoint, "stream/contents"):
+		err = g.streamContents(w, r, a, strings.TrimPrefix(strings.TrimPrefix(endpoint, "stream/contents"), "/"))
+	case endpoint == "edit-tag":
+		err = g.editTag(w, r, a)
+	case endpoint == "mark-all-as-read":
+		err = g.markAllAsRead(w, r, a)
+	case strings.HasPrefix(endpoint, "subscription/"):
+		err = errors.Newf(errors.Unimplemented, nil, "the subscriptions are managed in the config")
+	default:
+		err = errors.Newf(errors.NotFound, nil, "not found")
+	}
+	if err != nil {
+		writeError(w, g.logger, err)
+	}
+}
+
+func (g *GReader) login(w http.ResponseWriter, r *http.Request) {
+	email, password := r.Form.Get("Email"), r.Form.Get("Passwd")
+	a, ok := g.account(email)
+	if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(a.subscriber.ReaderPassword)) != 1 {
+		http.Error(w, "Error=BadAuthentication", http.StatusUnauthorized)
+		return
+	}
+	token := greaderAuthToken(email, password)
+	if r.Form.Get("output") == "json" {
+		writeJSON(w, http.StatusOK, map[string]string{"SID": token, "LSID": token, "Auth": token})
+		return
+	}
+	writeText(w, fmt.Sprintf("SID=%s\nLSID=%s\nAuth=%s\n", token, token, token))
+}
+
+func writeText(w http.ResponseWriter, s string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte(s))
+}
+
+func (g *GReader) subscriptions(w http.ResponseWriter, a *readerAccount) {
+	subscriptions := []map[string]interface{}{}
+	for _, feed := range a.feeds {
+		categories := []map[string]string{}
+		if feed.Group != "" {
+			categories = append(categories, map[string]string{"id": greaderLabelPrefix + feed.Group, "label": feed.Group})
+		}
+		subscriptions = append(subscriptions, map[string]interface{}{
+			"id":         greaderFeedPrefix + feed.URL,
+			"title":      feed.Title,
+			"categories": categories,
+			"url":        feed.URL,
+			"htmlUrl":    feed.URL,
+			"iconUrl":    "",
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"subscriptions": subscriptions})
+}
+
+func (g *GReader) unreadCount(w http.ResponseWriter, r *http.Request, a *readerAccount) error {
+	ses, err := g.storage.NewAutoSession(r.Context())
+	if err != nil {
+		return err
+	}
+	query := a.query(nil)
+	query.Read = boolPtr(false)
+	refs, err := g.storage.GetItemRefs(ses, query)
+	if err != nil {
+		return err
+	}
+	type count struct {
+		n      int
+		newest time.Time
+	}
+	counts := make(map[string]*count)
+	add := func(id string, ref ItemRef) {
+		c, ok := counts[id]
+		if !ok {
+			c = &count{}
+			counts[id] = c
+		}
+		c.n++
+		if ref.SavedAt.After(c.newest) {
+			c.newest = ref.SavedAt
+		}
+	}
+	for _, ref := range refs {
+		add(greaderReadingList, ref)
+		add(greaderFeedPrefix+ref.SiteURL, ref)
+		if group := a.feedsByURL[ref.SiteURL].Group; group != "" {
+			add(greaderLabelPrefix+group, ref)
+		}
+	}
+	unreadCounts := []map[string]interface{}{}
+	for id, c := range counts {
+		unreadCounts = append(unreadCounts, map[string]interface{}{
+			"id":                      id,
+			"count":                   c.n,
+			"newestItemTimestampUsec": strconv.FormatInt(c.newest.UnixMicro(), 10),
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"max": greaderMaxPageSize, "unreadcounts": unreadCounts})
+	return nil
+}
+
+// streamQuery returns the item query of the stream, i.e., the reading
+// list, the read or starred state, a feed or a label, with the stream
+// arguments, e.g., the excluded state, the time range & the continuation.
+func (g *GReader) streamQuery(r *http.Request, a *readerAccount, stream string) (ItemQuery, error) {
+	query := a.query(nil)
+	if err := g.filterStream(&query, a, stream, true); err != nil {
+		return query, err
+	}
+	for _, exclude := range r.Form["xt"] {
+		if err := g.filterStream(&query, a, exclude, false); err != nil {
+			return query, err
+		}
+	}
+	if it := r.Form.Get("it"); it != "" {
+		if err := g.filterStream(&query, a, it, true); err != nil {
+			return query, err
+		}
+	}
+	query.Desc = r.Form.Get("r") != "o"
+	query.Limit = greaderPageSize
+	if s := r.Form.Get("n"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return query, errors.Newf(errors.InvalidArgument, err, "invalid n %q", s)
+		}
+		query.Limit = n
+		if n > greaderMaxPageSize {
+			query.Limit = greaderMaxPageSize
+		}
+	}
+	for _, v := range []struct {
+		name string
+		to   *time.Time
+		by   int64
+	}{{"ot", &query.SavedAfter, -1}, {"nt", &query.SavedBefore, 1}} {
+		if s := r.Form.Get(v.name); s != "" {
+			sec, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return query, errors.Newf(errors.InvalidArgument, err, "invalid %s %q", v.name, s)
+			}
+			// The bounds are inclusive in the api.
+			*v.to = time.Unix(sec+v.by, 0)
+		}
+	}
+	if s := r.Form.Get("c"); s != "" {
+		seq, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return query, errors.Newf(errors.InvalidArgument, err, "invalid continuation %q", s)
+		}
+		if query.Desc {
+			query.MaxSeq = seq
+		} else {
+			query.MinSeq = seq
+		}
+	}
+	return query, nil
+}
+
+// filterStream narrows the query to the stream, or to the items not in the
+// stream if include is false, only the state streams can be excluded.
+func (g *GReader) filterStream(query *ItemQuery, a *readerAccount, stream string, include bool) error {
+	stream = normalizeStream(stream)
+	switch {
+	case stream == greaderReadingList && include:
+	case stream == greaderRead:
+		query.Read = boolPtr(include)
+	case stream == greaderStarred:
+		query.Starred = boolPtr(include)
+	case strings.HasPrefix(stream, greaderFeedPrefix) && include:
+		feed, ok := a.feedsByURL[strings.TrimPrefix(stream, greaderFeedPrefix)]
+		if !ok {
+			return errors.Newf(errors.NotFound, nil, "stream %s not found", stream)
+		}
+		query.Sites = []string{feed.URL}
+	case strings.HasPrefix(stream, greaderLabelPrefix) && include:
+		query.Sites = a.siteURLs(strings.TrimPrefix(stream, greaderLabelPrefix))
+		if len(query.Sites) == 0 {
+			return errors.Newf(errors.NotFound, nil, "stream %s not found", stream)
+		}
+	default:
+		return errors.Newf(errors.InvalidArgument, nil, "unsupported stream %s", stream)
+	}
+	return nil
+}
+
+// normalizeStream replaces the user id in the user streams with -, the
+// clients use either.
+func normalizeStream(stream string) string {
+	if !strings.HasPrefix(stream, "user/") {
+		return stream
+	}
+	parts := strings.SplitN(stream, "/", 3)
+	if len(parts) < 3 {
+		return stream
+	}
+	return "user/-/" + parts[2]
+}
+
+func (g *GReader) itemIds(w http.ResponseWriter, r *http.Request, a *readerAccount) error {
+	query, err := g.streamQuery(r, a, r.Form.Get("s"))
+	if err != nil {
+		return err
+	}
+	query.Limit++
+	ses, err := g.storage.NewAutoSession(r.Context())
+	if err != nil {
+		return err
+	}
+	refs, err := g.storage.GetItemRefs(ses, query)
+	if err != nil {
+		return err
+	}
+	resp := map[string]interface{}{}
+	if len(refs) == query.Limit {
+		refs = refs[:len(refs)-1]
+		resp["continuation"] = strconv.FormatInt(refs[len(refs)-1].Seq, 10)
+	}
+	itemRefs := []map[string]interface{}{}
+	for _, ref := range refs {
+		itemRefs = append(itemRefs, map[string]interface{}{
+			"id":              strconv.FormatInt(ref.Seq, 10),
+			"timestampUsec":   strconv.FormatInt(ref.SavedAt.UnixMicro(), 10),
+			"directStreamIds": []string{},
+		})
+	}
+	resp["itemRefs"] = itemRefs
+	writeJSON(w, http.StatusOK, resp)
+	return nil
+}
+
+func (g *GReader) itemContents(w http.ResponseWriter, r *http.Request, a *readerAccount) error {
+	seqs, err := parseItemIds(r.Form["i"])
+	if err != nil {
+		return err
+	}
+	query := a.query(nil)
+	query.Seqs = seqs
+	query.Desc = true
+	var items []*Item
+	if len(seqs) > 0 {
+		ses, err := g.storage.NewAutoSession(r.Context())
+		if err != nil {
+			return err
+		}
+		if items, err = g.storage.GetItems(ses, query); err != nil {
+			return err
+		}
+	}
+	g.writeItems(w, a, greaderReadingList, items, "")
+	return nil
+}
+
+func (g *GReader) streamContents(w http.ResponseWriter, r *http.Request, a *readerAccount, stream string) error {
+	if s, err := url.PathUnescape(stream); err == nil {
+		stream = s
+	}
+	if stream == "" {
+		stream = r.Form.Get("s")
+	}
+	if stream == "" {
+		stream = greaderReadingList
+	}
+	query, err := g.streamQuery(r, a, stream)
+	if err != nil {
+		return err
+	}
+	query.Limit++
+	ses, err := g.storage.NewAutoSession(r.Context())
+	if err != nil {
+		return err
+	}
+	items, err := g.storage.GetItems(ses, query)
+	if err != nil {
+		return err
+	}
+	var continuation string
+	if len(items) == query.Limit {
+		items = items[:len(items)-1]
+		continuation = strconv.FormatInt(items[len(items)-1].Seq, 10)
+	}
+	g.writeItems(w, a, stream, items, continuation)
+	return nil
+}
+
+func (g *GReader) writeItems(w http.ResponseWriter, a *readerAccount, stream string, items []*Item, continuation string) {
+	list := []map[string]interface{}{}
+	for _, it := range items {
+		feed := a.feedsByURL[it.SiteURL]
+		fi := newFeedItem(it.Feed)
+		categories := []string{greaderReadingList}
+		if it.Read {
+			categories = append(categories, greaderRead)
+		}
+		if it.Starred {
+			categories = append(categories, greaderStarred)
+		}
+		if feed.Group != "" {
+			categories = append(categories, greaderLabelPrefix+feed.Group)
+		}
+		content := it.Content
+		if content == "" {
+			content = it.Description
+		}
+		list = append(list, map[string]interface{}{
+			"id":            greaderItemId(it.Seq),
+			"crawlTimeMsec": strconv.FormatInt(it.SavedAt.UnixMilli(), 10),
+			"timestampUsec": strconv.FormatInt(it.SavedAt.UnixMicro(), 10),
+			"published":     fi.Published.Unix(),
+			"updated":       fi.Updated.Unix(),
+			"title":         it.Title,
+			"author":        it.Author,
+			"canonical":     []map[string]string{{"href": it.Link}},
+			"alternate":     []map[string]string{{"href": it.Link, "type": "text/html"}},
+			"summary":       map[string]string{"direction": "ltr", "content": content},
+			"categories":    categories,
+			"origin": map[string]string{
+				"streamId": greaderFeedPrefix + it.SiteURL,
+				"title":    feed.Title,
+				"htmlUrl":  it.SiteURL,
+			},
+		})
+	}
+	resp := map[string]interface{}{
+		"id":      stream,
+		"updated": time.Now().Unix(),
+		"items":   list,
+	}
+	if continuation != "" {
+		resp["continuation"] = continuation
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (g *GReader) editTag(w http.ResponseWriter, r *http.Request, a *readerAccount) error {
+	if r.Method != http.MethodPost {
+		return errors.Newf(errors.InvalidArgument, nil, "edit-tag requires POST")
+	}
+	seqs, err := parseItemIds(r.Form["i"])
+	if err != nil {
+		return err
+	}
+	var change ItemChange
+	for _, v := range []struct {
+		tags []string
+		to   bool
+	}{{r.Form["a"], true}, {r.Form["r"], false}} {
+		for _, tag := range v.tags {
+			switch normalizeStream(tag) {
+			case greaderRead:
+				change.Read = boolPtr(v.to)
+			case greaderStarred:
+				change.Starred = boolPtr(v.to)
+			default:
+				// The other states, e.g. kept-unread, & the labels of the
+				// items are not supported.
+			}
+		}
+	}
+	if len(seqs) > 0 && (change.Read != nil || change.Starred != nil) {
+		query := a.query(nil)
+		query.Seqs = seqs
+		if err = markItems(r.Context(), g.storage, query, change); err != nil {
+			return err
+		}
+	}
+	writeText(w, "OK")
+	return nil
+}
+
+func (g *GReader) markAllAsRead(w http.ResponseWriter, r *http.Request, a *readerAccount) error {
+	if r.Method != http.MethodPost {
+		return errors.Newf(errors.InvalidArgument, nil, "mark-all-as-read requires POST")
+	}
+	query := a.query(nil)
+	if err := g.filterStream(&query, a, r.Form.Get("s"), true); err != nil {
+		return err
+	}
+	query.Read = boolPtr(false)
+	if s := r.Form.Get("ts"); s != "" {
+		usec, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return errors.Newf(errors.InvalidArgument, err, "invalid ts %q", s)
+		}
+		query.SavedBefore = time.UnixMicro(usec).Add(time.Second)
+	}
+	if err := markItems(r.Context(), g.storage, query, ItemChange{Read: boolPtr(true)}); err != nil {
+		return err
+	}
+	writeText(w, "OK")
+	return nil
+}
+
+func greaderItemId(seq int64) string {
+	return fmt.Sprintf("%s%016x", greaderItemPrefix, seq)
+}
+
+// parseItemIds parses the item ids in either the long form, i.e., the
+// hex one with the tag prefix, or the short form, i.e., the decimal one.
+func parseItemIds(ids []string) ([]int64, error) {
+	seqs := make([]int64, 0, len(ids))
+	for _, id := range ids {
+		var seq int64
+		var err error
+		if hexId, ok := strings.CutPrefix(id, greaderItemPrefix); ok {
+			var u uint64
+			u, err = strconv.ParseUint(hexId, 16, 64)
+			seq = int64(u)
+		} else {
+			seq, err = strconv.ParseInt(id, 10, 64)
+		}
+		if err != nil {
+			return nil, errors.Newf(errors.InvalidArgument, err, "invalid item id %q", id)
+		}
+		seqs = append(seqs, seq)
+	}
+	return seqs, nil
+}
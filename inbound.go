@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maxnilz/feed/errors"
+	"golang.org/x/net/html/charset"
+)
+
+const (
+	defaultInboundDomain  = "feeds.local"
+	defaultInboundMaxSize = 10 << 20
+
+	// inboundTimeout is the idle timeout of a smtp session.
+	inboundTimeout = 5 * time.Minute
+)
+
+// inboundSiteURL returns the normalized site url if the endpoint is a
+// virtual site fed by the smtp receiver, i.e., mailto:<token>@<domain>.
+func inboundSiteURL(endpoint string) (string, bool) {
+	u := strings.ToLower(strings.TrimSpace(endpoint))
+	if !strings.HasPrefix(u, "mailto:") {
+		return "", false
+	}
+	return u, true
+}
+
+// Receiver is an embedded smtp server which turns the mails sent to the
+// virtual sites, e.g., newsletters, into feeds. It accepts the mails to
+// the configured tokens only, and relays nothing.
+type Receiver struct {
+	addr    string
+	domain  string
+	maxSize int64
+	// sites are the virtual site urls by the recipient addresses.
+	sites   map[string]string
+	storage Storage
+
+	listener net.Listener
+	waiter   sync.WaitGroup
+
+	logger Logger
+}
+
+func NewReceiver(cfg Config, storage Storage, logger Logger) (*Receiver, error) {
+	ic := cfg.Inbound
+	r := &Receiver{
+		addr:    ic.Addr,
+		domain:  strings.ToLower(ic.Domain),
+		maxSize: ic.MaxSize,
+		sites:   make(map[string]string),
+		storage: storage,
+		logger:  logger,
+	}
+	if r.domain == "" {
+		r.domain = defaultInboundDomain
+	}
+	if r.maxSize <= 0 {
+		r.maxSize = defaultInboundMaxSize
+	}
+	for _, site := range ic.Sites {
+		if site.Token == "" || strings.ContainsAny(site.Token, "@ <>") {
+			return nil, errors.Newf(errors.InvalidArgument, nil, "invalid inbound token of site %s", site.Name)
+		}
+		addr := strings.ToLower(site.Token) + "@" + r.domain
+		if _, ok := r.sites[addr]; ok {
+			return nil, errors.Newf(errors.InvalidArgument, nil, "duplicated inbound token of site %s", site.Name)
+		}
+		r.sites[addr] = "mailto:" + addr
+	}
+	return r, nil
+}
+
+// Start listens on the configured address & serves the smtp sessions
+// until the context is done.
+func (r *Receiver) Start(ctx context.Context) error {
+	l, err := net.Listen("tcp", r.addr)
+	if err != nil {
+		return errors.Newf(errors.Internal, err, "listen on %s failed", r.addr)
+	}
+	r.listener = l
+	r.logger.Info("smtp receiver started", "addr", l.Addr().String(), "domain", r.domain)
+	r.waiter.Add(1)
+	go func() {
+		defer r.waiter.Done()
+		<-ctx.Done()
+		l.Close()
+	}()
+	r.waiter.Add(1)
+	go func() {
+		defer r.waiter.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if ctx.Err() == nil {
+					r.logger.Error(err, "accept smtp connection failed")
+				}
+				return
+			}
+			r.waiter.Add(1)
+			go func() {
+				defer r.waiter.Done()
+				r.serve(ctx, conn)
+			}()
+		}
+	}()
+	return nil
+}
+
+// Addr returns the address the receiver listens on.
+func (r *Receiver) Addr() string {
+	return r.listener.Addr().String()
+}
+
+func (r *Receiver) Stop() {
+	r.waiter.Wait()
+}
+
+// serve runs a smtp session, refer to https://www.rfc-editor.org/rfc/rfc5321
+func (r *Receiver) serve(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	// Interrupt the session on shutdown.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	c := textproto.NewConn(conn)
+	reply := func(format string, args ...interface{}) bool {
+		_ = conn.SetDeadline(time.Now().Add(inboundTimeout))
+		return c.PrintfLine(format, args...) == nil
+	}
+	if !reply("220 %s ESMTP feed", r.domain) {
+		return
+	}
+	// from is the reverse path of the mail transaction, which is empty
+	// for the bounces, started tells if MAIL is received.
+	var from string
+	var started bool
+	var sites []string
+	for ctx.Err() == nil {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			reply("250 %s", r.domain)
+		case "EHLO":
+			reply("250-%s\r\n250-8BITMIME\r\n250 SIZE %d", r.domain, r.maxSize)
+		case "MAIL":
+			addr, ok := parsePath(arg, "FROM:")
+			if !ok {
+				reply("501 5.5.4 syntax: MAIL FROM:<address>")
+				continue
+			}
+			from, started, sites = addr, true, nil
+			reply("250 2.1.0 OK")
+		case "RCPT":
+			addr, ok := parsePath(arg, "TO:")
+			if !ok {
+				reply("501 5.5.4 syntax: RCPT TO:<address>")
+				continue
+			}
+			if !started {
+				reply("503 5.5.1 need MAIL first")
+				continue
+			}
+			site, ok := r.sites[strings.ToLower(addr)]
+			if !ok {
+				reply("550 5.1.1 mailbox unavailable")
+				continue
+			}
+			sites = append(sites, site)
+			reply("250 2.1.5 OK")
+		case "DATA":
+			if len(sites) == 0 {
+				reply("503 5.5.1 need RCPT first")
+				continue
+			}
+			if !reply("354 end data with <CR><LF>.<CR><LF>") {
+				return
+			}
+			data, err := io.ReadAll(io.LimitReader(c.DotReader(), r.maxSize+1))
+			if err != nil {
+				return
+			}
+			if int64(len(data)) > r.maxSize {
+				// Drain the rest of the message before the reply.
+				if _, err = io.Copy(io.Discard, c.DotReader()); err != nil {
+					return
+				}
+				reply("552 5.3.4 message too big")
+			} else if err = r.receive(ctx, data, sites); err != nil {
+				r.logger.Error(err, "receive mail failed", "from", from)
+				if errors.Code(err) == errors.InvalidArgument {
+					reply("554 5.6.0 invalid message")
+				} else {
+					reply("451 4.3.0 try again later")
+				}
+			} else {
+				reply("250 2.0.0 OK")
+			}
+			from, started, sites = "", false, nil
+		case "RSET":
+			from, started, sites = "", false, nil
+			reply("250 2.0.0 OK")
+		case "NOOP":
+			reply("250 2.0.0 OK")
+		case "VRFY":
+			reply("252 2.5.0 cannot verify")
+		case "QUIT":
+			reply("221 2.0.0 bye")
+			return
+		default:
+			reply("502 5.5.2 command not implemented")
+		}
+	}
+}
+
+// parsePath returns the address of MAIL FROM:<addr> or RCPT TO:<addr>,
+// the parameters after the path are ignored.
+func parsePath(arg, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(arg, "<") {
+		return "", false
+	}
+	end := strings.Index(arg, ">")
+	if end < 0 {
+		return "", false
+	}
+	return arg[1:end], true
+}
+
+func (r *Receiver) receive(ctx context.Context, data []byte, sites []string) error {
+	feed, err := parseInboundMail(data, time.Now())
+	if err != nil {
+		return err
+	}
+	ses, err := r.storage.NewSession(ctx)
+	if err != nil {
+		return err
+	}
+	ses, err = ses.Begin()
+	if err != nil {
+		return err
+	}
+	for _, site := range sites {
+		f := *feed
+		f.SiteURL = site
+		if err = r.storage.SaveInboundFeed(ses, &f); err != nil {
+			_ = ses.Rollback()
+			return err
+		}
+		r.logger.Info("received mail", "site", site, "title", f.Title)
+	}
+	return ses.Commit()
+}
+
+// parseInboundMail parses the mail into a feed, with the subject as the
+// title, the html body as the content & the sender as the author. The
+// feed is identified by the message id.
+func parseInboundMail(data []byte, now time.Time) (*Feed, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.Newf(errors.InvalidArgument, err, "parse mail failed")
+	}
+	dec := &mime.WordDecoder{CharsetReader: charset.NewReaderLabel}
+	title, err := dec.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		title = msg.Header.Get("Subject")
+	}
+	var author string
+	if from, err := mail.ParseAddress(msg.Header.Get("From")); err == nil {
+		author = from.Name
+		if author == "" {
+			author = from.Address
+		}
+	} else {
+		author, _ = dec.DecodeHeader(msg.Header.Get("From"))
+	}
+	publishedAt := now
+	if date, err := msg.Header.Date(); err == nil {
+		publishedAt = date
+	}
+	content, err := mailContent(textproto.MIMEHeader(msg.Header), msg.Body)
+	if err != nil {
+		return nil, err
+	}
+	id := strings.Trim(msg.Header.Get("Message-Id"), "<> ")
+	if id == "" {
+		sum := sha256.Sum256(data)
+		id = hex.EncodeToString(sum[:])
+	}
+	return &Feed{
+		Id:          id,
+		Title:       title,
+		Content:     content,
+		Author:      author,
+		PublishedAt: publishedAt.Format(time.RFC1123Z),
+		FetchAt:     now,
+	}, nil
+}
+
+// mailContent returns the body of the mail part as html, the html
+// alternative is preferred over the plain text one.
+func mailContent(header textproto.MIMEHeader, body io.Reader) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		var plain string
+		for {
+			p, err := mr.NextRawPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return "", errors.Newf(errors.InvalidArgument, err, "read multipart mail failed")
+			}
+			if strings.HasPrefix(p.Header.Get("Content-Disposition"), "attachment") {
+				continue
+			}
+			content, err := mailContent(p.Header, p)
+			if err != nil {
+				return "", err
+			}
+			partType, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+			if partType == "text/html" || (strings.HasPrefix(partType, "multipart/") && content != "") {
+				return content, nil
+			}
+			if plain == "" {
+				plain = content
+			}
+		}
+		return plain, nil
+	}
+	if mediaType != "text/html" && mediaType != "text/plain" {
+		return "", nil
+	}
+
+	var r io.Reader = body
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	case "base64":
+		// The line breaks are ignored by the decoder.
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	}
+	if cs := params["charset"]; cs != "" && !strings.EqualFold(cs, "utf-8") {
+		if r, err = charset.NewReaderLabel(cs, r); err != nil {
+			return "", errors.Newf(errors.InvalidArgument, err, "unsupported charset %s", cs)
+		}
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return "", errors.Newf(errors.InvalidArgument, err, "decode mail body failed")
+	}
+	if mediaType == "text/plain" {
+		return fmt.Sprintf("<pre>%s</pre>", html.EscapeString(string(b))), nil
+	}
+	return string(b), nil
+}
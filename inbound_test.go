@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const newsletter = "From: Weekly News <news@example.com>\r\n" +
+	"To: abc@feeds.local\r\n" +
+	"Subject: =?UTF-8?Q?Issue_#1_=E2=80=94_h=C3=A9llo?=\r\n" +
+	"Date: Sat, 22 Jul 2023 07:00:00 +0000\r\n" +
+	"Message-ID: <issue-1@example.com>\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/alternative; boundary=\"b1\"\r\n" +
+	"\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/plain; charset=UTF-8\r\n" +
+	"\r\n" +
+	"plain body\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/html; charset=UTF-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"<p>html =3D body</p>\r\n" +
+	"--b1--\r\n"
+
+func TestReceiver(t *testing.T) {
+	s := newTestSQLite(t)
+	cfg := Config{Inbound: InboundConfig{Addr: "127.0.0.1:0", Sites: []InboundSite{{Name: "news", Token: "abc"}}}}
+	receiver, err := NewReceiver(cfg, s, DiscardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if err = receiver.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cancel()
+		receiver.Stop()
+	}()
+
+	if err = smtp.SendMail(receiver.Addr(), nil, "news@example.com", []string{"nobody@feeds.local"}, []byte(newsletter)); err == nil {
+		t.Fatal("expected unknown recipient to be rejected")
+	}
+	// The same mail delivered twice is saved once.
+	for i := 0; i < 2; i++ {
+		if err = smtp.SendMail(receiver.Addr(), nil, "news@example.com", []string{"ABC@feeds.local"}, []byte(newsletter)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir := filepath.Join(t.TempDir(), "Maildir")
+	subscriber := Subscriber{
+		Name:      "foo",
+		Email:     "foo@example.com",
+		Sites:     []Site{{Name: "Weekly News", URL: "mailto:abc@feeds.local"}},
+		Notifiers: []NotifierConfig{{Type: NotifierMaildir, Path: dir, Delivery: DeliveryPerItem}},
+	}
+	cfg.Subscribers = []Subscriber{subscriber}
+	notifiers, err := NewNotifiers(cfg, DiscardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewWorker(subscriber, s, notifiers, NewOutbox(cfg, s, notifiers, DiscardLogger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err = w.Run(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, _ := os.ReadDir(filepath.Join(dir, "new"))
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(entries))
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "new", entries[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := string(data); !strings.Contains(body, "<p>html = body</p>") || strings.Contains(body, "plain body") {
+		t.Fatalf("expected the html body, got:\n%s", body)
+	}
+}
+
+func TestParseInboundMail(t *testing.T) {
+	now := time.Now()
+	feed, err := parseInboundMail([]byte(newsletter), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if feed.Id != "issue-1@example.com" || feed.Title != "Issue #1 — héllo" || feed.Author != "Weekly News" ||
+		feed.PublishedAt != "Sat, 22 Jul 2023 07:00:00 +0000" {
+		t.Fatalf("unexpected feed: %+v", feed)
+	}
+
+	plain := "From: news@example.com\r\n" +
+		"Subject: hi\r\n" +
+		"Content-Type: text/plain; charset=ISO-8859-1\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"PGjpbGxvPg==\r\n"
+	feed, err = parseInboundMail([]byte(plain), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if feed.Content != "<pre>&lt;héllo&gt;</pre>" || feed.Author != "news@example.com" || feed.Id == "" {
+		t.Fatalf("unexpected feed: %+v", feed)
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maxnilz/feed/errors"
+)
+
+const (
+	ItemStateAll      = "all"
+	ItemStateUnread   = "unread"
+	ItemStateRead     = "read"
+	ItemStateStarred  = "starred"
+	ItemStateArchived = "archived"
+)
+
+// Items manages the reading state of the saved items of the subscribers,
+// i.e., read, starred, archived & the tags.
+type Items struct {
+	subscribers *Subscribers
+	storage     Storage
+	logger      Logger
+}
+
+func NewItems(subscribers *Subscribers, storage Storage, logger Logger) *Items {
+	return &Items{subscribers: subscribers, storage: storage, logger: logger}
+}
+
+type ItemListRequest struct {
+	Subscriber string
+	// State is one of all, unread, read, starred & archived, the archived
+	// items are left out unless it's all or archived.
+	State string
+	Site  string
+	// SiteName filters the items by the name of the site, i.e., by all
+	// the urls of it.
+	SiteName string
+	Tag      string
+	// Search is the text the items contain.
+	Search string
+	// Before is the seq to list the items older than, for paging.
+	Before int64
+	Limit  int
+}
+
+func (s *Items) subscriber(name string) (Subscriber, error) {
+	subscriber, ok := s.subscribers.Get(name)
+	if !ok {
+		return subscriber, errors.Newf(errors.NotFound, nil, "subscriber %s not found", name)
+	}
+	return subscriber, nil
+}
+
+// List returns the items of the subscriber from the newest to the oldest.
+func (s *Items) List(ctx context.Context, req ItemListRequest) ([]*Item, error) {
+	subscriber, err := s.subscriber(req.Subscriber)
+	if err != nil {
+		return nil, err
+	}
+	query := ItemQuery{Email: subscriber.Email, Tag: req.Tag, Search: req.Search, MaxSeq: req.Before, Desc: true, Limit: pageLimit(req.Limit)}
+	if req.Site != "" {
+		query.Sites = []string{req.Site}
+	}
+	if req.SiteName != "" {
+		for siteURL, name := range siteNames(subscriber.Sites) {
+			if name == req.SiteName {
+				query.Sites = append(query.Sites, siteURL)
+			}
+		}
+		if len(query.Sites) == 0 {
+			return nil, errors.Newf(errors.NotFound, nil, "site %s of %s not found", req.SiteName, req.Subscriber)
+		}
+	}
+	switch req.State {
+	case "", ItemStateUnread:
+		query.Read, query.Archived = boolPtr(false), boolPtr(false)
+	case ItemStateRead:
+		query.Read, query.Archived = boolPtr(true), boolPtr(false)
+	case ItemStateStarred:
+		query.Starred = boolPtr(true)
+	case ItemStateArchived:
+		query.Archived = boolPtr(true)
+	case ItemStateAll:
+	default:
+		return nil, errors.Newf(errors.InvalidArgument, nil, "invalid item state %q", req.State)
+	}
+	ses, err := s.storage.NewAutoSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	items, err := s.storage.GetItems(ses, query)
+	if err != nil {
+		return nil, err
+	}
+	s.setSiteNames(subscriber, items)
+	return items, nil
+}
+
+// Get returns the item of the subscriber by the seq.
+func (s *Items) Get(ctx context.Context, name string, seq int64) (*Item, error) {
+	subscriber, err := s.subscriber(name)
+	if err != nil {
+		return nil, err
+	}
+	ses, err := s.storage.NewAutoSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	items, err := s.storage.GetItems(ses, ItemQuery{Email: subscriber.Email, Seqs: []int64{seq}})
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, errors.Newf(errors.NotFound, nil, "item %d of %s not found", seq, name)
+	}
+	s.setSiteNames(subscriber, items)
+	return items[0], nil
+}
+
+// UnreadCounts returns the number of the unread items of the subscriber
+// by the site url, the archived items are not counted.
+func (s *Items) UnreadCounts(ctx context.Context, name string) (map[string]int, error) {
+	subscriber, err := s.subscriber(name)
+	if err != nil {
+		return nil, err
+	}
+	ses, err := s.storage.NewAutoSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := s.storage.GetItemRefs(ses, ItemQuery{Email: subscriber.Email, Read: boolPtr(false), Archived: boolPtr(false)})
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	for _, ref := range refs {
+		counts[ref.SiteURL]++
+	}
+	return counts, nil
+}
+
+// Update changes the state of the items of the subscriber by the seqs.
+func (s *Items) Update(ctx context.Context, name string, seqs []int64, change ItemChange) error {
+	subscriber, err := s.subscriber(name)
+	if err != nil {
+		return err
+	}
+	if err = validateTags(change.AddTags); err != nil {
+		return err
+	}
+	return markItems(ctx, s.storage, ItemQuery{Email: subscriber.Email, Seqs: seqs}, change)
+}
+
+// UpdateByGuid changes the state of the item of the site by the guid, &
+// returns the item. It's used by the links in the mails, which are
+// rendered before the items are saved.
+func (s *Items) UpdateByGuid(ctx context.Context, name, site, id string, change ItemChange) (*Item, error) {
+	subscriber, err := s.subscriber(name)
+	if err != nil {
+		return nil, err
+	}
+	query := ItemQuery{Email: subscriber.Email, Sites: []string{site}, Ids: []string{id}}
+	if err = validateTags(change.AddTags); err != nil {
+		return nil, err
+	}
+	if err = markItems(ctx, s.storage, query, change); err != nil {
+		return nil, err
+	}
+	ses, err := s.storage.NewAutoSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	items, err := s.storage.GetItems(ses, query)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, errors.Newf(errors.NotFound, nil, "item %s of %s not found", id, site)
+	}
+	s.setSiteNames(subscriber, items)
+	return items[0], nil
+}
+
+// pageLimit returns the number of items per page by the requested one.
+func pageLimit(limit int) int {
+	if limit <= 0 {
+		return defaultPageSize
+	}
+	if limit > maxPageSize {
+		return maxPageSize
+	}
+	return limit
+}
+
+func (s *Items) setSiteNames(subscriber Subscriber, items []*Item) {
+	names := siteNames(subscriber.Sites)
+	for _, it := range items {
+		it.SiteName = names[it.SiteURL]
+	}
+}
+
+func validateTags(tags []string) error {
+	for _, tag := range tags {
+		if strings.TrimSpace(tag) == "" || strings.ContainsRune(tag, '\x1f') {
+			return errors.Newf(errors.InvalidArgument, nil, "invalid tag %q", tag)
+		}
+	}
+	return nil
+}
+
+// ServeHTTP serves the json api at /api/items/<subscriber>[/<seq>], the
+// feed token of the subscriber is required as it is for the feeds.
+func (s *Items) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/items/"), "/")
+	subscriber, ok := s.subscribers.Get(name)
+	if !ok || subscriber.FeedToken == "" || !validToken(r, subscriber.FeedToken) {
+		writeError(w, s.logger, errors.Newf(errors.NotFound, nil, "subscriber not found"))
+		return
+	}
+	if rest == "" {
+		s.serveList(w, r, name)
+		return
+	}
+	seq, err := strconv.ParseInt(rest, 10, 64)
+	if err != nil {
+		writeError(w, s.logger, errors.Newf(errors.NotFound, nil, "item %s not found", rest))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPatch:
+		var body struct {
+			Read       *bool    `json:"read"`
+			Starred    *bool    `json:"starred"`
+			Archived   *bool    `json:"archived"`
+			AddTags    []string `json:"addTags"`
+			RemoveTags []string `json:"removeTags"`
+		}
+		if err = json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, s.logger, errors.Newf(errors.InvalidArgument, err, "invalid item change"))
+			return
+		}
+		change := ItemChange{
+			Read:       body.Read,
+			Starred:    body.Starred,
+			Archived:   body.Archived,
+			AddTags:    body.AddTags,
+			RemoveTags: body.RemoveTags,
+		}
+		if err = s.Update(r.Context(), name, []int64{seq}, change); err != nil {
+			writeError(w, s.logger, err)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, PATCH")
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	it, err := s.Get(r.Context(), name, seq)
+	if err != nil {
+		writeError(w, s.logger, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newItemJSON(it))
+}
+
+func (s *Items) serveList(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	q := r.URL.Query()
+	req := ItemListRequest{Subscriber: name, State: q.Get("state"), Site: q.Get("site"), Tag: q.Get("tag")}
+	var err error
+	if b := q.Get("before"); b != "" {
+		if req.Before, err = strconv.ParseInt(b, 10, 64); err != nil {
+			writeError(w, s.logger, errors.Newf(errors.InvalidArgument, err, "invalid before %q", b))
+			return
+		}
+	}
+	if l := q.Get("limit"); l != "" {
+		if req.Limit, err = strconv.Atoi(l); err != nil {
+			writeError(w, s.logger, errors.Newf(errors.InvalidArgument, err, "invalid limit %q", l))
+			return
+		}
+	}
+	items, err := s.List(r.Context(), req)
+	if err != nil {
+		writeError(w, s.logger, err)
+		return
+	}
+	out := struct {
+		Items []itemJSON `json:"items"`
+		// Next is the before argument of the next page.
+		Next int64 `json:"next,omitempty"`
+	}{Items: []itemJSON{}}
+	for _, it := range items {
+		out.Items = append(out.Items, newItemJSON(it))
+	}
+	if len(items) > 0 && len(items) == pageLimit(req.Limit) {
+		out.Next = items[len(items)-1].Seq
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+type itemJSON struct {
+	Seq         int64     `json:"seq"`
+	Id          string    `json:"id"`
+	Site        string    `json:"site"`
+	SiteName    string    `json:"siteName,omitempty"`
+	Title       string    `json:"title"`
+	Link        string    `json:"link"`
+	Author      string    `json:"author,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Content     string    `json:"content,omitempty"`
+	PublishedAt string    `json:"publishedAt,omitempty"`
+	UpdatedAt   string    `json:"updatedAt,omitempty"`
+	SavedAt     time.Time `json:"savedAt"`
+	Read        bool      `json:"read"`
+	Starred     bool      `json:"starred"`
+	Archived    bool      `json:"archived"`
+	Tags        []string  `json:"tags"`
+}
+
+func newItemJSON(it *Item) itemJSON {
+	tags := it.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	return itemJSON{
+		Seq:         it.Seq,
+		Id:          it.Id,
+		Site:        it.SiteURL,
+		SiteName:    it.SiteName,
+		Title:       it.Title,
+		Link:        it.Link,
+		Author:      it.Author,
+		Description: it.Description,
+		Content:     it.Content,
+		PublishedAt: it.PublishedAt,
+		UpdatedAt:   it.UpdatedAt,
+		SavedAt:     it.SavedAt.UTC(),
+		Read:        it.Read,
+		Starred:     it.Starred,
+		Archived:    it.Archived,
+		Tags:        tags,
+	}
+}
+
+func formatItems(items []*Item) string {
+	sb := strings.Builder{}
+	sb.WriteString(fmt.Sprintf("Total Items: %d\n", len(items)))
+	sb.WriteString("Seq | State | Site | Title | Tags\n")
+	sb.WriteString(strings.Repeat("-", 60))
+	sb.WriteString("\n")
+	for _, it := range items {
+		state := []byte("---")
+		if it.Read {
+			state[0] = 'r'
+		}
+		if it.Starred {
+			state[1] = 's'
+		}
+		if it.Archived {
+			state[2] = 'a'
+		}
+		site := it.SiteName
+		if site == "" {
+			site = it.SiteURL
+		}
+		sb.WriteString(fmt.Sprintf("%d | %s | %s | %s | %s\n", it.Seq, state, site, it.Title, strings.Join(it.Tags, ",")))
+	}
+	return sb.String()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestItems(t *testing.T) {
+	s := newTestSQLite(t)
+	subscriber := Subscriber{
+		Name:      "foo",
+		Email:     "foo@example.com",
+		FeedToken: "s3cr3t",
+		Sites:     []Site{{Name: "site 0", URL: "https://site0.com/index.rss"}},
+	}
+	cfg := Config{
+		Subscribers: []Subscriber{subscriber},
+	}
+	feeds := makeTestFeeds("foo@example.com", 1, 3, "hello")
+	ctx := context.Background()
+	ses, _ := s.NewAutoSession(ctx)
+	if err := s.SaveFeeds(ses, feeds.List...); err != nil {
+		t.Fatal(err)
+	}
+	items := NewItems(NewSubscribers(cfg.Subscribers), s, DiscardLogger)
+	server, err := NewServer(cfg, DiscardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Handle("/api/items/", items)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	call := func(method, path, body string, out interface{}) int {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer s3cr3t")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if out != nil {
+			if err = json.NewDecoder(resp.Body).Decode(out); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode
+	}
+	var list struct {
+		Items []itemJSON
+		Next  int64
+	}
+	if status := call(http.MethodGet, "/api/items/foo?limit=2", "", &list); status != http.StatusOK ||
+		len(list.Items) != 2 || list.Next == 0 || list.Items[0].SiteName != "site 0" {
+		t.Fatalf("unexpected items: %d %+v", status, list)
+	}
+	seq := list.Items[0].Seq
+	var it itemJSON
+	call(http.MethodPatch, "/api/items/foo/"+jsonString(seq), `{"starred":true,"archived":true,"addTags":["go","db"]}`, &it)
+	if !it.Starred || !it.Archived || it.Read || strings.Join(it.Tags, ",") != "db,go" {
+		t.Fatalf("unexpected item: %+v", it)
+	}
+	call(http.MethodPatch, "/api/items/foo/"+jsonString(seq), `{"removeTags":["db"]}`, &it)
+	if !it.Starred || strings.Join(it.Tags, ",") != "go" {
+		t.Fatalf("unexpected item: %+v", it)
+	}
+	// The archived items are left out of the unread ones.
+	if call(http.MethodGet, "/api/items/foo", "", &list); len(list.Items) != 2 {
+		t.Fatalf("expected 2 unread items, got %+v", list)
+	}
+	if call(http.MethodGet, "/api/items/foo?state=archived&tag=go", "", &list); len(list.Items) != 1 || list.Items[0].Seq != seq {
+		t.Fatalf("expected the archived item, got %+v", list)
+	}
+	if status := call(http.MethodPatch, "/api/items/foo/999", `{"read":true}`, nil); status != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", status)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/maxnilz/feed/errors"
+)
+
+// JobsAPI serves the json api to run the scheduled jobs right away at
+// /api/jobs/run & /api/jobs/<name>/run, e.g., to debug a subscriber. The
+// admin token of the server is required as a bearer token, the api is
+// disabled without it.
+type JobsAPI struct {
+	token string
+	// trigger is the trigger the runs are recorded with.
+	trigger   string
+	scheduler *Scheduler
+	logger    Logger
+}
+
+func NewJobsAPI(cfg Config, scheduler *Scheduler, logger Logger) *JobsAPI {
+	return &JobsAPI{token: cfg.Server.AdminToken, trigger: TriggerAPI, scheduler: scheduler, logger: logger}
+}
+
+func (a *JobsAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if a.token == "" || !validBearer(r, a.token) {
+		writeError(w, a.logger, errors.Newf(errors.NotFound, nil, "not found"))
+		return
+	}
+	a.serve(w, r)
+}
+
+// serve triggers the job of the name in the path, or all the jobs if it's
+// left out, by their overlap policies, i.e., POST /api/jobs/foo/run.
+func (a *JobsAPI) serve(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/jobs"), "/")
+	if path != "run" && !strings.HasSuffix(path, "/run") {
+		writeError(w, a.logger, errors.Newf(errors.NotFound, nil, "not found"))
+		return
+	}
+	if r.Method != http.MethodPost {
+		_ = methodNotAllowed(w, "POST")
+		return
+	}
+	name := strings.TrimSuffix(strings.TrimSuffix(path, "run"), "/")
+	triggers, err := a.scheduler.Trigger(name, a.trigger)
+	if err != nil {
+		writeError(w, a.logger, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"triggers": triggers})
+}
+
+// Control serves the jobs api over the unix socket of the daemon, which
+// the commands trigger the jobs of the running daemon through. The socket
+// is only accessible by the user the daemon runs as, so no token is
+// required.
+type Control struct {
+	socket string
+	jobs   *JobsAPI
+
+	srv    *http.Server
+	waiter sync.WaitGroup
+
+	logger Logger
+}
+
+// NewControl returns the control of the daemon, it's nil if the socket
+// is not configured.
+func NewControl(cfg Config, scheduler *Scheduler, logger Logger) *Control {
+	if cfg.Control.Socket == "" {
+		return nil
+	}
+	return &Control{
+		socket: cfg.Control.Socket,
+		jobs:   &JobsAPI{trigger: TriggerCLI, scheduler: scheduler, logger: logger},
+		logger: logger,
+	}
+}
+
+// Start listens on the socket & serves the requests until the context is
+// done, the socket is removed then.
+func (c *Control) Start(ctx context.Context) error {
+	if c == nil {
+		return nil
+	}
+	// The socket left by a daemon which didn't stop cleanly is removed,
+	// unless a daemon is still listening on it.
+	if conn, err := net.Dial("unix", c.socket); err == nil {
+		conn.Close()
+		return errors.Newf(errors.FailedPrecondition, nil, "a daemon is listening on %s already", c.socket)
+	}
+	if err := os.Remove(c.socket); err != nil && !os.IsNotExist(err) {
+		return errors.Newf(errors.Internal, err, "remove stale socket %s failed", c.socket)
+	}
+	l, err := net.Listen("unix", c.socket)
+	if err != nil {
+		return errors.Newf(errors.Internal, err, "listen on %s failed", c.socket)
+	}
+	if err = os.Chmod(c.socket, 0o600); err != nil {
+		l.Close()
+		return errors.Newf(errors.Internal, err, "restrict socket %s failed", c.socket)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/jobs/", c.jobs.serve)
+	c.srv = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: serverReadTimeout,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+	c.logger.Info("control socket started", "socket", c.socket)
+	c.waiter.Add(1)
+	go func() {
+		defer c.waiter.Done()
+		if err := c.srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			c.logger.Error(err, "control socket failed")
+		}
+	}()
+	c.waiter.Add(1)
+	go func() {
+		defer c.waiter.Done()
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), serverShutdownTimeout)
+		defer cancel()
+		if err := c.srv.Shutdown(shutdownCtx); err != nil {
+			c.logger.Error(err, "shutdown control socket failed")
+		}
+	}()
+	return nil
+}
+
+func (c *Control) Stop() {
+	if c == nil {
+		return
+	}
+	c.waiter.Wait()
+}
+
+// triggerJobs asks the daemon listening on the socket to run the job of
+// the name, or all the jobs if it's empty, right away.
+func triggerJobs(ctx context.Context, socket, name string) ([]JobTrigger, error) {
+	if socket == "" {
+		return nil, errors.Newf(errors.FailedPrecondition, nil, "control socket is not configured")
+	}
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}}
+	path := "/api/jobs/run"
+	if name != "" {
+		path = "/api/jobs/" + url.PathEscape(name) + "/run"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://feed"+path, nil)
+	if err != nil {
+		return nil, errors.Newf(errors.Internal, err, "create trigger request failed")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Newf(errors.Unavailable, err, "connect to the daemon at %s failed", socket)
+	}
+	defer resp.Body.Close()
+	var out struct {
+		Triggers []JobTrigger `json:"triggers"`
+		Error    string       `json:"error"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, errors.Newf(errors.Internal, err, "invalid response of the daemon: %s", resp.Status)
+	}
+	switch resp.StatusCode {
+	case http.StatusAccepted:
+		return out.Triggers, nil
+	case http.StatusNotFound:
+		return nil, errors.Newf(errors.NotFound, nil, "%s", out.Error)
+	case http.StatusConflict:
+		return nil, errors.Newf(errors.FailedPrecondition, nil, "%s", out.Error)
+	default:
+		return nil, errors.Newf(errors.Internal, nil, "trigger jobs failed: %s %s", resp.Status, out.Error)
+	}
+}
+
+func formatJobTriggers(triggers []JobTrigger) string {
+	sb := strings.Builder{}
+	for _, t := range triggers {
+		sb.WriteString(fmt.Sprintf("%s | %s\n", t.Job, t.Status))
+	}
+	return sb.String()
+}
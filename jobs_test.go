@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/maxnilz/feed/errors"
+)
+
+func TestTriggerJobs(t *testing.T) {
+	s := newTestSQLite(t)
+	release := make(chan struct{})
+	var runs int32
+	scheduler := NewScheduler(s, DiscardLogger)
+	// the jobs are not due in the test, they run only if triggered.
+	if _, err := scheduler.Schedule("0 0 1 1 *", funcJob{name: "foo digest", fn: func(ctx context.Context) error {
+		atomic.AddInt32(&runs, 1)
+		<-release
+		return nil
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := scheduler.Schedule("0 0 1 1 *", funcJob{name: "bar"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := scheduler.Trigger("bar", TriggerAPI); errors.Code(err) != errors.FailedPrecondition {
+		t.Fatalf("expect no trigger before the start, got %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	scheduler.Start(ctx)
+
+	cfg := Config{Server: ServerConfig{AdminToken: "s3cret"}, Control: ControlConfig{Socket: filepath.Join(t.TempDir(), "feed.sock")}}
+	api := NewJobsAPI(cfg, scheduler, DiscardLogger)
+	do := func(method, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := do(http.MethodPost, "/api/jobs/foo%20digest/run", "wrong"); rec.Code != http.StatusNotFound {
+		t.Fatalf("expect the api hidden without the token, got %d", rec.Code)
+	}
+	if rec := do(http.MethodGet, "/api/jobs/foo%20digest/run", "s3cret"); rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expect method not allowed, got %d", rec.Code)
+	}
+	if rec := do(http.MethodPost, "/api/jobs/baz/run", "s3cret"); rec.Code != http.StatusNotFound {
+		t.Fatalf("expect unknown job not found, got %d", rec.Code)
+	}
+	if rec := do(http.MethodPost, "/api/jobs/foo%20digest/run", "s3cret"); rec.Code != http.StatusAccepted {
+		t.Fatalf("expect the job triggered, got %d %s", rec.Code, rec.Body)
+	}
+	waitFor(t, func() bool { return atomic.LoadInt32(&runs) == 1 })
+
+	// the cli talks to the daemon over the control socket, the overlap
+	// policy skips the run while the last one is in progress.
+	control := NewControl(cfg, scheduler, DiscardLogger)
+	if err := control.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(cfg.Control.Socket); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("expect the socket only accessible by the user, got %v %v", info, err)
+	}
+	triggers, err := triggerJobs(ctx, cfg.Control.Socket, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := map[string]string{}
+	for _, it := range triggers {
+		statuses[it.Job] = it.Status
+	}
+	if len(triggers) != 2 || statuses["foo digest"] != JobSkipped || statuses["bar"] != JobStarted {
+		t.Fatalf("unexpected triggers %+v", triggers)
+	}
+	if _, err = triggerJobs(ctx, cfg.Control.Socket, "baz"); errors.Code(err) != errors.NotFound {
+		t.Fatalf("expect unknown job not found, got %v", err)
+	}
+	close(release)
+
+	// the runs are recorded with their triggers.
+	runsOf := func(job string) []*JobRun {
+		ses, _ := s.NewAutoSession(ctx)
+		list, err := s.GetJobRuns(ses, JobRunQuery{Job: job})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return list
+	}
+	waitFor(t, func() bool { return len(runsOf("foo digest")) == 1 && len(runsOf("bar")) == 1 })
+	if run := runsOf("foo digest")[0]; run.Trigger != TriggerAPI {
+		t.Fatalf("expect the run triggered by the api, got %+v", run)
+	}
+	if run := runsOf("bar")[0]; run.Trigger != TriggerCLI {
+		t.Fatalf("expect the run triggered by the cli, got %+v", run)
+	}
+	// the triggered runs don't change the schedule.
+	for _, entry := range scheduler.Entries() {
+		if !entry.Next.Equal(time.Date(time.Now().Year()+1, 1, 1, 0, 0, 0, 0, time.Local)) {
+			t.Fatalf("unexpected next run of %s at %v", entry.Name, entry.Next)
+		}
+	}
+
+	cancel()
+	control.Stop()
+	scheduler.Stop()
+	if _, err = os.Stat(cfg.Control.Socket); !os.IsNotExist(err) {
+		t.Fatalf("expect the socket removed on the stop, got %v", err)
+	}
+}
+
+func TestTriggerJobsFollower(t *testing.T) {
+	// two replicas share the same sqlite db, r1 is the leader.
+	dbfile := filepath.Join(t.TempDir(), "feed.db")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	newReplica := func(id string) *Scheduler {
+		s, err := newSQLite(dbfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		elector := NewElector(Config{Election: ElectionConfig{Enabled: true, Id: id, LeaseTTL: time.Minute}}, s, DiscardLogger)
+		elector.Lead(ctx)
+		scheduler := NewScheduler(s, DiscardLogger)
+		scheduler.SetElector(elector)
+		if _, err = scheduler.Schedule("0 0 1 1 *", funcJob{name: "foo"}); err != nil {
+			t.Fatal(err)
+		}
+		scheduler.Start(ctx)
+		t.Cleanup(scheduler.Stop)
+		return scheduler
+	}
+	leader, follower := newReplica("r1"), newReplica("r2")
+
+	// the follower tells the trigger would be dropped rather than started.
+	if _, err := follower.Trigger("foo", TriggerSignal); errors.Code(err) != errors.FailedPrecondition {
+		t.Fatalf("expect no trigger on the follower, got %v", err)
+	}
+	api := NewJobsAPI(Config{Server: ServerConfig{AdminToken: "s3cret"}}, follower, DiscardLogger)
+	req := httptest.NewRequest(http.MethodPost, "/api/jobs/foo/run", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, req)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("expect 409 on the follower, got %d %s", rec.Code, rec.Body)
+	}
+	if triggers, err := leader.Trigger("foo", TriggerSignal); err != nil || len(triggers) != 1 || triggers[0].Status != JobStarted {
+		t.Fatalf("expect the job started on the leader, got %+v %v", triggers, err)
+	}
+}
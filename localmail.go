@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/maxnilz/feed/errors"
+)
+
+const (
+	NotifierMaildir = "maildir"
+	NotifierMbox    = "mbox"
+
+	// defaultLocalSender is the sender of the local mails if the mail
+	// sender is not configured.
+	defaultLocalSender = "feed@localhost"
+)
+
+func newLocalMailRenderer(cfg Config, nc NotifierConfig) (mailRenderer, error) {
+	if err := validateDelivery(nc.Delivery); err != nil {
+		return mailRenderer{}, err
+	}
+	if nc.Path == "" {
+		return mailRenderer{}, errors.Newf(errors.InvalidArgument, nil, "path is required")
+	}
+	from := cfg.MailSender.SenderAddr
+	if from == "" {
+		from = defaultLocalSender
+	}
+	return mailRenderer{from: from, maxItems: nc.MaxItems}, nil
+}
+
+// maildirNotifier delivers the messages into a maildir, refer to
+// https://cr.yp.to/proto/maildir.html
+type maildirNotifier struct {
+	dir      string
+	delivery string
+	renderer mailRenderer
+	logger   Logger
+}
+
+func newMaildirNotifier(cfg Config, nc NotifierConfig, logger Logger) (Notifier, error) {
+	renderer, err := newLocalMailRenderer(cfg, nc)
+	if err != nil {
+		return nil, err
+	}
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err = os.MkdirAll(filepath.Join(nc.Path, sub), 0o700); err != nil {
+			return nil, errors.Newf(errors.Internal, err, "create maildir %s failed", nc.Path)
+		}
+	}
+	return &maildirNotifier{dir: nc.Path, delivery: nc.Delivery, renderer: renderer, logger: logger}, nil
+}
+
+func (n *maildirNotifier) Compose(feeds Feeds) ([]*Message, error) {
+	return n.renderer.compose(feeds, n.delivery), nil
+}
+
+var maildirSeq uint64
+
+func (n *maildirNotifier) Send(ctx context.Context, msg *Message) error {
+	n.logger.Info("Deliver RSS feeds notification to maildir", "email", msg.Email, "feeds", len(msg.Feeds))
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	// '/' & ':' are not allowed in the unique name.
+	host = strings.NewReplacer("/", "\\057", ":", "\\072").Replace(host)
+	now := time.Now()
+	name := fmt.Sprintf("%d.M%dP%dQ%d.%s",
+		now.Unix(), now.Nanosecond()/1000, os.Getpid(), atomic.AddUint64(&maildirSeq, 1), host)
+
+	// Write into tmp first, then move it into new, so that the mail
+	// clients never see a partial message.
+	tmp := filepath.Join(n.dir, "tmp", name)
+	if err = os.WriteFile(tmp, toUnixLineEndings(msg.Body), 0o600); err != nil {
+		_ = os.Remove(tmp)
+		return errors.Newf(errors.Internal, err, "write maildir message failed")
+	}
+	if err = os.Rename(tmp, filepath.Join(n.dir, "new", name)); err != nil {
+		_ = os.Remove(tmp)
+		return errors.Newf(errors.Internal, err, "move maildir message failed")
+	}
+	return nil
+}
+
+// mboxNotifier appends the messages into a mbox file in the mboxrd
+// format, i.e., the lines matching /^>*From / in the body are quoted
+// with one more '>'.
+type mboxNotifier struct {
+	path     string
+	delivery string
+	renderer mailRenderer
+	logger   Logger
+}
+
+// mboxLocks serializes the writers of the same mbox file in process.
+var mboxLocks sync.Map
+
+func newMboxNotifier(cfg Config, nc NotifierConfig, logger Logger) (Notifier, error) {
+	renderer, err := newLocalMailRenderer(cfg, nc)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(filepath.Dir(nc.Path), 0o700); err != nil {
+		return nil, errors.Newf(errors.Internal, err, "create mbox dir of %s failed", nc.Path)
+	}
+	return &mboxNotifier{path: nc.Path, delivery: nc.Delivery, renderer: renderer, logger: logger}, nil
+}
+
+func (n *mboxNotifier) Compose(feeds Feeds) ([]*Message, error) {
+	return n.renderer.compose(feeds, n.delivery), nil
+}
+
+func (n *mboxNotifier) Send(ctx context.Context, msg *Message) error {
+	n.logger.Info("Deliver RSS feeds notification to mbox", "email", msg.Email, "feeds", len(msg.Feeds))
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf("From %s %s\n", n.renderer.from, time.Now().UTC().Format(time.ANSIC)))
+	sc := bufio.NewScanner(bytes.NewReader(toUnixLineEndings(msg.Body)))
+	sc.Buffer(make([]byte, 64*1024), len(msg.Body)+1)
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+			buf.WriteString(">")
+		}
+		buf.WriteString(line)
+		buf.WriteString("\n")
+	}
+	if err := sc.Err(); err != nil {
+		return errors.Newf(errors.Internal, err, "quote mbox message failed")
+	}
+	buf.WriteString("\n")
+
+	mu, _ := mboxLocks.LoadOrStore(n.path, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	defer mu.(*sync.Mutex).Unlock()
+	f, err := os.OpenFile(n.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return errors.Newf(errors.Internal, err, "open mbox %s failed", n.path)
+	}
+	if _, err = f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return errors.Newf(errors.Internal, err, "append to mbox %s failed", n.path)
+	}
+	if err = f.Close(); err != nil {
+		return errors.Newf(errors.Internal, err, "close mbox %s failed", n.path)
+	}
+	return nil
+}
+
+func toUnixLineEndings(b []byte) []byte {
+	return bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n"))
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"mime"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMaildirNotifier(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "Maildir")
+	n, err := newMaildirNotifier(Config{}, NotifierConfig{Type: NotifierMaildir, Path: dir}, DiscardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := n.Compose(makeTestFeeds("foo@example.com", 2, 2, "hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 digest, got %d", len(msgs))
+	}
+	if err = n.Send(context.Background(), msgs[0]); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 message in new, got %d", len(entries))
+	}
+	if tmp, _ := os.ReadDir(filepath.Join(dir, "tmp")); len(tmp) != 0 {
+		t.Fatalf("expected tmp to be empty, got %d", len(tmp))
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "new", entries[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Header.Get("From") != defaultLocalSender || m.Header.Get("To") != "foo@example.com" ||
+		m.Header.Get("Subject") != subject || m.Header.Get("Message-Id") == "" || m.Header.Get("Date") == "" {
+		t.Fatalf("unexpected headers: %v", m.Header)
+	}
+}
+
+func TestMboxNotifier(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mail", "feeds.mbox")
+	cfg := Config{MailSender: MailSender{SenderAddr: "sender@example.com"}}
+	nc := NotifierConfig{Type: NotifierMbox, Path: path, Delivery: DeliveryPerItem}
+	n, err := newMboxNotifier(cfg, nc, DiscardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	feeds := makeTestFeeds("foo@example.com", 1, 2, "héllo")
+	feeds.List[0].Content = "<p>first line</p>\nFrom the start\n>From quoted"
+	msgs, err := n.Compose(feeds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(msgs))
+	}
+	for _, msg := range msgs {
+		if err = n.Send(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := string(data)
+	if got := strings.Count(content, "\nFrom sender@example.com "); got != 1 || !strings.HasPrefix(content, "From sender@example.com ") {
+		t.Fatalf("expected 2 messages separated by From lines, got:\n%s", content)
+	}
+	if !strings.Contains(content, "\n>From the start\n>>From quoted") {
+		t.Fatalf("expected From lines to be quoted, got:\n%s", content)
+	}
+	first := strings.SplitN(content, "\n", 2)[1]
+	m, err := mail.ReadMessage(strings.NewReader(first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := new(mime.WordDecoder).DecodeHeader(m.Header.Get("Subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "héllo 0-0" {
+		t.Fatalf("expected the item title as subject, got %q", got)
+	}
+
+	if _, err = newMboxNotifier(cfg, NotifierConfig{Type: NotifierMbox}, DiscardLogger); err == nil {
+		t.Fatal("expected missing path error")
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"mime"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/maxnilz/feed/errors"
+)
+
+const (
+	// DeliveryDigest renders all the new feeds into one message.
+	DeliveryDigest = "digest"
+	// DeliveryPerItem renders every feed as its own message.
+	DeliveryPerItem = "per-item"
+)
+
+func validateDelivery(delivery string) error {
+	switch delivery {
+	case "", DeliveryDigest, DeliveryPerItem:
+		return nil
+	}
+	return errors.Newf(errors.InvalidArgument, nil, "unknown delivery %q", delivery)
+}
+
+// mailRenderer renders the feeds into RFC 5322 messages, which are sent
+// over smtp or written into the local mail stores.
+type mailRenderer struct {
+	from string
+	// maxItems caps the items listed per site in a digest, the rest are
+	// summarized as "and N more".
+	maxItems int
+	// links are the signed action links, e.g. mark as read & unsubscribe,
+	// which are left out if it's nil.
+	links *mailLinks
+}
+
+func (r mailRenderer) compose(feeds Feeds, delivery string) []*Message {
+	var msgs []*Message
+	for _, email := range feeds.Emails {
+		sitesFeeds, ok := feeds.SitesFeeds(email)
+		if !ok {
+			continue
+		}
+		if delivery == DeliveryPerItem {
+			msgs = append(msgs, r.items(email, sitesFeeds)...)
+			continue
+		}
+		if msg := r.digest(email, sitesFeeds); msg != nil {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs
+}
+
+func (r mailRenderer) digest(email Email, sitesFeeds *SitesFeeds) *Message {
+	var fs []*Feed
+	buf := bytes.Buffer{}
+	r.writeHeaders(&buf, email, mailHeader{
+		from:        r.from,
+		subject:     subject,
+		messageId:   newMessageId(r.from),
+		unsubscribe: r.unsubscribe(),
+	})
+	buf.WriteString("<body>")
+	for _, site := range sitesFeeds.names {
+		siteFeeds, ok := sitesFeeds.get(site)
+		if !ok || len(siteFeeds) == 0 {
+			continue
+		}
+		fs = append(fs, siteFeeds...)
+		buf.WriteString(fmt.Sprintf("<h1>New posts from %s</h1>", site))
+		if r.links != nil {
+			buf.WriteString("<p>")
+			writeLink(&buf, r.links.mute(siteFeeds[0].SiteURL), "[mute "+html.EscapeString(site)+"]")
+			buf.WriteString("</p>")
+		}
+		listed := siteFeeds
+		if r.maxItems > 0 && len(listed) > r.maxItems {
+			listed = listed[:r.maxItems]
+		}
+		// The items are grouped by the day they're fetched if they span
+		// several days, e.g., in a weekly digest.
+		days := groupByDay(listed)
+		for _, day := range days {
+			if len(days) > 1 {
+				buf.WriteString(fmt.Sprintf("<h2>%s</h2>", day[0].FetchAt.Format("Mon, 02 Jan 2006")))
+			}
+			buf.WriteString("<ol>")
+			for _, feed := range day {
+				buf.WriteString("<li>")
+				r.writeItem(&buf, feed)
+				buf.WriteString("</li>")
+			}
+			buf.WriteString("</ol>")
+		}
+		if more := len(siteFeeds) - len(listed); more > 0 {
+			buf.WriteString(fmt.Sprintf("<p>and %d more from %s</p>", more, site))
+		}
+	}
+	r.writeFooter(&buf)
+	buf.WriteString("</body>")
+	if len(fs) == 0 {
+		return nil
+	}
+	return &Message{Email: email, Subject: subject, Body: buf.Bytes(), Feeds: fs}
+}
+
+// items renders every feed as its own message, sent on behalf of the
+// site. The message id is derived from the guid of the item, so that
+// the updates of an item are threaded under the original one.
+func (r mailRenderer) items(email Email, sitesFeeds *SitesFeeds) []*Message {
+	var msgs []*Message
+	for _, site := range sitesFeeds.names {
+		siteFeeds, _ := sitesFeeds.get(site)
+		for _, feed := range siteFeeds {
+			title := feed.Title
+			if title == "" {
+				title = fmt.Sprintf("New post from %s", site)
+			}
+			h := mailHeader{
+				from:        (&mail.Address{Name: site, Address: r.from}).String(),
+				subject:     title,
+				messageId:   itemMessageId(r.from, feed, ""),
+				unsubscribe: r.unsubscribe(),
+			}
+			if feed.Update {
+				h.inReplyTo = h.messageId
+				h.messageId = itemMessageId(r.from, feed, feed.UpdatedAt)
+			}
+			buf := bytes.Buffer{}
+			r.writeHeaders(&buf, email, h)
+			buf.WriteString("<body>")
+			r.writeItem(&buf, feed)
+			if content := feed.Content; content != "" {
+				buf.WriteString("<hr>")
+				buf.WriteString(content)
+			} else if feed.Description != "" {
+				buf.WriteString("<hr>")
+				buf.WriteString(feed.Description)
+			}
+			if r.links != nil {
+				buf.WriteString("<p>")
+				writeLink(&buf, r.links.mute(feed.SiteURL), "[mute "+html.EscapeString(site)+"]")
+				buf.WriteString("</p>")
+			}
+			r.writeFooter(&buf)
+			buf.WriteString("</body>")
+			msgs = append(msgs, &Message{Email: email, Subject: title, Body: buf.Bytes(), Feeds: []*Feed{feed}})
+		}
+	}
+	return msgs
+}
+
+// groupByDay splits the feeds by the day they're fetched, the order of
+// the feeds is kept.
+func groupByDay(feeds []*Feed) [][]*Feed {
+	var days [][]*Feed
+	var last string
+	for _, feed := range feeds {
+		day := feed.FetchAt.Format("2006-01-02")
+		if len(days) == 0 || day != last {
+			days = append(days, nil)
+			last = day
+		}
+		days[len(days)-1] = append(days[len(days)-1], feed)
+	}
+	return days
+}
+
+func (r mailRenderer) writeItem(buf *bytes.Buffer, feed *Feed) {
+	buf.WriteString(fmt.Sprintf("<a href=\"%s\">%s</a>", feed.Link, feed.Title))
+	if feed.Id != "" {
+		buf.WriteString(fmt.Sprintf("&nbsp;<a href=\"%s\">%s</a>", feed.Id, "[guid]"))
+	}
+	buf.WriteString(fmt.Sprintf("&nbsp;%s", feed.PublishedAt))
+	if feed.UpdatedAt != "" {
+		buf.WriteString(fmt.Sprintf("&nbsp;%s", feed.UpdatedAt))
+	}
+	if r.links != nil && feed.Id != "" {
+		writeLink(buf, r.links.item(feed, ActionRead), "[mark as read]")
+		writeLink(buf, r.links.item(feed, ActionStar), "[save]")
+	}
+}
+
+func writeLink(buf *bytes.Buffer, link, text string) {
+	buf.WriteString(fmt.Sprintf("&nbsp;<a href=\"%s\">%s</a>", html.EscapeString(link), text))
+}
+
+func (r mailRenderer) unsubscribe() string {
+	if r.links == nil {
+		return ""
+	}
+	return r.links.unsubscribe()
+}
+
+// writeFooter writes the links to manage the subscription.
+func (r mailRenderer) writeFooter(buf *bytes.Buffer) {
+	if r.links == nil {
+		return
+	}
+	buf.WriteString("<hr><p>")
+	writeLink(buf, r.links.pause(7), "pause for 7 days")
+	writeLink(buf, r.links.pause(30), "pause for 30 days")
+	writeLink(buf, r.links.unsubscribe(), "unsubscribe")
+	buf.WriteString("</p>")
+}
+
+type mailHeader struct {
+	from, subject string
+	messageId     string
+	// inReplyTo is the message id of the original item if it's an update.
+	inReplyTo string
+	// unsubscribe is the one-click unsubscription link, refer to RFC 8058.
+	unsubscribe string
+}
+
+func (r mailRenderer) writeHeaders(buf *bytes.Buffer, to Email, h mailHeader) {
+	buf.WriteString("From: " + h.from + "\r\n")
+	buf.WriteString("To: " + to.String() + "\r\n")
+	buf.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	buf.WriteString("Message-ID: " + h.messageId + "\r\n")
+	if h.inReplyTo != "" {
+		buf.WriteString("In-Reply-To: " + h.inReplyTo + "\r\n")
+		buf.WriteString("References: " + h.inReplyTo + "\r\n")
+	}
+	if h.unsubscribe != "" {
+		buf.WriteString("List-Unsubscribe: <" + h.unsubscribe + ">\r\n")
+		buf.WriteString("List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n")
+	}
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/html; charset=UTF-8\r\n")
+	buf.WriteString("Subject: " + mime.QEncoding.Encode("UTF-8", h.subject) + "\r\n")
+	buf.WriteString("\r\n")
+}
+
+// newMessageId returns a random message id in the domain of the address.
+func newMessageId(addr string) string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return fmt.Sprintf("<%s@%s>", hex.EncodeToString(b), messageIdDomain(addr))
+}
+
+// itemMessageId returns the message id of the item derived from the site
+// & the guid, or the link if the item has no guid. The updates of the
+// item are told apart by the updated time.
+func itemMessageId(addr string, feed *Feed, updatedAt string) string {
+	id := feed.Id
+	if id == "" {
+		id = feed.Link
+	}
+	key := feed.SiteURL + "\x00" + id
+	if updatedAt != "" {
+		key += "\x00" + updatedAt
+	}
+	sum := sha256.Sum256([]byte(key))
+	return fmt.Sprintf("<%s@%s>", hex.EncodeToString(sum[:16]), messageIdDomain(addr))
+}
+
+func messageIdDomain(addr string) string {
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		return strings.TrimRight(addr[i+1:], ">")
+	}
+	return "localhost"
+}
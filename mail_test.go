@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"mime"
+	"net/mail"
+	"testing"
+)
+
+func TestPerItemDelivery(t *testing.T) {
+	cfg := Config{
+		MailSender:  MailSender{SmtpServer: "smtp.example.com:587", SenderAddr: "sender@example.com", Password: "password"},
+		Subscribers: []Subscriber{{Name: "foo", Email: "foo@example.com", Delivery: DeliveryPerItem}},
+	}
+	notifiers, err := NewNotifiers(cfg, DiscardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	feeds := makeTestFeeds("foo@example.com", 1, 2, "héllo")
+	// The item updated since it's published is a new one unless an earlier
+	// version of it is sent.
+	feeds.List[1].UpdatedAt = "2023-07-23 08:00:00"
+	updated := *feeds.List[0]
+	updated.UpdatedAt = "2023-07-23 07:00:00"
+	updated.Update = true
+	feeds.Append(&updated)
+	msgs, err := notifiers.Compose("foo@example.com", feeds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 3 {
+		t.Fatalf("expected 3 messages, got %d", len(msgs))
+	}
+	var headers []mail.Header
+	for _, msg := range msgs {
+		m, err := mail.ReadMessage(bytes.NewReader(msg.Body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers = append(headers, m.Header)
+	}
+	from, err := mail.ParseAddress(headers[0].Get("From"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from.Name != "site 0" || from.Address != "sender@example.com" {
+		t.Fatalf("expected the site as the sender name, got %v", from)
+	}
+	got, err := new(mime.WordDecoder).DecodeHeader(headers[0].Get("Subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "héllo 0-0" {
+		t.Fatalf("expected the item title as subject, got %q", got)
+	}
+
+	original, update := headers[0], headers[2]
+	for _, h := range headers[:2] {
+		if h.Get("In-Reply-To") != "" || h.Get("References") != "" {
+			t.Fatalf("expected a new thread of the item never sent, got %v", h)
+		}
+	}
+	if update.Get("Message-Id") == original.Get("Message-Id") {
+		t.Fatalf("expected the update to have its own message id")
+	}
+	if update.Get("In-Reply-To") != original.Get("Message-Id") || update.Get("References") != original.Get("Message-Id") {
+		t.Fatalf("expected the update to reply to %s, got %v", original.Get("Message-Id"), update)
+	}
+
+	// The message id is stable across the renderings.
+	again, _ := notifiers.Compose("foo@example.com", feeds)
+	m, err := mail.ReadMessage(bytes.NewReader(again[0].Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Header.Get("Message-Id") != original.Get("Message-Id") {
+		t.Fatalf("expected stable message id %s, got %s", original.Get("Message-Id"), m.Header.Get("Message-Id"))
+	}
+
+	cfg.Subscribers[0].Delivery = "weekly"
+	if _, err = NewNotifiers(cfg, DiscardLogger); err == nil {
+		t.Fatal("expected unknown delivery error")
+	}
+}
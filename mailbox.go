@@ -1,22 +1,27 @@
 package main
 
 import (
-	"bytes"
-	"fmt"
+	"context"
+	"crypto/tls"
 	"net"
 	"net/smtp"
 	"strings"
 
 	"github.com/maxnilz/feed/errors"
+	"golang.org/x/net/proxy"
 )
 
-type SendCallback func(feeds ...*Feed) error
-
-type Mailbox interface {
-	SendFeeds(feeds Feeds, callback SendCallback) error
+// NewMailbox returns the email notifier which sends one message per
+// recipient via the configured smtp server.
+func NewMailbox(cfg Config, logger Logger) (Notifier, error) {
+	s, err := newMailbox(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
 }
 
-func NewMailbox(cfg Config, logger Logger) (Mailbox, error) {
+func newMailbox(cfg Config, logger Logger) (*smtpImpl, error) {
 	mailSender := cfg.MailSender
 	host, port, err := net.SplitHostPort(mailSender.SmtpServer)
 	if err != nil {
@@ -28,7 +33,10 @@ func NewMailbox(cfg Config, logger Logger) (Mailbox, error) {
 	}
 	auth := smtp.PlainAuth("", senderAddr, password, host)
 
-	// TODO: need to support smtp over socks or http proxy
+	dialer, err := newProxyDialer(mailSender.Proxy)
+	if err != nil {
+		return nil, err
+	}
 
 	return &smtpImpl{
 		hostPort:   mailSender.SmtpServer,
@@ -37,6 +45,7 @@ func NewMailbox(cfg Config, logger Logger) (Mailbox, error) {
 		senderAddr: senderAddr,
 		password:   password,
 		auth:       auth,
+		dialer:     dialer,
 		Logger:     logger,
 	}, nil
 }
@@ -46,63 +55,97 @@ type smtpImpl struct {
 	username, password   string
 	auth                 smtp.Auth
 	senderAddr           string
-	Logger               Logger
+	dialer               proxy.Dialer
+	// delivery is either digest or per-item, maxItems caps the items
+	// listed per site in a digest.
+	delivery string
+	maxItems int
+	links    *mailLinks
+	Logger   Logger
+}
+
+const subject = "RSS feeds notification"
+
+func (s *smtpImpl) Compose(feeds Feeds) ([]*Message, error) {
+	return mailRenderer{from: s.senderAddr, maxItems: s.maxItems, links: s.links}.compose(feeds, s.delivery), nil
 }
 
-func (s *smtpImpl) SendFeeds(feeds Feeds, callback SendCallback) error {
-	var fs []*Feed
-	for _, email := range feeds.Emails {
-		buf := bytes.Buffer{}
-		buf.WriteString("From: " + s.senderAddr + "\r\n")
-		buf.WriteString("To: " + email.String() + "\r\n")
-		buf.WriteString("Content-Type: text/html; charset=UTF-8\r\n")
-		buf.WriteString("Subject: RSS feeds notification\r\n")
-		buf.WriteString("\r\n")
-		buf.WriteString("<body>")
-		sitesFeeds, ok := feeds.SitesFeeds(email)
-		if !ok {
-			continue
+// withOptions returns a copy of the mailbox which renders the feeds by
+// the options, the smtp settings are shared.
+func (s *smtpImpl) withOptions(delivery string, maxItems int, links *mailLinks) (*smtpImpl, error) {
+	if err := validateDelivery(delivery); err != nil {
+		return nil, err
+	}
+	c := *s
+	c.delivery, c.maxItems, c.links = delivery, maxItems, links
+	return &c, nil
+}
+
+func (s *smtpImpl) Send(ctx context.Context, msg *Message) error {
+	s.Logger.Info("Send RSS feeds notification", "email", msg.Email, "feeds", len(msg.Feeds))
+	if err := s.sendMail(ctx, []string{msg.Email.String()}, msg.Body); err != nil {
+		const shortErrMsg = "short response: "
+		// Ignore the error if it's a short response error, refer to
+		//  smpt.Client.Quit
+		//    smpt.Client.cmd
+		//      c.Text.ReadResponse(expectCode)
+		//        net.textproto.Reader.ReadResponse
+		//          net.textproto.Reader.readCodeLine
+		//            net.textproto.Reader.parseCodeLine
+		if !strings.HasPrefix(err.Error(), shortErrMsg) {
+			return errors.Newf(errors.Internal, err, "send feeds failed")
 		}
-		for _, site := range sitesFeeds.names {
-			siteFeeds, ok := sitesFeeds.get(site)
-			if !ok || len(siteFeeds) == 0 {
-				continue
-			}
-			fs = append(fs, siteFeeds...)
-			buf.WriteString(fmt.Sprintf("<h1>New posts from %s</h1>", site))
-			buf.WriteString("<ol>")
-			for _, feed := range siteFeeds {
-				buf.WriteString("<li>")
-				buf.WriteString(fmt.Sprintf("<a href=\"%s\">%s</a>", feed.Link, feed.Title))
-				if feed.Id != "" {
-					buf.WriteString(fmt.Sprintf("&nbsp;<a href=\"%s\">%s</a>", feed.Id, "[guid]"))
-				}
-				buf.WriteString(fmt.Sprintf("&nbsp;%s", feed.PublishedAt))
-				if feed.UpdatedAt != "" {
-					buf.WriteString(fmt.Sprintf("&nbsp;%s", feed.UpdatedAt))
-				}
-				buf.WriteString("</li>")
-			}
-			buf.WriteString("</ol>")
+	}
+	return nil
+}
+
+// sendMail is the same as smtp.SendMail except that the connection to
+// the smtp server is established via the configured dialer, which may
+// go through a socks5 or http proxy.
+func (s *smtpImpl) sendMail(ctx context.Context, to []string, msg []byte) error {
+	conn, err := dialContext(ctx, s.dialer, "tcp", s.hostPort)
+	if err != nil {
+		return err
+	}
+	c, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if err = c.Hello("localhost"); err != nil {
+		return err
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: s.host}); err != nil {
+			return err
 		}
-		buf.WriteString("</body>")
-		s.Logger.Info("Send RSS feeds notification", "email", email, "feeds", len(fs))
-		if err := smtp.SendMail(s.hostPort, s.auth, s.senderAddr, []string{email.String()}, buf.Bytes()); err != nil {
-			const shortErrMsg = "short response: "
-			// Ignore the error if it's a short response error, refer to
-			//  smpt.Client.Quit
-			//    smpt.Client.cmd
-			//      c.Text.ReadResponse(expectCode)
-			//        net.textproto.Reader.ReadResponse
-			//          net.textproto.Reader.readCodeLine
-			//            net.textproto.Reader.parseCodeLine
-			if !strings.HasPrefix(err.Error(), shortErrMsg) {
-				return errors.Newf(errors.Internal, err, "send feeds failed")
-			}
+	}
+	if s.auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.Newf(errors.Unimplemented, nil, "smtp: server doesn't support AUTH")
 		}
-		if callback != nil {
-			_ = callback(fs...)
+		if err = c.Auth(s.auth); err != nil {
+			return err
 		}
 	}
-	return nil
+	if err = c.Mail(s.senderAddr); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err = c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
 }
@@ -7,6 +7,10 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
+	// The time zones of the subscribers are loaded without the zoneinfo
+	// of the system, e.g., in the alpine image.
+	_ "time/tzdata"
 
 	"gopkg.in/yaml.v3"
 )
@@ -42,25 +46,127 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	mailbox, err := NewMailbox(config, logger)
+	subscribers, err := LoadSubscribers(context.Background(), config, storage, logger)
 	if err != nil {
 		log.Fatal(err)
 	}
+	config.Subscribers = subscribers.List()
+	notifiers, err := NewNotifiers(config, logger)
+	if err != nil {
+		log.Fatal(err)
+	}
+	outbox := NewOutbox(config, storage, notifiers, logger)
+	server, err := NewServer(config, logger)
+	if err != nil {
+		log.Fatal(err)
+	}
+	publisher := NewPublisher(subscribers, storage, server, logger)
+	server.Handle("/feeds/", publisher)
+	server.Handle("/fever/", NewFever(subscribers, storage, logger))
+	server.Handle("/greader/", NewGReader(subscribers, storage, logger))
+	items := NewItems(subscribers, storage, logger)
+	server.Handle("/api/items/", items)
+	actions := NewActions(config, subscribers, storage, items, logger)
+	server.Handle("/actions/", actions)
+	var mailbox Notifier
+	if config.MailSender.SmtpServer != "" {
+		if mailbox, err = NewMailbox(config, logger); err != nil {
+			log.Fatal(err)
+		}
+	}
+	web, err := NewWeb(config, subscribers, storage, items, mailbox, server, logger)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.Handle("/web/", web)
+	subscribersAPI := NewSubscribersAPI(config, subscribers, logger)
+	server.Handle("/api/subscribers", subscribersAPI)
+	server.Handle("/api/subscribers/", subscribersAPI)
+	runs := NewRuns(storage, logger)
+	runsAPI := NewRunsAPI(config, runs, logger)
+	server.Handle("/api/runs", runsAPI)
+	server.Handle("/api/runs/", runsAPI)
 
-	scheduler := NewScheduler(logger)
-	for _, subscriber := range config.Subscribers {
-		worker, err := NewWorker(subscriber, storage, mailbox)
+	if flag.NArg() > 0 {
+		cmds := &commands{outbox: outbox, publisher: publisher, items: items, runs: runs, socket: config.Control.Socket, stdin: os.Stdin}
+		err = cmds.run(context.Background(), os.Stdout, flag.Args())
+		storage.Close()
 		if err != nil {
 			log.Fatal(err)
 		}
-		if err = scheduler.Schedule(subscriber.Schedule, worker); err != nil {
+		return
+	}
+
+	elector := NewElector(config, storage, logger)
+	scheduler := NewScheduler(storage, logger)
+	scheduler.SetElector(elector)
+	actions.SetScheduler(scheduler)
+	jobsAPI := NewJobsAPI(config, scheduler, logger)
+	server.Handle("/api/jobs/", jobsAPI)
+	control := NewControl(config, scheduler, logger)
+	outbox.SetElector(elector)
+	for _, subscriber := range config.Subscribers {
+		if err = scheduleSubscriber(scheduler, subscriber, storage, notifiers, outbox); err != nil {
 			log.Fatal(err)
 		}
 	}
+	// The changes of the subscribers apply to the running daemon.
+	subscribers.Watch(func(old, new *Subscriber) {
+		if old != nil {
+			scheduler.Remove(old.Name)
+			scheduler.Remove(old.Name + digestJobSuffix)
+			notifiers.Remove(Email(old.Email))
+		}
+		if new == nil {
+			return
+		}
+		if err := notifiers.Set(*new); err != nil {
+			logger.Error(err, "set notifiers failed", "subscriber", new.Name)
+			return
+		}
+		if err := scheduleSubscriber(scheduler, *new, storage, notifiers, outbox); err != nil {
+			logger.Error(err, "schedule subscriber failed", "subscriber", new.Name)
+		}
+	})
 
 	ctx, cancel := context.WithCancel(context.Background())
 
+	var receiver *Receiver
+	if config.Inbound.Addr != "" {
+		if receiver, err = NewReceiver(config, storage, logger); err != nil {
+			log.Fatal(err)
+		}
+		if err = receiver.Start(ctx); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if config.Server.Addr != "" {
+		if err = server.Start(ctx); err != nil {
+			log.Fatal(err)
+		}
+	}
+	elector.Start(ctx)
+	outbox.Start(ctx)
 	scheduler.Start(ctx)
+	if err = control.Start(ctx); err != nil {
+		log.Fatal(err)
+	}
+
+	// SIGUSR1 runs all the jobs right away by their overlap policies.
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	go func() {
+		for {
+			select {
+			case <-usr1:
+				if _, err := scheduler.Trigger("", TriggerSignal); err != nil {
+					logger.Error(err, "trigger jobs failed")
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
 
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
@@ -73,6 +179,36 @@ func main() {
 	<-done
 
 	cancel()
+	control.Stop()
 	scheduler.Stop()
+	outbox.Stop()
+	elector.Stop()
+	if receiver != nil {
+		receiver.Stop()
+	}
+	server.Stop()
 	storage.Close()
 }
+
+// scheduleSubscriber schedules the fetches & the digests of the subscriber.
+func scheduleSubscriber(scheduler *Scheduler, subscriber Subscriber, storage Storage, notifiers *Notifiers, outbox *Outbox) error {
+	worker, err := NewWorker(subscriber, storage, notifiers, outbox)
+	if err != nil {
+		return err
+	}
+	opts := subscriber.JobOptions()
+	opts.Jitter = time.Duration(subscriber.Jitter)
+	opts.Schedule = worker.Schedule()
+	if _, err = scheduler.ScheduleJob(subscriber.ZonedSpec(subscriber.FetchSpec()), worker, opts); err != nil {
+		return err
+	}
+	// The feeds held in the quiet hours are sent by the digest at the end
+	// of them if the subscriber has no digest schedule.
+	if subscriber.DigestSchedule == "" && worker.quiet == nil {
+		return nil
+	}
+	opts = subscriber.JobOptions()
+	opts.Quiet = worker.quiet
+	_, err = scheduler.ScheduleJob(subscriber.ZonedSpec(string(subscriber.DigestSchedule)), DigestJob{worker}, opts)
+	return err
+}
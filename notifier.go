@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/maxnilz/feed/errors"
+)
+
+// Notifier renders the feeds into messages of a channel, e.g., email or
+// chat webhooks, and delivers them.
+type Notifier interface {
+	// Compose renders the feeds into messages, a digest may be split
+	// into several messages to fit in the size limits of the channel.
+	Compose(feeds Feeds) ([]*Message, error)
+	// Send delivers a composed message.
+	Send(ctx context.Context, msg *Message) error
+}
+
+const (
+	NotifierEmail   = "email"
+	NotifierSlack   = "slack"
+	NotifierDiscord = "discord"
+	NotifierTeams   = "teams"
+)
+
+// Notifiers holds the notifiers of every subscriber by the subscriber
+// email & the notifier name.
+type Notifiers struct {
+	cfg    Config
+	logger Logger
+
+	mu    sync.RWMutex
+	m     map[Email]map[string]Notifier
+	names map[Email][]string
+	// mailbox is shared by the subscribers, it's created only if it's
+	// used since the mail sender config is optional otherwise.
+	mailbox *smtpImpl
+}
+
+func NewNotifiers(cfg Config, logger Logger) (*Notifiers, error) {
+	ns := &Notifiers{
+		cfg:    cfg,
+		logger: logger,
+		m:      make(map[Email]map[string]Notifier),
+		names:  make(map[Email][]string),
+	}
+	for _, subscriber := range cfg.Subscribers {
+		if err := ns.Set(subscriber); err != nil {
+			return nil, err
+		}
+	}
+	return ns, nil
+}
+
+// Set replaces the notifiers of the subscriber.
+func (ns *Notifiers) Set(subscriber Subscriber) error {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	email := Email(subscriber.Email)
+	m := make(map[string]Notifier)
+	var names []string
+	for _, nc := range subscriber.NotifierConfigs() {
+		name := nc.NameOrType()
+		if nc.Delivery == "" {
+			nc.Delivery = subscriber.Delivery
+		}
+		if nc.MaxItems == 0 {
+			nc.MaxItems = subscriber.DigestMaxItems
+		}
+		if _, ok := m[name]; ok {
+			return errors.Newf(errors.InvalidArgument, nil, "duplicated notifier %s of %s", name, subscriber.Name)
+		}
+		n, err := ns.newNotifier(subscriber, nc)
+		if err != nil {
+			return errors.Wrapf(err, "invalid notifier %s of %s", name, subscriber.Name)
+		}
+		m[name] = n
+		names = append(names, name)
+	}
+	ns.m[email], ns.names[email] = m, names
+	return nil
+}
+
+// Remove removes the notifiers of the subscriber.
+func (ns *Notifiers) Remove(email Email) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	delete(ns.m, email)
+	delete(ns.names, email)
+}
+
+func (ns *Notifiers) newNotifier(subscriber Subscriber, nc NotifierConfig) (Notifier, error) {
+	cfg, logger := ns.cfg, ns.logger
+	switch nc.Type {
+	case NotifierEmail:
+		if ns.mailbox == nil {
+			mailbox, err := newMailbox(cfg, logger)
+			if err != nil {
+				return nil, err
+			}
+			ns.mailbox = mailbox
+		}
+		return ns.mailbox.withOptions(nc.Delivery, nc.MaxItems, newMailLinks(cfg, subscriber))
+	case NotifierSlack:
+		return newSlackNotifier(nc, logger)
+	case NotifierDiscord:
+		return newDiscordNotifier(nc, logger)
+	case NotifierTeams:
+		return newTeamsNotifier(nc, logger)
+	case NotifierWebhook:
+		return newWebhookNotifier(subscriber, nc, logger)
+	case NotifierTelegram:
+		return newTelegramNotifier(nc, logger)
+	case NotifierMatrix:
+		return newMatrixNotifier(nc, logger)
+	case NotifierNtfy:
+		return newNtfyNotifier(nc, logger)
+	case NotifierGotify:
+		return newGotifyNotifier(nc, logger)
+	case NotifierMaildir:
+		return newMaildirNotifier(cfg, nc, logger)
+	case NotifierMbox:
+		return newMboxNotifier(cfg, nc, logger)
+	default:
+		return nil, errors.Newf(errors.InvalidArgument, nil, "unknown notifier type %q", nc.Type)
+	}
+}
+
+func (ns *Notifiers) add(email Email, name string, n Notifier) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if ns.m[email] == nil {
+		ns.m[email] = make(map[string]Notifier)
+	}
+	ns.m[email][name] = n
+	ns.names[email] = append(ns.names[email], name)
+}
+
+func (ns *Notifiers) Get(email Email, name string) (Notifier, bool) {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+	n, ok := ns.m[email][name]
+	return n, ok
+}
+
+// Compose renders the feeds of the subscriber into messages by every
+// notifier of it.
+func (ns *Notifiers) Compose(email Email, feeds Feeds) ([]*Message, error) {
+	ns.mu.RLock()
+	names, m := ns.names[email], ns.m[email]
+	ns.mu.RUnlock()
+	var msgs []*Message
+	for _, name := range names {
+		out, err := m[name].Compose(feeds)
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range out {
+			msg.Notifier = name
+		}
+		msgs = append(msgs, out...)
+	}
+	return msgs, nil
+}
+
+// Send delivers the message by the notifier it was composed by.
+func (ns *Notifiers) Send(ctx context.Context, msg *Message) error {
+	n, ok := ns.Get(msg.Email, msg.Notifier)
+	if !ok {
+		return errors.Newf(errors.NotFound, nil, "notifier %s of %s not found", msg.Notifier, msg.Email)
+	}
+	return n.Send(ctx, msg)
+}
+
+// digestBuilder accumulates the feeds of a digest into one message
+// until the limits of the channel are hit.
+type digestBuilder interface {
+	// add adds the feed to the message, it reports false without
+	// changing the message if the feed doesn't fit in. A feed always
+	// fits in an empty message.
+	add(site string, feed *Feed) bool
+	// build renders the message body.
+	build() ([]byte, error)
+}
+
+// composeDigest renders the feeds of each recipient site by site, a new
+// message is started whenever the current one is full.
+func composeDigest(feeds Feeds, subject string, newBuilder func() digestBuilder) ([]*Message, error) {
+	var msgs []*Message
+	for _, email := range feeds.Emails {
+		sitesFeeds, ok := feeds.SitesFeeds(email)
+		if !ok {
+			continue
+		}
+		b := newBuilder()
+		var fs []*Feed
+		flush := func() error {
+			if len(fs) == 0 {
+				return nil
+			}
+			body, err := b.build()
+			if err != nil {
+				return err
+			}
+			msgs = append(msgs, &Message{Email: email, Subject: subject, Body: body, Feeds: fs})
+			b, fs = newBuilder(), nil
+			return nil
+		}
+		for _, site := range sitesFeeds.names {
+			siteFeeds, _ := sitesFeeds.get(site)
+			for _, feed := range siteFeeds {
+				if b.add(site, feed) {
+					fs = append(fs, feed)
+					continue
+				}
+				if err := flush(); err != nil {
+					return nil, err
+				}
+				b.add(site, feed)
+				fs = append(fs, feed)
+			}
+		}
+		if err := flush(); err != nil {
+			return nil, err
+		}
+	}
+	return msgs, nil
+}
+
+// truncate shortens s to at most n runes with an ellipsis.
+func truncate(s string, n int) string {
+	rs := []rune(s)
+	if len(rs) <= n {
+		return s
+	}
+	if n <= 1 {
+		return string(rs[:n])
+	}
+	return string(rs[:n-1]) + "…"
+}
+
+// truncateBytes shortens s to at most n bytes with an ellipsis, it never
+// splits a rune.
+func truncateBytes(s string, n int) string {
+	const ellipsis = "…"
+	if len(s) <= n {
+		return s
+	}
+	if n < len(ellipsis) {
+		return ""
+	}
+	end := 0
+	for i := range s {
+		if i > n-len(ellipsis) {
+			break
+		}
+		end = i
+	}
+	return s[:end] + ellipsis
+}
+
+const webhookTimeout = 30 * time.Second
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// postJSON posts the body to the webhook url, any non-2xx response is
+// treated as a failure so that the outbox retries it.
+func postJSON(ctx context.Context, endpoint string, header http.Header, body []byte) error {
+	return sendJSON(ctx, http.MethodPost, endpoint, header, body)
+}
+
+func sendJSON(ctx context.Context, method, endpoint string, header http.Header, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return errors.Newf(errors.InvalidArgument, err, "create post request to webhook failed")
+	}
+	for k, vs := range header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	if req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return errors.Newf(errors.Unavailable, err, "post to webhook failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		code := errors.Internal
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+			code = errors.Unavailable
+		}
+		return errors.Newf(code, nil, "invalid webhook response: %v %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// itemTime returns the time shown for the feed in the digest.
+func itemTime(feed *Feed) string {
+	if feed.UpdatedAt != "" && feed.UpdatedAt != feed.PublishedAt {
+		return fmt.Sprintf("%s (updated %s)", feed.PublishedAt, feed.UpdatedAt)
+	}
+	return feed.PublishedAt
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	stderr "errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maxnilz/feed/errors"
+)
+
+type MessageState string
+
+const (
+	// MessagePending is waiting for the (next) delivery attempt.
+	MessagePending MessageState = "pending"
+	// MessageSent has been delivered, and its feeds are acked.
+	MessageSent MessageState = "sent"
+	// MessageDead has run out of delivery attempts.
+	MessageDead MessageState = "dead"
+)
+
+// Message is a rendered notification to a single recipient, it
+// carries the feeds it contains so that they can be acked once the
+// message is delivered.
+type Message struct {
+	Id    int64
+	Email Email
+	// Notifier is the name of the subscriber's notifier which composed
+	// the message, it's used to send the message as well.
+	Notifier string
+	Subject  string
+	Body     []byte
+	Feeds    []*Feed
+
+	State         MessageState
+	Attempts      int
+	NextAttemptAt time.Time
+	LastError     string
+	CreatedAt     time.Time
+	SentAt        time.Time
+}
+
+const (
+	defaultOutboxMaxAttempts = 8
+	defaultOutboxInterval    = time.Minute
+	defaultOutboxBackoff     = time.Minute
+	defaultOutboxMaxBackoff  = 6 * time.Hour
+
+	outboxBatchSize = 100
+)
+
+// Outbox persists rendered messages & delivers them in background,
+// failed deliveries are retried with exponential backoff until the max
+// attempts is reached, after which the message is moved to dead state.
+type Outbox struct {
+	storage   Storage
+	notifiers *Notifiers
+
+	maxAttempts int
+	interval    time.Duration
+	backoff     time.Duration
+	maxBackoff  time.Duration
+
+	// mu serializes the deliveries, so that a message is never sent by
+	// a flush & Deliver at the same time.
+	mu     sync.Mutex
+	waiter sync.WaitGroup
+
+	elector *Elector
+	logger  Logger
+}
+
+func NewOutbox(cfg Config, storage Storage, notifiers *Notifiers, logger Logger) *Outbox {
+	o := &Outbox{
+		storage:     storage,
+		notifiers:   notifiers,
+		maxAttempts: cfg.Outbox.MaxAttempts,
+		interval:    cfg.Outbox.Interval,
+		backoff:     cfg.Outbox.Backoff,
+		maxBackoff:  cfg.Outbox.MaxBackoff,
+		logger:      logger,
+	}
+	if o.maxAttempts <= 0 {
+		o.maxAttempts = defaultOutboxMaxAttempts
+	}
+	if o.interval <= 0 {
+		o.interval = defaultOutboxInterval
+	}
+	if o.backoff <= 0 {
+		o.backoff = defaultOutboxBackoff
+	}
+	if o.maxBackoff <= 0 {
+		o.maxBackoff = defaultOutboxMaxBackoff
+	}
+	return o
+}
+
+// Enqueue saves the messages as pending within the given session, so
+// that they are committed or rolled back together with the feeds.
+func (o *Outbox) Enqueue(ses Session, msgs ...*Message) error {
+	now := time.Now()
+	for _, msg := range msgs {
+		msg.State = MessagePending
+		msg.Attempts = 0
+		msg.CreatedAt = now
+		msg.NextAttemptAt = now
+	}
+	return o.storage.EnqueueMessages(ses, msgs...)
+}
+
+func (o *Outbox) Start(ctx context.Context) {
+	o.waiter.Add(1)
+	go func() {
+		defer o.waiter.Done()
+		o.run(ctx)
+	}()
+}
+
+func (o *Outbox) Stop() {
+	o.waiter.Wait()
+}
+
+// SetElector makes the outbox flush the due messages only while the
+// replica is the leader elected by the elector, it's called before the
+// start.
+func (o *Outbox) SetElector(elector *Elector) {
+	o.elector = elector
+}
+
+func (o *Outbox) run(ctx context.Context) {
+	ticker := time.NewTicker(o.interval)
+	defer ticker.Stop()
+	for {
+		// The flush is fenced by the lease, so that it stops once another
+		// replica takes over.
+		if lease, ok := o.elector.held(); !ok {
+			o.logger.Info("outbox flush skipped, the replica is not the leader")
+		} else if err := o.Flush(withLease(ctx, lease)); err != nil {
+			o.logger.Error(err, "flush outbox failed")
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			o.logger.Info("outbox stop")
+			return
+		}
+	}
+}
+
+// Delivery is the result of a delivery attempt of a message to its
+// recipient.
+type Delivery struct {
+	MessageId int64
+	Email     Email
+	Notifier  string
+	// Feeds are the feeds delivered to the recipient & acked, it's empty
+	// if the delivery failed.
+	Feeds []*Feed
+	// Err is the send error, the message is retried later if it's not
+	// dead yet.
+	Err error
+}
+
+// Flush tries to deliver all the pending messages which are due, a
+// message failed doesn't hold the others back, the errors are returned
+// after all of them are tried.
+func (o *Outbox) Flush(ctx context.Context) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var errs []error
+	// tried are the messages tried in this flush, which are still due if
+	// their states failed to be saved.
+	tried := make(map[int64]bool)
+	for {
+		ses, err := o.storage.NewAutoSession(ctx)
+		if err != nil {
+			return stderr.Join(append(errs, err)...)
+		}
+		msgs, err := o.storage.GetDueMessages(ses, time.Now(), outboxBatchSize)
+		if err != nil {
+			return stderr.Join(append(errs, err)...)
+		}
+		fresh := 0
+		for _, msg := range msgs {
+			if tried[msg.Id] {
+				continue
+			}
+			tried[msg.Id] = true
+			fresh++
+			if err = ctx.Err(); err != nil {
+				return stderr.Join(append(errs, err)...)
+			}
+			d, err := o.deliver(ctx, msg)
+			if d == nil {
+				// The lease is lost, the rest are left to the new leader.
+				return stderr.Join(append(errs, err)...)
+			}
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if len(msgs) < outboxBatchSize || fresh == 0 {
+			return stderr.Join(errs...)
+		}
+	}
+}
+
+// Deliver tries to deliver the given messages right away, it reports
+// one delivery per message which is still pending. The returned error
+// is about acking the delivered feeds or the outbox bookkeeping, the
+// send errors are reported by the deliveries.
+func (o *Outbox) Deliver(ctx context.Context, msgs ...*Message) ([]*Delivery, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var deliveries []*Delivery
+	var errs []error
+	for _, it := range msgs {
+		ses, err := o.storage.NewAutoSession(ctx)
+		if err != nil {
+			return deliveries, err
+		}
+		// The message may have been delivered by a flush in between.
+		msg, err := o.storage.GetMessage(ses, it.Id)
+		if err != nil {
+			return deliveries, err
+		}
+		if msg.State != MessagePending {
+			continue
+		}
+		d, err := o.deliver(ctx, msg)
+		if d == nil {
+			return deliveries, stderr.Join(append(errs, err)...)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, stderr.Join(errs...)
+}
+
+// deliver sends the message once & acks its feeds on success, the
+// returned error is about acking or the outbox bookkeeping rather than
+// the delivery itself, which is reported by Delivery.Err. The delivery is
+// nil if the message is not sent since the lease it's sent under is lost.
+func (o *Outbox) deliver(ctx context.Context, msg *Message) (*Delivery, error) {
+	// A former leader doesn't send the message along with the new one.
+	ses, err := o.storage.NewAutoSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err = fence(ctx, o.storage, ses); err != nil {
+		return nil, err
+	}
+	d := &Delivery{MessageId: msg.Id, Email: msg.Email, Notifier: msg.Notifier}
+	msg.Attempts++
+	d.Err = o.notifiers.Send(ctx, msg)
+	now := time.Now()
+
+	switch {
+	case d.Err == nil:
+		msg.State = MessageSent
+		msg.SentAt = now
+		msg.LastError = ""
+		o.logger.Info("message delivered", "id", msg.Id, "email", msg.Email, "notifier", msg.Notifier,
+			"feeds", len(msg.Feeds))
+	case msg.Attempts >= o.maxAttempts:
+		msg.State = MessageDead
+		msg.LastError = d.Err.Error()
+		o.logger.Error(d.Err, "message dead", "id", msg.Id, "email", msg.Email, "notifier", msg.Notifier,
+			"attempts", msg.Attempts)
+	default:
+		msg.LastError = d.Err.Error()
+		msg.NextAttemptAt = now.Add(o.backoffOf(msg.Attempts))
+		o.logger.Error(d.Err, "deliver message failed", "id", msg.Id, "email", msg.Email, "notifier", msg.Notifier,
+			"attempts", msg.Attempts, "next", msg.NextAttemptAt)
+	}
+
+	ackErr := o.update(ctx, msg, now)
+	if ackErr == nil {
+		if msg.State == MessageSent {
+			d.Feeds = msg.Feeds
+		}
+		return d, nil
+	}
+	if msg.State != MessageSent {
+		return d, ackErr
+	}
+	// The message is out, it must not be sent again even if its feeds
+	// can't be acked, they are still excluded from the next fetch since
+	// they are referenced by the outbox.
+	o.logger.Error(ackErr, "ack feeds failed", "id", msg.Id, "email", msg.Email)
+	msg.LastError = ackErr.Error()
+	if err = o.storage.UpdateMessage(ses, msg); err != nil {
+		return d, stderr.Join(ackErr, err)
+	}
+	return d, ackErr
+}
+
+// update saves the message state, and acks its feeds in the same
+// transaction if it's sent.
+func (o *Outbox) update(ctx context.Context, msg *Message, now time.Time) error {
+	ses, err := o.storage.NewSession(ctx)
+	if err != nil {
+		return err
+	}
+	ses, err = ses.Begin()
+	if err != nil {
+		return err
+	}
+	defer ses.Rollback()
+	if err = fence(ctx, o.storage, ses); err != nil {
+		return err
+	}
+	if msg.State == MessageSent {
+		if err = o.storage.AckFeeds(ses, now, msg.Feeds...); err != nil {
+			return err
+		}
+	}
+	if err = o.storage.UpdateMessage(ses, msg); err != nil {
+		return err
+	}
+	return ses.Commit()
+}
+
+// backoffOf returns the delay before the next attempt given the number
+// of attempts already made.
+func (o *Outbox) backoffOf(attempts int) time.Duration {
+	d := o.backoff
+	for i := 1; i < attempts; i++ {
+		d *= 2
+		if d >= o.maxBackoff {
+			return o.maxBackoff
+		}
+	}
+	return d
+}
+
+// Retry moves a dead (or pending) message back to pending state, so
+// that it is delivered by the next flush.
+func (o *Outbox) Retry(ctx context.Context, id int64) error {
+	ses, err := o.storage.NewAutoSession(ctx)
+	if err != nil {
+		return err
+	}
+	msg, err := o.storage.GetMessage(ses, id)
+	if err != nil {
+		return err
+	}
+	if msg.State == MessageSent {
+		return errors.Newf(errors.FailedPrecondition, nil, "message %d is already sent", id)
+	}
+	msg.State = MessagePending
+	msg.Attempts = 0
+	msg.NextAttemptAt = time.Now()
+	return o.storage.UpdateMessage(ses, msg)
+}
+
+// List returns the most recent messages in the given state, all states
+// are included if state is empty.
+func (o *Outbox) List(ctx context.Context, state MessageState, limit int) ([]*Message, error) {
+	ses, err := o.storage.NewAutoSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return o.storage.GetMessages(ses, state, limit)
+}
+
+func formatMessages(msgs []*Message) string {
+	sb := strings.Builder{}
+	sb.WriteString(fmt.Sprintf("Total Messages: %d\n", len(msgs)))
+	sb.WriteString("Id | Email | Notifier | State | Attempts | Feeds | Next Attempt | Last Error\n")
+	sb.WriteString(strings.Repeat("-", 60))
+	sb.WriteString("\n")
+	for _, msg := range msgs {
+		next := ""
+		if msg.State == MessagePending {
+			next = msg.NextAttemptAt.Local().Format(time.RFC3339)
+		}
+		sb.WriteString(fmt.Sprintf("%d | %s | %s | %s | %d | %d | %s | %s\n",
+			msg.Id, msg.Email, msg.Notifier, msg.State, msg.Attempts, len(msg.Feeds), next, msg.LastError))
+	}
+	return sb.String()
+}
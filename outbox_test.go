@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	stderr "errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeMailbox struct {
+	sync.Mutex
+	err error
+	// errs are the send errors by recipient, it takes precedence over err.
+	errs map[Email]error
+	sent []*Message
+}
+
+func (m *fakeMailbox) Compose(feeds Feeds) ([]*Message, error) {
+	var msgs []*Message
+	for _, email := range feeds.Emails {
+		var fs []*Feed
+		for _, f := range feeds.List {
+			if f.Email == email {
+				fs = append(fs, f)
+			}
+		}
+		msgs = append(msgs, &Message{Email: email, Notifier: NotifierEmail, Subject: subject, Body: []byte("body"), Feeds: fs})
+	}
+	return msgs, nil
+}
+
+func (m *fakeMailbox) Send(ctx context.Context, msg *Message) error {
+	m.Lock()
+	defer m.Unlock()
+	if err, ok := m.errs[msg.Email]; ok {
+		return err
+	}
+	if m.err != nil {
+		return m.err
+	}
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+// newTestNotifiers returns the notifiers with the given email notifier
+// for each of the emails.
+func newTestNotifiers(n Notifier, emails ...Email) *Notifiers {
+	ns := &Notifiers{m: make(map[Email]map[string]Notifier), names: make(map[Email][]string)}
+	for _, email := range emails {
+		ns.add(email, NotifierEmail, n)
+	}
+	return ns
+}
+
+func newTestSQLite(t *testing.T) *sqllite {
+	s, err := newSQLite(filepath.Join(t.TempDir(), "feed.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func countAckedFeeds(t *testing.T, s *sqllite) int {
+	var n int
+	if err := s.db.QueryRow(`SELECT count(*) FROM feed WHERE ack = 1`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestOutbox(t *testing.T) {
+	s := newTestSQLite(t)
+	mailbox := &fakeMailbox{err: stderr.New("connection refused")}
+	cfg := Config{Outbox: OutboxConfig{MaxAttempts: 2, Backoff: time.Nanosecond}}
+	outbox := NewOutbox(cfg, s, newTestNotifiers(mailbox, "a@example.com", "b@example.com"), DiscardLogger)
+	ctx := context.Background()
+
+	var feeds Feeds
+	feeds.Append(
+		&Feed{Id: "1", Email: "a@example.com", SiteURL: "https://foo.com/index.rss", SiteName: "foo",
+			FetchAt: mustParseTime("2023-07-22 07:00:00")},
+		&Feed{Id: "2", Email: "b@example.com", SiteURL: "https://foo.com/index.rss", SiteName: "foo",
+			FetchAt: mustParseTime("2023-07-22 07:00:00")},
+	)
+	msgs, err := mailbox.Compose(feeds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ses, err := s.NewSession(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ses, err = ses.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SaveFeeds(ses, feeds.List...); err != nil {
+		t.Fatal(err)
+	}
+	if err = outbox.Enqueue(ses, msgs...); err != nil {
+		t.Fatal(err)
+	}
+	if err = ses.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The enqueued feeds must not be picked up again by the next fetch.
+	ses, _ = s.NewAutoSession(ctx)
+	mark, err := s.GetLatestFeedWaterMark(ses, "a@example.com", "https://foo.com/index.rss")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mark.IsZero() {
+		t.Fatal("expected the water mark to include enqueued feeds")
+	}
+
+	if err = outbox.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	pending, err := outbox.List(ctx, MessagePending, listLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 || pending[0].Attempts != 1 || pending[0].LastError == "" {
+		t.Fatalf("expected 2 pending messages after the first attempt, got %s", formatMessages(pending))
+	}
+
+	if err = outbox.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	dead, err := outbox.List(ctx, MessageDead, listLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 2 {
+		t.Fatalf("expected 2 dead messages, got %s", formatMessages(dead))
+	}
+	if n := countAckedFeeds(t, s); n != 0 {
+		t.Fatalf("expected no acked feeds, got %d", n)
+	}
+
+	mailbox.err = nil
+	for _, msg := range dead {
+		if err = outbox.Retry(ctx, msg.Id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = outbox.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	sent, err := outbox.List(ctx, MessageSent, listLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 2 || len(mailbox.sent) != 2 {
+		t.Fatalf("expected 2 sent messages, got %s", formatMessages(sent))
+	}
+	if len(sent[0].Feeds) != 1 || sent[0].SentAt.IsZero() {
+		t.Fatalf("unexpected sent message: %+v", sent[0])
+	}
+	if n := countAckedFeeds(t, s); n != 2 {
+		t.Fatalf("expected 2 acked feeds, got %d", n)
+	}
+	if err = outbox.Retry(ctx, sent[0].Id); err == nil {
+		t.Fatal("expected retrying a sent message to fail")
+	}
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	cfg := Config{Outbox: OutboxConfig{Backoff: time.Minute, MaxBackoff: 5 * time.Minute}}
+	o := NewOutbox(cfg, nil, nil, DiscardLogger)
+	for attempts, want := range map[int]time.Duration{
+		1: time.Minute,
+		2: 2 * time.Minute,
+		3: 4 * time.Minute,
+		4: 5 * time.Minute,
+		9: 5 * time.Minute,
+	} {
+		if got := o.backoffOf(attempts); got != want {
+			t.Errorf("attempts %d: expected %v, got %v", attempts, want, got)
+		}
+	}
+}
+
+func TestOutboxDeliver(t *testing.T) {
+	s := newTestSQLite(t)
+	mailbox := &fakeMailbox{errs: map[Email]error{"b@example.com": stderr.New("mailbox unavailable")}}
+	outbox := NewOutbox(Config{}, s, newTestNotifiers(mailbox, "a@example.com", "b@example.com"), DiscardLogger)
+	ctx := context.Background()
+
+	// The same item is saved once per subscriber.
+	var feeds Feeds
+	feeds.Append(
+		&Feed{Id: "1", Email: "a@example.com", SiteURL: "https://foo.com/index.rss", SiteName: "foo"},
+		&Feed{Id: "2", Email: "a@example.com", SiteURL: "https://foo.com/index.rss", SiteName: "foo"},
+		&Feed{Id: "1", Email: "b@example.com", SiteURL: "https://foo.com/index.rss", SiteName: "foo"},
+	)
+	msgs, err := mailbox.Compose(feeds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ses, _ := s.NewAutoSession(ctx)
+	if err = s.SaveFeeds(ses, feeds.List...); err != nil {
+		t.Fatal(err)
+	}
+	if err = outbox.Enqueue(ses, msgs...); err != nil {
+		t.Fatal(err)
+	}
+
+	deliveries, err := outbox.Deliver(ctx, msgs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 2 {
+		t.Fatalf("expected 2 deliveries, got %d", len(deliveries))
+	}
+	for _, d := range deliveries {
+		switch d.Email {
+		case "a@example.com":
+			if d.Err != nil || len(d.Feeds) != 2 {
+				t.Fatalf("expected 2 feeds delivered to %s, got %d, err: %v", d.Email, len(d.Feeds), d.Err)
+			}
+		case "b@example.com":
+			if d.Err == nil || len(d.Feeds) != 0 {
+				t.Fatalf("expected delivery to %s failed, got %d feeds", d.Email, len(d.Feeds))
+			}
+		}
+	}
+	var n int
+	q := `SELECT count(*) FROM feed WHERE ack = 1 AND email = ?`
+	if err = s.db.QueryRow(q, "b@example.com").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("expected no feeds of b@example.com acked, got %d", n)
+	}
+	if n = countAckedFeeds(t, s); n != 2 {
+		t.Fatalf("expected 2 acked feeds, got %d", n)
+	}
+
+	// Delivered messages are never sent twice.
+	deliveries, err = outbox.Deliver(ctx, msgs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 0 || len(mailbox.sent) != 1 {
+		t.Fatalf("expected the sent message to be skipped, got %d deliveries", len(deliveries))
+	}
+
+	// The updates of the items sent only are threaded under them.
+	for _, tt := range []struct {
+		feed *Feed
+		sent bool
+	}{
+		{feeds.List[0], true},
+		{feeds.List[2], false},
+		{&Feed{Id: "3", Email: "a@example.com", SiteURL: "https://foo.com/index.rss"}, false},
+	} {
+		if sent, err := s.IsFeedSent(ses, tt.feed); err != nil || sent != tt.sent {
+			t.Fatalf("expected feed %s of %s sent %v, got %v %v", tt.feed.Id, tt.feed.Email, tt.sent, sent, err)
+		}
+	}
+}
+
+// failingUpdates fails to save the state of the message of the id.
+type failingUpdates struct {
+	*sqllite
+	id int64
+}
+
+func (s failingUpdates) UpdateMessage(ses Session, msg *Message) error {
+	if msg.Id == s.id {
+		return stderr.New("disk I/O error")
+	}
+	return s.sqllite.UpdateMessage(ses, msg)
+}
+
+func TestOutboxFlushBatches(t *testing.T) {
+	s := newTestSQLite(t)
+	mailbox := &fakeMailbox{}
+	ctx := context.Background()
+	ses, _ := s.NewAutoSession(ctx)
+	var msgs []*Message
+	for i := 0; i <= outboxBatchSize; i++ {
+		msgs = append(msgs, &Message{Email: "a@example.com", Notifier: NotifierEmail, Subject: subject, Body: []byte("body")})
+	}
+	outbox := NewOutbox(Config{}, s, newTestNotifiers(mailbox, "a@example.com"), DiscardLogger)
+	if err := outbox.Enqueue(ses, msgs...); err != nil {
+		t.Fatal(err)
+	}
+	due, err := s.GetDueMessages(ses, time.Now(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The message failed in the first batch doesn't hold the next batch
+	// back, nor is it tried again in the same flush.
+	outbox = NewOutbox(Config{}, failingUpdates{sqllite: s, id: due[0].Id}, newTestNotifiers(mailbox, "a@example.com"), DiscardLogger)
+	if err = outbox.Flush(ctx); err == nil {
+		t.Fatal("expected the failed message reported")
+	}
+	sent, err := outbox.List(ctx, MessageSent, 2*outboxBatchSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != outboxBatchSize || len(mailbox.sent) != outboxBatchSize+1 {
+		t.Fatalf("expected all but the failed message sent, got %d of %d", len(sent), len(mailbox.sent))
+	}
+}
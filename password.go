@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/maxnilz/feed/errors"
+)
+
+const (
+	// passwordHashScheme is the scheme of the password hashes, i.e.,
+	// pbkdf2-sha256$<iterations>$<salt>$<key> in unpadded base64.
+	passwordHashScheme = "pbkdf2-sha256"
+	passwordIterations = 600000
+	passwordSaltLen    = 16
+	passwordKeyLen     = 32
+)
+
+// newPasswordHash returns the hash of the password with a random salt,
+// which is put in the config as the passwordHash of a subscriber.
+func newPasswordHash(password string) (string, error) {
+	if password == "" {
+		return "", errors.Newf(errors.InvalidArgument, nil, "empty password")
+	}
+	salt := make([]byte, passwordSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", errors.Newf(errors.Internal, err, "generate salt failed")
+	}
+	return hashPassword(password, salt, passwordIterations), nil
+}
+
+func hashPassword(password string, salt []byte, iterations int) string {
+	key := pbkdf2SHA256([]byte(password), salt, iterations, passwordKeyLen)
+	return fmt.Sprintf("%s$%d$%s$%s", passwordHashScheme, iterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+// verifyPassword reports whether the password matches the hash, the
+// malformed hashes match nothing.
+func verifyPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != passwordHashScheme {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(key) == 0 {
+		return false
+	}
+	return subtle.ConstantTimeCompare(pbkdf2SHA256([]byte(password), salt, iterations, len(key)), key) == 1
+}
+
+// pbkdf2SHA256 derives the key from the password, refer to RFC 8018.
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	blocks := (keyLen + hashLen - 1) / hashLen
+	key := make([]byte, 0, blocks*hashLen)
+	var idx [4]byte
+	u := make([]byte, hashLen)
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(idx[:], uint32(block))
+		prf.Write(idx[:])
+		key = prf.Sum(key)
+		t := key[len(key)-hashLen:]
+		copy(u, t)
+		for n := 2; n <= iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for i := range u {
+				t[i] ^= u[i]
+			}
+		}
+	}
+	return key[:keyLen]
+}
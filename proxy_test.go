@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSMTPServer is a minimal smtp server which records the received
+// messages, it supports AUTH PLAIN without TLS.
+type fakeSMTPServer struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	messages []string
+}
+
+func newFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTPServer{ln: ln}
+	go s.serve()
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+func (s *fakeSMTPServer) Addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *fakeSMTPServer) Messages() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.messages...)
+}
+
+func (s *fakeSMTPServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeSMTPServer) handle(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	_ = tp.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch cmd {
+		case "EHLO":
+			_ = tp.PrintfLine("250-localhost")
+			_ = tp.PrintfLine("250 AUTH PLAIN")
+		case "AUTH":
+			_ = tp.PrintfLine("235 Authentication successful")
+		case "MAIL", "RCPT", "RSET", "NOOP":
+			_ = tp.PrintfLine("250 OK")
+		case "DATA":
+			_ = tp.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, string(data))
+			s.mu.Unlock()
+			_ = tp.PrintfLine("250 OK")
+		case "QUIT":
+			_ = tp.PrintfLine("221 Bye")
+			return
+		default:
+			_ = tp.PrintfLine("502 Command not implemented")
+		}
+	}
+}
+
+// newConnectProxy starts a http proxy supporting the CONNECT method only.
+func newConnectProxy(t *testing.T, wantAuth string) (addr string, tunnels func() int) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var mu sync.Mutex
+	var n int
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				if req.Header.Get("Proxy-Authorization") != wantAuth {
+					_, _ = io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+					return
+				}
+				upstream, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					_, _ = io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer upstream.Close()
+				mu.Lock()
+				n++
+				mu.Unlock()
+				_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go func() { _, _ = io.Copy(upstream, conn) }()
+				_, _ = io.Copy(conn, upstream)
+			}(conn)
+		}
+	}()
+	return ln.Addr().String(), func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return n
+	}
+}
+
+func TestSendMailOverHTTPProxy(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	// base64 of "user:pass"
+	proxyAddr, tunnels := newConnectProxy(t, "Basic dXNlcjpwYXNz")
+
+	cfg := Config{MailSender: MailSender{
+		SmtpServer: server.Addr(),
+		SenderAddr: "sender@example.com",
+		Password:   "password",
+		Proxy:      "http://user:pass@" + proxyAddr,
+	}}
+	mailbox, err := NewMailbox(cfg, DiscardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := mailbox.(*smtpImpl)
+	// PlainAuth refuses to send credentials over an unencrypted
+	// connection unless the server is localhost.
+	s.auth = smtp.PlainAuth("", s.senderAddr, s.password, "localhost")
+	s.host = "localhost"
+	if err = s.sendMail(context.Background(), []string{"foo@example.com"}, []byte("Subject: hi\r\n\r\nhello\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got := tunnels(); got != 1 {
+		t.Fatalf("expected 1 tunnel, got %d", got)
+	}
+	msgs := server.Messages()
+	if len(msgs) != 1 || !strings.Contains(msgs[0], "hello") {
+		t.Fatalf("unexpected messages: %q", msgs)
+	}
+}
+
+func TestProxyDialerRejected(t *testing.T) {
+	proxyAddr, _ := newConnectProxy(t, "Basic dXNlcjpwYXNz")
+	dialer, err := newProxyDialer("http://" + proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = dialer.Dial("tcp", "127.0.0.1:25"); err == nil {
+		t.Fatal("expected proxy authentication error")
+	}
+}
+
+func TestProxyDialerFromEnv(t *testing.T) {
+	t.Setenv("ALL_PROXY", "socks5://127.0.0.1:1080")
+	t.Setenv("NO_PROXY", "")
+	dialer, err := newProxyDialer("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := dialer.(*net.Dialer); ok {
+		t.Fatal("expected a proxy dialer from ALL_PROXY")
+	}
+	if _, err = newProxyDialer("ftp://127.0.0.1"); err == nil {
+		t.Fatal("expected unsupported proxy scheme error")
+	}
+}
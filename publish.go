@@ -0,0 +1,570 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maxnilz/feed/errors"
+)
+
+const (
+	FormatRSS  = "rss"
+	FormatAtom = "atom"
+	FormatJSON = "json"
+
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+var feedContentTypes = map[string]string{
+	FormatRSS:  "application/rss+xml; charset=utf-8",
+	FormatAtom: "application/atom+xml; charset=utf-8",
+	FormatJSON: "application/feed+json; charset=utf-8",
+}
+
+// Publisher renders the saved feeds of a subscriber, or a site group of
+// it, as a RSS 2.0, Atom 1.0 or JSON Feed 1.1 document.
+type Publisher struct {
+	subscribers *Subscribers
+	storage     Storage
+	server      *Server
+	logger      Logger
+}
+
+func NewPublisher(subscribers *Subscribers, storage Storage, server *Server, logger Logger) *Publisher {
+	return &Publisher{subscribers: subscribers, storage: storage, server: server, logger: logger}
+}
+
+type PublishRequest struct {
+	Subscriber string
+	// Group is the optional site group to publish.
+	Group  string
+	Format string
+	// Page starts from 1, Limit is the number of items per page.
+	Page  int
+	Limit int
+	// URL is where the feed is served, it's used to build the self &
+	// paging links, which are left out if it's nil.
+	URL *url.URL
+}
+
+type Published struct {
+	Body        []byte
+	ContentType string
+	// ETag is the strong entity tag of the body.
+	ETag string
+}
+
+func (p *Publisher) Publish(ctx context.Context, req PublishRequest) (*Published, error) {
+	subscriber, ok := p.subscribers.Get(req.Subscriber)
+	if !ok {
+		return nil, errors.Newf(errors.NotFound, nil, "subscriber %s not found", req.Subscriber)
+	}
+	contentType, ok := feedContentTypes[req.Format]
+	if !ok {
+		return nil, errors.Newf(errors.InvalidArgument, nil, "unsupported feed format %q", req.Format)
+	}
+	if req.Page <= 0 {
+		req.Page = 1
+	}
+	if req.Limit <= 0 {
+		req.Limit = defaultPageSize
+	}
+	if req.Limit > maxPageSize {
+		req.Limit = maxPageSize
+	}
+
+	sites := subscriber.Sites
+	title := subscriber.Name
+	if req.Group != "" {
+		sites = nil
+		for _, site := range subscriber.Sites {
+			if site.Group == req.Group {
+				sites = append(sites, site)
+			}
+		}
+		if len(sites) == 0 {
+			return nil, errors.Newf(errors.NotFound, nil, "site group %s of %s not found", req.Group, req.Subscriber)
+		}
+		title = fmt.Sprintf("%s - %s", subscriber.Name, req.Group)
+	}
+	names := siteNames(sites)
+	query := FeedQuery{Email: subscriber.Email, Limit: req.Limit + 1, Offset: (req.Page - 1) * req.Limit}
+	if req.Group != "" {
+		for siteURL := range names {
+			query.Sites = append(query.Sites, siteURL)
+		}
+	}
+	ses, err := p.storage.NewAutoSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	feeds, err := p.storage.GetFeeds(ses, query)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := &feedDoc{Title: title, Id: "urn:feed:" + url.PathEscape(req.Subscriber), Updated: time.Unix(0, 0).UTC()}
+	if req.Group != "" {
+		doc.Id += ":" + url.PathEscape(req.Group)
+	}
+	if req.URL != nil {
+		doc.SelfURL = pageURL(req.URL, req.Page)
+		if req.Page > 1 {
+			doc.PrevURL = pageURL(req.URL, req.Page-1)
+		}
+		if len(feeds) > req.Limit {
+			doc.NextURL = pageURL(req.URL, req.Page+1)
+		}
+	}
+	if len(feeds) > req.Limit {
+		feeds = feeds[:req.Limit]
+	}
+	for _, f := range feeds {
+		it := newFeedItem(f)
+		it.Site = names[f.SiteURL]
+		if it.Site == "" {
+			it.Site = f.SiteURL
+		}
+		if it.Updated.After(doc.Updated) {
+			doc.Updated = it.Updated
+		}
+		doc.Items = append(doc.Items, it)
+	}
+
+	var body []byte
+	switch req.Format {
+	case FormatRSS:
+		body, err = renderRSS(doc)
+	case FormatAtom:
+		body, err = renderAtom(doc)
+	case FormatJSON:
+		body, err = renderJSONFeed(doc)
+	}
+	if err != nil {
+		return nil, errors.Newf(errors.Internal, err, "render %s feed of %s failed", req.Format, req.Subscriber)
+	}
+	sum := sha256.Sum256(body)
+	return &Published{Body: body, ContentType: contentType, ETag: `"` + hex.EncodeToString(sum[:16]) + `"`}, nil
+}
+
+// ServeHTTP serves the feeds at /feeds/<subscriber>.<format> or
+// /feeds/<subscriber>/<group>.<format>, the format is one of rss, atom &
+// json. The feed token of the subscriber is required either in the
+// token query or as a bearer token.
+func (p *Publisher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	req, err := parsePublishPath(strings.TrimPrefix(r.URL.Path, "/feeds/"))
+	if err != nil {
+		writeError(w, p.logger, err)
+		return
+	}
+	// The feeds without a token are not served, & a wrong token is not
+	// told apart from an unknown subscriber.
+	subscriber, ok := p.subscribers.Get(req.Subscriber)
+	if !ok || subscriber.FeedToken == "" || !validToken(r, subscriber.FeedToken) {
+		writeError(w, p.logger, errors.Newf(errors.NotFound, nil, "feed not found"))
+		return
+	}
+	q := r.URL.Query()
+	for _, v := range []struct {
+		name string
+		to   *int
+	}{{"page", &req.Page}, {"limit", &req.Limit}} {
+		if s := q.Get(v.name); s != "" {
+			if *v.to, err = strconv.Atoi(s); err != nil {
+				writeError(w, p.logger, errors.Newf(errors.InvalidArgument, err, "invalid %s %q", v.name, s))
+				return
+			}
+		}
+	}
+	req.URL = r.URL
+	if p.server != nil {
+		req.URL = p.server.requestURL(r)
+	}
+	out, err := p.Publish(r.Context(), req)
+	if err != nil {
+		writeError(w, p.logger, err)
+		return
+	}
+	w.Header().Set("ETag", out.ETag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if etagMatch(r.Header.Get("If-None-Match"), out.ETag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", out.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(out.Body)))
+	if r.Method == http.MethodHead {
+		return
+	}
+	_, _ = w.Write(out.Body)
+}
+
+func parsePublishPath(p string) (PublishRequest, error) {
+	var req PublishRequest
+	ext := path.Ext(p)
+	req.Format = strings.TrimPrefix(ext, ".")
+	p = strings.TrimSuffix(p, ext)
+	req.Subscriber, req.Group, _ = strings.Cut(p, "/")
+	if req.Subscriber == "" || strings.Contains(req.Group, "/") {
+		return req, errors.Newf(errors.NotFound, nil, "feed not found")
+	}
+	if _, ok := feedContentTypes[req.Format]; !ok {
+		return req, errors.Newf(errors.NotFound, nil, "feed not found")
+	}
+	return req, nil
+}
+
+func validToken(r *http.Request, token string) bool {
+	got := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); got == "" && strings.HasPrefix(auth, "Bearer ") {
+		got = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// etagMatch reports whether the If-None-Match header matches the etag,
+// the weak comparison is used as RFC 9110 requires.
+func etagMatch(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func pageURL(u *url.URL, page int) string {
+	c := *u
+	q := c.Query()
+	if page > 1 {
+		q.Set("page", strconv.Itoa(page))
+	} else {
+		q.Del("page")
+	}
+	c.RawQuery = q.Encode()
+	return c.String()
+}
+
+// feedDoc is the format neutral feed to render.
+type feedDoc struct {
+	Title   string
+	Id      string
+	SelfURL string
+	PrevURL string
+	NextURL string
+	Updated time.Time
+	Items   []*feedItem
+}
+
+type feedItem struct {
+	Id          string
+	Title       string
+	Link        string
+	Site        string
+	Author      string
+	Description string
+	Content     string
+	Published   time.Time
+	Updated     time.Time
+}
+
+func newFeedItem(f *Feed) *feedItem {
+	it := &feedItem{
+		Id:          f.Id,
+		Title:       f.Title,
+		Link:        f.Link,
+		Author:      f.Author,
+		Description: f.Description,
+		Content:     f.Content,
+	}
+	if it.Id == "" {
+		it.Id = f.Link
+	}
+	published, ok := parseFeedTime(f.PublishedAt)
+	if !ok {
+		published = f.FetchAt
+	}
+	it.Published = published.UTC()
+	it.Updated = it.Published
+	if updated, ok := parseFeedTime(f.UpdatedAt); ok {
+		it.Updated = updated.UTC()
+	}
+	return it
+}
+
+// feedTimeLayouts are the layouts the sites usually use for the item
+// times, which are saved as is.
+var feedTimeLayouts = []string{
+	time.RFC3339,
+	time.RFC1123Z,
+	time.RFC1123,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	time.RFC822Z,
+	time.RFC822,
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+func parseFeedTime(s string) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, false
+	}
+	for _, layout := range feedTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// atomId returns the id of the item as an IRI, which atom requires.
+func atomId(feedId string, it *feedItem) string {
+	if u, err := url.Parse(it.Id); err == nil && u.IsAbs() {
+		return it.Id
+	}
+	sum := sha256.Sum256([]byte(it.Site + "\x00" + it.Id))
+	return feedId + ":" + hex.EncodeToString(sum[:16])
+}
+
+// RSS 2.0, refer to https://www.rssboard.org/rss-specification
+type rssDoc struct {
+	XMLName   xml.Name   `xml:"rss"`
+	Version   string     `xml:"version,attr"`
+	AtomNS    string     `xml:"xmlns:atom,attr"`
+	ContentNS string     `xml:"xmlns:content,attr"`
+	DCNS      string     `xml:"xmlns:dc,attr"`
+	Channel   rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string     `xml:"title"`
+	Link          string     `xml:"link"`
+	Description   string     `xml:"description"`
+	LastBuildDate string     `xml:"lastBuildDate"`
+	Links         []atomLink `xml:"atom:link"`
+	Items         []rssItem  `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title,omitempty"`
+	Link        string  `xml:"link,omitempty"`
+	Description string  `xml:"description,omitempty"`
+	Content     string  `xml:"content:encoded,omitempty"`
+	Creator     string  `xml:"dc:creator,omitempty"`
+	Category    string  `xml:"category,omitempty"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+	// Date is the updated time, which RSS lacks.
+	Date string `xml:"dc:date"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+func renderRSS(doc *feedDoc) ([]byte, error) {
+	ch := rssChannel{
+		Title:         doc.Title,
+		Link:          doc.SelfURL,
+		Description:   fmt.Sprintf("New posts of %s", doc.Title),
+		LastBuildDate: doc.Updated.Format(time.RFC1123Z),
+		Links:         feedLinks(doc),
+	}
+	for _, it := range doc.Items {
+		ch.Items = append(ch.Items, rssItem{
+			Title:       it.Title,
+			Link:        it.Link,
+			Description: it.Description,
+			Content:     it.Content,
+			Creator:     it.Author,
+			Category:    it.Site,
+			GUID:        rssGUID{IsPermaLink: false, Value: it.Id},
+			PubDate:     it.Published.Format(time.RFC1123Z),
+			Date:        it.Updated.Format(time.RFC3339),
+		})
+	}
+	return marshalXML(rssDoc{
+		Version:   "2.0",
+		AtomNS:    "http://www.w3.org/2005/Atom",
+		ContentNS: "http://purl.org/rss/1.0/modules/content/",
+		DCNS:      "http://purl.org/dc/elements/1.1/",
+		Channel:   ch,
+	})
+}
+
+// Atom 1.0, refer to https://www.rfc-editor.org/rfc/rfc4287
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	Id      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	Title     string        `xml:"title"`
+	Id        string        `xml:"id"`
+	Updated   string        `xml:"updated"`
+	Published string        `xml:"published"`
+	Links     []atomLink    `xml:"link"`
+	Author    *atomPerson   `xml:"author,omitempty"`
+	Category  *atomCategory `xml:"category,omitempty"`
+	Summary   *atomText     `xml:"summary,omitempty"`
+	Content   *atomText     `xml:"content,omitempty"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+func renderAtom(doc *feedDoc) ([]byte, error) {
+	feed := atomFeed{
+		Title:   doc.Title,
+		Id:      doc.Id,
+		Updated: doc.Updated.Format(time.RFC3339),
+		Links:   feedLinks(doc),
+	}
+	for _, it := range doc.Items {
+		entry := atomEntry{
+			Title:     it.Title,
+			Id:        atomId(doc.Id, it),
+			Updated:   it.Updated.Format(time.RFC3339),
+			Published: it.Published.Format(time.RFC3339),
+			Category:  &atomCategory{Term: it.Site},
+		}
+		if it.Link != "" {
+			entry.Links = []atomLink{{Rel: "alternate", Type: "text/html", Href: it.Link}}
+		}
+		if it.Author != "" {
+			entry.Author = &atomPerson{Name: it.Author}
+		}
+		if it.Description != "" {
+			entry.Summary = &atomText{Type: "html", Body: it.Description}
+		}
+		if it.Content != "" {
+			entry.Content = &atomText{Type: "html", Body: it.Content}
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+	return marshalXML(feed)
+}
+
+// feedLinks returns the self & the paging links, refer to
+// https://www.rfc-editor.org/rfc/rfc5005#section-3
+func feedLinks(doc *feedDoc) []atomLink {
+	var links []atomLink
+	for _, l := range []struct{ rel, href string }{
+		{"self", doc.SelfURL}, {"previous", doc.PrevURL}, {"next", doc.NextURL},
+	} {
+		if l.href != "" {
+			links = append(links, atomLink{Rel: l.rel, Href: l.href})
+		}
+	}
+	return links
+}
+
+func marshalXML(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	buf.WriteString("\n")
+	return buf.Bytes(), nil
+}
+
+// JSON Feed 1.1, refer to https://www.jsonfeed.org/version/1.1/
+type jsonFeed struct {
+	Version string          `json:"version"`
+	Title   string          `json:"title"`
+	FeedURL string          `json:"feed_url,omitempty"`
+	NextURL string          `json:"next_url,omitempty"`
+	Items   []*jsonFeedItem `json:"items"`
+}
+
+type jsonFeedItem struct {
+	Id            string           `json:"id"`
+	URL           string           `json:"url,omitempty"`
+	Title         string           `json:"title,omitempty"`
+	ContentHTML   string           `json:"content_html"`
+	Summary       string           `json:"summary,omitempty"`
+	DatePublished string           `json:"date_published"`
+	DateModified  string           `json:"date_modified"`
+	Authors       []jsonFeedAuthor `json:"authors,omitempty"`
+	Tags          []string         `json:"tags,omitempty"`
+}
+
+type jsonFeedAuthor struct {
+	Name string `json:"name"`
+}
+
+func renderJSONFeed(doc *feedDoc) ([]byte, error) {
+	feed := jsonFeed{
+		Version: "https://jsonfeed.org/version/1.1",
+		Title:   doc.Title,
+		FeedURL: doc.SelfURL,
+		NextURL: doc.NextURL,
+		Items:   []*jsonFeedItem{},
+	}
+	for _, it := range doc.Items {
+		item := &jsonFeedItem{
+			Id:            it.Id,
+			URL:           it.Link,
+			Title:         it.Title,
+			ContentHTML:   it.Content,
+			DatePublished: it.Published.Format(time.RFC3339),
+			DateModified:  it.Updated.Format(time.RFC3339),
+			Tags:          []string{it.Site},
+		}
+		if item.ContentHTML == "" {
+			item.ContentHTML = it.Description
+		} else {
+			item.Summary = it.Description
+		}
+		if it.Author != "" {
+			item.Authors = []jsonFeedAuthor{{Name: it.Author}}
+		}
+		feed.Items = append(feed.Items, item)
+	}
+	return json.MarshalIndent(feed, "", "  ")
+}
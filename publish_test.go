@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+func TestPublisher(t *testing.T) {
+	s := newTestSQLite(t)
+	subscriber := Subscriber{
+		Name:      "foo",
+		Email:     "foo@example.com",
+		FeedToken: "s3cr3t",
+		Sites: []Site{
+			{Name: "site 0", URL: "https://site0.com/index.rss", Group: "tech"},
+			{Name: "site 1", URL: "https://site1.com/index.rss"},
+		},
+	}
+	cfg := Config{Subscribers: []Subscriber{subscriber}}
+	feeds := makeTestFeeds("foo@example.com", 2, 3, "hello")
+	for i, f := range feeds.List {
+		f.PublishedAt = time.Date(2023, 7, 22, i, 0, 0, 0, time.UTC).Format(time.RFC1123Z)
+		f.Content = fmt.Sprintf("<p>content %d</p>", i)
+		f.FetchAt = time.Now()
+	}
+	// An updated version of an item is published once.
+	updated := *feeds.List[0]
+	updated.UpdatedAt = "2023-07-23T07:00:00Z"
+	ctx := context.Background()
+	ses, _ := s.NewAutoSession(ctx)
+	if err := s.SaveFeeds(ses, append(feeds.List, &updated)...); err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewServer(Config{}, DiscardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Handle("/feeds/", NewPublisher(NewSubscribers(cfg.Subscribers), s, server, DiscardLogger))
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	get := func(path string, header http.Header) (*http.Response, []byte) {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, body
+	}
+
+	for _, path := range []string{"/feeds/foo.rss", "/feeds/foo.rss?token=wrong", "/feeds/bar.rss?token=s3cr3t", "/feeds/foo.xml?token=s3cr3t"} {
+		if resp, _ := get(path, nil); resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("expected 404 of %s, got %d", path, resp.StatusCode)
+		}
+	}
+
+	fp := gofeed.NewParser()
+	for _, format := range []string{FormatRSS, FormatAtom, FormatJSON} {
+		resp, body := get("/feeds/foo."+format+"?token=s3cr3t&limit=4", nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200 of %s, got %d: %s", format, resp.StatusCode, body)
+		}
+		if got := resp.Header.Get("Content-Type"); got != feedContentTypes[format] {
+			t.Fatalf("expected content type %s, got %s", feedContentTypes[format], got)
+		}
+		feed, err := fp.Parse(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("parse %s feed failed: %v\n%s", format, err, body)
+		}
+		if len(feed.Items) != 4 || feed.Items[0].Title != "hello 0-0" {
+			t.Fatalf("unexpected %s items: %s", format, body)
+		}
+		// The updated time of RSS is in dc:date, which gofeed leaves out.
+		if format == FormatRSS {
+			if !strings.Contains(string(body), "<dc:date>2023-07-23T07:00:00Z</dc:date>") {
+				t.Fatalf("expected the updated time of the item: %s", body)
+			}
+		} else if it := feed.Items[0]; it.UpdatedParsed == nil ||
+			!it.UpdatedParsed.Equal(time.Date(2023, 7, 23, 7, 0, 0, 0, time.UTC)) {
+			t.Fatalf("expected the updated time of the item, got %v", it.UpdatedParsed)
+		}
+		if !strings.Contains(string(body), "page=2") {
+			t.Fatalf("expected a next page link in %s feed: %s", format, body)
+		}
+
+		// The second page has the rest.
+		_, body = get("/feeds/foo."+format+"?token=s3cr3t&limit=4&page=2", nil)
+		if feed, err = fp.Parse(bytes.NewReader(body)); err != nil || len(feed.Items) != 2 {
+			t.Fatalf("unexpected second page of %s feed: %v\n%s", format, err, body)
+		}
+
+		etag := resp.Header.Get("ETag")
+		resp, _ = get("/feeds/foo."+format+"?token=s3cr3t&limit=4", http.Header{"If-None-Match": {etag}})
+		if resp.StatusCode != http.StatusNotModified {
+			t.Fatalf("expected 304 with etag %s, got %d", etag, resp.StatusCode)
+		}
+	}
+
+	resp, body := get("/feeds/foo/tech.atom", http.Header{"Authorization": {"Bearer s3cr3t"}})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 of site group, got %d: %s", resp.StatusCode, body)
+	}
+	feed, err := fp.Parse(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if feed.Title != "foo - tech" || len(feed.Items) != 3 {
+		t.Fatalf("expected 3 items of site group tech, got %d: %s", len(feed.Items), body)
+	}
+	if resp, _ = get("/feeds/foo/nope.atom?token=s3cr3t", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 of unknown site group, got %d", resp.StatusCode)
+	}
+}
+
+func TestParseFeedTime(t *testing.T) {
+	want := time.Date(2023, 7, 22, 7, 0, 0, 0, time.UTC)
+	for _, s := range []string{
+		"2023-07-22T07:00:00Z",
+		"Sat, 22 Jul 2023 07:00:00 +0000",
+		"Sat, 22 Jul 2023 07:00:00 GMT",
+		"2023-07-22 07:00:00",
+	} {
+		got, ok := parseFeedTime(s)
+		if !ok || !got.Equal(want) {
+			t.Errorf("parseFeedTime(%q): expected %v, got %v", s, want, got)
+		}
+	}
+	if _, ok := parseFeedTime("yesterday"); ok {
+		t.Error("expected invalid time")
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/maxnilz/feed/errors"
+)
+
+const (
+	NotifierTelegram = "telegram"
+	NotifierMatrix   = "matrix"
+	NotifierNtfy     = "ntfy"
+	NotifierGotify   = "gotify"
+)
+
+// textBuilder accumulates the digest as a single text in some markup
+// until the max length is hit, the length is counted in bytes which is
+// never less than the characters the platforms count.
+type textBuilder struct {
+	max    int
+	header func(site string) string
+	item   func(feed *Feed) string
+	render func(text string) ([]byte, error)
+
+	site string
+	sb   strings.Builder
+	n    int
+}
+
+func (b *textBuilder) add(site string, feed *Feed) bool {
+	s := b.text(site, feed)
+	if !b.fits(s) {
+		return false
+	}
+	b.write(site, s)
+	return true
+}
+
+// text returns the text to append for the feed.
+func (b *textBuilder) text(site string, feed *Feed) string {
+	var s string
+	if site != b.site {
+		if b.n > 0 {
+			s += "\n"
+		}
+		s += b.header(site) + "\n"
+	}
+	return s + b.item(feed) + "\n"
+}
+
+func (b *textBuilder) fits(s string) bool {
+	return b.n == 0 || b.n+len(s) <= b.max
+}
+
+func (b *textBuilder) write(site, s string) {
+	// A single item may be too long on its own, it's truncated as the
+	// last resort even though the markup might be broken.
+	if len(s) > b.max {
+		s = truncateBytes(s, b.max)
+	}
+	b.sb.WriteString(s)
+	b.n += len(s)
+	b.site = site
+}
+
+func (b *textBuilder) build() ([]byte, error) {
+	return b.render(strings.TrimRight(b.sb.String(), "\n"))
+}
+
+func htmlHeader(site string) string {
+	return fmt.Sprintf("<b>New posts from %s</b>", html.EscapeString(site))
+}
+
+func htmlItem(feed *Feed) string {
+	return fmt.Sprintf("• <a href=\"%s\">%s</a> %s",
+		html.EscapeString(feed.Link), html.EscapeString(feed.Title), html.EscapeString(itemTime(feed)))
+}
+
+var markdownEscape = strings.NewReplacer(
+	"\\", "\\\\", "_", "\\_", "*", "\\*", "[", "\\[", "]", "\\]", "(", "\\(", ")", "\\)", "~", "\\~",
+	"`", "\\`", ">", "\\>", "#", "\\#", "+", "\\+", "-", "\\-", "=", "\\=", "|", "\\|", "{", "\\{",
+	"}", "\\}", ".", "\\.", "!", "\\!",
+)
+
+func markdownHeader(site string) string {
+	return fmt.Sprintf("*New posts from %s*", markdownEscape.Replace(site))
+}
+
+func markdownItem(feed *Feed) string {
+	// Only ")" & "\" need escaping inside the link url.
+	link := strings.NewReplacer("\\", "\\\\", ")", "\\)").Replace(feed.Link)
+	return fmt.Sprintf("• [%s](%s) %s", markdownEscape.Replace(feed.Title), link, markdownEscape.Replace(itemTime(feed)))
+}
+
+// Telegram bot api, refer to https://core.telegram.org/bots/api#sendmessage
+const (
+	telegramAPIURL     = "https://api.telegram.org"
+	telegramMaxTextLen = 4096
+)
+
+type telegramNotifier struct {
+	apiURL    string
+	token     string
+	chatId    string
+	parseMode string
+	logger    Logger
+}
+
+func newTelegramNotifier(nc NotifierConfig, logger Logger) (Notifier, error) {
+	if nc.Token == "" || nc.ChatID == "" {
+		return nil, errors.Newf(errors.InvalidArgument, nil, "telegram bot token & chat id are required")
+	}
+	n := &telegramNotifier{apiURL: nc.URL, token: nc.Token, chatId: nc.ChatID, logger: logger}
+	if n.apiURL == "" {
+		n.apiURL = telegramAPIURL
+	}
+	switch strings.ToLower(nc.ParseMode) {
+	case "", "html":
+		n.parseMode = "HTML"
+	case "markdown", "markdownv2":
+		n.parseMode = "MarkdownV2"
+	default:
+		return nil, errors.Newf(errors.InvalidArgument, nil, "unsupported telegram parse mode %q", nc.ParseMode)
+	}
+	return n, nil
+}
+
+func (n *telegramNotifier) Compose(feeds Feeds) ([]*Message, error) {
+	return composeDigest(feeds, subject, func() digestBuilder {
+		b := &textBuilder{max: telegramMaxTextLen, header: htmlHeader, item: htmlItem}
+		if n.parseMode == "MarkdownV2" {
+			b.header, b.item = markdownHeader, markdownItem
+		}
+		b.render = func(text string) ([]byte, error) {
+			return json.Marshal(map[string]interface{}{
+				"chat_id":                  n.chatId,
+				"text":                     text,
+				"parse_mode":               n.parseMode,
+				"disable_web_page_preview": true,
+			})
+		}
+		return b
+	})
+}
+
+func (n *telegramNotifier) Send(ctx context.Context, msg *Message) error {
+	n.logger.Info("Send RSS feeds notification to telegram", "email", msg.Email, "feeds", len(msg.Feeds))
+	endpoint := fmt.Sprintf("%s/bot%s/sendMessage", strings.TrimRight(n.apiURL, "/"), n.token)
+	return postJSON(ctx, endpoint, nil, msg.Body)
+}
+
+// Matrix client-server api, refer to
+// https://spec.matrix.org/latest/client-server-api/#put_matrixclientv3roomsroomidsendeventtypetxnid
+const (
+	// matrixMaxTextLen keeps the event well below the 65KB limit given
+	// both the plain & the formatted body are sent.
+	matrixMaxTextLen = 16 * 1024
+)
+
+type matrixNotifier struct {
+	homeserver string
+	token      string
+	roomId     string
+	logger     Logger
+}
+
+func newMatrixNotifier(nc NotifierConfig, logger Logger) (Notifier, error) {
+	if err := validateWebhookURL(nc); err != nil {
+		return nil, errors.Wrapf(err, "invalid matrix homeserver url")
+	}
+	if nc.Token == "" || nc.RoomID == "" {
+		return nil, errors.Newf(errors.InvalidArgument, nil, "matrix access token & room id are required")
+	}
+	return &matrixNotifier{homeserver: nc.URL, token: nc.Token, roomId: nc.RoomID, logger: logger}, nil
+}
+
+func (n *matrixNotifier) Compose(feeds Feeds) ([]*Message, error) {
+	return composeDigest(feeds, subject, func() digestBuilder { return newMatrixBuilder() })
+}
+
+func (n *matrixNotifier) Send(ctx context.Context, msg *Message) error {
+	n.logger.Info("Send RSS feeds notification to matrix", "email", msg.Email, "feeds", len(msg.Feeds))
+	// The transaction id is derived from the outbox message, so that the
+	// homeserver dedups the retries of the same message.
+	endpoint := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/feed-%d",
+		strings.TrimRight(n.homeserver, "/"), url.PathEscape(n.roomId), msg.Id)
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+n.token)
+	return sendJSON(ctx, http.MethodPut, endpoint, header, msg.Body)
+}
+
+// matrixBuilder renders both the plain & the html body.
+type matrixBuilder struct {
+	plain, html *textBuilder
+}
+
+func newMatrixBuilder() *matrixBuilder {
+	return &matrixBuilder{
+		plain: &textBuilder{
+			max:    matrixMaxTextLen,
+			header: func(site string) string { return fmt.Sprintf("New posts from %s", site) },
+			item: func(feed *Feed) string {
+				return fmt.Sprintf("- %s %s %s", feed.Title, feed.Link, itemTime(feed))
+			},
+		},
+		html: &textBuilder{
+			max:    matrixMaxTextLen,
+			header: htmlHeader,
+			item:   htmlItem,
+		},
+	}
+}
+
+func (b *matrixBuilder) add(site string, feed *Feed) bool {
+	p, h := b.plain.text(site, feed), b.html.text(site, feed)
+	if !b.plain.fits(p) || !b.html.fits(h) {
+		return false
+	}
+	b.plain.write(site, p)
+	b.html.write(site, h)
+	return true
+}
+
+func (b *matrixBuilder) build() ([]byte, error) {
+	formatted := strings.ReplaceAll(strings.TrimRight(b.html.sb.String(), "\n"), "\n", "<br>")
+	return json.Marshal(map[string]string{
+		"msgtype":        "m.text",
+		"body":           strings.TrimRight(b.plain.sb.String(), "\n"),
+		"format":         "org.matrix.custom.html",
+		"formatted_body": formatted,
+	})
+}
+
+// ntfy, refer to https://docs.ntfy.sh/publish/#publish-as-json
+const (
+	ntfyServerURL     = "https://ntfy.sh"
+	ntfyMaxMessageLen = 4096
+)
+
+type ntfyNotifier struct {
+	server string
+	topic  string
+	token  string
+	logger Logger
+}
+
+func newNtfyNotifier(nc NotifierConfig, logger Logger) (Notifier, error) {
+	if nc.Topic == "" {
+		return nil, errors.Newf(errors.InvalidArgument, nil, "ntfy topic is required")
+	}
+	n := &ntfyNotifier{server: nc.URL, topic: nc.Topic, token: nc.Token, logger: logger}
+	if n.server == "" {
+		n.server = ntfyServerURL
+	}
+	return n, nil
+}
+
+func (n *ntfyNotifier) Compose(feeds Feeds) ([]*Message, error) {
+	return composeDigest(feeds, subject, func() digestBuilder {
+		return &textBuilder{
+			max:    ntfyMaxMessageLen,
+			header: markdownHeader,
+			item:   markdownItem,
+			render: func(text string) ([]byte, error) {
+				return json.Marshal(map[string]interface{}{
+					"topic":    n.topic,
+					"title":    subject,
+					"message":  text,
+					"markdown": true,
+				})
+			},
+		}
+	})
+}
+
+func (n *ntfyNotifier) Send(ctx context.Context, msg *Message) error {
+	n.logger.Info("Send RSS feeds notification to ntfy", "email", msg.Email, "feeds", len(msg.Feeds))
+	header := http.Header{}
+	if n.token != "" {
+		header.Set("Authorization", "Bearer "+n.token)
+	}
+	return postJSON(ctx, n.server, header, msg.Body)
+}
+
+// Gotify, refer to https://gotify.net/api-docs#/message/createMessage
+const gotifyMaxMessageLen = 16 * 1024
+
+type gotifyNotifier struct {
+	server string
+	token  string
+	logger Logger
+}
+
+func newGotifyNotifier(nc NotifierConfig, logger Logger) (Notifier, error) {
+	if err := validateWebhookURL(nc); err != nil {
+		return nil, errors.Wrapf(err, "invalid gotify server url")
+	}
+	if nc.Token == "" {
+		return nil, errors.Newf(errors.InvalidArgument, nil, "gotify application token is required")
+	}
+	return &gotifyNotifier{server: nc.URL, token: nc.Token, logger: logger}, nil
+}
+
+func (n *gotifyNotifier) Compose(feeds Feeds) ([]*Message, error) {
+	return composeDigest(feeds, subject, func() digestBuilder {
+		return &textBuilder{
+			max:    gotifyMaxMessageLen,
+			header: markdownHeader,
+			item:   markdownItem,
+			render: func(text string) ([]byte, error) {
+				return json.Marshal(map[string]interface{}{
+					"title":   subject,
+					"message": text,
+					"extras": map[string]interface{}{
+						"client::display": map[string]string{"contentType": "text/markdown"},
+					},
+				})
+			},
+		}
+	})
+}
+
+func (n *gotifyNotifier) Send(ctx context.Context, msg *Message) error {
+	n.logger.Info("Send RSS feeds notification to gotify", "email", msg.Email, "feeds", len(msg.Feeds))
+	header := http.Header{}
+	header.Set("X-Gotify-Key", n.token)
+	return postJSON(ctx, strings.TrimRight(n.server, "/")+"/message", header, msg.Body)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// pushRequest is a request received by the push api stand-in.
+type pushRequest struct {
+	method, path, auth string
+	body               map[string]interface{}
+}
+
+func newPushServer(t *testing.T) (*httptest.Server, func() []pushRequest) {
+	var mu sync.Mutex
+	var reqs []pushRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		req := pushRequest{method: r.Method, path: r.URL.Path, auth: r.Header.Get("Authorization")}
+		if key := r.Header.Get("X-Gotify-Key"); key != "" {
+			req.auth = key
+		}
+		if err := json.Unmarshal(data, &req.body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		reqs = append(reqs, req)
+		mu.Unlock()
+		_, _ = io.WriteString(w, `{"ok":true}`)
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []pushRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]pushRequest(nil), reqs...)
+	}
+}
+
+func TestPushNotifiers(t *testing.T) {
+	server, requests := newPushServer(t)
+	subscriber := Subscriber{Name: "foo", Email: "foo@example.com", Notifiers: []NotifierConfig{
+		{Type: NotifierTelegram, URL: server.URL, Token: "123:abc", ChatID: "42"},
+		{Type: NotifierMatrix, URL: server.URL, Token: "syt_token", RoomID: "!room:example.com"},
+		{Type: NotifierNtfy, URL: server.URL, Topic: "feeds", Token: "tk_token"},
+		{Type: NotifierGotify, URL: server.URL, Token: "app_token"},
+	}}
+	notifiers, err := NewNotifiers(Config{Subscribers: []Subscriber{subscriber}}, DiscardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := notifiers.Compose("foo@example.com", makeTestFeeds("foo@example.com", 2, 2, "<hello> & [bye]"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 4 {
+		t.Fatalf("expected 4 messages, got %d", len(msgs))
+	}
+	ctx := context.Background()
+	for i, msg := range msgs {
+		msg.Id = int64(i + 1)
+		if err = notifiers.Send(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reqs := requests()
+	if len(reqs) != 4 {
+		t.Fatalf("expected 4 requests, got %d", len(reqs))
+	}
+	telegram, matrix, ntfy, gotify := reqs[0], reqs[1], reqs[2], reqs[3]
+	if telegram.path != "/bot123:abc/sendMessage" || telegram.body["chat_id"] != "42" ||
+		telegram.body["parse_mode"] != "HTML" {
+		t.Fatalf("unexpected telegram request: %+v", telegram)
+	}
+	if text := telegram.body["text"].(string); !strings.Contains(text, "&lt;hello&gt; &amp; [bye]") {
+		t.Fatalf("expected escaped html, got %s", text)
+	}
+	if matrix.method != http.MethodPut || matrix.auth != "Bearer syt_token" ||
+		matrix.path != "/_matrix/client/v3/rooms/!room:example.com/send/m.room.message/feed-2" {
+		t.Fatalf("unexpected matrix request: %+v", matrix)
+	}
+	if matrix.body["format"] != "org.matrix.custom.html" || matrix.body["body"] == "" {
+		t.Fatalf("unexpected matrix event: %+v", matrix.body)
+	}
+	if ntfy.path != "/" || ntfy.auth != "Bearer tk_token" || ntfy.body["topic"] != "feeds" ||
+		ntfy.body["markdown"] != true {
+		t.Fatalf("unexpected ntfy request: %+v", ntfy)
+	}
+	if text := ntfy.body["message"].(string); !strings.Contains(text, `<hello\> & \[bye\]`) {
+		t.Fatalf("expected escaped markdown, got %s", text)
+	}
+	if gotify.path != "/message" || gotify.auth != "app_token" {
+		t.Fatalf("unexpected gotify request: %+v", gotify)
+	}
+}
+
+func TestTelegramSplit(t *testing.T) {
+	nc := NotifierConfig{Type: NotifierTelegram, Token: "123:abc", ChatID: "42", ParseMode: "markdown"}
+	n, err := newTelegramNotifier(nc, DiscardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	feeds := makeTestFeeds("foo@example.com", 3, 40, strings.Repeat("a title. ", 10))
+	msgs, err := n.Compose(feeds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) < 2 {
+		t.Fatalf("expected the digest to be split, got %d message", len(msgs))
+	}
+	checkSplit(t, feeds, msgs)
+	for _, msg := range msgs {
+		var payload map[string]interface{}
+		if err = json.Unmarshal(msg.Body, &payload); err != nil {
+			t.Fatal(err)
+		}
+		text := payload["text"].(string)
+		if len([]rune(text)) > telegramMaxTextLen || payload["parse_mode"] != "MarkdownV2" {
+			t.Fatalf("unexpected message, length: %d, parse mode: %v", len(text), payload["parse_mode"])
+		}
+	}
+
+	if _, err = newTelegramNotifier(NotifierConfig{Token: "123:abc"}, DiscardLogger); err == nil {
+		t.Fatal("expected missing chat id error")
+	}
+}
+
+func TestTruncateBytes(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"hello", 5, "hello"},
+		{"hello world", 8, "hello…"},
+		{"你好世界", 9, "你好…"},
+	} {
+		if got := truncateBytes(c.s, c.n); got != c.want || len(got) > c.n {
+			t.Errorf("truncateBytes(%q, %d): expected %q, got %q", c.s, c.n, c.want, got)
+		}
+	}
+}
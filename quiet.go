@@ -0,0 +1,157 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/maxnilz/feed/errors"
+)
+
+// quietHours is the parsed QuietHours in the time zone of the subscriber.
+type quietHours struct {
+	// start & end are the minutes of the day, the hours are quiet from
+	// start until end, over midnight if end is before start. They're
+	// not quiet if start equals end.
+	start, end int
+	days       [7]bool
+	loc        *time.Location
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// newQuietHours returns nil if the quiet hours are not set.
+func newQuietHours(q *QuietHours, timezone string) (*quietHours, error) {
+	if q == nil {
+		return nil, nil
+	}
+	loc, err := loadLocation(timezone)
+	if err != nil {
+		return nil, err
+	}
+	h := &quietHours{loc: loc}
+	if q.Start != "" || q.End != "" {
+		if h.start, err = parseTimeOfDay(q.Start); err != nil {
+			return nil, err
+		}
+		if h.end, err = parseTimeOfDay(q.End); err != nil {
+			return nil, err
+		}
+	}
+	quietDays := 0
+	for _, day := range q.Days {
+		// The days are named by the first three letters at least, e.g.,
+		// sat or saturday.
+		name := strings.ToLower(day)
+		if len(name) > 3 {
+			name = name[:3]
+		}
+		wd, ok := weekdays[name]
+		if !ok {
+			return nil, errors.Newf(errors.InvalidArgument, nil, "invalid quiet day %q", day)
+		}
+		if !h.days[wd] {
+			quietDays++
+		}
+		h.days[wd] = true
+	}
+	if quietDays == len(h.days) {
+		return nil, errors.Newf(errors.InvalidArgument, nil, "the quiet days can't be all the days")
+	}
+	if quietDays == 0 {
+		if q.Start == "" && q.End == "" {
+			return nil, errors.Newf(errors.InvalidArgument, nil, "the quiet hours need either the start & the end or the days")
+		}
+		if h.start == h.end {
+			return nil, errors.Newf(errors.InvalidArgument, nil, "the start & the end of the quiet hours can't be the same")
+		}
+	}
+	return h, nil
+}
+
+// loadLocation returns the time zone by the IANA name, the local one if
+// it's empty.
+func loadLocation(timezone string) (*time.Location, error) {
+	if timezone == "" {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, errors.Newf(errors.InvalidArgument, err, "invalid timezone %q", timezone)
+	}
+	return loc, nil
+}
+
+// parseTimeOfDay returns the minutes of the day by the time, e.g., 07:30.
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, errors.Newf(errors.InvalidArgument, err, "invalid time of day %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// contains reports whether the time is in the quiet hours.
+func (h *quietHours) contains(t time.Time) bool {
+	t = t.In(h.loc)
+	if h.days[t.Weekday()] {
+		return true
+	}
+	m := t.Hour()*60 + t.Minute()
+	switch {
+	case h.start < h.end:
+		return h.start <= m && m < h.end
+	case h.start > h.end:
+		return m >= h.start || m < h.end
+	}
+	return false
+}
+
+// endOf returns the time the quiet hours the time is in are over, which
+// is the time itself if it's not quiet.
+func (h *quietHours) endOf(t time.Time) time.Time {
+	// The quiet hours are on the minute boundaries & last a week at most.
+	for i := 0; i <= 8*24*60; i++ {
+		if !h.contains(t) {
+			return t
+		}
+		t = t.Truncate(time.Minute).Add(time.Minute)
+	}
+	return time.Time{}
+}
+
+// nextEnd returns the next time after t the quiet hours are over.
+func (h *quietHours) nextEnd(t time.Time) time.Time {
+	t = t.Truncate(time.Minute)
+	quiet := h.contains(t)
+	for i := 0; i <= 8*24*60; i++ {
+		t = t.Add(time.Minute)
+		if !h.contains(t) && quiet {
+			return t
+		}
+		quiet = h.contains(t)
+	}
+	return time.Time{}
+}
+
+// quietSchedule defers the activations of the schedule in the quiet hours
+// to the end of them, so that the digests held in the quiet hours are
+// sent when they're over. It activates at the end of every quiet hours
+// if the schedule is nil.
+type quietSchedule struct {
+	Schedule
+	quiet *quietHours
+}
+
+func (s quietSchedule) Next(t time.Time) time.Time {
+	if s.Schedule == nil {
+		return s.quiet.nextEnd(t)
+	}
+	next := s.Schedule.Next(t)
+	if next.IsZero() {
+		return next
+	}
+	return s.quiet.endOf(next)
+}
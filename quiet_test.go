@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/maxnilz/feed/errors"
+)
+
+func TestQuietHours(t *testing.T) {
+	quiet, err := newQuietHours(&QuietHours{Start: "22:00", End: "07:30", Days: []string{"Sunday"}}, "Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	loc := quiet.loc
+	at := func(day, hour, min int) time.Time {
+		// 2024-01-01 is a monday.
+		return time.Date(2024, 1, day, hour, min, 0, 0, loc)
+	}
+	for _, tt := range []struct {
+		t     time.Time
+		quiet bool
+		end   time.Time
+	}{
+		{at(1, 12, 0), false, at(1, 12, 0)},
+		{at(1, 22, 0), true, at(2, 7, 30)},
+		{at(2, 7, 29), true, at(2, 7, 30)},
+		{at(2, 7, 30), false, at(2, 7, 30)},
+		// the quiet hours of saturday night last until monday morning.
+		{at(6, 23, 0), true, at(8, 7, 30)},
+		{at(7, 12, 0), true, at(8, 7, 30)},
+	} {
+		if got := quiet.contains(tt.t); got != tt.quiet {
+			t.Fatalf("expect %v quiet %v, got %v", tt.t, tt.quiet, got)
+		}
+		if got := quiet.endOf(tt.t); !got.Equal(tt.end) {
+			t.Fatalf("expect the quiet hours of %v end at %v, got %v", tt.t, tt.end, got)
+		}
+	}
+	// the time zone of the quiet hours is the one of the subscriber.
+	if !quiet.contains(time.Date(2024, 1, 1, 21, 30, 0, 0, time.UTC)) {
+		t.Fatal("expect 22:30 in Berlin quiet")
+	}
+	if got := quiet.nextEnd(at(1, 12, 0)); !got.Equal(at(2, 7, 30)) {
+		t.Fatalf("unexpected next end %v", got)
+	}
+
+	schedule, err := newJobSchedule("", JobOptions{Quiet: quiet})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := schedule.Next(at(2, 7, 30)); !got.Equal(at(3, 7, 30)) {
+		t.Fatalf("expect the schedule without spec at the next end, got %v", got)
+	}
+	schedule, err = newJobSchedule("CRON_TZ=Europe/Berlin 0 * * * *", JobOptions{Quiet: quiet})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := schedule.Next(at(1, 21, 30)); !got.Equal(at(2, 7, 30)) {
+		t.Fatalf("expect the activation deferred to the end, got %v", got)
+	}
+	if got := schedule.Next(at(2, 7, 30)); !got.Equal(at(2, 8, 0)) {
+		t.Fatalf("unexpected activation out of the quiet hours %v", got)
+	}
+
+	for _, q := range []QuietHours{
+		{Start: "22:00"},
+		{Start: "25:00", End: "07:00"},
+		{Days: []string{"someday"}},
+		{Days: []string{"mon", "tue", "wed", "thu", "fri", "sat", "sun"}},
+		{},
+		{Start: "22:00", End: "22:00"},
+	} {
+		if _, err = newQuietHours(&q, ""); errors.Code(err) != errors.InvalidArgument {
+			t.Fatalf("expect invalid quiet hours %+v, got %v", q, err)
+		}
+	}
+	if _, err = newQuietHours(&QuietHours{}, "Mars/Olympus"); errors.Code(err) != errors.InvalidArgument {
+		t.Fatalf("expect invalid timezone, got %v", err)
+	}
+}
+
+func TestZonedSpec(t *testing.T) {
+	subscriber := Subscriber{Timezone: "Asia/Tokyo"}
+	for spec, expected := range map[string]string{
+		"0 9 * * *":             "CRON_TZ=Asia/Tokyo 0 9 * * *",
+		"CRON_TZ=UTC 0 9 * * *": "CRON_TZ=UTC 0 9 * * *",
+		"R/2024-01-01T07:15/PT6H; CRON_TZ=UTC 0 9 * * *": "CRON_TZ=Asia/Tokyo R/2024-01-01T07:15/PT6H; CRON_TZ=UTC 0 9 * * *",
+		"": "",
+	} {
+		if got := subscriber.ZonedSpec(spec); got != expected {
+			t.Fatalf("expect %q, got %q", expected, got)
+		}
+	}
+	schedule, err := parseSchedule(subscriber.ZonedSpec("0 9 * * *"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := schedule.Next(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	if !next.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Add(24 * time.Hour)) {
+		t.Fatalf("expect 9:00 in Tokyo, got %v", next.UTC())
+	}
+}
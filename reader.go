@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"hash/crc32"
+	"sort"
+	"time"
+)
+
+// readerAccount is a subscriber signed in the reader apis, i.e., the
+// Fever & Google Reader compatible ones.
+type readerAccount struct {
+	subscriber Subscriber
+	feeds      []readerFeed
+	feedsById  map[int64]readerFeed
+	feedsByURL map[string]readerFeed
+}
+
+// readerFeed is a site url subscribed, a site with several urls is listed
+// as several feeds since the items are saved by the url.
+type readerFeed struct {
+	Id    int64
+	URL   string
+	Title string
+	Group string
+}
+
+// newReaderAccount returns the account of the subscriber, the accounts
+// are built per request so that the changes of the subscribers apply.
+func newReaderAccount(subscriber Subscriber) *readerAccount {
+	a := &readerAccount{
+		subscriber: subscriber,
+		feedsById:  make(map[int64]readerFeed),
+		feedsByURL: make(map[string]readerFeed),
+	}
+	for _, site := range subscriber.Sites {
+		for _, endpoint := range append([]string{site.URL}, site.URLs...) {
+			if siteURL, ok := inboundSiteURL(endpoint); ok {
+				endpoint = siteURL
+			}
+			if endpoint == "" {
+				continue
+			}
+			if _, ok := a.feedsByURL[endpoint]; ok {
+				continue
+			}
+			f := readerFeed{Id: readerId(endpoint), URL: endpoint, Title: site.Name, Group: site.Group}
+			a.feeds = append(a.feeds, f)
+			a.feedsById[f.Id] = f
+			a.feedsByURL[f.URL] = f
+		}
+	}
+	return a
+}
+
+// readerId derives the stable numeric id the reader clients require from
+// the url of a feed or the name of a group.
+func readerId(s string) int64 {
+	return int64(crc32.ChecksumIEEE([]byte(s)) & 0x7fffffff)
+}
+
+// groups returns the site groups of the account in name order.
+func (a *readerAccount) groups() []string {
+	seen := make(map[string]bool)
+	var groups []string
+	for _, f := range a.feeds {
+		if f.Group != "" && !seen[f.Group] {
+			seen[f.Group] = true
+			groups = append(groups, f.Group)
+		}
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+// siteURLs returns the feed urls in the group, or all of them if the
+// group is empty.
+func (a *readerAccount) siteURLs(group string) []string {
+	var urls []string
+	for _, f := range a.feeds {
+		if group == "" || f.Group == group {
+			urls = append(urls, f.URL)
+		}
+	}
+	return urls
+}
+
+// query returns the item query limited to the subscribed sites, the items
+// of the sites no longer subscribed are not served.
+func (a *readerAccount) query(sites []string) ItemQuery {
+	if len(sites) == 0 {
+		sites = a.siteURLs("")
+	}
+	return ItemQuery{Email: a.subscriber.Email, Sites: sites}
+}
+
+// markItems changes the state of the items matched by the query.
+func markItems(ctx context.Context, storage Storage, query ItemQuery, change ItemChange) error {
+	ses, err := storage.NewSession(ctx)
+	if err != nil {
+		return err
+	}
+	if ses, err = ses.Begin(); err != nil {
+		return err
+	}
+	refs, err := storage.GetItemRefs(ses, query)
+	if err != nil {
+		_ = ses.Rollback()
+		return err
+	}
+	seqs := make([]int64, 0, len(refs))
+	for _, ref := range refs {
+		seqs = append(seqs, ref.Seq)
+	}
+	if err = storage.UpdateItems(ses, query.Email, seqs, change, time.Now()); err != nil {
+		_ = ses.Rollback()
+		return err
+	}
+	return ses.Commit()
+}
+
+func boolPtr(v bool) *bool {
+	return &v
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func newTestReaderServer(t *testing.T) (*sqllite, *httptest.Server) {
+	s := newTestSQLite(t)
+	cfg := Config{Subscribers: []Subscriber{{
+		Name:           "foo",
+		Email:          "foo@example.com",
+		ReaderPassword: "s3cr3t",
+		Sites: []Site{
+			{Name: "site 0", URL: "https://site0.com/index.rss", Group: "tech"},
+			{Name: "site 1", URL: "https://site1.com/index.rss"},
+		},
+	}}}
+	feeds := makeTestFeeds("foo@example.com", 2, 2, "hello")
+	ses, _ := s.NewAutoSession(context.Background())
+	if err := s.SaveFeeds(ses, feeds.List...); err != nil {
+		t.Fatal(err)
+	}
+	subscribers := NewSubscribers(cfg.Subscribers)
+	server, err := NewServer(cfg, DiscardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Handle("/fever/", NewFever(subscribers, s, DiscardLogger))
+	server.Handle("/greader/", NewGReader(subscribers, s, DiscardLogger))
+	ts := httptest.NewServer(server)
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+func TestFever(t *testing.T) {
+	s, ts := newTestReaderServer(t)
+	call := func(query string, form url.Values) map[string]interface{} {
+		resp, err := http.PostForm(ts.URL+"/fever/?api&"+query, form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var out map[string]interface{}
+		if err = json.NewDecoder(resp.Body).Decode(&out); err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	if out := call("", url.Values{"api_key": {"wrong"}}); out["auth"] != 0.0 || out["api_version"] != 3.0 {
+		t.Fatalf("expected unauthenticated, got %v", out)
+	}
+	key := url.Values{"api_key": {feverAPIKey("foo@example.com", "s3cr3t")}}
+
+	out := call("groups&feeds", key)
+	if out["auth"] != 1.0 || len(out["groups"].([]interface{})) != 1 || len(out["feeds"].([]interface{})) != 2 {
+		t.Fatalf("unexpected groups & feeds: %v", out)
+	}
+	out = call("items", key)
+	items := out["items"].([]interface{})
+	if out["total_items"] != 4.0 || len(items) != 4 {
+		t.Fatalf("expected 4 items, got %v", out)
+	}
+	first := items[0].(map[string]interface{})
+	id := jsonString(first["id"])
+	if out = call("items&since_id="+id, key); len(out["items"].([]interface{})) != 3 {
+		t.Fatalf("expected 3 items since %s, got %v", id, out)
+	}
+
+	// Mark an item as read & saved, & the items of site 0 before now as
+	// read, which acks them too.
+	out = call("unread_item_ids&saved_item_ids", withForm(key, "mark", "item", "as", "saved", "id", id))
+	if out["saved_item_ids"] != id || strings.Count(out["unread_item_ids"].(string), ",") != 3 {
+		t.Fatalf("unexpected item ids: %v", out)
+	}
+	feedId := jsonString(first["feed_id"])
+	out = call("unread_item_ids", withForm(key, "mark", "feed", "as", "read", "id", feedId, "before", "99999999999"))
+	if strings.Count(out["unread_item_ids"].(string), ",") != 1 {
+		t.Fatalf("expected 2 unread items, got %v", out)
+	}
+	if n := countAckedFeeds(t, s); n != 2 {
+		t.Fatalf("expected 2 acked feeds, got %d", n)
+	}
+}
+
+func TestGReader(t *testing.T) {
+	s, ts := newTestReaderServer(t)
+	resp, err := http.PostForm(ts.URL+"/greader/accounts/ClientLogin", url.Values{"Email": {"foo@example.com"}, "Passwd": {"wrong"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", resp.StatusCode)
+	}
+	resp, err = http.PostForm(ts.URL+"/greader/accounts/ClientLogin", url.Values{"Email": {"foo@example.com"}, "Passwd": {"s3cr3t"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	_, auth, ok := strings.Cut(string(body), "Auth=")
+	if !ok {
+		t.Fatalf("expected auth token, got %s", body)
+	}
+	auth = strings.TrimSpace(auth)
+
+	call := func(method, path string, form url.Values, out interface{}) int {
+		req, _ := http.NewRequest(method, ts.URL+"/greader/reader/api/0/"+path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "GoogleLogin auth="+auth)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if out != nil {
+			if err = json.NewDecoder(resp.Body).Decode(out); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode
+	}
+
+	var subs struct {
+		Subscriptions []struct {
+			Id         string
+			Categories []struct{ Label string }
+		}
+	}
+	if call(http.MethodGet, "subscription/list?output=json", nil, &subs); len(subs.Subscriptions) != 2 ||
+		subs.Subscriptions[0].Id != "feed/https://site0.com/index.rss" || subs.Subscriptions[0].Categories[0].Label != "tech" {
+		t.Fatalf("unexpected subscriptions: %+v", subs)
+	}
+
+	var ids struct {
+		ItemRefs     []struct{ Id string }
+		Continuation string
+	}
+	call(http.MethodGet, "stream/items/ids?s="+greaderReadingList+"&n=3", nil, &ids)
+	if len(ids.ItemRefs) != 3 || ids.Continuation == "" {
+		t.Fatalf("expected 3 items & a continuation, got %+v", ids)
+	}
+	c := ids.Continuation
+	ids.Continuation = ""
+	call(http.MethodGet, "stream/items/ids?s="+greaderReadingList+"&n=3&c="+c, nil, &ids)
+	if len(ids.ItemRefs) != 1 || ids.Continuation != "" {
+		t.Fatalf("expected the last item, got %+v", ids)
+	}
+
+	var contents struct {
+		Items []struct {
+			Id         string
+			Categories []string
+		}
+	}
+	call(http.MethodPost, "stream/items/contents", url.Values{"i": {ids.ItemRefs[0].Id}}, &contents)
+	if len(contents.Items) != 1 || !strings.HasPrefix(contents.Items[0].Id, greaderItemPrefix) {
+		t.Fatalf("unexpected contents: %+v", contents)
+	}
+	if status := call(http.MethodPost, "edit-tag", url.Values{"i": {contents.Items[0].Id}, "a": {"user/-/state/com.google/read"}}, nil); status != http.StatusOK {
+		t.Fatalf("edit-tag failed with %d", status)
+	}
+	call(http.MethodGet, "stream/contents/"+url.PathEscape(greaderRead), nil, &contents)
+	if len(contents.Items) != 1 {
+		t.Fatalf("expected 1 read item, got %+v", contents)
+	}
+
+	if status := call(http.MethodPost, "mark-all-as-read", url.Values{"s": {greaderLabelPrefix + "tech"}}, nil); status != http.StatusOK {
+		t.Fatalf("mark-all-as-read failed with %d", status)
+	}
+	var counts struct {
+		UnreadCounts []struct {
+			Id    string
+			Count int
+		}
+	}
+	call(http.MethodGet, "unread-count", nil, &counts)
+	for _, c := range counts.UnreadCounts {
+		if c.Id == greaderReadingList && c.Count != 2 {
+			t.Fatalf("expected 2 unread items, got %d", c.Count)
+		}
+	}
+	if n := countAckedFeeds(t, s); n != 2 {
+		t.Fatalf("expected 2 acked feeds, got %d", n)
+	}
+	if status := call(http.MethodPost, "subscription/quickadd", url.Values{"quickadd": {"https://example.com"}}, nil); status != http.StatusNotImplemented {
+		t.Fatalf("expected 501, got %d", status)
+	}
+}
+
+func withForm(form url.Values, kvs ...string) url.Values {
+	out := url.Values{}
+	for k, v := range form {
+		out[k] = v
+	}
+	for i := 0; i+1 < len(kvs); i += 2 {
+		out.Set(kvs[i], kvs[i+1])
+	}
+	return out
+}
+
+func jsonString(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
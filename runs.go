@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maxnilz/feed/errors"
+)
+
+type runRecorderKey struct{}
+
+// runRecorder collects what a run of a job does, the scheduler passes it
+// to the job in the context & saves the run in the history when it's
+// done.
+type runRecorder struct {
+	mu  sync.Mutex
+	run JobRun
+}
+
+func withRunRecorder(ctx context.Context, r *runRecorder) context.Context {
+	return context.WithValue(ctx, runRecorderKey{}, r)
+}
+
+// recordRun applies the change to the run recorded in the context, it's
+// a no-op if the job is not run by the scheduler.
+func recordRun(ctx context.Context, fn func(run *JobRun)) {
+	r, ok := ctx.Value(runRecorderKey{}).(*runRecorder)
+	if !ok {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fn(&r.run)
+}
+
+// recordSiteError records the error the site url failed by.
+func recordSiteError(ctx context.Context, site string, err error) {
+	recordRun(ctx, func(run *JobRun) {
+		run.SiteErrors = append(run.SiteErrors, SiteError{Site: site, Code: errors.Code(err).String(), Error: err.Error()})
+	})
+}
+
+func (r *runRecorder) snapshot() JobRun {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	run := r.run
+	run.SiteErrors = append([]SiteError(nil), r.run.SiteErrors...)
+	return run
+}
+
+// countingReader counts the bytes read into the run recorded in the
+// context.
+type countingReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	recordRun(c.ctx, func(run *JobRun) { run.Bytes += int64(n) })
+	return n, err
+}
+
+// Runs serves the run history of the scheduled jobs.
+type Runs struct {
+	storage Storage
+	logger  Logger
+}
+
+func NewRuns(storage Storage, logger Logger) *Runs {
+	return &Runs{storage: storage, logger: logger}
+}
+
+func (r *Runs) List(ctx context.Context, query JobRunQuery) ([]*JobRun, error) {
+	ses, err := r.storage.NewAutoSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return r.storage.GetJobRuns(ses, query)
+}
+
+func (r *Runs) Get(ctx context.Context, id int64) (*JobRun, error) {
+	ses, err := r.storage.NewAutoSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return r.storage.GetJobRun(ses, id)
+}
+
+// Prune deletes the runs started more than the age ago.
+func (r *Runs) Prune(ctx context.Context, age time.Duration) (int64, error) {
+	if age <= 0 {
+		return 0, errors.Newf(errors.InvalidArgument, nil, "invalid age %v to prune the runs", age)
+	}
+	ses, err := r.storage.NewAutoSession(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return r.storage.PruneJobRuns(ses, time.Now().Add(-age))
+}
+
+// RunsAPI serves the json api of the run history at /api/runs[/<id>],
+// the admin token of the server is required as a bearer token, the api
+// is disabled without it.
+type RunsAPI struct {
+	token  string
+	runs   *Runs
+	logger Logger
+}
+
+func NewRunsAPI(cfg Config, runs *Runs, logger Logger) *RunsAPI {
+	return &RunsAPI{token: cfg.Server.AdminToken, runs: runs, logger: logger}
+}
+
+func (a *RunsAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if a.token == "" || !validBearer(r, a.token) {
+		writeError(w, a.logger, errors.Newf(errors.NotFound, nil, "not found"))
+		return
+	}
+	var err error
+	if id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/runs"), "/"); id != "" {
+		err = a.serveRun(w, r, id)
+	} else {
+		err = a.serveRuns(w, r)
+	}
+	if err != nil {
+		writeError(w, a.logger, err)
+	}
+}
+
+// serveRuns lists the runs filtered by the job, the subscriber & the
+// outcome in the query, or prunes the ones older than the age in the
+// query, e.g., DELETE /api/runs?olderThan=720h.
+func (a *RunsAPI) serveRuns(w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	switch r.Method {
+	case http.MethodGet:
+		limit, _ := strconv.Atoi(q.Get("limit"))
+		runs, err := a.runs.List(r.Context(), JobRunQuery{
+			Job:        q.Get("job"),
+			Subscriber: q.Get("subscriber"),
+			Outcome:    q.Get("outcome"),
+			Limit:      pageLimit(limit),
+		})
+		if err != nil {
+			return err
+		}
+		if runs == nil {
+			runs = []*JobRun{}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"runs": runs})
+		return nil
+	case http.MethodDelete:
+		age, err := time.ParseDuration(q.Get("olderThan"))
+		if err != nil {
+			return errors.Newf(errors.InvalidArgument, err, "invalid age %q", q.Get("olderThan"))
+		}
+		n, err := a.runs.Prune(r.Context(), age)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusOK, map[string]int64{"deleted": n})
+		return nil
+	default:
+		return methodNotAllowed(w, "GET, DELETE")
+	}
+}
+
+func (a *RunsAPI) serveRun(w http.ResponseWriter, r *http.Request, s string) error {
+	if r.Method != http.MethodGet {
+		return methodNotAllowed(w, "GET")
+	}
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return errors.Newf(errors.NotFound, nil, "run %s not found", s)
+	}
+	run, err := a.runs.Get(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, run)
+	return nil
+}
+
+func formatRuns(runs []*JobRun) string {
+	sb := strings.Builder{}
+	sb.WriteString(fmt.Sprintf("Total Runs: %d\n", len(runs)))
+	sb.WriteString("Id | Job | Started At | Duration | Outcome | Sites | Found | Filtered | Sent | Bytes | Site Errors\n")
+	sb.WriteString(strings.Repeat("-", 60))
+	sb.WriteString("\n")
+	for _, run := range runs {
+		sb.WriteString(fmt.Sprintf("%d | %s | %s | %v | %s | %d | %d | %d | %d | %d | %d\n",
+			run.Id, run.Job, run.StartedAt.Local().Format(time.RFC3339), run.Duration, run.Outcome,
+			run.Sites, run.Found, run.Filtered, run.Sent, run.Bytes, len(run.SiteErrors)))
+	}
+	return sb.String()
+}
+
+func formatRun(run *JobRun) string {
+	sb := strings.Builder{}
+	sb.WriteString(fmt.Sprintf("Id: %d\nJob: %s\nSubscriber: %s\n", run.Id, run.Job, run.Subscriber))
+	sb.WriteString(fmt.Sprintf("Started At: %s\nEnded At: %s\nDuration: %v\n",
+		run.StartedAt.Local().Format(time.RFC3339), run.EndedAt.Local().Format(time.RFC3339), run.Duration))
+	sb.WriteString(fmt.Sprintf("Outcome: %s\n", run.Outcome))
+	if run.Trigger != "" {
+		sb.WriteString(fmt.Sprintf("Trigger: %s\n", run.Trigger))
+	}
+	if run.Error != "" {
+		sb.WriteString(fmt.Sprintf("Error: %s\n", run.Error))
+	}
+	sb.WriteString(fmt.Sprintf("Sites: %d\nFound: %d\nFiltered: %d\nSent: %d\nBytes: %d\n",
+		run.Sites, run.Found, run.Filtered, run.Sent, run.Bytes))
+	for _, e := range run.SiteErrors {
+		sb.WriteString(fmt.Sprintf("Site Error: %s | %s | %s\n", e.Site, e.Code, e.Error))
+	}
+	return sb.String()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJobRuns(t *testing.T) {
+	feedServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bad" {
+			http.Error(w, "oops", http.StatusInternalServerError)
+			return
+		}
+		_, _ = fmt.Fprint(w, `<?xml version="1.0"?><rss version="2.0"><channel><title>foo</title>`)
+		for i := 0; i < 3; i++ {
+			_, _ = fmt.Fprintf(w, `<item><guid>%d</guid><title>post %d</title><pubDate>Sat, 22 Jul 2023 07:0%d:00 +0000</pubDate></item>`, i, i, i)
+		}
+		_, _ = fmt.Fprint(w, `</channel></rss>`)
+	}))
+	defer feedServer.Close()
+
+	subscriber := Subscriber{
+		Name:      "foo",
+		Email:     "foo@example.com",
+		Sites:     []Site{{Name: "Bad", URL: feedServer.URL + "/bad"}, {Name: "Foo", URL: feedServer.URL + "/ok"}},
+		Notifiers: []NotifierConfig{{Type: NotifierMaildir, Path: filepath.Join(t.TempDir(), "Maildir")}},
+	}
+	cfg := Config{Subscribers: []Subscriber{subscriber}, Server: ServerConfig{AdminToken: "s3cret"}}
+	s := newTestSQLite(t)
+	notifiers, err := NewNotifiers(cfg, DiscardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	worker, err := NewWorker(subscriber, s, notifiers, NewOutbox(cfg, s, notifiers, DiscardLogger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduler := NewScheduler(s, DiscardLogger)
+	if _, err = scheduler.Schedule("0 0 1 1 *", worker); err != nil {
+		t.Fatal(err)
+	}
+	// the site failed doesn't stop the other one.
+	for i := 0; i < 2; i++ {
+		scheduler.Lock()
+		scheduler.startJob(context.Background(), scheduler.jobs[0], time.Now(), "")
+		scheduler.Unlock()
+		scheduler.Stop()
+	}
+
+	runs := NewRuns(s, DiscardLogger)
+	ctx := context.Background()
+	list, err := runs.List(ctx, JobRunQuery{Job: "foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("expect 2 runs, got %d", len(list))
+	}
+	first, second := list[1], list[0]
+	if first.Subscriber != "foo" || first.Outcome != RunFailed || first.Sites != 2 || first.Found != 3 ||
+		first.Filtered != 0 || first.Sent != 3 || first.Bytes == 0 || len(first.SiteErrors) != 1 {
+		t.Fatalf("unexpected first run: %+v", first)
+	}
+	if e := first.SiteErrors[0]; e.Site != feedServer.URL+"/bad" || e.Code != "Internal" || !strings.Contains(e.Error, "500") {
+		t.Fatalf("unexpected site error: %+v", e)
+	}
+	if second.Found != 3 || second.Filtered != 3 || second.Sent != 0 {
+		t.Fatalf("expect the seen items filtered, got %+v", second)
+	}
+	if list, _ = runs.List(ctx, JobRunQuery{Outcome: RunOK}); len(list) != 0 {
+		t.Fatalf("unexpected runs succeeded: %+v", list)
+	}
+
+	api := NewRunsAPI(cfg, runs, DiscardLogger)
+	serve := func(method, path, token string) (int, []byte) {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, req)
+		return rec.Code, rec.Body.Bytes()
+	}
+	if status, _ := serve(http.MethodGet, "/api/runs", "wrong"); status != http.StatusNotFound {
+		t.Fatalf("expect 404 with a wrong token, got %d", status)
+	}
+	status, body := serve(http.MethodGet, fmt.Sprintf("/api/runs/%d", first.Id), "s3cret")
+	var run JobRun
+	if err = json.Unmarshal(body, &run); err != nil || status != http.StatusOK || run.Id != first.Id || len(run.SiteErrors) != 1 {
+		t.Fatalf("unexpected run: %d %s", status, body)
+	}
+	if status, _ = serve(http.MethodGet, "/api/runs/404", "s3cret"); status != http.StatusNotFound {
+		t.Fatalf("expect 404 on an unknown run, got %d", status)
+	}
+	if status, body = serve(http.MethodDelete, "/api/runs?olderThan=1h", "s3cret"); status != http.StatusOK || !bytes.Contains(body, []byte(`"deleted":0`)) {
+		t.Fatalf("unexpected prune: %d %s", status, body)
+	}
+
+	var out bytes.Buffer
+	if err = runRunsCommand(ctx, &out, runs, []string{"list", "-subscriber", "foo"}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Total Runs: 2") {
+		t.Fatalf("unexpected runs list:\n%s", out.String())
+	}
+	out.Reset()
+	if err = runRunsCommand(ctx, &out, runs, []string{"show", fmt.Sprint(first.Id)}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Site Error: "+feedServer.URL+"/bad | Internal") {
+		t.Fatalf("unexpected run details:\n%s", out.String())
+	}
+
+	// prune the runs started before now.
+	ses, _ := s.NewAutoSession(ctx)
+	if n, err := s.PruneJobRuns(ses, time.Now().Add(time.Second)); err != nil || n != 2 {
+		t.Fatalf("expect 2 runs pruned, got %d %v", n, err)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+var (
+	// sanitizeTags are the elements kept by sanitizeHTML with the
+	// attributes allowed on them.
+	sanitizeTags = map[string][]string{
+		"a": {"href", "title"}, "abbr": {"title"}, "b": nil, "blockquote": nil, "br": nil,
+		"caption": nil, "code": nil, "dd": nil, "del": nil, "div": nil, "dl": nil, "dt": nil,
+		"em": nil, "figcaption": nil, "figure": nil, "h1": nil, "h2": nil, "h3": nil, "h4": nil,
+		"h5": nil, "h6": nil, "hr": nil, "i": nil, "img": {"src", "alt", "title", "width", "height"},
+		"ins": nil, "kbd": nil, "li": nil, "mark": nil, "ol": nil, "p": nil, "pre": nil, "q": nil,
+		"s": nil, "small": nil, "span": nil, "strong": nil, "sub": nil, "sup": nil, "table": nil,
+		"tbody": nil, "td": {"colspan", "rowspan"}, "tfoot": nil, "th": {"colspan", "rowspan"},
+		"thead": nil, "tr": nil, "u": nil, "ul": nil,
+	}
+	// sanitizeDropped are the elements dropped along with their content.
+	sanitizeDropped = map[string]bool{
+		"script": true, "style": true, "iframe": true, "object": true, "embed": true, "noscript": true,
+		"template": true, "svg": true, "math": true, "form": true, "textarea": true, "select": true,
+		"head": true, "title": true,
+	}
+)
+
+// sanitizeHTML returns the html of the item content with the allowed
+// elements & attributes only, e.g., the scripts, the styles & the event
+// handlers are dropped. The relative links are resolved against the base
+// url, & the links other than http, https & mailto are dropped.
+func sanitizeHTML(s string, base *url.URL) string {
+	z := html.NewTokenizer(strings.NewReader(s))
+	var sb strings.Builder
+	var open []string
+	dropped := 0
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		tok := z.Token()
+		switch tt {
+		case html.TextToken:
+			if dropped == 0 {
+				sb.WriteString(html.EscapeString(tok.Data))
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if sanitizeDropped[tok.Data] {
+				if tt == html.StartTagToken {
+					dropped++
+				}
+				continue
+			}
+			attrs, ok := sanitizeTags[tok.Data]
+			if !ok || dropped > 0 {
+				continue
+			}
+			sb.WriteString("<" + tok.Data)
+			for _, attr := range tok.Attr {
+				if !contains(attrs, attr.Key) {
+					continue
+				}
+				val := attr.Val
+				if attr.Key == "href" || attr.Key == "src" {
+					if val = sanitizeURL(val, base); val == "" {
+						continue
+					}
+				}
+				sb.WriteString(" " + attr.Key + "=\"" + html.EscapeString(val) + "\"")
+			}
+			if tok.Data == "a" {
+				sb.WriteString(` rel="noopener noreferrer" target="_blank"`)
+			}
+			sb.WriteString(">")
+			if tt == html.StartTagToken && !voidElement(tok.Data) {
+				open = append(open, tok.Data)
+			}
+		case html.EndTagToken:
+			if sanitizeDropped[tok.Data] {
+				if dropped > 0 {
+					dropped--
+				}
+				continue
+			}
+			// The end tags close the open elements up to the matched one,
+			// the unmatched ones are ignored so the output is balanced.
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i] != tok.Data {
+					continue
+				}
+				for j := len(open) - 1; j >= i; j-- {
+					sb.WriteString("</" + open[j] + ">")
+				}
+				open = open[:i]
+				break
+			}
+		}
+	}
+	for i := len(open) - 1; i >= 0; i-- {
+		sb.WriteString("</" + open[i] + ">")
+	}
+	return sb.String()
+}
+
+func sanitizeURL(raw string, base *url.URL) string {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return ""
+	}
+	if base != nil {
+		u = base.ResolveReference(u)
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https", "mailto":
+		return u.String()
+	}
+	return ""
+}
+
+func voidElement(tag string) bool {
+	switch tag {
+	case "br", "hr", "img":
+		return true
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, it := range list {
+		if it == s {
+			return true
+		}
+	}
+	return false
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"math/rand"
 	"sort"
 	"sync"
 	"time"
@@ -15,40 +16,419 @@ type Job interface {
 	Run(ctx context.Context) error
 }
 
-func NewScheduler(logger Logger) *Scheduler {
+// NewScheduler returns the scheduler which keeps the states of the jobs
+// in the storage, they're kept in memory only if the storage is nil.
+func NewScheduler(storage Storage, logger Logger) *Scheduler {
 	return &Scheduler{
 		Mutex:     sync.Mutex{},
 		jobWaiter: sync.WaitGroup{},
+		changed:   make(chan struct{}, 1),
+		storage:   storage,
 		logger:    logger,
 	}
 }
 
+// Scheduler runs the jobs by their cron specs. The jobs can be added,
+// removed, paused, resumed & rescheduled while it's running, the run
+// loop is woken up to pick the changes up.
 type Scheduler struct {
-	jobs []*CronJob
+	jobs   []*CronJob
+	nextID EntryID
 
 	sync.Mutex
-	running   bool
+	running bool
+	// ctx is the context the scheduler is started with, which the runs
+	// triggered manually run in.
+	ctx       context.Context
 	jobWaiter sync.WaitGroup
+	// changed wakes the run loop up when the jobs are changed.
+	changed chan struct{}
 
-	logger Logger
+	storage Storage
+	elector *Elector
+	logger  Logger
 }
 
-func (s *Scheduler) Schedule(spec string, job Job) error {
-	schedule, err := cron.ParseStandard(spec)
+// SetElector makes the scheduler run the jobs only while the replica is
+// the leader elected by the elector, it's called before the start.
+func (s *Scheduler) SetElector(elector *Elector) {
+	s.elector = elector
+}
+
+// maxSleep bounds how long the run loop sleeps, the timers don't count
+// the time the system is suspended, so the wall clock is checked at least
+// that often to notice the runs due meanwhile.
+const maxSleep = time.Minute
+
+const (
+	// OverlapSkip skips the run if the last run of the job is still in
+	// progress, it's the default.
+	OverlapSkip = "skip"
+	// OverlapQueue runs the job right after the last run in progress, at
+	// most one run is queued.
+	OverlapQueue = "queue"
+	// OverlapAllow runs the job regardless of the runs in progress.
+	OverlapAllow = "allow"
+)
+
+func validateOverlap(overlap string) error {
+	switch overlap {
+	case "", OverlapSkip, OverlapQueue, OverlapAllow:
+		return nil
+	}
+	return errors.Newf(errors.InvalidArgument, nil, "unknown overlap policy %q", overlap)
+}
+
+const (
+	// CatchUpIgnore ignores the runs missed while the scheduler is not
+	// running or the system is suspended, it's the default.
+	CatchUpIgnore = "ignore"
+	// CatchUpOnce runs the job once right away if any run is missed.
+	CatchUpOnce = "once"
+)
+
+func validateCatchUp(catchUp string) error {
+	switch catchUp {
+	case "", CatchUpIgnore, CatchUpOnce:
+		return nil
+	}
+	return errors.Newf(errors.InvalidArgument, nil, "unknown catch-up policy %q", catchUp)
+}
+
+// JobOptions are the options of how a job is run.
+type JobOptions struct {
+	// Overlap is one of skip, queue & allow, it defaults to skip.
+	Overlap string
+	// Timeout cancels the context of a run which takes longer, it's
+	// unlimited if zero.
+	Timeout time.Duration
+	// Jitter delays every run by a random duration up to it.
+	Jitter time.Duration
+	// Quiet defers the runs in the quiet hours to the end of them, the job
+	// runs at the end of every quiet hours if the spec is empty.
+	Quiet *quietHours
+	// CatchUp is one of ignore & once, it defaults to ignore.
+	CatchUp string
+	// Schedule overrides the spec if set, e.g., the fetches polled
+	// adaptively.
+	Schedule Schedule
+}
+
+// EntryID identifies a scheduled job, it's unique in the scheduler.
+type EntryID int
+
+// Entry is a snapshot of a scheduled job.
+type Entry struct {
+	ID     EntryID
+	Name   string
+	Spec   string
+	Paused bool
+	// Next is the time the job runs next, it's zero if the scheduler
+	// isn't running or the job is paused. Prev is the time it last ran,
+	// which is kept across the restarts along with the outcome & the
+	// duration of the last run finished.
+	Next     time.Time
+	Prev     time.Time
+	Outcome  string
+	Duration time.Duration
+	// Running is the number of the runs in progress.
+	Running int
+	// Runs, Skipped & TimedOut are the number of the runs started, the
+	// ones skipped due to the overlap policy & the ones timed out.
+	Runs     int
+	Skipped  int
+	TimedOut int
+}
+
+// Schedule adds the job run by the spec with the default options & returns
+// the id of the entry.
+func (s *Scheduler) Schedule(spec string, job Job) (EntryID, error) {
+	return s.ScheduleJob(spec, job, JobOptions{})
+}
+
+// ScheduleJob adds the job run by the spec & the options, & returns the
+// id of the entry.
+func (s *Scheduler) ScheduleJob(spec string, job Job, opts JobOptions) (EntryID, error) {
+	schedule, err := newJobSchedule(spec, opts)
+	if err != nil {
+		return 0, err
+	}
+	if err = validateOverlap(opts.Overlap); err != nil {
+		return 0, err
+	}
+	if err = validateCatchUp(opts.CatchUp); err != nil {
+		return 0, err
+	}
+	it := &CronJob{Job: job, Spec: spec, Schedule: schedule, opts: opts}
+	if err = s.restore(it); err != nil {
+		return 0, err
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.nextID++
+	it.ID = s.nextID
+	if s.running {
+		it.Next = it.first(time.Now())
+		s.logger.Info("schedule", "job", job.Name(), "next", it.Next)
+	}
+	s.jobs = append(s.jobs, it)
+	s.notifyChanged()
+	return it.ID, nil
+}
+
+// restore loads the state of the last run of the job from the storage.
+func (s *Scheduler) restore(it *CronJob) error {
+	if s.storage == nil {
+		return nil
+	}
+	ses, err := s.storage.NewAutoSession(context.Background())
+	if err != nil {
+		return err
+	}
+	state, err := s.storage.GetJobState(ses, it.Job.Name())
 	if err != nil {
-		return errors.Newf(errors.InvalidArgument, err, "invalid cron spec")
+		return err
 	}
-	s.jobs = append(s.jobs, &CronJob{Job: job, Schedule: schedule})
+	it.Prev, it.outcome, it.duration = state.Scheduled, state.Outcome, state.Duration
 	return nil
 }
 
+// save keeps the state of the run finished in the storage & records the
+// run in the history.
+func (s *Scheduler) save(state *JobState, run *JobRun) {
+	if s.storage == nil {
+		return
+	}
+	// The state is saved even if the runs are canceled by the stop.
+	ses, err := s.storage.NewAutoSession(context.Background())
+	if err == nil {
+		err = s.storage.SaveJobState(ses, state)
+	}
+	if err == nil {
+		err = s.storage.SaveJobRun(ses, run)
+	}
+	if err != nil {
+		s.logger.Error(err, "save job run failed", "job", state.Name)
+	}
+}
+
+// newJobSchedule returns the schedule of the job by the spec & the quiet
+// hours of the options.
+func newJobSchedule(spec string, opts JobOptions) (Schedule, error) {
+	if spec == "" && opts.Schedule == nil && opts.Quiet != nil {
+		return quietSchedule{quiet: opts.Quiet}, nil
+	}
+	schedule := opts.Schedule
+	if schedule == nil {
+		var err error
+		if schedule, err = parseSchedule(spec); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Quiet != nil {
+		schedule = quietSchedule{Schedule: schedule, quiet: opts.Quiet}
+	}
+	return schedule, nil
+}
+
+// Remove removes the jobs of the name, the runs in progress are not
+// interrupted.
+func (s *Scheduler) Remove(name string) {
+	s.Lock()
+	defer s.Unlock()
+	s.removeIf(func(it *CronJob) bool { return it.Job.Name() == name })
+}
+
+// RemoveEntry removes the job by the entry id, the run in progress is not
+// interrupted.
+func (s *Scheduler) RemoveEntry(id EntryID) {
+	s.Lock()
+	defer s.Unlock()
+	s.removeIf(func(it *CronJob) bool { return it.ID == id })
+}
+
+func (s *Scheduler) removeIf(fn func(it *CronJob) bool) {
+	jobs := s.jobs[:0]
+	for _, it := range s.jobs {
+		if !fn(it) {
+			jobs = append(jobs, it)
+		} else {
+			it.removed = true
+		}
+	}
+	s.jobs = jobs
+	s.notifyChanged()
+}
+
+// Pause stops running the jobs of the name until they're resumed.
+func (s *Scheduler) Pause(name string) error {
+	return s.update(name, func(it *CronJob, now time.Time) {
+		it.Paused, it.Next = true, time.Time{}
+	})
+}
+
+// Resume runs the paused jobs of the name by their specs again.
+func (s *Scheduler) Resume(name string) error {
+	return s.update(name, func(it *CronJob, now time.Time) {
+		it.Paused = false
+		if s.running && it.Next.IsZero() {
+			it.Next = it.next(now)
+		}
+	})
+}
+
+// Rescheduler is implemented by the jobs which schedule themselves by the
+// Schedule of the options, e.g., the fetches polled adaptively, whose
+// schedules are rebuilt when they're rescheduled. It's nil if the job
+// runs by the spec.
+type Rescheduler interface {
+	Reschedule(ctx context.Context) (Schedule, error)
+}
+
+// Reschedule changes the spec of the jobs of the name, the schedules set
+// by the options are rebuilt by the jobs. The paused jobs stay paused.
+func (s *Scheduler) Reschedule(name, spec string) error {
+	s.Lock()
+	var jobs []*CronJob
+	for _, it := range s.jobs {
+		if it.Job.Name() == name {
+			jobs = append(jobs, it)
+		}
+	}
+	s.Unlock()
+	// The schedules are built out of the lock, the jobs may load their
+	// states from the storage.
+	schedules := make(map[*CronJob]Schedule)
+	for _, it := range jobs {
+		opts := it.opts
+		if r, ok := it.Job.(Rescheduler); ok && opts.Schedule != nil {
+			var err error
+			if opts.Schedule, err = r.Reschedule(context.Background()); err != nil {
+				return err
+			}
+		}
+		schedule, err := newJobSchedule(spec, opts)
+		if err != nil {
+			return err
+		}
+		schedules[it] = schedule
+	}
+	return s.update(name, func(it *CronJob, now time.Time) {
+		// The jobs added meanwhile are left as they are.
+		schedule, ok := schedules[it]
+		if !ok {
+			return
+		}
+		it.Spec, it.Schedule = spec, schedule
+		if s.running && !it.Paused {
+			it.Next = it.next(now)
+		}
+	})
+}
+
+const (
+	JobStarted = "started"
+	JobQueued  = "queued"
+	JobSkipped = "skipped"
+)
+
+// JobTrigger is how a job triggered manually is handled by its overlap
+// policy, i.e., started, queued or skipped.
+type JobTrigger struct {
+	Job    string `json:"job"`
+	Status string `json:"status"`
+}
+
+// Trigger runs the jobs of the name right away by their overlap policies,
+// or all the jobs except the paused ones if the name is empty. The runs
+// are recorded as started by the trigger, e.g., api, & don't change when
+// the jobs run next. It's NotFound if there are no such jobs, & it's
+// FailedPrecondition on a replica which is not the leader, whose runs
+// would be dropped.
+func (s *Scheduler) Trigger(name, trigger string) ([]JobTrigger, error) {
+	s.Lock()
+	defer s.Unlock()
+	if !s.running {
+		return nil, errors.Newf(errors.FailedPrecondition, nil, "scheduler is not running")
+	}
+	if !s.elector.Leading() {
+		return nil, errors.Newf(errors.FailedPrecondition, nil, "not the leader, trigger the jobs on the leader")
+	}
+	var out []JobTrigger
+	for _, it := range s.jobs {
+		if (name == "" && !it.Paused) || it.Job.Name() == name {
+			// The run is saved as due at the last tick, so that the
+			// catch up is not misled.
+			status := s.startJob(s.ctx, it, it.Prev, trigger)
+			out = append(out, JobTrigger{Job: it.Job.Name(), Status: status})
+		}
+	}
+	if len(out) == 0 && name != "" {
+		return nil, errors.Newf(errors.NotFound, nil, "job %s not found", name)
+	}
+	return out, nil
+}
+
+// update applies the change to the jobs of the name, it's NotFound if
+// there are no such jobs.
+func (s *Scheduler) update(name string, fn func(it *CronJob, now time.Time)) error {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	found := false
+	for _, it := range s.jobs {
+		if it.Job.Name() == name {
+			fn(it, now)
+			found = true
+		}
+	}
+	if !found {
+		return errors.Newf(errors.NotFound, nil, "job %s not found", name)
+	}
+	s.notifyChanged()
+	return nil
+}
+
+// Entries returns the snapshot of the scheduled jobs in the order they
+// run next, the paused ones come last.
+func (s *Scheduler) Entries() []Entry {
+	s.Lock()
+	defer s.Unlock()
+	jobs := append([]*CronJob{}, s.jobs...)
+	sort.Stable(byTime(jobs))
+	entries := make([]Entry, 0, len(jobs))
+	for _, it := range jobs {
+		entries = append(entries, it.entry())
+	}
+	return entries
+}
+
+// Entry returns the snapshot of the scheduled job by the entry id.
+func (s *Scheduler) Entry(id EntryID) (Entry, bool) {
+	s.Lock()
+	defer s.Unlock()
+	for _, it := range s.jobs {
+		if it.ID == id {
+			return it.entry(), true
+		}
+	}
+	return Entry{}, false
+}
+
+func (s *Scheduler) notifyChanged() {
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
 func (s *Scheduler) Start(ctx context.Context) {
 	s.Lock()
 	if s.running {
 		s.Unlock()
 		return
 	}
-	s.running = true
+	s.running, s.ctx = true, ctx
 	s.Unlock()
 
 	s.jobWaiter.Add(1)
@@ -60,35 +440,51 @@ func (s *Scheduler) Start(ctx context.Context) {
 
 func (s *Scheduler) run(ctx context.Context) {
 	now := time.Now()
+	s.Lock()
 	for _, it := range s.jobs {
-		it.Next = it.Schedule.Next(now)
+		if it.Paused {
+			continue
+		}
+		it.Next = it.first(now)
 		s.logger.Info("schedule", "now", now, "job", it.Job.Name(), "next", it.Next)
 	}
+	s.Unlock()
 	for {
+		s.Lock()
 		sort.Sort(byTime(s.jobs))
-		var timer *time.Timer
-		if len(s.jobs) == 0 || s.jobs[0].Next.IsZero() {
-			// If there are no entries yet, just sleep - it still handles new entries
-			// and stop requests.
-			timer = time.NewTimer(100000 * time.Hour)
-		} else {
-			timer = time.NewTimer(s.jobs[0].Next.Sub(now))
+		sleep := maxSleep
+		if len(s.jobs) > 0 && !s.jobs[0].Next.IsZero() && s.jobs[0].Next.Sub(now) < sleep {
+			sleep = s.jobs[0].Next.Sub(now)
 		}
+		timer := time.NewTimer(sleep)
+		s.Unlock()
 
 		for {
 			select {
 			case now = <-timer.C:
 				s.logger.Info("wake", "now", now)
 				// Run every job whose next time was less than now
+				s.Lock()
 				for _, it := range s.jobs {
 					if it.Next.After(now) || it.Next.IsZero() {
 						break
 					}
-					s.startJob(ctx, it.Job)
+					if it.missed(now) && it.opts.CatchUp != CatchUpOnce {
+						// The timer woke up late, e.g., after the system is
+						// resumed, the runs missed are ignored.
+						s.logger.Info("job missed", "now", now, "job", it.Job.Name(), "due", it.Next)
+						it.Next = it.next(now)
+						continue
+					}
+					s.startJob(ctx, it, it.Next, "")
 					it.Prev = it.Next
-					it.Next = it.Schedule.Next(now)
+					it.Next = it.next(now)
 					s.logger.Info("schedule job", "now", now, "job", it.Job.Name(), "next", it.Next)
 				}
+				s.Unlock()
+			case <-s.changed:
+				timer.Stop()
+				now = time.Now()
 			case <-ctx.Done():
 				s.logger.Info("stop")
 				timer.Stop()
@@ -99,32 +495,181 @@ func (s *Scheduler) run(ctx context.Context) {
 	}
 }
 
-func (s *Scheduler) startJob(ctx context.Context, job Job) {
+// startJob starts a run of the job due at the time by its overlap policy
+// & returns whether it's started, queued or skipped, the trigger is set
+// if it's started manually. It's called with the lock held.
+func (s *Scheduler) startJob(ctx context.Context, it *CronJob, scheduled time.Time, trigger string) string {
+	name := it.Job.Name()
+	if it.running > 0 {
+		switch it.opts.Overlap {
+		case OverlapAllow:
+		case OverlapQueue:
+			if !it.queued {
+				it.queued, it.queuedAt, it.queuedBy = true, scheduled, trigger
+				s.logger.Info("job queued, the last run is in progress", "job", name)
+				return JobQueued
+			}
+			fallthrough
+		default:
+			it.skipped++
+			s.logger.Info("job skipped, the last run is in progress", "job", name, "skipped", it.skipped)
+			return JobSkipped
+		}
+	}
+	it.running++
+	it.runs++
 	s.jobWaiter.Add(1)
 	go func() {
 		defer s.jobWaiter.Done()
-		if err := job.Run(ctx); err != nil {
-			s.logger.Error(err, "job failed", "job", job.Name())
+		lease, leading := s.elector.Lead(ctx)
+		if !leading {
+			s.logger.Info("job skipped, the replica is not the leader", "job", name)
+			s.Lock()
+			defer s.Unlock()
+			it.running--
+			it.runs--
+			s.dequeue(ctx, it)
+			return
+		}
+		runCtx, cancel := runContext(withLease(ctx, lease), it.opts.Timeout)
+		start := time.Now()
+		recorder := &runRecorder{run: JobRun{Job: name, StartedAt: start, Trigger: trigger}}
+		err := it.Job.Run(withRunRecorder(runCtx, recorder))
+		timedOut := ctx.Err() == nil && runCtx.Err() == context.DeadlineExceeded
+		cancel()
+		if timedOut && err == nil {
+			// The job returns nothing if it stops quietly on the cancel.
+			err = context.DeadlineExceeded
+		}
+		if timedOut {
+			s.logger.Error(err, "job timed out", "job", name, "timeout", it.opts.Timeout)
+		} else if err != nil {
+			s.logger.Error(err, "job failed", "job", name)
+		}
+		duration := time.Since(start)
+		s.logger.Info("job done", "job", name, "duration", duration)
+		state := &JobState{Name: name, Scheduled: scheduled, Started: start, Duration: duration, Outcome: RunOK}
+		if timedOut {
+			state.Outcome, state.Error = RunTimedOut, err.Error()
+		} else if err != nil {
+			state.Outcome, state.Error = RunFailed, err.Error()
+		}
+		run := recorder.snapshot()
+		run.EndedAt, run.Duration, run.Outcome, run.Error = start.Add(duration), duration, state.Outcome, state.Error
+		s.save(state, &run)
+
+		s.Lock()
+		defer s.Unlock()
+		it.running--
+		if timedOut {
+			it.timedOut++
 		}
+		it.outcome, it.duration = state.Outcome, duration
+		s.dequeue(ctx, it)
 	}()
+	return JobStarted
+}
+
+// dequeue starts the run queued once the runs in progress are done, it's
+// called with the lock held.
+func (s *Scheduler) dequeue(ctx context.Context, it *CronJob) {
+	if it.queued && it.running == 0 {
+		it.queued = false
+		if ctx.Err() == nil && !it.removed {
+			s.startJob(ctx, it, it.queuedAt, it.queuedBy)
+		}
+	}
 }
 
+// runContext returns the context of a run, which is canceled after the
+// timeout if it's set.
+func runContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// Stop waits for the run loop & the runs in progress to return, the
+// context passed to Start is supposed to be done.
 func (s *Scheduler) Stop() {
 	s.Lock()
-	defer s.Unlock()
-	if s.running {
-		s.running = false
-	}
+	s.running = false
+	s.Unlock()
 	s.jobWaiter.Wait()
 }
 
 type Schedule cron.Schedule
 
 type CronJob struct {
+	ID       EntryID
 	Job      Job
+	Spec     string
+	Paused   bool
 	Next     time.Time
 	Prev     time.Time
 	Schedule Schedule
+
+	opts JobOptions
+	// running is the number of the runs in progress, queued is set if a
+	// run is queued after them, which is due at queuedAt & triggered by
+	// queuedBy.
+	running  int
+	queued   bool
+	queuedAt time.Time
+	queuedBy string
+	removed  bool
+	// runs, skipped & timedOut count the runs of the job.
+	runs, skipped, timedOut int
+	// outcome & duration are of the last run finished.
+	outcome  string
+	duration time.Duration
+}
+
+// first returns the time the job runs first after the scheduler starts,
+// which is right away if a run is missed since the last one & the job
+// catches up.
+func (j *CronJob) first(now time.Time) time.Time {
+	if j.opts.CatchUp == CatchUpOnce && !j.Prev.IsZero() {
+		if missed := j.Schedule.Next(j.Prev); !missed.IsZero() && missed.Before(now) {
+			return now
+		}
+	}
+	return j.next(now)
+}
+
+// missed reports whether the job, which is due, missed a run, i.e., the
+// run after the one due is due too.
+func (j *CronJob) missed(now time.Time) bool {
+	next := j.Schedule.Next(j.Next)
+	return !next.IsZero() && !next.After(now)
+}
+
+// next returns the time the job runs next after the time, delayed by a
+// random jitter.
+func (j *CronJob) next(t time.Time) time.Time {
+	next := j.Schedule.Next(t)
+	if next.IsZero() || j.opts.Jitter <= 0 {
+		return next
+	}
+	return next.Add(time.Duration(rand.Int63n(int64(j.opts.Jitter))))
+}
+
+func (j *CronJob) entry() Entry {
+	return Entry{
+		ID:       j.ID,
+		Name:     j.Job.Name(),
+		Spec:     j.Spec,
+		Paused:   j.Paused,
+		Next:     j.Next,
+		Prev:     j.Prev,
+		Outcome:  j.outcome,
+		Duration: j.duration,
+		Running:  j.running,
+		Runs:     j.runs,
+		Skipped:  j.skipped,
+		TimedOut: j.timedOut,
+	}
 }
 
 // byTime is a wrapper for sorting the job array by time
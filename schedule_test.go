@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	stderr "errors"
+	"testing"
+	"time"
+
+	"github.com/maxnilz/feed/errors"
+)
+
+type funcJob struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+func (j funcJob) Name() string { return j.name }
+
+func (j funcJob) Run(ctx context.Context) error {
+	if j.fn == nil {
+		return nil
+	}
+	return j.fn(ctx)
+}
+
+func TestSchedulerRemove(t *testing.T) {
+	scheduler := NewScheduler(nil, DiscardLogger)
+	for _, name := range []string{"foo", "bar", "foo"} {
+		if _, err := scheduler.Schedule("* * * * *", funcJob{name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	scheduler.Remove("foo")
+	if len(scheduler.jobs) != 1 || scheduler.jobs[0].Job.Name() != "bar" {
+		t.Fatalf("unexpected jobs after removal: %+v", scheduler.jobs)
+	}
+}
+
+func TestSchedulerEntries(t *testing.T) {
+	scheduler := NewScheduler(nil, DiscardLogger)
+	var ids []EntryID
+	for _, name := range []string{"foo", "bar", "foo"} {
+		id, err := scheduler.Schedule("* * * * *", funcJob{name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if ids[0] == ids[1] || ids[1] == ids[2] {
+		t.Fatalf("expect unique entry ids, got %v", ids)
+	}
+	if _, err := scheduler.Schedule("every minute", funcJob{name: "baz"}); errors.Code(err) != errors.InvalidArgument {
+		t.Fatalf("expect invalid spec, got %v", err)
+	}
+	if entry, ok := scheduler.Entry(ids[1]); !ok || entry.Name != "bar" || !entry.Next.IsZero() {
+		t.Fatalf("unexpected entry before start: %+v", entry)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	scheduler.Start(ctx)
+	waitFor(t, func() bool {
+		for _, entry := range scheduler.Entries() {
+			if entry.Next.IsZero() {
+				return false
+			}
+		}
+		return true
+	})
+	if err := scheduler.Pause("foo"); err != nil {
+		t.Fatal(err)
+	}
+	entries := scheduler.Entries()
+	if len(entries) != 3 || entries[0].Name != "bar" || !entries[1].Paused || !entries[2].Next.IsZero() {
+		t.Fatalf("unexpected entries after pause: %+v", entries)
+	}
+	if err := scheduler.Reschedule("foo", "0 0 1 1 *"); err != nil {
+		t.Fatal(err)
+	}
+	if entry, _ := scheduler.Entry(ids[0]); !entry.Paused || !entry.Next.IsZero() || entry.Spec != "0 0 1 1 *" {
+		t.Fatalf("expect the rescheduled entry paused, got %+v", entry)
+	}
+	if err := scheduler.Resume("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if entry, _ := scheduler.Entry(ids[0]); entry.Paused || entry.Next.Month() != time.January || entry.Next.Day() != 1 {
+		t.Fatalf("unexpected resumed entry: %+v", entry)
+	}
+	if err := scheduler.Pause("qux"); errors.Code(err) != errors.NotFound {
+		t.Fatalf("expect unknown job not found, got %v", err)
+	}
+	scheduler.RemoveEntry(ids[2])
+	scheduler.Remove("bar")
+	if entries = scheduler.Entries(); len(entries) != 1 || entries[0].ID != ids[0] {
+		t.Fatalf("unexpected entries after removal: %+v", entries)
+	}
+	cancel()
+	scheduler.Stop()
+}
+
+func TestSchedulerAddWhileRunning(t *testing.T) {
+	scheduler := NewScheduler(nil, DiscardLogger)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	scheduler.Start(ctx)
+
+	// the job added to the idle scheduler wakes the run loop up.
+	runs := make(chan struct{}, 10)
+	id, err := scheduler.Schedule("@every 1s", funcJob{name: "foo", fn: func(ctx context.Context) error {
+		runs <- struct{}{}
+		return nil
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-runs:
+	case <-time.After(3 * time.Second):
+		t.Fatal("the job added while running is not run")
+	}
+	waitFor(t, func() bool {
+		entry, _ := scheduler.Entry(id)
+		return !entry.Prev.IsZero()
+	})
+	cancel()
+	scheduler.Stop()
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSchedulerOverlap(t *testing.T) {
+	for _, tt := range []struct {
+		overlap string
+		// runs & skipped are the expected counts after three ticks while
+		// the first run blocks.
+		runs, skipped int
+	}{
+		{OverlapSkip, 1, 2},
+		{OverlapQueue, 2, 1},
+		{OverlapAllow, 3, 0},
+	} {
+		t.Run(tt.overlap, func(t *testing.T) {
+			scheduler := NewScheduler(nil, DiscardLogger)
+			release := make(chan struct{})
+			started := make(chan struct{}, 10)
+			job := funcJob{name: "foo", fn: func(ctx context.Context) error {
+				started <- struct{}{}
+				<-release
+				return nil
+			}}
+			id, err := scheduler.ScheduleJob("* * * * *", job, JobOptions{Overlap: tt.overlap})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := context.Background()
+			scheduler.Lock()
+			for i := 0; i < 3; i++ {
+				scheduler.startJob(ctx, scheduler.jobs[0], time.Now(), "")
+			}
+			scheduler.Unlock()
+			close(release)
+			for i := 0; i < tt.runs; i++ {
+				select {
+				case <-started:
+				case <-time.After(3 * time.Second):
+					t.Fatalf("expect %d runs, got %d", tt.runs, i)
+				}
+			}
+			scheduler.Stop()
+			entry, _ := scheduler.Entry(id)
+			if entry.Runs != tt.runs || entry.Skipped != tt.skipped || entry.Running != 0 {
+				t.Fatalf("unexpected entry: %+v", entry)
+			}
+		})
+	}
+}
+
+func TestSchedulerTimeout(t *testing.T) {
+	scheduler := NewScheduler(nil, DiscardLogger)
+	done := make(chan error, 1)
+	job := funcJob{name: "foo", fn: func(ctx context.Context) error {
+		<-ctx.Done()
+		done <- ctx.Err()
+		return ctx.Err()
+	}}
+	id, err := scheduler.ScheduleJob("* * * * *", job, JobOptions{Timeout: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = scheduler.ScheduleJob("* * * * *", job, JobOptions{Overlap: "never"}); errors.Code(err) != errors.InvalidArgument {
+		t.Fatalf("expect invalid overlap policy, got %v", err)
+	}
+	scheduler.Lock()
+	scheduler.startJob(context.Background(), scheduler.jobs[0], time.Now(), "")
+	scheduler.Unlock()
+	select {
+	case err = <-done:
+		if err != context.DeadlineExceeded {
+			t.Fatalf("expect the run timed out, got %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("the run is not canceled")
+	}
+	scheduler.Stop()
+	if entry, _ := scheduler.Entry(id); entry.TimedOut != 1 || entry.Runs != 1 {
+		t.Fatalf("unexpected entry: %+v", entry)
+	}
+}
+
+func TestSchedulerTimeoutQuietly(t *testing.T) {
+	s := newTestSQLite(t)
+	scheduler := NewScheduler(s, DiscardLogger)
+	// the job stops without an error when it's canceled.
+	job := funcJob{name: "foo", fn: func(ctx context.Context) error {
+		<-ctx.Done()
+		return nil
+	}}
+	id, err := scheduler.ScheduleJob("0 0 1 1 *", job, JobOptions{Timeout: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduler.Lock()
+	scheduler.startJob(context.Background(), scheduler.jobs[0], time.Now(), "")
+	scheduler.Unlock()
+	scheduler.Stop()
+	if entry, _ := scheduler.Entry(id); entry.TimedOut != 1 || entry.Outcome != RunTimedOut {
+		t.Fatalf("unexpected entry: %+v", entry)
+	}
+	ses, _ := s.NewAutoSession(context.Background())
+	state, err := s.GetJobState(ses, "foo")
+	if err != nil || state.Outcome != RunTimedOut || state.Error != context.DeadlineExceeded.Error() {
+		t.Fatalf("unexpected state %+v %v", state, err)
+	}
+}
+
+func TestSchedulerJitter(t *testing.T) {
+	scheduler := NewScheduler(nil, DiscardLogger)
+	if _, err := scheduler.ScheduleJob("0 * * * *", funcJob{name: "foo"}, JobOptions{Jitter: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 1, 1, 12, 30, 0, 0, time.UTC)
+	hour := now.Truncate(time.Hour).Add(time.Hour)
+	for i := 0; i < 100; i++ {
+		next := scheduler.jobs[0].next(now)
+		if next.Before(hour) || !next.Before(hour.Add(time.Minute)) {
+			t.Fatalf("expect the next run within the jitter, got %v", next)
+		}
+	}
+}
+
+func TestSchedulerCatchUp(t *testing.T) {
+	s := newTestSQLite(t)
+	ses, _ := s.NewAutoSession(context.Background())
+	lastRun := time.Now().Add(-3 * time.Hour).Truncate(time.Hour)
+	for _, name := range []string{"foo", "bar"} {
+		state := &JobState{Name: name, Scheduled: lastRun, Started: lastRun, Duration: time.Second, Outcome: RunOK}
+		if err := s.SaveJobState(ses, state); err != nil {
+			t.Fatal(err)
+		}
+	}
+	scheduler := NewScheduler(s, DiscardLogger)
+	runs := make(chan string, 10)
+	newJob := func(name string, err error) Job {
+		return funcJob{name: name, fn: func(ctx context.Context) error {
+			runs <- name
+			return err
+		}}
+	}
+	id, err := scheduler.ScheduleJob("0 * * * *", newJob("foo", stderr.New("boom")), JobOptions{CatchUp: CatchUpOnce})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = scheduler.ScheduleJob("0 * * * *", newJob("bar", nil), JobOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = scheduler.ScheduleJob("0 * * * *", newJob("baz", nil), JobOptions{CatchUp: "all"}); errors.Code(err) != errors.InvalidArgument {
+		t.Fatalf("expect invalid catch-up policy, got %v", err)
+	}
+	if entry, _ := scheduler.Entry(id); !entry.Prev.Equal(lastRun) || entry.Outcome != RunOK || entry.Duration != time.Second {
+		t.Fatalf("expect the state restored, got %+v", entry)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	scheduler.Start(ctx)
+	select {
+	case name := <-runs:
+		if name != "foo" {
+			t.Fatalf("expect foo caught up, got %s", name)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("the missed run is not caught up")
+	}
+	waitFor(t, func() bool {
+		entry, _ := scheduler.Entry(id)
+		return entry.Outcome == RunFailed
+	})
+	cancel()
+	scheduler.Stop()
+	select {
+	case name := <-runs:
+		t.Fatalf("unexpected run of %s", name)
+	default:
+	}
+	state, err := s.GetJobState(ses, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !state.Scheduled.After(lastRun) || state.Outcome != RunFailed || state.Error != "boom" {
+		t.Fatalf("unexpected saved state: %+v", state)
+	}
+
+	// the timer woke up two hours late.
+	schedule, _ := parseSchedule("0 * * * *")
+	due := time.Now().Add(-2 * time.Hour)
+	job := &CronJob{Schedule: schedule, Next: due}
+	if !job.missed(time.Now()) || job.missed(due) {
+		t.Fatal("unexpected missed runs")
+	}
+}
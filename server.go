@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maxnilz/feed/errors"
+)
+
+const (
+	serverReadTimeout     = 30 * time.Second
+	serverShutdownTimeout = 10 * time.Second
+)
+
+// Server serves the http endpoints, e.g., the feeds of the subscribers.
+type Server struct {
+	addr    string
+	baseURL *url.URL
+	mux     *http.ServeMux
+
+	srv      *http.Server
+	listener net.Listener
+	waiter   sync.WaitGroup
+
+	logger Logger
+}
+
+func NewServer(cfg Config, logger Logger) (*Server, error) {
+	s := &Server{addr: cfg.Server.Addr, mux: http.NewServeMux(), logger: logger}
+	if cfg.Server.BaseURL != "" {
+		u, err := url.Parse(strings.TrimRight(cfg.Server.BaseURL, "/"))
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, errors.Newf(errors.InvalidArgument, err, "invalid server base url %q", cfg.Server.BaseURL)
+		}
+		s.baseURL = u
+	}
+	return s, nil
+}
+
+// Handle registers the handler for the pattern, refer to http.ServeMux.
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// ServeHTTP serves the request by the registered handlers.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Start listens on the configured address & serves the requests until
+// the context is done.
+func (s *Server) Start(ctx context.Context) error {
+	l, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return errors.Newf(errors.Internal, err, "listen on %s failed", s.addr)
+	}
+	s.listener = l
+	s.srv = &http.Server{
+		Handler:           s,
+		ReadHeaderTimeout: serverReadTimeout,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+	s.logger.Info("http server started", "addr", l.Addr().String())
+	s.waiter.Add(1)
+	go func() {
+		defer s.waiter.Done()
+		if err := s.srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			s.logger.Error(err, "http server failed")
+		}
+	}()
+	s.waiter.Add(1)
+	go func() {
+		defer s.waiter.Done()
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), serverShutdownTimeout)
+		defer cancel()
+		if err := s.srv.Shutdown(shutdownCtx); err != nil {
+			s.logger.Error(err, "shutdown http server failed")
+		}
+	}()
+	return nil
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *Server) Stop() {
+	s.waiter.Wait()
+}
+
+// requestURL returns the external url of the request, which is resolved
+// against the base url if it's configured.
+func (s *Server) requestURL(r *http.Request) *url.URL {
+	u := *r.URL
+	if s.baseURL != nil {
+		u.Scheme, u.Host = s.baseURL.Scheme, s.baseURL.Host
+		u.Path = s.baseURL.Path + r.URL.Path
+		u.RawPath = ""
+		return &u
+	}
+	u.Scheme, u.Host = "http", r.Host
+	if r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https") {
+		u.Scheme = "https"
+	}
+	return &u
+}
+
+// validBearer reports whether the request carries the bearer token.
+func validBearer(r *http.Request, token string) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) == 1
+}
+
+// httpStatus maps the error to the http status code.
+func httpStatus(err error) int {
+	switch errors.Code(err) {
+	case errors.InvalidArgument:
+		return http.StatusBadRequest
+	case errors.NotFound:
+		return http.StatusNotFound
+	case errors.AlreadyExists, errors.FailedPrecondition:
+		return http.StatusConflict
+	case errors.Unauthenticated:
+		return http.StatusUnauthorized
+	case errors.PermissionDenied:
+		return http.StatusForbidden
+	case errors.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case errors.Unimplemented:
+		return http.StatusNotImplemented
+	case errors.Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeError writes the error as a json document, the details of the
+// internal errors are logged rather than exposed.
+func writeError(w http.ResponseWriter, logger Logger, err error) {
+	status := httpStatus(err)
+	msg := errors.Message(err)
+	if status == http.StatusInternalServerError {
+		logger.Error(err, "serve http request failed")
+		msg = http.StatusText(status)
+	}
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maxnilz/feed/errors"
+	"github.com/robfig/cron/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// parseSchedule parses the spec, which is one of
+//   - a cron spec of 5 fields or a descriptor, e.g., @daily, @hourly or
+//     @every 30m,
+//   - an ISO-8601 repeating interval R[n]/<start>/<duration>, e.g.,
+//     R/2024-01-01T07:15:00/PT6H runs every 6 hours starting at 07:15,
+//     it runs n times only if n is set,
+//   - an ISO-8601 date time, e.g., 2024-01-01T07:15:00, which runs once,
+//
+// or a list of them separated by semicolons. Every spec may be prefixed
+// by CRON_TZ=<zone> to be evaluated in the time zone, which is the local
+// one by default.
+func parseSchedule(spec string) (Schedule, error) {
+	parts := splitSpec(spec)
+	if len(parts) == 0 {
+		return nil, errors.Newf(errors.InvalidArgument, nil, "empty schedule spec")
+	}
+	var schedules multiSchedule
+	for _, part := range parts {
+		schedule, err := parseSingleSchedule(part)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, schedule)
+	}
+	if len(schedules) == 1 {
+		return schedules[0], nil
+	}
+	return schedules, nil
+}
+
+// Spec is a schedule spec of the config, which is either a string of
+// the specs separated by semicolons or a list of them, e.g.,
+//
+//	schedule:
+//	  - 0 8 * * 1-5
+//	  - 0 10 * * 0,6
+type Spec string
+
+func (s *Spec) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.SequenceNode {
+		var spec string
+		if err := value.Decode(&spec); err != nil {
+			return err
+		}
+		*s = Spec(spec)
+		return nil
+	}
+	var specs []string
+	if err := value.Decode(&specs); err != nil {
+		return err
+	}
+	*s = Spec(strings.Join(specs, "; "))
+	return nil
+}
+
+func (s *Spec) UnmarshalJSON(data []byte) error {
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		return json.Unmarshal(data, (*string)(s))
+	}
+	var specs []string
+	if err := json.Unmarshal(data, &specs); err != nil {
+		return err
+	}
+	*s = Spec(strings.Join(specs, "; "))
+	return nil
+}
+
+func splitSpec(spec string) []string {
+	var parts []string
+	for _, part := range strings.Split(spec, ";") {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+func parseSingleSchedule(spec string) (Schedule, error) {
+	loc, rest := time.Local, spec
+	if zone, ok := specZone(spec); ok {
+		var err error
+		if loc, err = time.LoadLocation(zone); err != nil {
+			return nil, errors.Newf(errors.InvalidArgument, err, "invalid time zone of spec %q", spec)
+		}
+		rest = strings.TrimSpace(spec[strings.Index(spec, " ")+1:])
+	}
+	if repeatingInterval.MatchString(rest) {
+		return parseRepeatingInterval(rest, loc)
+	}
+	if at, err := parseDateTime(rest, loc); err == nil {
+		return onceSchedule{at: at}, nil
+	}
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, errors.Newf(errors.InvalidArgument, err, "invalid cron spec")
+	}
+	return schedule, nil
+}
+
+// specZone returns the time zone the spec is prefixed with.
+func specZone(spec string) (string, bool) {
+	for _, prefix := range []string{"CRON_TZ=", "TZ="} {
+		if strings.HasPrefix(spec, prefix) {
+			i := strings.Index(spec, " ")
+			if i < 0 {
+				return "", false
+			}
+			return spec[len(prefix):i], true
+		}
+	}
+	return "", false
+}
+
+// multiSchedule activates at the earliest activation of the schedules.
+type multiSchedule []Schedule
+
+func (s multiSchedule) Next(t time.Time) time.Time {
+	var next time.Time
+	for _, schedule := range s {
+		n := schedule.Next(t)
+		if !n.IsZero() && (next.IsZero() || n.Before(next)) {
+			next = n
+		}
+	}
+	return next
+}
+
+// onceSchedule activates once at the time.
+type onceSchedule struct {
+	at time.Time
+}
+
+func (s onceSchedule) Next(t time.Time) time.Time {
+	if t.Before(s.at) {
+		return s.at
+	}
+	return time.Time{}
+}
+
+var dateTimeLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02T15:04"}
+
+// parseDateTime parses the ISO-8601 date time, which is in the location
+// if it has no offset.
+func parseDateTime(s string, loc *time.Location) (time.Time, error) {
+	var err error
+	for _, layout := range dateTimeLayouts {
+		var t time.Time
+		if t, err = time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+var repeatingInterval = regexp.MustCompile(`^R(\d*)/([^/]+)/([^/]+)$`)
+
+// intervalSchedule activates at start & every period after it, times
+// times only if times is positive.
+type intervalSchedule struct {
+	start  time.Time
+	period isoDuration
+	times  int
+}
+
+func parseRepeatingInterval(spec string, loc *time.Location) (Schedule, error) {
+	m := repeatingInterval.FindStringSubmatch(spec)
+	s := intervalSchedule{}
+	var err error
+	if m[1] != "" {
+		if s.times, err = strconv.Atoi(m[1]); err != nil || s.times <= 0 {
+			return nil, errors.Newf(errors.InvalidArgument, err, "invalid repetitions of spec %q", spec)
+		}
+	}
+	if s.start, err = parseDateTime(m[2], loc); err != nil {
+		return nil, errors.Newf(errors.InvalidArgument, err, "invalid start of spec %q", spec)
+	}
+	if s.period, err = parseISODuration(m[3]); err != nil {
+		return nil, errors.Newf(errors.InvalidArgument, err, "invalid duration of spec %q", spec)
+	}
+	return s, nil
+}
+
+func (s intervalSchedule) Next(t time.Time) time.Time {
+	// Start from the least number of the periods passed, then step to the
+	// first activation after the time, the calendar periods vary in length.
+	k := 0
+	if t.After(s.start) {
+		k = int(t.Sub(s.start)/s.period.longest()) - 1
+		if k < 0 {
+			k = 0
+		}
+	}
+	for ; s.times <= 0 || k < s.times; k++ {
+		if next := s.period.addTo(s.start, k); next.After(t) {
+			return next
+		}
+	}
+	return time.Time{}
+}
+
+// isoDuration is an ISO-8601 duration, e.g., P1DT12H, the years, the
+// months & the days are calendar ones.
+type isoDuration struct {
+	years, months, days int
+	clock               time.Duration
+}
+
+var isoDurationPattern = regexp.MustCompile(`^P(?:(\d+)Y)?(?:(\d+)M)?(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+func parseISODuration(s string) (isoDuration, error) {
+	m := isoDurationPattern.FindStringSubmatch(s)
+	if m == nil || s == "P" || strings.HasSuffix(s, "T") {
+		return isoDuration{}, errors.Newf(errors.InvalidArgument, nil, "invalid ISO-8601 duration %q", s)
+	}
+	n := make([]int, len(m))
+	for i := 1; i < len(m); i++ {
+		if m[i] != "" {
+			n[i], _ = strconv.Atoi(m[i])
+		}
+	}
+	d := isoDuration{
+		years:  n[1],
+		months: n[2],
+		days:   n[3]*7 + n[4],
+		clock:  time.Duration(n[5])*time.Hour + time.Duration(n[6])*time.Minute + time.Duration(n[7])*time.Second,
+	}
+	if d.longest() <= 0 {
+		return isoDuration{}, errors.Newf(errors.InvalidArgument, nil, "zero ISO-8601 duration %q", s)
+	}
+	return d, nil
+}
+
+// addTo returns the time k periods after t.
+func (d isoDuration) addTo(t time.Time, k int) time.Time {
+	return t.AddDate(d.years*k, d.months*k, d.days*k).Add(d.clock * time.Duration(k))
+}
+
+// longest returns the longest length the period may be, e.g., a day is
+// 25 hours when the clocks go back.
+func (d isoDuration) longest() time.Duration {
+	day := 24 * time.Hour
+	return time.Duration(d.years)*366*day + time.Duration(d.months)*31*day + time.Duration(d.days)*25*time.Hour + d.clock
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maxnilz/feed/errors"
+	"gopkg.in/yaml.v3"
+)
+
+func TestParseSchedule(t *testing.T) {
+	utc := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2024, month, day, hour, min, 0, 0, time.UTC)
+	}
+	for _, tt := range []struct {
+		spec string
+		from time.Time
+		// next are the activations in order after from, the schedule is
+		// exhausted after them if done is set.
+		next []time.Time
+		done bool
+	}{
+		{"@every 30m", utc(1, 1, 0, 10), []time.Time{utc(1, 1, 0, 40), utc(1, 1, 1, 10)}, false},
+		{"CRON_TZ=UTC @daily", utc(1, 1, 12, 0), []time.Time{utc(1, 2, 0, 0), utc(1, 3, 0, 0)}, false},
+		{"CRON_TZ=UTC @hourly", utc(1, 1, 12, 30), []time.Time{utc(1, 1, 13, 0)}, false},
+		{"CRON_TZ=UTC 0 8 * * *; CRON_TZ=UTC 30 12 * * *", utc(1, 1, 9, 0),
+			[]time.Time{utc(1, 1, 12, 30), utc(1, 2, 8, 0), utc(1, 2, 12, 30)}, false},
+		// every 6 hours starting at 07:15.
+		{"R/2024-01-01T07:15:00Z/PT6H", utc(1, 1, 0, 0),
+			[]time.Time{utc(1, 1, 7, 15), utc(1, 1, 13, 15), utc(1, 1, 19, 15), utc(1, 2, 1, 15)}, false},
+		{"R/2024-01-01T07:15:00Z/PT6H", utc(3, 1, 14, 0), []time.Time{utc(3, 1, 19, 15)}, false},
+		{"CRON_TZ=UTC R2/2024-01-31T09:00/P1M", utc(1, 1, 0, 0), []time.Time{utc(1, 31, 9, 0), utc(3, 2, 9, 0)}, true},
+		{"R/2024-01-01T00:00:00Z/P1W", utc(2, 1, 0, 0), []time.Time{utc(2, 5, 0, 0)}, false},
+		{"2024-05-01T09:00:00Z", utc(1, 1, 0, 0), []time.Time{utc(5, 1, 9, 0)}, true},
+	} {
+		schedule, err := parseSchedule(tt.spec)
+		if err != nil {
+			t.Fatalf("parse %q: %v", tt.spec, err)
+		}
+		at := tt.from
+		for _, expected := range tt.next {
+			if at = schedule.Next(at); !at.Equal(expected) {
+				t.Fatalf("expect %q next at %v, got %v", tt.spec, expected, at)
+			}
+		}
+		if next := schedule.Next(at); next.IsZero() != tt.done {
+			t.Fatalf("unexpected %q next at %v", tt.spec, next)
+		}
+	}
+
+	// the repeating intervals follow the daylight saving time.
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	schedule, err := parseSchedule("CRON_TZ=Europe/Berlin R/2024-03-30T07:15/P1D")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next := schedule.Next(time.Date(2024, 3, 30, 12, 0, 0, 0, berlin)); !next.Equal(time.Date(2024, 3, 31, 7, 15, 0, 0, berlin)) {
+		t.Fatalf("unexpected next across the dst change %v", next)
+	}
+
+	for _, spec := range []string{
+		"", " ; ", "every 30m", "R/2024-01-01T00:00:00Z/PT0S", "R0/2024-01-01T00:00:00Z/PT1H",
+		"R/yesterday/PT1H", "R/2024-01-01T00:00:00Z/P1H", "CRON_TZ=Mars/Olympus R/2024-01-01T00:00/PT1H",
+		"0 8 * * *; every day",
+	} {
+		if _, err = parseSchedule(spec); errors.Code(err) != errors.InvalidArgument {
+			t.Fatalf("expect invalid spec %q, got %v", spec, err)
+		}
+	}
+}
+
+func TestSpecList(t *testing.T) {
+	var subscriber Subscriber
+	in := `
+schedule: '0 8 * * 1-5; 0 10 * * 0,6'
+fetchSchedule:
+  - 0 8 * * 1-5
+  - 0 10 * * 0,6
+`
+	if err := yaml.Unmarshal([]byte(in), &subscriber); err != nil {
+		t.Fatal(err)
+	}
+	if subscriber.Schedule != "0 8 * * 1-5; 0 10 * * 0,6" || subscriber.FetchSchedule != subscriber.Schedule {
+		t.Fatalf("unexpected specs %q %q", subscriber.Schedule, subscriber.FetchSchedule)
+	}
+	if err := yaml.Unmarshal([]byte("digestSchedule: {at: 8}"), &subscriber); err == nil {
+		t.Fatal("expect invalid spec")
+	}
+
+	// the api takes either of them too, the specs are stored as a string.
+	subscriber = Subscriber{}
+	if err := json.Unmarshal([]byte(`{"schedule": "@daily", "digestSchedule": ["0 8 * * *", "0 18 * * *"]}`), &subscriber); err != nil {
+		t.Fatal(err)
+	}
+	if subscriber.Schedule != "@daily" || subscriber.DigestSchedule != "0 8 * * *; 0 18 * * *" {
+		t.Fatalf("unexpected specs %q %q", subscriber.Schedule, subscriber.DigestSchedule)
+	}
+	if out, _ := json.Marshal(subscriber); !strings.Contains(string(out), `"digestSchedule":"0 8 * * *; 0 18 * * *"`) {
+		t.Fatalf("unexpected json %s", out)
+	}
+}
@@ -3,14 +3,34 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	stderr "errors"
+	"sort"
+	"strings"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 	"github.com/maxnilz/feed/errors"
 )
 
 var _ Storage = (*sqllite)(nil)
 
+// timeLayout is the layout of the time columns in the outbox tables,
+// the times are stored in UTC so that they can be compared as text.
+const timeLayout = "2006-01-02 15:04:05"
+
+// metaSubscribersSeeded is the meta key of the time the subscribers are
+// seeded from the config.
+const metaSubscribersSeeded = "subscribers_seeded"
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(timeLayout)
+}
+
+func parseTime(s string) (time.Time, error) {
+	return time.ParseInLocation(timeLayout, s, time.UTC)
+}
+
 func newSQLite(dbfile string) (*sqllite, error) {
 	db, err := sql.Open("sqlite3", dbfile)
 	if err != nil {
@@ -38,13 +58,13 @@ func (s *sqllite) NewSession(ctx context.Context) (Session, error) {
 
 func (s *sqllite) SaveFeeds(ses Session, feeds ...*Feed) error {
 	q := `
-INSERT INTO feed (id, email, site, title, description, content, link, updated_at, published_at, author, fetch_at) 
-VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+INSERT INTO feed (id, email, site, title, description, content, link, updated_at, published_at, author, fetch_at, saved_at) 
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
 `
 	for _, it := range feeds {
 		args := []interface{}{
 			it.Id, it.Email, it.SiteURL, it.Title, it.Description, it.Content, it.Link, it.UpdatedAt,
-			it.PublishedAt, it.Author, it.FetchAt.Format("2006-01-02 15:01:05"),
+			it.PublishedAt, it.Author, it.FetchAt.Format("2006-01-02 15:01:05"), formatTime(it.FetchAt),
 		}
 		if _, err := ses.Exec(q, args...); err != nil {
 			return errors.Newf(errors.Internal, err, "save feeds failed")
@@ -53,10 +73,10 @@ VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
 	return nil
 }
 
-func (s *sqllite) AckFeeds(ses Session, at time.Time, feedIds ...string) error {
-	q := `UPDATE feed SET ack = 1, ack_at = ? WHERE id = ?`
-	for _, id := range feedIds {
-		args := []interface{}{at.Format("2006-01-02 15:01:05"), id}
+func (s *sqllite) AckFeeds(ses Session, at time.Time, feeds ...*Feed) error {
+	q := `UPDATE feed SET ack = 1, ack_at = ? WHERE email = ? AND site = ? AND id = ?`
+	for _, it := range feeds {
+		args := []interface{}{at.Format("2006-01-02 15:01:05"), it.Email, it.SiteURL, it.Id}
 		if _, err := ses.Exec(q, args...); err != nil {
 			return errors.Newf(errors.Internal, err, "ack feeds failed")
 		}
@@ -64,8 +84,27 @@ func (s *sqllite) AckFeeds(ses Session, at time.Time, feedIds ...string) error {
 	return nil
 }
 
+func (s *sqllite) IsFeedSent(ses Session, feed *Feed) (bool, error) {
+	q := `
+SELECT EXISTS (
+    SELECT 1 FROM outbox_feed o JOIN outbox m ON m.id = o.message_id
+    WHERE o.feed_id = ? AND o.email = ? AND o.site = ? AND m.state = ?
+)`
+	var sent bool
+	if err := ses.QueryRow(q, feed.Id, feed.Email, feed.SiteURL, MessageSent).Scan(&sent); err != nil {
+		return false, errors.Newf(errors.Internal, err, "query sent feed %s failed", feed.Id)
+	}
+	return sent, nil
+}
+
 func (s *sqllite) GetLatestFeedWaterMark(ses Session, email, site string) (time.Time, error) {
-	q := `SELECT max(datetime(fetch_at)) FROM feed WHERE email = ? AND site = ? AND ack = 1`
+	// The feeds referenced by the outbox are counted as notified too, their
+	// delivery is on the outbox from then on, otherwise they would be
+	// fetched & enqueued again before the delivery is done.
+	q := `
+SELECT max(datetime(fetch_at)) FROM feed WHERE email = ? AND site = ? AND (ack = 1 OR EXISTS (
+    SELECT 1 FROM outbox_feed o WHERE o.feed_id = feed.id AND o.email = feed.email AND o.site = feed.site
+))`
 	r := ses.QueryRow(q, email, site)
 	var out *string
 	if err := r.Scan(&out); err != nil {
@@ -77,6 +116,875 @@ func (s *sqllite) GetLatestFeedWaterMark(ses Session, email, site string) (time.
 	return time.Parse("2006-01-02 15:01:05", *out)
 }
 
+func (s *sqllite) GetLatestFetchWaterMark(ses Session, email, site string) (time.Time, error) {
+	q := `SELECT max(datetime(fetch_at)) FROM feed WHERE email = ? AND site = ?`
+	r := ses.QueryRow(q, email, site)
+	var out *string
+	if err := r.Scan(&out); err != nil {
+		return time.Time{}, errors.Newf(errors.Internal, err, "get latest fetch water mark failed")
+	}
+	if out == nil {
+		return time.Time{}, nil
+	}
+	return time.Parse("2006-01-02 15:01:05", *out)
+}
+
+func (s *sqllite) GetPendingFeeds(ses Session, email string) ([]*Feed, error) {
+	q := selectFeeds + `WHERE email = ? AND ack = 0 AND NOT EXISTS (
+    SELECT 1 FROM outbox_feed o WHERE o.feed_id = feed.id AND o.email = feed.email AND o.site = feed.site
+) ORDER BY rowid`
+	return s.queryFeeds(ses, q, email)
+}
+
+const selectFeeds = `
+SELECT id, email, site, title, description, content, link, updated_at, published_at, author, fetch_at FROM feed
+`
+
+func (s *sqllite) GetFeeds(ses Session, query FeedQuery) ([]*Feed, error) {
+	cond := `email = ?`
+	args := []interface{}{query.Email}
+	if len(query.Sites) > 0 {
+		cond += ` AND site IN (?` + strings.Repeat(`, ?`, len(query.Sites)-1) + `)`
+		for _, site := range query.Sites {
+			args = append(args, site)
+		}
+	}
+	q := selectFeeds + `WHERE rowid IN (SELECT max(rowid) FROM feed WHERE ` + cond + ` GROUP BY site, id)
+ORDER BY rowid DESC LIMIT ? OFFSET ?`
+	args = append(args, query.Limit, query.Offset)
+	return s.queryFeeds(ses, q, args...)
+}
+
+func (s *sqllite) queryFeeds(ses Session, q string, args ...any) ([]*Feed, error) {
+	rows, err := ses.Query(q, args...)
+	if err != nil {
+		return nil, errors.Newf(errors.Internal, err, "query feeds failed")
+	}
+	defer rows.Close()
+	var feeds []*Feed
+	for rows.Next() {
+		f := &Feed{}
+		var updatedAt *string
+		var fetchAt string
+		if err = rows.Scan(&f.Id, &f.Email, &f.SiteURL, &f.Title, &f.Description, &f.Content, &f.Link, &updatedAt,
+			&f.PublishedAt, &f.Author, &fetchAt); err != nil {
+			return nil, errors.Newf(errors.Internal, err, "scan feed failed")
+		}
+		if updatedAt != nil {
+			f.UpdatedAt = *updatedAt
+		}
+		if f.FetchAt, err = time.ParseInLocation("2006-01-02 15:01:05", fetchAt, time.Local); err != nil {
+			return nil, errors.Newf(errors.Internal, err, "invalid fetch time of feed %s", f.Id)
+		}
+		feeds = append(feeds, f)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Newf(errors.Internal, err, "query feeds failed")
+	}
+	return feeds, nil
+}
+
+func (s *sqllite) SaveInboundFeed(ses Session, feed *Feed) error {
+	q := `
+INSERT OR IGNORE INTO inbound (id, site, title, content, author, published_at, received_at)
+VALUES (?, ?, ?, ?, ?, ?, ?);
+`
+	args := []interface{}{
+		feed.Id, feed.SiteURL, feed.Title, feed.Content, feed.Author, feed.PublishedAt, formatTime(feed.FetchAt),
+	}
+	if _, err := ses.Exec(q, args...); err != nil {
+		return errors.Newf(errors.Internal, err, "save inbound feed failed")
+	}
+	return nil
+}
+
+func (s *sqllite) GetInboundFeeds(ses Session, email, site string) ([]*Feed, error) {
+	q := `
+SELECT id, title, content, author, published_at FROM inbound i WHERE i.site = ? AND NOT EXISTS (
+    SELECT 1 FROM feed f WHERE f.id = i.id AND f.email = ? AND f.site = i.site
+) ORDER BY received_at, rowid`
+	rows, err := ses.Query(q, site, email)
+	if err != nil {
+		return nil, errors.Newf(errors.Internal, err, "query inbound feeds failed")
+	}
+	defer rows.Close()
+	var feeds []*Feed
+	for rows.Next() {
+		f := &Feed{Email: Email(email), SiteURL: site}
+		if err = rows.Scan(&f.Id, &f.Title, &f.Content, &f.Author, &f.PublishedAt); err != nil {
+			return nil, errors.Newf(errors.Internal, err, "scan inbound feed failed")
+		}
+		feeds = append(feeds, f)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Newf(errors.Internal, err, "query inbound feeds failed")
+	}
+	return feeds, nil
+}
+
+const selectItems = `
+SELECT f.rowid, f.id, f.email, f.site, f.title, f.description, f.content, f.link, f.updated_at, f.published_at,
+    f.author, f.fetch_at, COALESCE(f.saved_at, ''), COALESCE(i.read, 0), COALESCE(i.starred, 0),
+    COALESCE(i.archived, 0), COALESCE((
+        SELECT group_concat(t.tag, char(31)) FROM item_tag t
+        WHERE t.email = f.email AND t.site = f.site AND t.feed_id = f.id
+    ), '')
+FROM feed f LEFT JOIN item_state i ON i.email = f.email AND i.site = f.site AND i.feed_id = f.id
+`
+
+// itemConditions returns the where clause of the item query, only the
+// latest saved version of every feed is counted as an item.
+func itemConditions(q ItemQuery) (string, []interface{}) {
+	conds := []string{`f.rowid IN (SELECT max(rowid) FROM feed WHERE email = ? GROUP BY site, id)`}
+	args := []interface{}{q.Email}
+	in := func(column string, n int) string {
+		return column + ` IN (?` + strings.Repeat(`, ?`, n-1) + `)`
+	}
+	if len(q.Sites) > 0 {
+		conds = append(conds, in(`f.site`, len(q.Sites)))
+		for _, site := range q.Sites {
+			args = append(args, site)
+		}
+	}
+	if len(q.Seqs) > 0 {
+		conds = append(conds, in(`f.rowid`, len(q.Seqs)))
+		for _, seq := range q.Seqs {
+			args = append(args, seq)
+		}
+	}
+	if len(q.Ids) > 0 {
+		conds = append(conds, in(`f.id`, len(q.Ids)))
+		for _, id := range q.Ids {
+			args = append(args, id)
+		}
+	}
+	if q.Read != nil {
+		conds = append(conds, `COALESCE(i.read, 0) = ?`)
+		args = append(args, *q.Read)
+	}
+	if q.Starred != nil {
+		conds = append(conds, `COALESCE(i.starred, 0) = ?`)
+		args = append(args, *q.Starred)
+	}
+	if q.Archived != nil {
+		conds = append(conds, `COALESCE(i.archived, 0) = ?`)
+		args = append(args, *q.Archived)
+	}
+	if q.Tag != "" {
+		conds = append(conds, `EXISTS (
+    SELECT 1 FROM item_tag t WHERE t.email = f.email AND t.site = f.site AND t.feed_id = f.id AND t.tag = ?
+)`)
+		args = append(args, q.Tag)
+	}
+	if q.Search != "" {
+		pattern := "%" + likeEscaper.Replace(q.Search) + "%"
+		conds = append(conds, `(f.title LIKE ? ESCAPE '\' OR f.description LIKE ? ESCAPE '\' OR f.content LIKE ? ESCAPE '\')`)
+		args = append(args, pattern, pattern, pattern)
+	}
+	if q.MinSeq > 0 {
+		conds = append(conds, `f.rowid > ?`)
+		args = append(args, q.MinSeq)
+	}
+	if q.MaxSeq > 0 {
+		conds = append(conds, `f.rowid < ?`)
+		args = append(args, q.MaxSeq)
+	}
+	// The feeds saved before saved_at is added are counted as the oldest.
+	if !q.SavedAfter.IsZero() {
+		conds = append(conds, `COALESCE(f.saved_at, '') > ?`)
+		args = append(args, formatTime(q.SavedAfter))
+	}
+	if !q.SavedBefore.IsZero() {
+		conds = append(conds, `COALESCE(f.saved_at, '') < ?`)
+		args = append(args, formatTime(q.SavedBefore))
+	}
+	where := `WHERE ` + strings.Join(conds, ` AND `)
+	if q.Desc {
+		where += ` ORDER BY f.rowid DESC`
+	} else {
+		where += ` ORDER BY f.rowid`
+	}
+	if q.Limit > 0 {
+		where += ` LIMIT ?`
+		args = append(args, q.Limit)
+	}
+	return where, args
+}
+
+// likeEscaper escapes the wildcards of the LIKE patterns.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func (s *sqllite) GetItems(ses Session, query ItemQuery) ([]*Item, error) {
+	where, args := itemConditions(query)
+	rows, err := ses.Query(selectItems+where, args...)
+	if err != nil {
+		return nil, errors.Newf(errors.Internal, err, "query items failed")
+	}
+	defer rows.Close()
+	var items []*Item
+	for rows.Next() {
+		it := &Item{Feed: &Feed{}}
+		f := it.Feed
+		var updatedAt *string
+		var fetchAt, savedAt, tags string
+		if err = rows.Scan(&it.Seq, &f.Id, &f.Email, &f.SiteURL, &f.Title, &f.Description, &f.Content, &f.Link,
+			&updatedAt, &f.PublishedAt, &f.Author, &fetchAt, &savedAt, &it.Read, &it.Starred, &it.Archived, &tags); err != nil {
+			return nil, errors.Newf(errors.Internal, err, "scan item failed")
+		}
+		if tags != "" {
+			it.Tags = strings.Split(tags, "\x1f")
+			sort.Strings(it.Tags)
+		}
+		if updatedAt != nil {
+			f.UpdatedAt = *updatedAt
+		}
+		if f.FetchAt, err = time.ParseInLocation("2006-01-02 15:01:05", fetchAt, time.Local); err != nil {
+			return nil, errors.Newf(errors.Internal, err, "invalid fetch time of item %d", it.Seq)
+		}
+		it.SavedAt = f.FetchAt
+		if savedAt != "" {
+			if it.SavedAt, err = parseTime(savedAt); err != nil {
+				return nil, errors.Newf(errors.Internal, err, "invalid saved time of item %d", it.Seq)
+			}
+		}
+		items = append(items, it)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Newf(errors.Internal, err, "query items failed")
+	}
+	return items, nil
+}
+
+func (s *sqllite) GetItemRefs(ses Session, query ItemQuery) ([]ItemRef, error) {
+	where, args := itemConditions(query)
+	q := `SELECT f.rowid, f.site, COALESCE(f.saved_at, '') FROM feed f
+LEFT JOIN item_state i ON i.email = f.email AND i.site = f.site AND i.feed_id = f.id ` + where
+	rows, err := ses.Query(q, args...)
+	if err != nil {
+		return nil, errors.Newf(errors.Internal, err, "query item refs failed")
+	}
+	defer rows.Close()
+	var refs []ItemRef
+	for rows.Next() {
+		var ref ItemRef
+		var savedAt string
+		if err = rows.Scan(&ref.Seq, &ref.SiteURL, &savedAt); err != nil {
+			return nil, errors.Newf(errors.Internal, err, "scan item ref failed")
+		}
+		if savedAt != "" {
+			if ref.SavedAt, err = parseTime(savedAt); err != nil {
+				return nil, errors.Newf(errors.Internal, err, "invalid saved time of item %d", ref.Seq)
+			}
+		}
+		refs = append(refs, ref)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Newf(errors.Internal, err, "query item refs failed")
+	}
+	return refs, nil
+}
+
+func (s *sqllite) UpdateItems(ses Session, email string, seqs []int64, change ItemChange, at time.Time) error {
+	if len(seqs) == 0 {
+		return nil
+	}
+	// Resolve the seqs into the feeds first, a transactional session can't
+	// run queries in parallel.
+	q := `SELECT site, id FROM feed WHERE email = ? AND rowid IN (?` + strings.Repeat(`, ?`, len(seqs)-1) + `)`
+	args := []interface{}{email}
+	for _, seq := range seqs {
+		args = append(args, seq)
+	}
+	rows, err := ses.Query(q, args...)
+	if err != nil {
+		return errors.Newf(errors.Internal, err, "query items failed")
+	}
+	var feeds []*Feed
+	for rows.Next() {
+		f := &Feed{Email: Email(email)}
+		if err = rows.Scan(&f.SiteURL, &f.Id); err != nil {
+			rows.Close()
+			return errors.Newf(errors.Internal, err, "scan item failed")
+		}
+		feeds = append(feeds, f)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return errors.Newf(errors.Internal, err, "query items failed")
+	}
+
+	uq := `
+INSERT INTO item_state (email, site, feed_id, read, starred, archived, updated_at)
+VALUES (?, ?, ?, COALESCE(?, 0), COALESCE(?, 0), COALESCE(?, 0), ?)
+ON CONFLICT (email, site, feed_id) DO UPDATE SET
+    read = COALESCE(?, read), starred = COALESCE(?, starred), archived = COALESCE(?, archived),
+    updated_at = excluded.updated_at
+`
+	for _, f := range feeds {
+		args := []interface{}{
+			f.Email, f.SiteURL, f.Id, change.Read, change.Starred, change.Archived, formatTime(at),
+			change.Read, change.Starred, change.Archived,
+		}
+		if _, err = ses.Exec(uq, args...); err != nil {
+			return errors.Newf(errors.Internal, err, "update item state failed")
+		}
+		for _, tag := range change.AddTags {
+			q := `INSERT OR IGNORE INTO item_tag (email, site, feed_id, tag, created_at) VALUES (?, ?, ?, ?, ?)`
+			if _, err = ses.Exec(q, f.Email, f.SiteURL, f.Id, tag, formatTime(at)); err != nil {
+				return errors.Newf(errors.Internal, err, "tag item failed")
+			}
+		}
+		for _, tag := range change.RemoveTags {
+			q := `DELETE FROM item_tag WHERE email = ? AND site = ? AND feed_id = ? AND tag = ?`
+			if _, err = ses.Exec(q, f.Email, f.SiteURL, f.Id, tag); err != nil {
+				return errors.Newf(errors.Internal, err, "untag item failed")
+			}
+		}
+	}
+	// The read items are acked, so that they're not notified any more.
+	if change.Read != nil && *change.Read {
+		return s.AckFeeds(ses, at, feeds...)
+	}
+	return nil
+}
+
+func (s *sqllite) GetSubscribers(ses Session) ([]Subscriber, error) {
+	rows, err := ses.Query(`SELECT name, spec FROM subscriber ORDER BY name`)
+	if err != nil {
+		return nil, errors.Newf(errors.Internal, err, "query subscribers failed")
+	}
+	defer rows.Close()
+	var subscribers []Subscriber
+	for rows.Next() {
+		var name, spec string
+		if err = rows.Scan(&name, &spec); err != nil {
+			return nil, errors.Newf(errors.Internal, err, "scan subscriber failed")
+		}
+		var subscriber Subscriber
+		if err = json.Unmarshal([]byte(spec), &subscriber); err != nil {
+			return nil, errors.Newf(errors.Internal, err, "invalid spec of subscriber %s", name)
+		}
+		subscribers = append(subscribers, subscriber)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Newf(errors.Internal, err, "query subscribers failed")
+	}
+	return subscribers, nil
+}
+
+func (s *sqllite) CreateSubscriber(ses Session, subscriber Subscriber, at time.Time) error {
+	spec, err := json.Marshal(subscriber)
+	if err != nil {
+		return errors.Newf(errors.Internal, err, "marshal subscriber %s failed", subscriber.Name)
+	}
+	q := `INSERT INTO subscriber (name, email, spec, created_at, updated_at) VALUES (?, ?, ?, ?, ?)`
+	_, err = ses.Exec(q, subscriber.Name, subscriber.Email, string(spec), formatTime(at), formatTime(at))
+	if err != nil {
+		var sqliteErr sqlite3.Error
+		if stderr.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrConstraint {
+			return errors.Newf(errors.AlreadyExists, err, "subscriber %s or %s already exists", subscriber.Name, subscriber.Email)
+		}
+		return errors.Newf(errors.Internal, err, "create subscriber %s failed", subscriber.Name)
+	}
+	return nil
+}
+
+func (s *sqllite) UpdateSubscriber(ses Session, subscriber Subscriber, at time.Time) error {
+	spec, err := json.Marshal(subscriber)
+	if err != nil {
+		return errors.Newf(errors.Internal, err, "marshal subscriber %s failed", subscriber.Name)
+	}
+	q := `UPDATE subscriber SET email = ?, spec = ?, updated_at = ? WHERE name = ?`
+	res, err := ses.Exec(q, subscriber.Email, string(spec), formatTime(at), subscriber.Name)
+	if err != nil {
+		var sqliteErr sqlite3.Error
+		if stderr.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrConstraint {
+			return errors.Newf(errors.AlreadyExists, err, "subscriber %s already exists", subscriber.Email)
+		}
+		return errors.Newf(errors.Internal, err, "update subscriber %s failed", subscriber.Name)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.Newf(errors.NotFound, nil, "subscriber %s not found", subscriber.Name)
+	}
+	return nil
+}
+
+func (s *sqllite) DeleteSubscriber(ses Session, name string) error {
+	res, err := ses.Exec(`DELETE FROM subscriber WHERE name = ?`, name)
+	if err != nil {
+		return errors.Newf(errors.Internal, err, "delete subscriber %s failed", name)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.Newf(errors.NotFound, nil, "subscriber %s not found", name)
+	}
+	return nil
+}
+
+func (s *sqllite) IsSubscribersSeeded(ses Session) (bool, error) {
+	var seeded bool
+	q := `SELECT EXISTS (SELECT 1 FROM meta WHERE key = ?)`
+	if err := ses.QueryRow(q, metaSubscribersSeeded).Scan(&seeded); err != nil {
+		return false, errors.Newf(errors.Internal, err, "query seeded subscribers failed")
+	}
+	return seeded, nil
+}
+
+func (s *sqllite) MarkSubscribersSeeded(ses Session, at time.Time) error {
+	q := `INSERT INTO meta (key, value) VALUES (?, ?) ON CONFLICT (key) DO NOTHING`
+	if _, err := ses.Exec(q, metaSubscribersSeeded, formatTime(at)); err != nil {
+		return errors.Newf(errors.Internal, err, "mark subscribers seeded failed")
+	}
+	return nil
+}
+
+func (s *sqllite) GetSubscriptionState(ses Session, email string) (*SubscriptionState, error) {
+	state := &SubscriptionState{Email: email}
+	var pausedUntil, unsubscribedAt string
+	q := `SELECT COALESCE(paused_until, ''), COALESCE(unsubscribed_at, '') FROM subscription_state WHERE email = ?`
+	err := ses.QueryRow(q, email).Scan(&pausedUntil, &unsubscribedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, errors.Newf(errors.Internal, err, "query subscription state of %s failed", email)
+	}
+	if pausedUntil != "" {
+		if state.PausedUntil, err = parseTime(pausedUntil); err != nil {
+			return nil, errors.Newf(errors.Internal, err, "invalid paused time of %s", email)
+		}
+	}
+	if unsubscribedAt != "" {
+		if state.UnsubscribedAt, err = parseTime(unsubscribedAt); err != nil {
+			return nil, errors.Newf(errors.Internal, err, "invalid unsubscribed time of %s", email)
+		}
+	}
+	rows, err := ses.Query(`SELECT site FROM muted_site WHERE email = ? ORDER BY site`, email)
+	if err != nil {
+		return nil, errors.Newf(errors.Internal, err, "query muted sites of %s failed", email)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var site string
+		if err = rows.Scan(&site); err != nil {
+			return nil, errors.Newf(errors.Internal, err, "scan muted site failed")
+		}
+		state.MutedSites = append(state.MutedSites, site)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Newf(errors.Internal, err, "query muted sites of %s failed", email)
+	}
+	return state, nil
+}
+
+func (s *sqllite) UpdateSubscriptionState(ses Session, email string, change SubscriptionChange, at time.Time) error {
+	var pausedUntil, unsubscribedAt interface{}
+	if change.PausedUntil != nil {
+		pausedUntil = formatTime(*change.PausedUntil)
+	}
+	if change.Unsubscribed != nil {
+		// An empty time resubscribes.
+		unsubscribedAt = ""
+		if *change.Unsubscribed {
+			unsubscribedAt = formatTime(at)
+		}
+	}
+	q := `
+INSERT INTO subscription_state (email, paused_until, unsubscribed_at, updated_at) VALUES (?, ?, NULLIF(?, ''), ?)
+ON CONFLICT (email) DO UPDATE SET
+    paused_until = COALESCE(excluded.paused_until, paused_until),
+    unsubscribed_at = CASE WHEN ? IS NULL THEN unsubscribed_at ELSE excluded.unsubscribed_at END,
+    updated_at = excluded.updated_at
+`
+	if _, err := ses.Exec(q, email, pausedUntil, unsubscribedAt, formatTime(at), unsubscribedAt); err != nil {
+		return errors.Newf(errors.Internal, err, "update subscription state of %s failed", email)
+	}
+	for _, site := range change.MuteSites {
+		q := `INSERT OR IGNORE INTO muted_site (email, site, muted_at) VALUES (?, ?, ?)`
+		if _, err := ses.Exec(q, email, site, formatTime(at)); err != nil {
+			return errors.Newf(errors.Internal, err, "mute site %s of %s failed", site, email)
+		}
+	}
+	for _, site := range change.UnmuteSites {
+		if _, err := ses.Exec(`DELETE FROM muted_site WHERE email = ? AND site = ?`, email, site); err != nil {
+			return errors.Newf(errors.Internal, err, "unmute site %s of %s failed", site, email)
+		}
+	}
+	return nil
+}
+
+func (s *sqllite) CreateLoginToken(ses Session, token LoginToken) error {
+	now := formatTime(time.Now())
+	if _, err := ses.Exec(`DELETE FROM login_token WHERE expires_at < ?`, now); err != nil {
+		return errors.Newf(errors.Internal, err, "purge login tokens failed")
+	}
+	q := `INSERT INTO login_token (hash, subscriber, expires_at, created_at) VALUES (?, ?, ?, ?)`
+	if _, err := ses.Exec(q, token.Hash, token.Subscriber, formatTime(token.ExpiresAt), now); err != nil {
+		return errors.Newf(errors.Internal, err, "save login token of %s failed", token.Subscriber)
+	}
+	return nil
+}
+
+func (s *sqllite) ConsumeLoginToken(ses Session, hash string, now time.Time) (string, error) {
+	q := `UPDATE login_token SET used_at = ? WHERE hash = ? AND used_at IS NULL AND expires_at > ? RETURNING subscriber`
+	var subscriber string
+	err := ses.QueryRow(q, formatTime(now), hash, formatTime(now)).Scan(&subscriber)
+	if err == sql.ErrNoRows {
+		return "", errors.Newf(errors.NotFound, nil, "invalid or expired login link")
+	}
+	if err != nil {
+		return "", errors.Newf(errors.Internal, err, "consume login token failed")
+	}
+	return subscriber, nil
+}
+
+func (s *sqllite) GetJobState(ses Session, name string) (*JobState, error) {
+	q := `SELECT scheduled_at, started_at, duration_ms, outcome, error FROM job_state WHERE name = ?`
+	state := &JobState{Name: name}
+	var scheduled, started string
+	var duration int64
+	err := ses.QueryRow(q, name).Scan(&scheduled, &started, &duration, &state.Outcome, &state.Error)
+	if err == sql.ErrNoRows {
+		return state, nil
+	}
+	if err != nil {
+		return nil, errors.Newf(errors.Internal, err, "get state of job %s failed", name)
+	}
+	if state.Scheduled, err = parseTime(scheduled); err != nil {
+		return nil, errors.Newf(errors.Internal, err, "invalid scheduled time of job %s", name)
+	}
+	if state.Started, err = parseTime(started); err != nil {
+		return nil, errors.Newf(errors.Internal, err, "invalid started time of job %s", name)
+	}
+	state.Duration = time.Duration(duration) * time.Millisecond
+	return state, nil
+}
+
+func (s *sqllite) SaveJobState(ses Session, state *JobState) error {
+	q := `
+INSERT INTO job_state (name, scheduled_at, started_at, duration_ms, outcome, error) VALUES (?, ?, ?, ?, ?, ?)
+ON CONFLICT (name) DO UPDATE SET scheduled_at = excluded.scheduled_at, started_at = excluded.started_at,
+    duration_ms = excluded.duration_ms, outcome = excluded.outcome, error = excluded.error`
+	args := []interface{}{
+		state.Name, formatTime(state.Scheduled), formatTime(state.Started),
+		state.Duration.Milliseconds(), state.Outcome, state.Error,
+	}
+	if _, err := ses.Exec(q, args...); err != nil {
+		return errors.Newf(errors.Internal, err, "save state of job %s failed", state.Name)
+	}
+	return nil
+}
+
+func (s *sqllite) GetEndpointPolls(ses Session, email string) ([]*EndpointPoll, error) {
+	rows, err := ses.Query(`SELECT endpoint, interval_ms, next_fetch_at FROM endpoint_poll WHERE email = ?`, email)
+	if err != nil {
+		return nil, errors.Newf(errors.Internal, err, "query endpoint polls of %s failed", email)
+	}
+	defer rows.Close()
+	var polls []*EndpointPoll
+	for rows.Next() {
+		poll := &EndpointPoll{Email: email}
+		var interval int64
+		var nextFetchAt string
+		if err = rows.Scan(&poll.Endpoint, &interval, &nextFetchAt); err != nil {
+			return nil, errors.Newf(errors.Internal, err, "scan endpoint poll failed")
+		}
+		if poll.NextFetchAt, err = parseTime(nextFetchAt); err != nil {
+			return nil, errors.Newf(errors.Internal, err, "invalid next fetch time of %s", poll.Endpoint)
+		}
+		poll.Interval = time.Duration(interval) * time.Millisecond
+		polls = append(polls, poll)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Newf(errors.Internal, err, "query endpoint polls of %s failed", email)
+	}
+	return polls, nil
+}
+
+func (s *sqllite) SaveEndpointPoll(ses Session, poll *EndpointPoll) error {
+	q := `
+INSERT INTO endpoint_poll (email, endpoint, interval_ms, next_fetch_at) VALUES (?, ?, ?, ?)
+ON CONFLICT (email, endpoint) DO UPDATE SET interval_ms = excluded.interval_ms, next_fetch_at = excluded.next_fetch_at`
+	args := []interface{}{poll.Email, poll.Endpoint, poll.Interval.Milliseconds(), formatTime(poll.NextFetchAt)}
+	if _, err := ses.Exec(q, args...); err != nil {
+		return errors.Newf(errors.Internal, err, "save endpoint poll of %s failed", poll.Endpoint)
+	}
+	return nil
+}
+
+func (s *sqllite) AcquireLease(ses Session, lease *Lease, now time.Time) error {
+	// The expiry times are kept in milliseconds since the leases last
+	// seconds only.
+	q := `
+INSERT INTO lease (name, holder, token, expires_at) VALUES (?, ?, 1, ?)
+ON CONFLICT (name) DO UPDATE SET
+    token = CASE WHEN lease.holder = excluded.holder THEN lease.token ELSE lease.token + 1 END,
+    holder = excluded.holder, expires_at = excluded.expires_at
+WHERE lease.holder = excluded.holder OR lease.expires_at <= ?
+RETURNING token`
+	err := ses.QueryRow(q, lease.Name, lease.Holder, lease.ExpiresAt.UnixMilli(), now.UnixMilli()).Scan(&lease.Token)
+	if err == sql.ErrNoRows {
+		return errors.Newf(errors.FailedPrecondition, nil, "lease %s is held by another holder", lease.Name)
+	}
+	if err != nil {
+		return errors.Newf(errors.Internal, err, "acquire lease %s failed", lease.Name)
+	}
+	return nil
+}
+
+func (s *sqllite) ReleaseLease(ses Session, name, holder string) error {
+	if _, err := ses.Exec(`UPDATE lease SET expires_at = 0 WHERE name = ? AND holder = ?`, name, holder); err != nil {
+		return errors.Newf(errors.Internal, err, "release lease %s failed", name)
+	}
+	return nil
+}
+
+func (s *sqllite) GetLease(ses Session, name string) (*Lease, error) {
+	lease := &Lease{Name: name}
+	var expiresAt int64
+	err := ses.QueryRow(`SELECT holder, token, expires_at FROM lease WHERE name = ?`, name).Scan(&lease.Holder, &lease.Token, &expiresAt)
+	if err == sql.ErrNoRows {
+		return nil, errors.Newf(errors.NotFound, nil, "lease %s not found", name)
+	}
+	if err != nil {
+		return nil, errors.Newf(errors.Internal, err, "get lease %s failed", name)
+	}
+	lease.ExpiresAt = time.UnixMilli(expiresAt)
+	return lease, nil
+}
+
+func (s *sqllite) SaveJobRun(ses Session, run *JobRun) error {
+	siteErrors, err := json.Marshal(run.SiteErrors)
+	if err != nil {
+		return errors.Newf(errors.Internal, err, "marshal site errors of job %s failed", run.Job)
+	}
+	q := `
+INSERT INTO job_runs (job, subscriber, started_at, ended_at, duration_ms, outcome, error, triggered_by, sites, found, filtered, sent, bytes, site_errors)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	args := []interface{}{
+		run.Job, run.Subscriber, formatTime(run.StartedAt), formatTime(run.EndedAt), run.Duration.Milliseconds(),
+		run.Outcome, run.Error, run.Trigger, run.Sites, run.Found, run.Filtered, run.Sent, run.Bytes, string(siteErrors),
+	}
+	r, err := ses.Exec(q, args...)
+	if err != nil {
+		return errors.Newf(errors.Internal, err, "save run of job %s failed", run.Job)
+	}
+	if run.Id, err = r.LastInsertId(); err != nil {
+		return errors.Newf(errors.Internal, err, "save run of job %s failed", run.Job)
+	}
+	return nil
+}
+
+const selectJobRuns = `
+SELECT id, job, subscriber, started_at, ended_at, duration_ms, outcome, error, triggered_by, sites, found, filtered, sent, bytes, site_errors
+FROM job_runs `
+
+func (s *sqllite) GetJobRuns(ses Session, query JobRunQuery) ([]*JobRun, error) {
+	var conds []string
+	var args []interface{}
+	for _, it := range []struct{ col, val string }{
+		{"job", query.Job}, {"subscriber", query.Subscriber}, {"outcome", query.Outcome},
+	} {
+		if it.val != "" {
+			conds = append(conds, it.col+" = ?")
+			args = append(args, it.val)
+		}
+	}
+	q := selectJobRuns
+	if len(conds) > 0 {
+		q += "WHERE " + strings.Join(conds, " AND ") + " "
+	}
+	q += "ORDER BY id DESC"
+	if query.Limit > 0 {
+		q += " LIMIT ?"
+		args = append(args, query.Limit)
+	}
+	return s.queryJobRuns(ses, q, args...)
+}
+
+func (s *sqllite) GetJobRun(ses Session, id int64) (*JobRun, error) {
+	runs, err := s.queryJobRuns(ses, selectJobRuns+`WHERE id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(runs) == 0 {
+		return nil, errors.Newf(errors.NotFound, nil, "run %d not found", id)
+	}
+	return runs[0], nil
+}
+
+func (s *sqllite) queryJobRuns(ses Session, q string, args ...any) ([]*JobRun, error) {
+	rows, err := ses.Query(q, args...)
+	if err != nil {
+		return nil, errors.Newf(errors.Internal, err, "query job runs failed")
+	}
+	defer rows.Close()
+	var runs []*JobRun
+	for rows.Next() {
+		run := &JobRun{}
+		var startedAt, endedAt, siteErrors string
+		var duration int64
+		if err = rows.Scan(&run.Id, &run.Job, &run.Subscriber, &startedAt, &endedAt, &duration, &run.Outcome, &run.Error, &run.Trigger,
+			&run.Sites, &run.Found, &run.Filtered, &run.Sent, &run.Bytes, &siteErrors); err != nil {
+			return nil, errors.Newf(errors.Internal, err, "scan job run failed")
+		}
+		if run.StartedAt, err = parseTime(startedAt); err != nil {
+			return nil, errors.Newf(errors.Internal, err, "invalid start time of run %d", run.Id)
+		}
+		if run.EndedAt, err = parseTime(endedAt); err != nil {
+			return nil, errors.Newf(errors.Internal, err, "invalid end time of run %d", run.Id)
+		}
+		if err = json.Unmarshal([]byte(siteErrors), &run.SiteErrors); err != nil {
+			return nil, errors.Newf(errors.Internal, err, "invalid site errors of run %d", run.Id)
+		}
+		run.Duration = time.Duration(duration) * time.Millisecond
+		runs = append(runs, run)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Newf(errors.Internal, err, "query job runs failed")
+	}
+	return runs, nil
+}
+
+func (s *sqllite) PruneJobRuns(ses Session, before time.Time) (int64, error) {
+	r, err := ses.Exec(`DELETE FROM job_runs WHERE started_at < ?`, formatTime(before))
+	if err != nil {
+		return 0, errors.Newf(errors.Internal, err, "prune job runs failed")
+	}
+	n, err := r.RowsAffected()
+	if err != nil {
+		return 0, errors.Newf(errors.Internal, err, "prune job runs failed")
+	}
+	return n, nil
+}
+
+func (s *sqllite) EnqueueMessages(ses Session, msgs ...*Message) error {
+	q := `
+INSERT INTO outbox (email, notifier, subject, body, state, attempts, next_attempt_at, last_error, created_at)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);
+`
+	fq := `INSERT INTO outbox_feed (message_id, feed_id, email, site) VALUES (?, ?, ?, ?);`
+	for _, msg := range msgs {
+		args := []interface{}{
+			msg.Email, msg.Notifier, msg.Subject, msg.Body, msg.State, msg.Attempts,
+			formatTime(msg.NextAttemptAt), msg.LastError, formatTime(msg.CreatedAt),
+		}
+		r, err := ses.Exec(q, args...)
+		if err != nil {
+			return errors.Newf(errors.Internal, err, "enqueue message failed")
+		}
+		if msg.Id, err = r.LastInsertId(); err != nil {
+			return errors.Newf(errors.Internal, err, "enqueue message failed")
+		}
+		for _, f := range msg.Feeds {
+			if _, err = ses.Exec(fq, msg.Id, f.Id, f.Email, f.SiteURL); err != nil {
+				return errors.Newf(errors.Internal, err, "enqueue message feeds failed")
+			}
+		}
+	}
+	return nil
+}
+
+func (s *sqllite) UpdateMessage(ses Session, msg *Message) error {
+	q := `
+UPDATE outbox SET state = ?, attempts = ?, next_attempt_at = ?, last_error = ?, sent_at = ? WHERE id = ?
+`
+	var sentAt *string
+	if !msg.SentAt.IsZero() {
+		v := formatTime(msg.SentAt)
+		sentAt = &v
+	}
+	args := []interface{}{
+		msg.State, msg.Attempts, formatTime(msg.NextAttemptAt), msg.LastError, sentAt, msg.Id,
+	}
+	if _, err := ses.Exec(q, args...); err != nil {
+		return errors.Newf(errors.Internal, err, "update message %d failed", msg.Id)
+	}
+	return nil
+}
+
+const selectMessages = `
+SELECT id, email, notifier, subject, body, state, attempts, next_attempt_at, last_error, created_at, sent_at FROM outbox
+`
+
+func (s *sqllite) GetMessage(ses Session, id int64) (*Message, error) {
+	msgs, err := s.queryMessages(ses, selectMessages+`WHERE id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) == 0 {
+		return nil, errors.Newf(errors.NotFound, nil, "message %d not found", id)
+	}
+	return msgs[0], nil
+}
+
+func (s *sqllite) GetMessages(ses Session, state MessageState, limit int) ([]*Message, error) {
+	if state == "" {
+		return s.queryMessages(ses, selectMessages+`ORDER BY id DESC LIMIT ?`, limit)
+	}
+	return s.queryMessages(ses, selectMessages+`WHERE state = ? ORDER BY id DESC LIMIT ?`, state, limit)
+}
+
+func (s *sqllite) GetDueMessages(ses Session, now time.Time, limit int) ([]*Message, error) {
+	q := selectMessages + `WHERE state = ? AND next_attempt_at <= ? ORDER BY next_attempt_at, id LIMIT ?`
+	return s.queryMessages(ses, q, MessagePending, formatTime(now), limit)
+}
+
+func (s *sqllite) queryMessages(ses Session, q string, args ...any) ([]*Message, error) {
+	rows, err := ses.Query(q, args...)
+	if err != nil {
+		return nil, errors.Newf(errors.Internal, err, "query messages failed")
+	}
+	var msgs []*Message
+	for rows.Next() {
+		msg := &Message{}
+		var nextAttemptAt, createdAt string
+		var sentAt *string
+		if err = rows.Scan(&msg.Id, &msg.Email, &msg.Notifier, &msg.Subject, &msg.Body, &msg.State, &msg.Attempts,
+			&nextAttemptAt, &msg.LastError, &createdAt, &sentAt); err != nil {
+			rows.Close()
+			return nil, errors.Newf(errors.Internal, err, "scan message failed")
+		}
+		if msg.NextAttemptAt, err = parseTime(nextAttemptAt); err != nil {
+			rows.Close()
+			return nil, errors.Newf(errors.Internal, err, "invalid next attempt time of message %d", msg.Id)
+		}
+		if msg.CreatedAt, err = parseTime(createdAt); err != nil {
+			rows.Close()
+			return nil, errors.Newf(errors.Internal, err, "invalid creation time of message %d", msg.Id)
+		}
+		if sentAt != nil {
+			if msg.SentAt, err = parseTime(*sentAt); err != nil {
+				rows.Close()
+				return nil, errors.Newf(errors.Internal, err, "invalid sent time of message %d", msg.Id)
+			}
+		}
+		msgs = append(msgs, msg)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, errors.Newf(errors.Internal, err, "query messages failed")
+	}
+	// Load the feeds after the rows are closed, a transactional session
+	// can't run queries in parallel.
+	fq := `SELECT feed_id, email, site FROM outbox_feed WHERE message_id = ?`
+	for _, msg := range msgs {
+		rows, err = ses.Query(fq, msg.Id)
+		if err != nil {
+			return nil, errors.Newf(errors.Internal, err, "query message feeds failed")
+		}
+		for rows.Next() {
+			f := &Feed{}
+			if err = rows.Scan(&f.Id, &f.Email, &f.SiteURL); err != nil {
+				rows.Close()
+				return nil, errors.Newf(errors.Internal, err, "scan message feed failed")
+			}
+			msg.Feeds = append(msg.Feeds, f)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return nil, errors.Newf(errors.Internal, err, "query message feeds failed")
+		}
+	}
+	return msgs, nil
+}
+
 func (s *sqllite) migrate(ctx context.Context) error {
 	q := `
 CREATE TABLE IF NOT EXISTS feed (
@@ -96,10 +1004,176 @@ CREATE TABLE IF NOT EXISTS feed (
 );
 CREATE INDEX IF NOT EXISTS idx_feed_id ON feed(id);
 CREATE INDEX IF NOT EXISTS idx_feed_email_site ON feed(email, site);
+
+CREATE TABLE IF NOT EXISTS outbox (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    email TEXT NOT NULL,
+    notifier TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    body BLOB NOT NULL,
+    state TEXT NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TEXT NOT NULL,
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at TEXT NOT NULL,
+    sent_at TEXT
+);
+CREATE INDEX IF NOT EXISTS idx_outbox_state_next_attempt_at ON outbox(state, next_attempt_at);
+
+CREATE TABLE IF NOT EXISTS outbox_feed (
+    message_id INTEGER NOT NULL,
+    feed_id TEXT NOT NULL,
+    email TEXT NOT NULL,
+    site TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_outbox_feed_message_id ON outbox_feed(message_id);
+CREATE INDEX IF NOT EXISTS idx_outbox_feed_feed ON outbox_feed(feed_id, email, site);
+
+CREATE TABLE IF NOT EXISTS item_state (
+    email TEXT NOT NULL,
+    site TEXT NOT NULL,
+    feed_id TEXT NOT NULL,
+    read INTEGER NOT NULL DEFAULT 0,
+    starred INTEGER NOT NULL DEFAULT 0,
+    archived INTEGER NOT NULL DEFAULT 0,
+    updated_at TEXT NOT NULL,
+    PRIMARY KEY (email, site, feed_id)
+);
+
+CREATE TABLE IF NOT EXISTS item_tag (
+    email TEXT NOT NULL,
+    site TEXT NOT NULL,
+    feed_id TEXT NOT NULL,
+    tag TEXT NOT NULL,
+    created_at TEXT NOT NULL,
+    PRIMARY KEY (email, site, feed_id, tag)
+);
+
+CREATE TABLE IF NOT EXISTS subscriber (
+    name TEXT PRIMARY KEY,
+    email TEXT NOT NULL UNIQUE,
+    -- spec is the subscriber in json, e.g., the sites & the schedules.
+    spec TEXT NOT NULL,
+    created_at TEXT NOT NULL,
+    updated_at TEXT NOT NULL
+);
+
+-- meta is the state of the storage itself, e.g., the time the subscribers
+-- are seeded from the config.
+CREATE TABLE IF NOT EXISTS meta (
+    key TEXT PRIMARY KEY,
+    value TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS subscription_state (
+    email TEXT PRIMARY KEY,
+    paused_until TEXT,
+    unsubscribed_at TEXT,
+    updated_at TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS muted_site (
+    email TEXT NOT NULL,
+    site TEXT NOT NULL,
+    muted_at TEXT NOT NULL,
+    PRIMARY KEY (email, site)
+);
+
+CREATE TABLE IF NOT EXISTS login_token (
+    hash TEXT PRIMARY KEY,
+    subscriber TEXT NOT NULL,
+    expires_at TEXT NOT NULL,
+    created_at TEXT NOT NULL,
+    used_at TEXT
+);
+
+CREATE TABLE IF NOT EXISTS job_state (
+    name TEXT PRIMARY KEY,
+    scheduled_at TEXT NOT NULL,
+    started_at TEXT NOT NULL,
+    duration_ms INTEGER NOT NULL,
+    outcome TEXT NOT NULL,
+    error TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS endpoint_poll (
+    email TEXT NOT NULL,
+    endpoint TEXT NOT NULL,
+    interval_ms INTEGER NOT NULL,
+    next_fetch_at TEXT NOT NULL,
+    PRIMARY KEY (email, endpoint)
+);
+
+CREATE TABLE IF NOT EXISTS lease (
+    name TEXT PRIMARY KEY,
+    holder TEXT NOT NULL,
+    token INTEGER NOT NULL,
+    expires_at INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS job_runs (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    job TEXT NOT NULL,
+    subscriber TEXT NOT NULL,
+    started_at TEXT NOT NULL,
+    ended_at TEXT NOT NULL,
+    duration_ms INTEGER NOT NULL,
+    outcome TEXT NOT NULL,
+    error TEXT NOT NULL,
+    triggered_by TEXT NOT NULL,
+    sites INTEGER NOT NULL,
+    found INTEGER NOT NULL,
+    filtered INTEGER NOT NULL,
+    sent INTEGER NOT NULL,
+    bytes INTEGER NOT NULL,
+    site_errors TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_job_runs_job ON job_runs(job);
+CREATE INDEX IF NOT EXISTS idx_job_runs_started_at ON job_runs(started_at);
+
+CREATE TABLE IF NOT EXISTS inbound (
+    id TEXT NOT NULL,
+    site TEXT NOT NULL,
+    title TEXT NOT NULL,
+    content TEXT NOT NULL,
+    author TEXT NOT NULL,
+    published_at TEXT NOT NULL,
+    received_at TEXT NOT NULL,
+    PRIMARY KEY (site, id)
+);
 `
 	if _, err := s.db.ExecContext(ctx, q); err != nil {
 		return errors.Newf(errors.Internal, err, "migrate sqlite schemas failed")
 	}
+	// saved_at is the time the feed is saved in timeLayout, the feeds
+	// saved before it's added have it null.
+	return s.addColumn(ctx, "feed", "saved_at", "TEXT")
+}
+
+// addColumn adds the column to the table if it doesn't exist yet.
+func (s *sqllite) addColumn(ctx context.Context, table, column, def string) error {
+	rows, err := s.db.QueryContext(ctx, `SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return errors.Newf(errors.Internal, err, "query columns of %s failed", table)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return errors.Newf(errors.Internal, err, "scan column of %s failed", table)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return errors.Newf(errors.Internal, err, "query columns of %s failed", table)
+	}
+	rows.Close()
+	if _, err = s.db.ExecContext(ctx, `ALTER TABLE `+table+` ADD COLUMN `+column+` `+def); err != nil {
+		return errors.Newf(errors.Internal, err, "add column %s to %s failed", column, table)
+	}
 	return nil
 }
 
@@ -35,6 +35,7 @@ func TestSqllite(t *testing.T) {
 			"2023-07-22 07:00:00",
 			"foo",
 			mustParseTime("2023-07-22 07:00:00"),
+			false,
 		},
 		{
 			"2",
@@ -49,6 +50,7 @@ func TestSqllite(t *testing.T) {
 			"2023-07-22 08:00:00",
 			"foo",
 			mustParseTime("2023-07-22 08:00:00"),
+			false,
 		},
 		{
 			"nack",
@@ -63,6 +65,7 @@ func TestSqllite(t *testing.T) {
 			"2023-07-22 09:00:00",
 			"foo",
 			mustParseTime("2023-07-22 09:00:00"),
+			false,
 		},
 	}
 	ctx := context.Background()
@@ -85,7 +88,7 @@ func TestSqllite(t *testing.T) {
 		if it.Id == "nack" {
 			continue
 		}
-		if err := s.AckFeeds(ses, ackAt, it.Id); err != nil {
+		if err := s.AckFeeds(ses, ackAt, it); err != nil {
 			t.Fatal(err)
 		}
 	}
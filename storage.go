@@ -31,8 +31,97 @@ type Storage interface {
 	NewSession(ctx context.Context) (Session, error)
 	NewAutoSession(ctx context.Context) (Session, error)
 	SaveFeeds(ses Session, feeds ...*Feed) error
-	AckFeeds(ses Session, at time.Time, feedIds ...string) error
+	// AckFeeds marks the feeds as notified, a feed is identified by its
+	// email, site url & id since the same item is saved once per subscriber.
+	AckFeeds(ses Session, at time.Time, feeds ...*Feed) error
 	GetLatestFeedWaterMark(ses Session, email, site string) (time.Time, error)
+	// GetLatestFetchWaterMark is the same as GetLatestFeedWaterMark except
+	// that the pending feeds, i.e., saved but not notified yet, are counted.
+	GetLatestFetchWaterMark(ses Session, email, site string) (time.Time, error)
+	// GetPendingFeeds returns the saved feeds of the subscriber which are
+	// neither acked nor enqueued in the outbox, in the order they're saved.
+	GetPendingFeeds(ses Session, email string) ([]*Feed, error)
+	// IsFeedSent reports whether a message of the item of the feed, i.e.,
+	// any version of it, is sent to the subscriber.
+	IsFeedSent(ses Session, feed *Feed) (bool, error)
+	// GetFeeds returns the saved feeds of the subscriber by the query, the
+	// latest saved version of every item only, from the newest to oldest.
+	GetFeeds(ses Session, query FeedQuery) ([]*Feed, error)
+	// GetItems returns the items of the subscriber by the query, refer
+	// to Item.
+	GetItems(ses Session, query ItemQuery) ([]*Item, error)
+	// GetItemRefs is the same as GetItems except that the references of
+	// the items are returned only.
+	GetItemRefs(ses Session, query ItemQuery) ([]ItemRef, error)
+	// UpdateItems changes the state of the items of the subscriber, the
+	// items marked as read are acked too.
+	UpdateItems(ses Session, email string, seqs []int64, change ItemChange, at time.Time) error
+	// GetSubscribers returns the subscribers managed in the storage in
+	// name order.
+	GetSubscribers(ses Session) ([]Subscriber, error)
+	// CreateSubscriber saves a new subscriber, the name & the email are
+	// unique.
+	CreateSubscriber(ses Session, subscriber Subscriber, at time.Time) error
+	// UpdateSubscriber replaces the subscriber of the same name.
+	UpdateSubscriber(ses Session, subscriber Subscriber, at time.Time) error
+	DeleteSubscriber(ses Session, name string) error
+	// IsSubscribersSeeded reports whether the subscribers are seeded from
+	// the config, which is done once only.
+	IsSubscribersSeeded(ses Session) (bool, error)
+	MarkSubscribersSeeded(ses Session, at time.Time) error
+	// GetSubscriptionState returns the state of the subscription, which is
+	// the zero state if it's never changed.
+	GetSubscriptionState(ses Session, email string) (*SubscriptionState, error)
+	// UpdateSubscriptionState changes the state of the subscription.
+	UpdateSubscriptionState(ses Session, email string, change SubscriptionChange, at time.Time) error
+	// CreateLoginToken saves the one-time token of a magic link, the
+	// expired tokens are purged.
+	CreateLoginToken(ses Session, token LoginToken) error
+	// ConsumeLoginToken uses up the token by the hash & returns the name
+	// of the subscriber, it's NotFound if the token is unknown, used or
+	// expired.
+	ConsumeLoginToken(ses Session, hash string, now time.Time) (string, error)
+	// GetJobState returns the state of the scheduled job by the name, which
+	// is the zero state if the job never ran.
+	GetJobState(ses Session, name string) (*JobState, error)
+	// SaveJobState replaces the state of the scheduled job.
+	SaveJobState(ses Session, state *JobState) error
+	// GetEndpointPolls returns the polling states of the site urls of the
+	// subscriber, which are polled adaptively.
+	GetEndpointPolls(ses Session, email string) ([]*EndpointPoll, error)
+	// SaveEndpointPoll replaces the polling state of the site url.
+	SaveEndpointPoll(ses Session, poll *EndpointPoll) error
+	// AcquireLease acquires or renews the lease for the holder & sets its
+	// token, it's FailedPrecondition if the lease is held by another
+	// holder & not expired at the time.
+	AcquireLease(ses Session, lease *Lease, now time.Time) error
+	// ReleaseLease expires the lease if it's held by the holder.
+	ReleaseLease(ses Session, name, holder string) error
+	// GetLease returns the lease by the name, it's NotFound if it's never
+	// acquired.
+	GetLease(ses Session, name string) (*Lease, error)
+	// SaveJobRun records the run of a scheduled job in the run history &
+	// sets its id.
+	SaveJobRun(ses Session, run *JobRun) error
+	// GetJobRuns returns the runs by the query from the newest to oldest.
+	GetJobRuns(ses Session, query JobRunQuery) ([]*JobRun, error)
+	// GetJobRun returns the run by the id, it's NotFound if there is no
+	// such run.
+	GetJobRun(ses Session, id int64) (*JobRun, error)
+	// PruneJobRuns deletes the runs started before the time & returns the
+	// number of the runs deleted.
+	PruneJobRuns(ses Session, before time.Time) (int64, error)
+	// SaveInboundFeed saves the feed received by mail under its site, a
+	// feed received more than once is saved once.
+	SaveInboundFeed(ses Session, feed *Feed) error
+	// GetInboundFeeds returns the feeds received under the site which
+	// are not saved for the subscriber yet.
+	GetInboundFeeds(ses Session, email, site string) ([]*Feed, error)
+	EnqueueMessages(ses Session, msgs ...*Message) error
+	UpdateMessage(ses Session, msg *Message) error
+	GetMessage(ses Session, id int64) (*Message, error)
+	GetMessages(ses Session, state MessageState, limit int) ([]*Message, error)
+	GetDueMessages(ses Session, now time.Time, limit int) ([]*Message, error)
 	Close() error
 }
 
@@ -64,6 +153,212 @@ type Feed struct {
 	PublishedAt string
 	Author      string
 	FetchAt     time.Time
+	// Update is set if an earlier version of the item is sent, so that
+	// it's threaded under that one. It's not saved.
+	Update bool
+}
+
+// FeedQuery filters the saved feeds of a subscriber.
+type FeedQuery struct {
+	Email string
+	// Sites are the site urls to include, all the sites if it's empty.
+	Sites  []string
+	Limit  int
+	Offset int
+}
+
+// Item is the latest saved version of a feed along with the reading
+// state of the subscriber.
+type Item struct {
+	*Feed
+	// Seq is the row id of the saved feed, it identifies the item in the
+	// reader apis.
+	Seq      int64
+	SavedAt  time.Time
+	Read     bool
+	Starred  bool
+	Archived bool
+	// Tags are the labels the subscriber puts on the item, in order.
+	Tags []string
+}
+
+// ItemRef references an item.
+type ItemRef struct {
+	Seq     int64
+	SiteURL string
+	SavedAt time.Time
+}
+
+// ItemQuery filters the items of a subscriber, the zero values are not
+// used as filters.
+type ItemQuery struct {
+	Email string
+	Sites []string
+	Seqs  []int64
+	// Ids are the feed ids, i.e., the guids of the items.
+	Ids      []string
+	Read     *bool
+	Starred  *bool
+	Archived *bool
+	Tag      string
+	// Search matches the items which contain the text in the title, the
+	// description or the content, case-insensitively for ascii.
+	Search string
+	// MinSeq & MaxSeq bound the seq exclusively.
+	MinSeq int64
+	MaxSeq int64
+	// SavedAfter & SavedBefore bound the saved time exclusively.
+	SavedAfter  time.Time
+	SavedBefore time.Time
+	// Desc orders the items from the newest to the oldest.
+	Desc  bool
+	Limit int
+}
+
+// ItemChange changes the state of the items, the nil fields are kept.
+type ItemChange struct {
+	Read     *bool
+	Starred  *bool
+	Archived *bool
+	// AddTags & RemoveTags are the tags to put on & take off the items.
+	AddTags    []string
+	RemoveTags []string
+}
+
+// LoginToken is the one-time token of a magic link to sign in the web
+// reader, the token itself is never saved but its hash.
+type LoginToken struct {
+	Hash       string
+	Subscriber string
+	ExpiresAt  time.Time
+}
+
+const (
+	RunOK       = "ok"
+	RunFailed   = "failed"
+	RunTimedOut = "timeout"
+)
+
+// The triggers of the runs started manually rather than by the schedule.
+const (
+	TriggerAPI    = "api"
+	TriggerCLI    = "cli"
+	TriggerSignal = "signal"
+)
+
+// JobState is the state of the last run of a scheduled job, it's kept
+// across the restarts to catch up the runs missed.
+type JobState struct {
+	Name string
+	// Scheduled is the time the run was due, Started is the time it
+	// actually started.
+	Scheduled time.Time
+	Started   time.Time
+	Duration  time.Duration
+	// Outcome is one of ok, failed & timeout, Error is the message of the
+	// error the run failed by.
+	Outcome string
+	Error   string
+}
+
+// EndpointPoll is the polling state of a site url of a subscriber, the
+// url is polled every interval derived from its publishing frequency.
+type EndpointPoll struct {
+	Email       string
+	Endpoint    string
+	Interval    time.Duration
+	NextFetchAt time.Time
+}
+
+// Lease is held by a holder until it expires unless it's renewed. Token
+// is increased every time the lease changes hands, which fences off the
+// former holders.
+type Lease struct {
+	Name      string
+	Holder    string
+	Token     int64
+	ExpiresAt time.Time
+}
+
+// JobRun is a run of a scheduled job in the run history.
+type JobRun struct {
+	Id  int64  `json:"id"`
+	Job string `json:"job"`
+	// Subscriber is the name of the subscriber the job runs for, it's
+	// empty if the job is not of a subscriber.
+	Subscriber string        `json:"subscriber,omitempty"`
+	StartedAt  time.Time     `json:"startedAt"`
+	EndedAt    time.Time     `json:"endedAt"`
+	Duration   time.Duration `json:"duration"`
+	Outcome    string        `json:"outcome"`
+	Error      string        `json:"error,omitempty"`
+	// Trigger is how the run is started manually, e.g., api, it's empty
+	// if the run is started by the schedule.
+	Trigger string `json:"trigger,omitempty"`
+	// Sites is the number of the site urls fetched, Found is the number of
+	// the items in them, of which Filtered are skipped since they're seen
+	// already. Sent is the number of the feeds handed to the notifiers.
+	Sites    int `json:"sites"`
+	Found    int `json:"found"`
+	Filtered int `json:"filtered"`
+	Sent     int `json:"sent"`
+	// Bytes is the size of the responses of the site urls.
+	Bytes      int64       `json:"bytes"`
+	SiteErrors []SiteError `json:"siteErrors,omitempty"`
+}
+
+// SiteError is the error a site url failed by in a run.
+type SiteError struct {
+	Site  string `json:"site"`
+	Code  string `json:"code"`
+	Error string `json:"error"`
+}
+
+// JobRunQuery filters the run history, the zero values are not used as
+// filters.
+type JobRunQuery struct {
+	Job        string
+	Subscriber string
+	Outcome    string
+	Limit      int
+}
+
+// SubscriptionState is the state of a subscription changed by the
+// subscriber, e.g., by the links in the mails.
+type SubscriptionState struct {
+	Email string
+	// PausedUntil is the time the subscription is paused until.
+	PausedUntil time.Time
+	// UnsubscribedAt is the time the subscriber unsubscribed, the zero
+	// time if it's subscribed.
+	UnsubscribedAt time.Time
+	// MutedSites are the urls of the sites which are not fetched.
+	MutedSites []string
+}
+
+// Active reports whether the feeds are fetched & sent at the time.
+func (s *SubscriptionState) Active(now time.Time) bool {
+	return s.UnsubscribedAt.IsZero() && !now.Before(s.PausedUntil)
+}
+
+// Muted reports whether the site url is muted.
+func (s *SubscriptionState) Muted(siteURL string) bool {
+	for _, site := range s.MutedSites {
+		if site == siteURL {
+			return true
+		}
+	}
+	return false
+}
+
+// SubscriptionChange changes the state of a subscription, the nil fields
+// are kept.
+type SubscriptionChange struct {
+	PausedUntil  *time.Time
+	Unsubscribed *bool
+	// MuteSites & UnmuteSites are the site urls to mute & unmute.
+	MuteSites   []string
+	UnmuteSites []string
 }
 
 type Email string
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maxnilz/feed/errors"
+)
+
+// Subscribers is the registry of the subscribers shared by the daemon,
+// the changes are persisted in the storage if it's loaded from one, &
+// the watchers are told about them, e.g., to reschedule the workers.
+type Subscribers struct {
+	cfg     Config
+	storage Storage
+
+	// changeMu serializes the changes, mu guards the registry.
+	changeMu sync.Mutex
+	mu       sync.RWMutex
+	m        map[string]Subscriber
+	watchers []func(old, new *Subscriber)
+}
+
+// NewSubscribers returns the in-memory registry of the subscribers.
+func NewSubscribers(subscribers []Subscriber) *Subscribers {
+	s := &Subscribers{m: make(map[string]Subscriber)}
+	for _, subscriber := range subscribers {
+		s.m[subscriber.Name] = subscriber
+	}
+	return s
+}
+
+// LoadSubscribers returns the registry of the subscribers managed in the
+// storage, which are seeded by the ones in the config on the first start.
+// The config subscribers are ignored afterwards, even if all the subscribers
+// are deleted.
+func LoadSubscribers(ctx context.Context, cfg Config, storage Storage, logger Logger) (*Subscribers, error) {
+	ses, err := storage.NewSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if ses, err = ses.Begin(); err != nil {
+		return nil, err
+	}
+	defer func() { _ = ses.Rollback() }()
+	seeded, err := storage.IsSubscribersSeeded(ses)
+	if err != nil {
+		return nil, err
+	}
+	subscribers, err := storage.GetSubscribers(ses)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case !seeded && len(subscribers) == 0:
+		now := time.Now()
+		for _, subscriber := range cfg.Subscribers {
+			if err = validateSubscriber(cfg, subscriber); err != nil {
+				return nil, err
+			}
+			if err = storage.CreateSubscriber(ses, subscriber, now); err != nil {
+				return nil, err
+			}
+		}
+		subscribers = cfg.Subscribers
+		logger.Info("seeded subscribers from the config", "subscribers", len(subscribers))
+	case len(cfg.Subscribers) > 0:
+		logger.Info("config subscribers are ignored, the subscribers are managed in the storage")
+	}
+	// The storages seeded before the marker is added have the subscribers
+	// already, they're marked as seeded too.
+	if !seeded {
+		if err = storage.MarkSubscribersSeeded(ses, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+	if err = ses.Commit(); err != nil {
+		return nil, err
+	}
+	s := NewSubscribers(subscribers)
+	s.cfg, s.storage = cfg, storage
+	return s, nil
+}
+
+func (s *Subscribers) Get(name string) (Subscriber, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	subscriber, ok := s.m[name]
+	return subscriber, ok
+}
+
+// GetByEmail returns the subscriber by the email case-insensitively.
+func (s *Subscribers) GetByEmail(email string) (Subscriber, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, subscriber := range s.m {
+		if strings.EqualFold(subscriber.Email, email) {
+			return subscriber, true
+		}
+	}
+	return Subscriber{}, false
+}
+
+// List returns the subscribers in name order.
+func (s *Subscribers) List() []Subscriber {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	subscribers := make([]Subscriber, 0, len(s.m))
+	for _, subscriber := range s.m {
+		subscribers = append(subscribers, subscriber)
+	}
+	sort.Slice(subscribers, func(i, j int) bool { return subscribers[i].Name < subscribers[j].Name })
+	return subscribers
+}
+
+// Watch registers the function called after a subscriber is created,
+// updated or deleted, old is nil on creation & new is nil on deletion.
+func (s *Subscribers) Watch(fn func(old, new *Subscriber)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.watchers = append(s.watchers, fn)
+}
+
+func (s *Subscribers) Create(ctx context.Context, subscriber Subscriber) error {
+	return s.change(ctx, subscriber.Name, func(old *Subscriber, ses Session) (*Subscriber, error) {
+		if old != nil {
+			return nil, errors.Newf(errors.AlreadyExists, nil, "subscriber %s already exists", subscriber.Name)
+		}
+		if other, ok := s.GetByEmail(subscriber.Email); ok {
+			return nil, errors.Newf(errors.AlreadyExists, nil, "%s is subscribed by %s", subscriber.Email, other.Name)
+		}
+		if err := validateSubscriber(s.cfg, subscriber); err != nil {
+			return nil, err
+		}
+		if ses != nil {
+			return &subscriber, s.storage.CreateSubscriber(ses, subscriber, time.Now())
+		}
+		return &subscriber, nil
+	})
+}
+
+// Update replaces the subscriber of the same name.
+func (s *Subscribers) Update(ctx context.Context, subscriber Subscriber) error {
+	return s.change(ctx, subscriber.Name, func(old *Subscriber, ses Session) (*Subscriber, error) {
+		if old == nil {
+			return nil, errors.Newf(errors.NotFound, nil, "subscriber %s not found", subscriber.Name)
+		}
+		if other, ok := s.GetByEmail(subscriber.Email); ok && other.Name != subscriber.Name {
+			return nil, errors.Newf(errors.AlreadyExists, nil, "%s is subscribed by %s", subscriber.Email, other.Name)
+		}
+		if err := validateSubscriber(s.cfg, subscriber); err != nil {
+			return nil, err
+		}
+		if ses != nil {
+			return &subscriber, s.storage.UpdateSubscriber(ses, subscriber, time.Now())
+		}
+		return &subscriber, nil
+	})
+}
+
+func (s *Subscribers) Delete(ctx context.Context, name string) error {
+	return s.change(ctx, name, func(old *Subscriber, ses Session) (*Subscriber, error) {
+		if old == nil {
+			return nil, errors.Newf(errors.NotFound, nil, "subscriber %s not found", name)
+		}
+		if ses != nil {
+			return nil, s.storage.DeleteSubscriber(ses, name)
+		}
+		return nil, nil
+	})
+}
+
+// change applies the change to the subscriber of the name, the changes
+// are serialized so that the storage & the registry are kept in sync.
+func (s *Subscribers) change(ctx context.Context, name string, fn func(old *Subscriber, ses Session) (*Subscriber, error)) error {
+	s.changeMu.Lock()
+	defer s.changeMu.Unlock()
+	var old *Subscriber
+	if subscriber, ok := s.Get(name); ok {
+		old = &subscriber
+	}
+	var ses Session
+	if s.storage != nil {
+		var err error
+		if ses, err = s.storage.NewAutoSession(ctx); err != nil {
+			return err
+		}
+	}
+	updated, err := fn(old, ses)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if updated != nil {
+		s.m[name] = *updated
+	} else {
+		delete(s.m, name)
+	}
+	watchers := s.watchers
+	s.mu.Unlock()
+	for _, watch := range watchers {
+		watch(old, updated)
+	}
+	return nil
+}
+
+// validateSubscriber checks the subscriber the way the daemon uses it,
+// e.g., the schedules & the notifiers.
+func validateSubscriber(cfg Config, subscriber Subscriber) error {
+	if subscriber.Name == "" || strings.ContainsAny(subscriber.Name, "/?#") {
+		return errors.Newf(errors.InvalidArgument, nil, "invalid subscriber name %q", subscriber.Name)
+	}
+	if _, err := mail.ParseAddress(subscriber.Email); err != nil {
+		return errors.Newf(errors.InvalidArgument, err, "invalid email of %s", subscriber.Name)
+	}
+	names := make(map[string]bool)
+	for _, site := range subscriber.Sites {
+		if site.Name == "" || names[site.Name] {
+			return errors.Newf(errors.InvalidArgument, nil, "invalid or duplicated site name %q of %s", site.Name, subscriber.Name)
+		}
+		names[site.Name] = true
+		for _, endpoint := range append([]string{site.URL}, site.URLs...) {
+			if endpoint == "" {
+				continue
+			}
+			if u, err := url.Parse(endpoint); err != nil || u.Scheme == "" {
+				return errors.Newf(errors.InvalidArgument, err, "invalid url %q of site %s", endpoint, site.Name)
+			}
+		}
+	}
+	if subscriber.FetchSpec() == "" && subscriber.Adaptive == nil {
+		return errors.Newf(errors.InvalidArgument, nil, "schedule of %s is required", subscriber.Name)
+	}
+	if _, err := loadLocation(subscriber.Timezone); err != nil {
+		return err
+	}
+	for _, spec := range []string{subscriber.FetchSpec(), string(subscriber.DigestSchedule)} {
+		if spec == "" {
+			continue
+		}
+		if _, err := parseSchedule(subscriber.ZonedSpec(spec)); err != nil {
+			return errors.Newf(errors.InvalidArgument, err, "invalid schedule %q of %s", spec, subscriber.Name)
+		}
+	}
+	if _, err := newQuietHours(subscriber.QuietHours, subscriber.Timezone); err != nil {
+		return err
+	}
+	if a := subscriber.Adaptive; a != nil && (a.MinInterval < 0 || a.MaxInterval < 0 ||
+		(a.MinInterval > 0 && a.MaxInterval > 0 && a.MinInterval > a.MaxInterval)) {
+		return errors.Newf(errors.InvalidArgument, nil, "invalid adaptive polling intervals of %s", subscriber.Name)
+	}
+	if subscriber.Jitter < 0 {
+		return errors.Newf(errors.InvalidArgument, nil, "invalid jitter of %s", subscriber.Name)
+	}
+	if err := validateOverlap(subscriber.Overlap); err != nil {
+		return err
+	}
+	if err := validateCatchUp(subscriber.CatchUp); err != nil {
+		return err
+	}
+	if subscriber.MaxRunDuration < 0 {
+		return errors.Newf(errors.InvalidArgument, nil, "invalid max run duration of %s", subscriber.Name)
+	}
+	cfg.Subscribers = []Subscriber{subscriber}
+	_, err := NewNotifiers(cfg, DiscardLogger)
+	return err
+}
+
+// SubscribersAPI serves the json api to manage the subscribers at
+// /api/subscribers[/<name>[/sites[/<site>]]], the admin token of the
+// server is required as a bearer token, the api is disabled without it.
+type SubscribersAPI struct {
+	token       string
+	subscribers *Subscribers
+	logger      Logger
+}
+
+func NewSubscribersAPI(cfg Config, subscribers *Subscribers, logger Logger) *SubscribersAPI {
+	return &SubscribersAPI{token: cfg.Server.AdminToken, subscribers: subscribers, logger: logger}
+}
+
+func (a *SubscribersAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if a.token == "" || !validBearer(r, a.token) {
+		writeError(w, a.logger, errors.Newf(errors.NotFound, nil, "not found"))
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/subscribers"), "/"), "/")
+	for i, part := range parts {
+		parts[i], _ = url.PathUnescape(part)
+	}
+	var err error
+	switch {
+	case len(parts) == 1 && parts[0] == "":
+		err = a.serveSubscribers(w, r)
+	case len(parts) == 1:
+		err = a.serveSubscriber(w, r, parts[0])
+	case len(parts) == 2 && parts[1] == "sites":
+		err = a.serveSites(w, r, parts[0])
+	case len(parts) == 3 && parts[1] == "sites":
+		err = a.serveSite(w, r, parts[0], parts[2])
+	default:
+		err = errors.Newf(errors.NotFound, nil, "not found")
+	}
+	if err != nil {
+		writeError(w, a.logger, err)
+	}
+}
+
+func (a *SubscribersAPI) serveSubscribers(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet:
+		list := a.subscribers.List()
+		for i := range list {
+			list[i] = list[i].redacted()
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"subscribers": list})
+		return nil
+	case http.MethodPost:
+		var subscriber Subscriber
+		if err := decodeJSON(r, &subscriber); err != nil {
+			return err
+		}
+		if err := a.subscribers.Create(r.Context(), subscriber); err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusCreated, subscriber.redacted())
+		return nil
+	default:
+		return methodNotAllowed(w, "GET, POST")
+	}
+}
+
+func (a *SubscribersAPI) serveSubscriber(w http.ResponseWriter, r *http.Request, name string) error {
+	subscriber, ok := a.subscribers.Get(name)
+	if !ok {
+		return errors.Newf(errors.NotFound, nil, "subscriber %s not found", name)
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPatch:
+		// PATCH merges the fields in the body into the subscriber.
+		if r.Method == http.MethodPut {
+			subscriber = Subscriber{}
+		}
+		if err := decodeJSON(r, &subscriber); err != nil {
+			return err
+		}
+		if subscriber.Name != name {
+			return errors.Newf(errors.InvalidArgument, nil, "subscriber can't be renamed")
+		}
+		if err := a.subscribers.Update(r.Context(), subscriber); err != nil {
+			return err
+		}
+	case http.MethodDelete:
+		if err := a.subscribers.Delete(r.Context(), name); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	default:
+		return methodNotAllowed(w, "GET, PUT, PATCH, DELETE")
+	}
+	writeJSON(w, http.StatusOK, subscriber.redacted())
+	return nil
+}
+
+// redacted returns the subscriber without the secrets, i.e., the tokens,
+// the passwords & the ones of the notifiers, which are write-only in the
+// api.
+func (s Subscriber) redacted() Subscriber {
+	s.FeedToken, s.ReaderPassword, s.PasswordHash = "", "", ""
+	if s.Notifiers != nil {
+		notifiers := make([]NotifierConfig, len(s.Notifiers))
+		for i, nc := range s.Notifiers {
+			// The headers of the webhooks carry the credentials as well.
+			nc.Token, nc.Secret, nc.Headers = "", "", nil
+			notifiers[i] = nc
+		}
+		s.Notifiers = notifiers
+	}
+	return s
+}
+
+func (a *SubscribersAPI) serveSites(w http.ResponseWriter, r *http.Request, name string) error {
+	subscriber, ok := a.subscribers.Get(name)
+	if !ok {
+		return errors.Newf(errors.NotFound, nil, "subscriber %s not found", name)
+	}
+	switch r.Method {
+	case http.MethodGet:
+		sites := subscriber.Sites
+		if sites == nil {
+			sites = []Site{}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"sites": sites})
+		return nil
+	case http.MethodPost:
+		var site Site
+		if err := decodeJSON(r, &site); err != nil {
+			return err
+		}
+		for _, it := range subscriber.Sites {
+			if it.Name == site.Name {
+				return errors.Newf(errors.AlreadyExists, nil, "site %s of %s already exists", site.Name, name)
+			}
+		}
+		subscriber.Sites = append(append([]Site{}, subscriber.Sites...), site)
+		if err := a.subscribers.Update(r.Context(), subscriber); err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusCreated, site)
+		return nil
+	default:
+		return methodNotAllowed(w, "GET, POST")
+	}
+}
+
+func (a *SubscribersAPI) serveSite(w http.ResponseWriter, r *http.Request, name, siteName string) error {
+	subscriber, ok := a.subscribers.Get(name)
+	if !ok {
+		return errors.Newf(errors.NotFound, nil, "subscriber %s not found", name)
+	}
+	idx := -1
+	for i, site := range subscriber.Sites {
+		if site.Name == siteName {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		return errors.Newf(errors.NotFound, nil, "site %s of %s not found", siteName, name)
+	}
+	sites := append([]Site{}, subscriber.Sites...)
+	site := sites[idx]
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, site)
+		return nil
+	case http.MethodPut:
+		site = Site{}
+		if err := decodeJSON(r, &site); err != nil {
+			return err
+		}
+		sites[idx] = site
+	case http.MethodDelete:
+		sites = append(sites[:idx], sites[idx+1:]...)
+	default:
+		return methodNotAllowed(w, "GET, PUT, DELETE")
+	}
+	subscriber.Sites = sites
+	if err := a.subscribers.Update(r.Context(), subscriber); err != nil {
+		return err
+	}
+	if r.Method == http.MethodDelete {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	writeJSON(w, http.StatusOK, site)
+	return nil
+}
+
+func decodeJSON(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return errors.Newf(errors.InvalidArgument, err, "invalid json body")
+	}
+	return nil
+}
+
+func methodNotAllowed(w http.ResponseWriter, allow string) error {
+	w.Header().Set("Allow", allow)
+	writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSubscribers(t *testing.T) {
+	s := newTestSQLite(t)
+	cfg := Config{
+		Server:     ServerConfig{AdminToken: "s3cr3t"},
+		MailSender: MailSender{SmtpServer: "smtp.example.com:587", SenderAddr: "sender@example.com", Password: "password"},
+		Subscribers: []Subscriber{{
+			Name:     "foo",
+			Email:    "foo@example.com",
+			Schedule: "* * * * *",
+			Sites:    []Site{{Name: "site 0", URL: "https://site0.com/index.rss"}},
+		}},
+	}
+	ctx := context.Background()
+	subscribers, err := LoadSubscribers(ctx, cfg, s, DiscardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := subscribers.List(); len(list) != 1 || list[0].Name != "foo" {
+		t.Fatalf("unexpected seeded subscribers: %+v", list)
+	}
+	type change struct{ old, new string }
+	var changes []change
+	subscribers.Watch(func(old, new *Subscriber) {
+		var c change
+		if old != nil {
+			c.old = old.Name
+		}
+		if new != nil {
+			c.new = new.Name
+		}
+		changes = append(changes, c)
+	})
+
+	server, err := NewServer(cfg, DiscardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := NewSubscribersAPI(cfg, subscribers, DiscardLogger)
+	server.Handle("/api/subscribers", api)
+	server.Handle("/api/subscribers/", api)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	call := func(method, path, token, body string, out interface{}) int {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if out != nil {
+			if err = json.NewDecoder(resp.Body).Decode(out); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode
+	}
+	if status := call(http.MethodGet, "/api/subscribers", "wrong", "", nil); status != http.StatusNotFound {
+		t.Fatalf("expect 404 with a wrong token, got %d", status)
+	}
+	bar := `{"name":"bar","email":"bar@example.com","schedule":"0 * * * *","jitter":"30s","sites":[{"name":"site 1","url":"https://site1.com/index.rss"}]}`
+	if status := call(http.MethodPost, "/api/subscribers", "s3cr3t", bar, nil); status != http.StatusCreated {
+		t.Fatalf("expect 201 on creation, got %d", status)
+	}
+	if status := call(http.MethodPost, "/api/subscribers", "s3cr3t", bar, nil); status != http.StatusConflict {
+		t.Fatalf("expect 409 on duplicated creation, got %d", status)
+	}
+	invalid := `{"name":"baz","email":"baz@example.com","schedule":"every minute"}`
+	if status := call(http.MethodPost, "/api/subscribers", "s3cr3t", invalid, nil); status != http.StatusBadRequest {
+		t.Fatalf("expect 400 on an invalid schedule, got %d", status)
+	}
+	var list struct{ Subscribers []Subscriber }
+	if status := call(http.MethodGet, "/api/subscribers", "s3cr3t", "", &list); status != http.StatusOK ||
+		len(list.Subscribers) != 2 || list.Subscribers[0].Name != "bar" || list.Subscribers[0].Jitter != Duration(30*time.Second) {
+		t.Fatalf("unexpected subscribers: %d %+v", status, list)
+	}
+
+	var got Subscriber
+	if status := call(http.MethodPatch, "/api/subscribers/bar", "s3cr3t", `{"digestSchedule":"0 8 * * *"}`, &got); status != http.StatusOK ||
+		got.DigestSchedule != "0 8 * * *" || got.Schedule != "0 * * * *" || len(got.Sites) != 1 {
+		t.Fatalf("unexpected patched subscriber: %d %+v", status, got)
+	}
+	if status := call(http.MethodPatch, "/api/subscribers/bar", "s3cr3t", `{"name":"qux"}`, nil); status != http.StatusBadRequest {
+		t.Fatalf("expect 400 on renaming, got %d", status)
+	}
+	site := `{"name":"site 2","url":"https://site2.com/index.rss"}`
+	if status := call(http.MethodPost, "/api/subscribers/bar/sites", "s3cr3t", site, nil); status != http.StatusCreated {
+		t.Fatalf("expect 201 on adding site, got %d", status)
+	}
+	if status := call(http.MethodPost, "/api/subscribers/bar/sites", "s3cr3t", site, nil); status != http.StatusConflict {
+		t.Fatalf("expect 409 on duplicated site, got %d", status)
+	}
+	if status := call(http.MethodDelete, "/api/subscribers/bar/sites/site%201", "s3cr3t", "", nil); status != http.StatusNoContent {
+		t.Fatalf("expect 204 on removing site, got %d", status)
+	}
+	var sites struct{ Sites []Site }
+	if status := call(http.MethodGet, "/api/subscribers/bar/sites", "s3cr3t", "", &sites); status != http.StatusOK ||
+		len(sites.Sites) != 1 || sites.Sites[0].Name != "site 2" {
+		t.Fatalf("unexpected sites: %d %+v", status, sites)
+	}
+	if status := call(http.MethodDelete, "/api/subscribers/foo", "s3cr3t", "", nil); status != http.StatusNoContent {
+		t.Fatalf("expect 204 on deletion, got %d", status)
+	}
+	if status := call(http.MethodGet, "/api/subscribers/foo", "s3cr3t", "", nil); status != http.StatusNotFound {
+		t.Fatalf("expect 404 after deletion, got %d", status)
+	}
+	expected := []change{{"", "bar"}, {"bar", "bar"}, {"bar", "bar"}, {"bar", "bar"}, {"foo", ""}}
+	if len(changes) != len(expected) {
+		t.Fatalf("unexpected changes: %+v", changes)
+	}
+	for i := range expected {
+		if changes[i] != expected[i] {
+			t.Fatalf("unexpected changes: %+v", changes)
+		}
+	}
+
+	// the subscribers in the storage win over the config once seeded.
+	reloaded, err := LoadSubscribers(ctx, cfg, s, DiscardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := reloaded.List(); len(list) != 1 || list[0].Name != "bar" || list[0].DigestSchedule != "0 8 * * *" ||
+		len(list[0].Sites) != 1 || list[0].Sites[0].Name != "site 2" {
+		t.Fatalf("unexpected reloaded subscribers: %+v", list)
+	}
+
+	// the config isn't seeded again after all the subscribers are deleted.
+	if err = reloaded.Delete(ctx, "bar"); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded, err = LoadSubscribers(ctx, cfg, s, DiscardLogger); err != nil {
+		t.Fatal(err)
+	}
+	if list := reloaded.List(); len(list) != 0 {
+		t.Fatalf("expect no subscribers after deleting all, got %+v", list)
+	}
+}
+
+func TestSubscribersRedacted(t *testing.T) {
+	s := newTestSQLite(t)
+	cfg := Config{Server: ServerConfig{AdminToken: "s3cr3t"}}
+	subscribers, err := LoadSubscribers(context.Background(), cfg, s, DiscardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := NewSubscribersAPI(cfg, subscribers, DiscardLogger)
+	call := func(method, path, body string) string {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer s3cr3t")
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, req)
+		if rec.Code >= 300 {
+			t.Fatalf("%s %s failed: %d %s", method, path, rec.Code, rec.Body)
+		}
+		return rec.Body.String()
+	}
+	secrets := []string{"feed-token", "reader-password", "password-hash", "bot-token", "signing-secret", "Bearer header"}
+	foo := `{"name":"foo","email":"foo@example.com","schedule":"0 * * * *",
+"feedToken":"feed-token","readerPassword":"reader-password","passwordHash":"password-hash",
+"notifiers":[{"type":"telegram","token":"bot-token","chatId":"1"},
+{"type":"webhook","url":"https://example.com/hook","secret":"signing-secret","headers":{"Authorization":"Bearer header"}}]}`
+	for _, out := range []string{
+		call(http.MethodPost, "/api/subscribers", foo),
+		call(http.MethodGet, "/api/subscribers", ""),
+		call(http.MethodGet, "/api/subscribers/foo", ""),
+		call(http.MethodPatch, "/api/subscribers/foo", `{"digestSchedule":"0 8 * * *"}`),
+	} {
+		for _, secret := range secrets {
+			if strings.Contains(out, secret) {
+				t.Fatalf("expect %q left out of the response:\n%s", secret, out)
+			}
+		}
+		if !strings.Contains(out, "https://example.com/hook") {
+			t.Fatalf("expect the rest of the subscriber in the response:\n%s", out)
+		}
+	}
+	// the secrets are kept in the storage.
+	got, _ := subscribers.Get("foo")
+	if got.FeedToken != "feed-token" || got.Notifiers[0].Token != "bot-token" || got.Notifiers[1].Secret != "signing-secret" {
+		t.Fatalf("expect the secrets kept, got %+v", got)
+	}
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maxnilz/feed/errors"
+)
+
+const (
+	webSessionCookie = "feed_session"
+	webSessionTTL    = 30 * 24 * time.Hour
+	// loginLinkTTL is how long the magic links are valid.
+	loginLinkTTL = 15 * time.Minute
+)
+
+// Web serves the web reader at /web/, in which the subscribers read the
+// saved items by site, search them & mark them as read or starred.
+//
+// A subscriber signs in by the email & the password matching the password
+// hash, or by the one-time magic link mailed to the email. The session is
+// kept in a signed cookie.
+type Web struct {
+	subscribers *Subscribers
+	items       *Items
+	storage     Storage
+	server      *Server
+	// mailbox sends the magic links, which are disabled if it's nil.
+	mailbox Notifier
+	from    string
+	// secret signs the session cookies, it's the link secret of the
+	// server or a random one, with which the sessions don't survive the
+	// restarts.
+	secret []byte
+	logger Logger
+}
+
+func NewWeb(cfg Config, subscribers *Subscribers, storage Storage, items *Items, mailbox Notifier, server *Server, logger Logger) (*Web, error) {
+	secret := []byte(cfg.Server.LinkSecret)
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, errors.Newf(errors.Internal, err, "generate session secret failed")
+		}
+	}
+	return &Web{
+		subscribers: subscribers,
+		items:       items,
+		storage:     storage,
+		server:      server,
+		mailbox:     mailbox,
+		from:        cfg.MailSender.SenderAddr,
+		secret:      secret,
+		logger:      logger,
+	}, nil
+}
+
+func (s *Web) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/web")
+	switch path {
+	case "/login":
+		s.serveLogin(w, r)
+		return
+	case "/login/email":
+		s.serveLoginEmail(w, r)
+		return
+	case "/login/link":
+		s.serveLoginLink(w, r)
+		return
+	case "/logout":
+		if r.Method != http.MethodPost {
+			s.methodNotAllowed(w, "POST")
+			return
+		}
+		s.setSession(w, r, "", time.Unix(0, 0))
+		http.Redirect(w, r, "/web/login", http.StatusSeeOther)
+		return
+	}
+	subscriber, csrf, ok := s.session(r)
+	if !ok {
+		http.Redirect(w, r, "/web/login", http.StatusSeeOther)
+		return
+	}
+	switch {
+	case path == "" || path == "/":
+		if r.Method != http.MethodGet {
+			s.methodNotAllowed(w, "GET")
+			return
+		}
+		s.serveList(w, r, subscriber, csrf)
+	case strings.HasPrefix(path, "/items/"):
+		seq, err := strconv.ParseInt(strings.TrimPrefix(path, "/items/"), 10, 64)
+		if err != nil {
+			s.writeMessage(w, errors.Newf(errors.NotFound, nil, "item not found"), "")
+			return
+		}
+		s.serveItem(w, r, subscriber, csrf, seq)
+	default:
+		s.writeMessage(w, errors.Newf(errors.NotFound, nil, "page not found"), "")
+	}
+}
+
+func (s *Web) serveLogin(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.render(w, http.StatusOK, "login", webLoginPage{MagicLinks: s.mailbox != nil})
+	case http.MethodPost:
+		email, password := r.PostFormValue("email"), r.PostFormValue("password")
+		subscriber, ok := s.subscribers.GetByEmail(email)
+		if !ok || subscriber.PasswordHash == "" || !verifyPassword(subscriber.PasswordHash, password) {
+			s.logger.Info("web login failed", "email", email)
+			s.render(w, http.StatusUnauthorized, "login", webLoginPage{
+				MagicLinks: s.mailbox != nil,
+				Email:      email,
+				Error:      "Invalid email or password.",
+			})
+			return
+		}
+		s.setSession(w, r, subscriber.Name, time.Now().Add(webSessionTTL))
+		http.Redirect(w, r, "/web/", http.StatusSeeOther)
+	default:
+		s.methodNotAllowed(w, "GET, POST")
+	}
+}
+
+// serveLoginEmail mails the magic link to the email if it's subscribed,
+// the response is the same either way so as not to tell the emails.
+func (s *Web) serveLoginEmail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.methodNotAllowed(w, "POST")
+		return
+	}
+	if s.mailbox == nil {
+		s.writeMessage(w, errors.Newf(errors.NotFound, nil, "magic links are disabled"), "")
+		return
+	}
+	email := r.PostFormValue("email")
+	if subscriber, ok := s.subscribers.GetByEmail(email); ok {
+		if err := s.sendLoginLink(r, subscriber); err != nil {
+			s.writeMessage(w, err, "")
+			return
+		}
+	}
+	s.writeMessage(w, nil, "If "+email+" is subscribed, a sign-in link is sent to it.")
+}
+
+func (s *Web) sendLoginLink(r *http.Request, subscriber Subscriber) error {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return errors.Newf(errors.Internal, err, "generate login token failed")
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	ses, err := s.storage.NewAutoSession(r.Context())
+	if err != nil {
+		return err
+	}
+	expiresAt := time.Now().Add(loginLinkTTL)
+	if err = s.storage.CreateLoginToken(ses, LoginToken{Hash: loginTokenHash(token), Subscriber: subscriber.Name, ExpiresAt: expiresAt}); err != nil {
+		return err
+	}
+	u := s.server.requestURL(r)
+	u.Path = strings.TrimSuffix(u.Path, "/email") + "/link"
+	u.RawQuery = url.Values{"token": {token}}.Encode()
+	const title = "Sign in to the feed reader"
+	buf := bytes.Buffer{}
+	mailRenderer{from: s.from}.writeHeaders(&buf, Email(subscriber.Email), mailHeader{
+		from:      s.from,
+		subject:   title,
+		messageId: newMessageId(s.from),
+	})
+	buf.WriteString("<body><p>")
+	writeLink(&buf, u.String(), title)
+	buf.WriteString("</p><p>The link is valid for 15 minutes & can be used once.</p></body>")
+	msg := &Message{Email: Email(subscriber.Email), Notifier: NotifierEmail, Subject: title, Body: buf.Bytes()}
+	if err = s.mailbox.Send(r.Context(), msg); err != nil {
+		return err
+	}
+	s.logger.Info("login link sent", "subscriber", subscriber.Name)
+	return nil
+}
+
+// serveLoginLink signs the subscriber in by the magic link, which asks
+// for a confirmation on GET so that it's not used up by the link scanners.
+func (s *Web) serveLoginLink(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+	switch r.Method {
+	case http.MethodGet:
+		s.render(w, http.StatusOK, "confirm", webConfirmPage{Token: token})
+	case http.MethodPost:
+		ses, err := s.storage.NewAutoSession(r.Context())
+		if err != nil {
+			s.writeMessage(w, err, "")
+			return
+		}
+		name, err := s.storage.ConsumeLoginToken(ses, loginTokenHash(token), time.Now())
+		if err != nil {
+			s.writeMessage(w, err, "")
+			return
+		}
+		if _, ok := s.subscribers.Get(name); !ok {
+			s.writeMessage(w, errors.Newf(errors.NotFound, nil, "subscriber %s not found", name), "")
+			return
+		}
+		s.setSession(w, r, name, time.Now().Add(webSessionTTL))
+		http.Redirect(w, r, "/web/", http.StatusSeeOther)
+	default:
+		s.methodNotAllowed(w, "GET, POST")
+	}
+}
+
+func loginTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *Web) serveList(w http.ResponseWriter, r *http.Request, subscriber Subscriber, csrf string) {
+	q := r.URL.Query()
+	page := webListPage{
+		Subscriber: subscriber.Name,
+		State:      q.Get("state"),
+		Site:       q.Get("site"),
+		Search:     q.Get("q"),
+		States:     []string{ItemStateUnread, ItemStateStarred, ItemStateRead, ItemStateArchived, ItemStateAll},
+		CSRF:       csrf,
+	}
+	if page.State == "" {
+		page.State = ItemStateUnread
+	}
+	req := ItemListRequest{Subscriber: subscriber.Name, State: page.State, SiteName: page.Site, Search: page.Search}
+	if b := q.Get("before"); b != "" {
+		var err error
+		if req.Before, err = strconv.ParseInt(b, 10, 64); err != nil {
+			s.writeMessage(w, errors.Newf(errors.InvalidArgument, err, "invalid before %q", b), "")
+			return
+		}
+	}
+	ctx := r.Context()
+	counts, err := s.items.UnreadCounts(ctx, subscriber.Name)
+	if err != nil {
+		s.writeMessage(w, err, "")
+		return
+	}
+	page.Sites = webSites(subscriber, counts)
+	for _, n := range counts {
+		page.Unread += n
+	}
+	items, err := s.items.List(ctx, req)
+	if err != nil {
+		s.writeMessage(w, err, "")
+		return
+	}
+	for _, it := range items {
+		page.Items = append(page.Items, webItem{Item: it, CSRF: csrf, Return: r.URL.RequestURI()})
+	}
+	if len(items) > 0 && len(items) == pageLimit(req.Limit) {
+		next := url.Values{"state": {page.State}, "before": {strconv.FormatInt(items[len(items)-1].Seq, 10)}}
+		if page.Site != "" {
+			next.Set("site", page.Site)
+		}
+		if page.Search != "" {
+			next.Set("q", page.Search)
+		}
+		page.Next = "/web/?" + next.Encode()
+	}
+	s.render(w, http.StatusOK, "list", page)
+}
+
+func (s *Web) serveItem(w http.ResponseWriter, r *http.Request, subscriber Subscriber, csrf string, seq int64) {
+	ctx := r.Context()
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if !hmac.Equal([]byte(r.PostFormValue("csrf")), []byte(csrf)) {
+			s.writeMessage(w, errors.Newf(errors.PermissionDenied, nil, "invalid form, please reload the page"), "")
+			return
+		}
+		var change ItemChange
+		for _, v := range []struct {
+			field string
+			to    **bool
+		}{{"read", &change.Read}, {"starred", &change.Starred}, {"archived", &change.Archived}} {
+			if val := r.PostFormValue(v.field); val != "" {
+				*v.to = boolPtr(val == "true")
+			}
+		}
+		if err := s.items.Update(ctx, subscriber.Name, []int64{seq}, change); err != nil {
+			s.writeMessage(w, err, "")
+			return
+		}
+		to := r.PostFormValue("return")
+		if !strings.HasPrefix(to, "/web/") {
+			to = "/web/items/" + strconv.FormatInt(seq, 10)
+		}
+		http.Redirect(w, r, to, http.StatusSeeOther)
+		return
+	default:
+		s.methodNotAllowed(w, "GET, POST")
+		return
+	}
+	it, err := s.items.Get(ctx, subscriber.Name, seq)
+	if err != nil {
+		s.writeMessage(w, err, "")
+		return
+	}
+	content := it.Content
+	if content == "" {
+		content = it.Description
+	}
+	base, _ := url.Parse(it.Link)
+	s.render(w, http.StatusOK, "item", webItemPage{
+		Subscriber: subscriber.Name,
+		Item:       webItem{Item: it, CSRF: csrf, Return: r.URL.RequestURI()},
+		Content:    template.HTML(sanitizeHTML(content, base)),
+	})
+}
+
+// webSites returns the sites of the subscriber with the unread counts.
+func webSites(subscriber Subscriber, counts map[string]int) []webSite {
+	var sites []webSite
+	for _, site := range subscriber.Sites {
+		it := webSite{Name: site.Name}
+		for siteURL, name := range siteNames([]Site{site}) {
+			if name == site.Name {
+				it.Unread += counts[siteURL]
+			}
+		}
+		sites = append(sites, it)
+	}
+	return sites
+}
+
+// session returns the subscriber signed in by the session cookie & the
+// csrf token of the session.
+func (s *Web) session(r *http.Request) (Subscriber, string, bool) {
+	c, err := r.Cookie(webSessionCookie)
+	if err != nil {
+		return Subscriber{}, "", false
+	}
+	parts := strings.Split(c.Value, ".")
+	if len(parts) != 3 || !hmac.Equal([]byte(parts[2]), []byte(s.sign("session", parts[0], parts[1]))) {
+		return Subscriber{}, "", false
+	}
+	exp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().After(time.Unix(exp, 0)) {
+		return Subscriber{}, "", false
+	}
+	name, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return Subscriber{}, "", false
+	}
+	subscriber, ok := s.subscribers.Get(string(name))
+	if !ok {
+		return Subscriber{}, "", false
+	}
+	return subscriber, s.sign("csrf", c.Value), true
+}
+
+// setSession signs the subscriber in until the expiry, or out if the
+// name is empty.
+func (s *Web) setSession(w http.ResponseWriter, r *http.Request, name string, expires time.Time) {
+	c := &http.Cookie{
+		Name:     webSessionCookie,
+		Path:     "/web/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   s.server.requestURL(r).Scheme == "https",
+		SameSite: http.SameSiteLaxMode,
+	}
+	if name == "" {
+		c.MaxAge = -1
+	} else {
+		encoded := base64.RawURLEncoding.EncodeToString([]byte(name))
+		exp := strconv.FormatInt(expires.Unix(), 10)
+		c.Value = encoded + "." + exp + "." + s.sign("session", encoded, exp)
+	}
+	http.SetCookie(w, c)
+}
+
+func (s *Web) sign(values ...string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	for _, v := range values {
+		mac.Write([]byte(v))
+		mac.Write([]byte{0})
+	}
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Web) methodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+}
+
+// writeMessage writes the error, or the message if err is nil, as a page.
+func (s *Web) writeMessage(w http.ResponseWriter, err error, msg string) {
+	status := http.StatusOK
+	if err != nil {
+		status = httpStatus(err)
+		msg = errors.Message(err)
+		if status == http.StatusInternalServerError {
+			s.logger.Error(err, "serve web reader failed")
+			msg = http.StatusText(status)
+		}
+	}
+	s.render(w, status, "message", msg)
+}
+
+func (s *Web) render(w http.ResponseWriter, status int, name string, data interface{}) {
+	buf := bytes.Buffer{}
+	if err := webTemplates.ExecuteTemplate(&buf, name, data); err != nil {
+		s.logger.Error(err, "render web page failed", "page", name)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; img-src * data:; style-src 'unsafe-inline'; form-action 'self'")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.WriteHeader(status)
+	_, _ = w.Write(buf.Bytes())
+}
+
+type webLoginPage struct {
+	MagicLinks bool
+	Email      string
+	Error      string
+}
+
+type webConfirmPage struct {
+	Token string
+}
+
+type webSite struct {
+	Name   string
+	Unread int
+}
+
+// webItem is an item along with the form fields to toggle its state.
+type webItem struct {
+	*Item
+	CSRF   string
+	Return string
+}
+
+type webListPage struct {
+	Subscriber string
+	Unread     int
+	Sites      []webSite
+	State      string
+	States     []string
+	Site       string
+	Search     string
+	Items      []webItem
+	// Next is the url of the page of the older items.
+	Next string
+	CSRF string
+}
+
+type webItemPage struct {
+	Subscriber string
+	Item       webItem
+	Content    template.HTML
+}
+
+var webTemplates = template.Must(template.New("web").Funcs(template.FuncMap{
+	"siteURL": func(site string) string { return "/web/?" + url.Values{"site": {site}}.Encode() },
+	"stateURL": func(state, site, search string) string {
+		v := url.Values{"state": {state}}
+		if site != "" {
+			v.Set("site", site)
+		}
+		if search != "" {
+			v.Set("q", search)
+		}
+		return "/web/?" + v.Encode()
+	},
+	"date": func(t time.Time) string { return t.Local().Format("02 Jan 2006 15:04") },
+}).Parse(`
+{{define "head"}}<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1">
+<title>feed</title>
+<style>
+body{font-family:sans-serif;margin:0;color:#222}
+header{padding:.5em 1em;background:#f4f4f4;border-bottom:1px solid #ddd;display:flex;gap:1em;align-items:center}
+header form{margin-left:auto}
+main{display:flex}
+nav{min-width:14em;padding:1em;border-right:1px solid #eee}
+nav a,nav span{display:block;padding:.2em 0}
+section{padding:1em;flex:1;max-width:50em}
+ol{padding-left:0;list-style:none}
+li{padding:.5em 0;border-bottom:1px solid #eee}
+.meta{color:#777;font-size:.85em}
+.read>a{color:#777}
+form.inline{display:inline}
+button{font-size:.8em}
+article img{max-width:100%;height:auto}
+.error{color:#b00}
+</style></head><body>{{end}}
+
+{{define "header"}}<header><a href="/web/">feed</a><span>{{.}}</span>
+<form method="get" action="/web/" class="inline"><input type="search" name="q" placeholder="search"></form>
+<form method="post" action="/web/logout" class="inline"><button type="submit">sign out</button></form></header>{{end}}
+
+{{define "toggles"}}<form method="post" action="/web/items/{{.Seq}}" class="inline">
+<input type="hidden" name="csrf" value="{{.CSRF}}"><input type="hidden" name="return" value="{{.Return}}">
+{{if .Read}}<button name="read" value="false">mark unread</button>{{else}}<button name="read" value="true">mark read</button>{{end}}
+{{if .Starred}}<button name="starred" value="false">unstar</button>{{else}}<button name="starred" value="true">star</button>{{end}}
+</form>{{end}}
+
+{{define "message"}}{{template "head"}}<section><p>{{.}}</p><p><a href="/web/">back</a></p></section></body></html>{{end}}
+
+{{define "login"}}{{template "head"}}<section><h1>Sign in</h1>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+<form method="post" action="/web/login">
+<p><input type="email" name="email" placeholder="email" value="{{.Email}}" required></p>
+<p><input type="password" name="password" placeholder="password" required></p>
+<p><button type="submit">Sign in</button></p></form>
+{{if .MagicLinks}}<form method="post" action="/web/login/email">
+<p><input type="email" name="email" placeholder="email" value="{{.Email}}" required>
+<button type="submit">Email me a sign-in link</button></p></form>{{end}}
+</section></body></html>{{end}}
+
+{{define "confirm"}}{{template "head"}}<section><form method="post" action="/web/login/link">
+<input type="hidden" name="token" value="{{.Token}}"><p><button type="submit">Sign in</button></p></form>
+</section></body></html>{{end}}
+
+{{define "list"}}{{template "head"}}{{template "header" .Subscriber}}<main><nav>
+<a href="/web/">All sites ({{.Unread}})</a>
+{{range .Sites}}<a href="{{siteURL .Name}}">{{.Name}}{{if .Unread}} ({{.Unread}}){{end}}</a>{{end}}
+</nav><section>
+<p>{{range .States}}{{if eq . $.State}}<b>{{.}}</b>{{else}}<a href="{{stateURL . $.Site $.Search}}">{{.}}</a>{{end}} {{end}}
+{{if .Site}}in <b>{{.Site}}</b>{{end}} {{if .Search}}matching <b>{{.Search}}</b>{{end}}</p>
+<ol>{{range .Items}}<li class="{{if .Read}}read{{end}}"><a href="/web/items/{{.Seq}}">{{if .Title}}{{.Title}}{{else}}(untitled){{end}}</a>
+{{if .Starred}}&#9733;{{end}}
+<div class="meta">{{.SiteName}} &middot; {{date .SavedAt}} {{template "toggles" .}}</div></li>
+{{else}}<li>No items.</li>{{end}}</ol>
+{{if .Next}}<p><a href="{{.Next}}">older</a></p>{{end}}
+</section></main></body></html>{{end}}
+
+{{define "item"}}{{template "head"}}{{template "header" .Subscriber}}<main><section><article>
+{{with .Item}}<h1>{{if .Title}}{{.Title}}{{else}}(untitled){{end}}</h1>
+<p class="meta">{{.SiteName}}{{if .Author}} &middot; {{.Author}}{{end}}{{if .PublishedAt}} &middot; {{.PublishedAt}}{{end}}
+{{if .Link}} &middot; <a href="{{.Link}}" rel="noopener noreferrer" target="_blank">original</a>{{end}}</p>
+<p>{{template "toggles" .}}</p>{{end}}
+{{.Content}}
+</article><p><a href="/web/">back</a></p></section></main></body></html>{{end}}
+`))
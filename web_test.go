@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestWeb(t *testing.T) {
+	s := newTestSQLite(t)
+	subscriber := Subscriber{
+		Name:         "foo",
+		Email:        "foo@example.com",
+		PasswordHash: hashPassword("p4ssw0rd", []byte("salt"), 1000),
+		Sites: []Site{
+			{Name: "site 0", URL: "https://site0.com/index.rss"},
+			{Name: "site 1", URL: "https://site1.com/index.rss"},
+		},
+	}
+	cfg := Config{
+		MailSender:  MailSender{SenderAddr: "sender@example.com"},
+		Subscribers: []Subscriber{subscriber},
+	}
+	feeds := makeTestFeeds("foo@example.com", 2, 2, "hello")
+	feeds.List[0].Content = `<p onclick="x()">safe <b>bold</b><script>alert(1)</script><a href="javascript:x()">js</a><img src="/a.png"></p>`
+	feeds.List[3].Title = "goodbye 1-1"
+	ses, _ := s.NewAutoSession(context.Background())
+	if err := s.SaveFeeds(ses, feeds.List...); err != nil {
+		t.Fatal(err)
+	}
+	subscribers := NewSubscribers(cfg.Subscribers)
+	server, err := NewServer(cfg, DiscardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mailbox := &fakeMailbox{}
+	web, err := NewWeb(cfg, subscribers, s, NewItems(subscribers, s, DiscardLogger), mailbox, server, DiscardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Handle("/web/", web)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	newClient := func() *http.Client {
+		jar, _ := cookiejar.New(nil)
+		return &http.Client{Jar: jar}
+	}
+	fetch := func(c *http.Client, method, path string, form url.Values) (int, string) {
+		var resp *http.Response
+		var err error
+		if method == http.MethodPost {
+			resp, err = c.PostForm(ts.URL+path, form)
+		} else {
+			resp, err = c.Get(ts.URL + path)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	c := newClient()
+	if _, body := fetch(c, http.MethodGet, "/web/", nil); !strings.Contains(body, "Sign in") {
+		t.Fatalf("expect the login page, got %s", body)
+	}
+	if status, _ := fetch(c, http.MethodPost, "/web/login", url.Values{"email": {"foo@example.com"}, "password": {"wrong"}}); status != http.StatusUnauthorized {
+		t.Fatalf("expect 401 with a wrong password, got %d", status)
+	}
+	status, body := fetch(c, http.MethodPost, "/web/login", url.Values{"email": {"FOO@example.com"}, "password": {"p4ssw0rd"}})
+	if status != http.StatusOK || !strings.Contains(body, "All sites (4)") || !strings.Contains(body, "site 1 (2)") {
+		t.Fatalf("unexpected list page: %d %s", status, body)
+	}
+
+	_, body = fetch(c, http.MethodGet, "/web/?q=goodbye", nil)
+	if !strings.Contains(body, "goodbye 1-1") || strings.Contains(body, "hello 0-0") {
+		t.Fatalf("unexpected search result: %s", body)
+	}
+	_, body = fetch(c, http.MethodGet, "/web/?site=site+0", nil)
+	seq := regexp.MustCompile(`href="/web/items/(\d+)">hello 0-0`).FindStringSubmatch(body)
+	if seq == nil || strings.Contains(body, "hello 1-0") {
+		t.Fatal("missing item in the site list")
+	}
+	_, body = fetch(c, http.MethodGet, "/web/items/"+seq[1], nil)
+	for _, unsafe := range []string{"<script", "onclick", "javascript:"} {
+		if strings.Contains(body, unsafe) {
+			t.Fatalf("unsanitized content %q: %s", unsafe, body)
+		}
+	}
+	if !strings.Contains(body, "safe <b>bold</b>") || !strings.Contains(body, `src="https://site0.com/a.png"`) {
+		t.Fatalf("unexpected sanitized content: %s", body)
+	}
+	csrf := regexp.MustCompile(`name="csrf" value="([^"]+)"`).FindStringSubmatch(body)
+	if csrf == nil {
+		t.Fatal("missing csrf token")
+	}
+	if status, _ := fetch(c, http.MethodPost, "/web/items/"+seq[1], url.Values{"read": {"true"}}); status != http.StatusForbidden {
+		t.Fatalf("expect 403 without csrf token, got %d", status)
+	}
+	_, body = fetch(c, http.MethodPost, "/web/items/"+seq[1], url.Values{"csrf": {csrf[1]}, "read": {"true"}, "starred": {"true"}, "return": {"/web/"}})
+	if !strings.Contains(body, "All sites (3)") || !strings.Contains(body, "site 0 (1)") {
+		t.Fatalf("unexpected list page after marking read: %s", body)
+	}
+	if _, body = fetch(c, http.MethodGet, "/web/?state=starred", nil); !strings.Contains(body, "hello 0-0") {
+		t.Fatalf("expect the starred item, got %s", body)
+	}
+	fetch(c, http.MethodPost, "/web/logout", url.Values{})
+	if _, body = fetch(c, http.MethodGet, "/web/", nil); !strings.Contains(body, "Sign in") {
+		t.Fatalf("expect the login page after logout, got %s", body)
+	}
+
+	// sign in by the magic link, which can be used once.
+	c = newClient()
+	if _, body = fetch(c, http.MethodPost, "/web/login/email", url.Values{"email": {"nobody@example.com"}}); len(mailbox.sent) != 0 {
+		t.Fatalf("unexpected mail to an unknown email: %s", body)
+	}
+	fetch(c, http.MethodPost, "/web/login/email", url.Values{"email": {"foo@example.com"}})
+	if len(mailbox.sent) != 1 || mailbox.sent[0].Email != "foo@example.com" {
+		t.Fatalf("expect the login link mailed, got %+v", mailbox.sent)
+	}
+	link := regexp.MustCompile(`href="([^"]+)"`).FindStringSubmatch(string(mailbox.sent[0].Body))
+	if link == nil {
+		t.Fatalf("missing login link: %s", mailbox.sent[0].Body)
+	}
+	u, _ := url.Parse(strings.ReplaceAll(link[1], "&amp;", "&"))
+	if _, body = fetch(c, http.MethodGet, u.RequestURI(), nil); !strings.Contains(body, "Sign in") {
+		t.Fatalf("expect the confirmation page, got %s", body)
+	}
+	token := url.Values{"token": {u.Query().Get("token")}}
+	if status, body = fetch(c, http.MethodPost, "/web/login/link", token); status != http.StatusOK || !strings.Contains(body, "All sites (3)") {
+		t.Fatalf("unexpected page after the login link: %d %s", status, body)
+	}
+	if status, _ = fetch(newClient(), http.MethodPost, "/web/login/link", token); status != http.StatusNotFound {
+		t.Fatalf("expect 404 on a used login link, got %d", status)
+	}
+}
+
+func TestPasswordHash(t *testing.T) {
+	hash := hashPassword("secret", []byte("0123456789abcdef"), 10)
+	if !verifyPassword(hash, "secret") || verifyPassword(hash, "Secret") || verifyPassword("secret", "secret") {
+		t.Fatalf("unexpected verification of %s", hash)
+	}
+	// the test vector of PBKDF2-HMAC-SHA256 with 2 iterations.
+	key := pbkdf2SHA256([]byte("password"), []byte("salt"), 2, 32)
+	if got := hex.EncodeToString(key); got != "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43" {
+		t.Fatalf("unexpected derived key %s", got)
+	}
+}
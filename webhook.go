@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"text/template"
+	"time"
+
+	"github.com/maxnilz/feed/errors"
+)
+
+const (
+	NotifierWebhook = "webhook"
+
+	// webhookSignatureHeader carries the hex encoded HMAC-SHA256 of the
+	// request body keyed by the shared secret, prefixed with "sha256=".
+	webhookSignatureHeader = "X-Feed-Signature-256"
+)
+
+// webhookNotifier posts the new feeds of a subscriber to a custom url
+// as a json document, or a document rendered by the given template.
+type webhookNotifier struct {
+	url         string
+	header      http.Header
+	secret      []byte
+	contentType string
+	tmpl        *template.Template
+
+	subscriber Subscriber
+	logger     Logger
+}
+
+func newWebhookNotifier(subscriber Subscriber, nc NotifierConfig, logger Logger) (Notifier, error) {
+	if err := validateWebhookURL(nc); err != nil {
+		return nil, err
+	}
+	n := &webhookNotifier{
+		url:         nc.URL,
+		header:      make(http.Header),
+		secret:      []byte(nc.Secret),
+		contentType: nc.ContentType,
+		subscriber:  subscriber,
+		logger:      logger,
+	}
+	for k, v := range nc.Headers {
+		n.header.Set(k, v)
+	}
+	if nc.Template != "" {
+		tmpl, err := template.New(nc.NameOrType()).Funcs(template.FuncMap{"json": toJSON}).Parse(nc.Template)
+		if err != nil {
+			return nil, errors.Newf(errors.InvalidArgument, err, "invalid webhook template")
+		}
+		n.tmpl = tmpl
+	}
+	if n.contentType == "" {
+		n.contentType = "application/json"
+	}
+	n.header.Set("Content-Type", n.contentType)
+	return n, nil
+}
+
+// WebhookPayload is the document posted to the webhook, it's the data
+// of the template as well.
+type WebhookPayload struct {
+	Subscriber WebhookSubscriber `json:"subscriber"`
+	Sites      []WebhookSite     `json:"sites"`
+	Items      []WebhookItem     `json:"items"`
+}
+
+type WebhookSubscriber struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+type WebhookSite struct {
+	Name  string        `json:"name"`
+	Items []WebhookItem `json:"items"`
+}
+
+type WebhookItem struct {
+	Id          string    `json:"id"`
+	SiteURL     string    `json:"siteUrl"`
+	SiteName    string    `json:"siteName"`
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	Content     string    `json:"content"`
+	Link        string    `json:"link"`
+	UpdatedAt   string    `json:"updatedAt"`
+	PublishedAt string    `json:"publishedAt"`
+	Author      string    `json:"author"`
+	FetchAt     time.Time `json:"fetchAt"`
+}
+
+func newWebhookItem(f *Feed) WebhookItem {
+	return WebhookItem{
+		Id:          f.Id,
+		SiteURL:     f.SiteURL,
+		SiteName:    f.SiteName,
+		Title:       f.Title,
+		Description: f.Description,
+		Content:     f.Content,
+		Link:        f.Link,
+		UpdatedAt:   f.UpdatedAt,
+		PublishedAt: f.PublishedAt,
+		Author:      f.Author,
+		FetchAt:     f.FetchAt,
+	}
+}
+
+func (n *webhookNotifier) Compose(feeds Feeds) ([]*Message, error) {
+	var msgs []*Message
+	for _, email := range feeds.Emails {
+		sitesFeeds, ok := feeds.SitesFeeds(email)
+		if !ok {
+			continue
+		}
+		payload := WebhookPayload{
+			Subscriber: WebhookSubscriber{Name: n.subscriber.Name, Email: email.String()},
+		}
+		var fs []*Feed
+		for _, site := range sitesFeeds.names {
+			siteFeeds, _ := sitesFeeds.get(site)
+			ws := WebhookSite{Name: site}
+			for _, f := range siteFeeds {
+				item := newWebhookItem(f)
+				ws.Items = append(ws.Items, item)
+				payload.Items = append(payload.Items, item)
+				fs = append(fs, f)
+			}
+			payload.Sites = append(payload.Sites, ws)
+		}
+		if len(fs) == 0 {
+			continue
+		}
+		body, err := n.render(payload)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, &Message{Email: email, Subject: subject, Body: body, Feeds: fs})
+	}
+	return msgs, nil
+}
+
+func (n *webhookNotifier) render(payload WebhookPayload) ([]byte, error) {
+	if n.tmpl == nil {
+		return json.Marshal(payload)
+	}
+	var buf bytes.Buffer
+	if err := n.tmpl.Execute(&buf, payload); err != nil {
+		return nil, errors.Newf(errors.InvalidArgument, err, "render webhook template failed")
+	}
+	return buf.Bytes(), nil
+}
+
+func (n *webhookNotifier) Send(ctx context.Context, msg *Message) error {
+	n.logger.Info("Send RSS feeds notification to webhook", "email", msg.Email, "feeds", len(msg.Feeds))
+	header := n.header.Clone()
+	if len(n.secret) > 0 {
+		header.Set(webhookSignatureHeader, signPayload(n.secret, msg.Body))
+	}
+	return postJSON(ctx, n.url, header, msg.Body)
+}
+
+// signPayload returns the signature of the body in the form of
+// sha256=<hex encoded HMAC-SHA256>.
+func signPayload(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// toJSON is the "json" template function, it's handy to embed strings
+// in a json template with proper escaping.
+func toJSON(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
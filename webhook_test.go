@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookNotifier(t *testing.T) {
+	const secret = "s3cr3t"
+	var mu sync.Mutex
+	var bodies [][]byte
+	failures := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Header.Get(webhookSignatureHeader) != signPayload([]byte(secret), body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		bodies = append(bodies, body)
+	}))
+	defer server.Close()
+
+	subscriber := Subscriber{Name: "foo", Email: "foo@example.com", Notifiers: []NotifierConfig{{
+		Type:    NotifierWebhook,
+		URL:     server.URL,
+		Secret:  secret,
+		Headers: map[string]string{"Authorization": "Bearer token"},
+	}}}
+	notifiers, err := NewNotifiers(Config{Subscribers: []Subscriber{subscriber}}, DiscardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestSQLite(t)
+	cfg := Config{Outbox: OutboxConfig{Backoff: time.Nanosecond}}
+	outbox := NewOutbox(cfg, s, notifiers, DiscardLogger)
+	ctx := context.Background()
+
+	feeds := makeTestFeeds("foo@example.com", 2, 2, "hello")
+	msgs, err := notifiers.Compose("foo@example.com", feeds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ses, _ := s.NewAutoSession(ctx)
+	if err = s.SaveFeeds(ses, feeds.List...); err != nil {
+		t.Fatal(err)
+	}
+	if err = outbox.Enqueue(ses, msgs...); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first attempt gets a non-2xx response, the message is retried.
+	deliveries, err := outbox.Deliver(ctx, msgs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 || deliveries[0].Err == nil {
+		t.Fatalf("expected the first delivery to fail")
+	}
+	if err = outbox.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(bodies) != 1 {
+		t.Fatalf("expected 1 request accepted, got %d", len(bodies))
+	}
+
+	var payload WebhookPayload
+	if err = json.Unmarshal(bodies[0], &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Subscriber.Name != "foo" || len(payload.Sites) != 2 || len(payload.Items) != 4 {
+		t.Fatalf("unexpected payload: %s", bodies[0])
+	}
+	if it := payload.Items[0]; it.Link != "https://site0.com/0" || it.PublishedAt == "" {
+		t.Fatalf("unexpected item: %+v", it)
+	}
+}
+
+func TestWebhookTemplate(t *testing.T) {
+	nc := NotifierConfig{
+		Type:        NotifierWebhook,
+		URL:         "https://example.com/hook",
+		ContentType: "text/plain",
+		Template:    `{{.Subscriber.Name}}:{{range .Items}} {{json .Title}}{{end}}`,
+	}
+	n, err := newWebhookNotifier(Subscriber{Name: "foo"}, nc, DiscardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := n.Compose(makeTestFeeds("foo@example.com", 1, 2, `say "hi"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `foo: "say \"hi\" 0-0" "say \"hi\" 0-1"`
+	if len(msgs) != 1 || string(msgs[0].Body) != want {
+		t.Fatalf("expected %s, got %s", want, msgs[0].Body)
+	}
+	if got := n.(*webhookNotifier).header.Get("Content-Type"); got != "text/plain" {
+		t.Fatalf("expected text/plain content type, got %s", got)
+	}
+
+	nc.Template = "{{.Nope"
+	if _, err = newWebhookNotifier(Subscriber{Name: "foo"}, nc, DiscardLogger); err == nil {
+		t.Fatal("expected invalid template error")
+	}
+}
@@ -2,12 +2,13 @@ package main
 
 import (
 	"context"
+	stderr "errors"
 	"fmt"
-	"io"
 	"net/http"
 	"net/url"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/maxnilz/feed/errors"
@@ -15,15 +16,20 @@ import (
 )
 
 type Worker struct {
-	storage Storage
-	mailbox Mailbox
+	storage   Storage
+	notifiers *Notifiers
+	outbox    *Outbox
 
 	subscriber Subscriber
+	digestMu   sync.Mutex
+	quiet      *quietHours
+	// poller is set if the site urls are polled adaptively.
+	poller *poller
 
 	fp *gofeed.Parser
 }
 
-func NewWorker(subscriber Subscriber, storage Storage, mailbox Mailbox) (*Worker, error) {
+func NewWorker(subscriber Subscriber, storage Storage, notifiers *Notifiers, outbox *Outbox) (*Worker, error) {
 	if subscriber.Name == "" {
 		return nil, errors.Newf(errors.InvalidArgument, nil, "subscriber name is required")
 	}
@@ -35,29 +41,163 @@ func NewWorker(subscriber Subscriber, storage Storage, mailbox Mailbox) (*Worker
 			return nil, errors.Newf(errors.InvalidArgument, nil, "found invalid site url in %s", subscriber.Name)
 		}
 	}
-	return &Worker{
+	quiet, err := newQuietHours(subscriber.QuietHours, subscriber.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	w := &Worker{
 		storage:    storage,
-		mailbox:    mailbox,
+		notifiers:  notifiers,
+		outbox:     outbox,
 		subscriber: subscriber,
-		fp:         gofeed.NewParser(),
-	}, nil
+		quiet:      quiet,
+		fp:         newFeedParser(),
+	}
+	if subscriber.Adaptive != nil {
+		if w.poller, err = w.newPoller(context.Background()); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// newPoller returns the poller of the site urls of the subscriber, which
+// resumes from the polling states saved.
+func (w *Worker) newPoller(ctx context.Context) (*poller, error) {
+	ses, err := w.storage.NewAutoSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	polls, err := w.storage.GetEndpointPolls(ses, w.subscriber.Email)
+	if err != nil {
+		return nil, err
+	}
+	var endpoints []string
+	for _, site := range w.subscriber.Sites {
+		for _, endpoint := range append([]string{site.URL}, site.URLs...) {
+			if _, inbound := inboundSiteURL(endpoint); endpoint != "" && !inbound {
+				endpoints = append(endpoints, endpoint)
+			}
+		}
+	}
+	return newPoller(w.subscriber.Adaptive, endpoints, polls), nil
+}
+
+// Schedule returns the schedule of the fetches if the site urls are
+// polled adaptively.
+func (w *Worker) Schedule() Schedule {
+	if w.poller == nil {
+		return nil
+	}
+	return w.poller
+}
+
+// Reschedule rebuilds the schedule of the fetches polled adaptively, i.e.,
+// the polling states are reloaded & bounded by the settings. It's nil if
+// the fetches run by the spec.
+func (w *Worker) Reschedule(ctx context.Context) (Schedule, error) {
+	if w.poller == nil {
+		return nil, nil
+	}
+	ses, err := w.storage.NewAutoSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	polls, err := w.storage.GetEndpointPolls(ses, w.subscriber.Email)
+	if err != nil {
+		return nil, err
+	}
+	w.poller.reset(polls)
+	return w.poller, nil
 }
 
 func (w *Worker) Name() string {
 	return fmt.Sprintf(w.subscriber.Name)
 }
 
+// Run fetches the new feeds of the subscriber, they're sent right away
+// unless the subscriber has a digest schedule or it's in the quiet hours,
+// in which case they're kept pending until the digest. A site failed
+// doesn't stop the others, the errors are returned after the feeds of
+// the others are handled.
 func (w *Worker) Run(ctx context.Context) error {
+	recordRun(ctx, func(run *JobRun) { run.Subscriber = w.subscriber.Name })
+	state, err := w.subscriptionState(ctx)
+	if err != nil || !state.Active(time.Now()) {
+		return err
+	}
 	var feeds Feeds
+	var errs []error
 	for _, site := range w.subscriber.Sites {
-		out, err := w.collectFeedsFromSite(ctx, site)
+		out, err := w.collectFeedsFromSite(ctx, site, state)
 		if err != nil {
-			return err
+			errs = append(errs, err)
 		}
 		feeds.Append(out...)
 	}
-	// log feeds first,
-	// then send feeds & ack later
+	if w.subscriber.DigestSchedule != "" || w.isQuiet(time.Now()) {
+		return stderr.Join(append(errs, w.hold(ctx, feeds))...)
+	}
+	return stderr.Join(append(errs, w.notify(ctx, feeds, true))...)
+}
+
+// Digest sends the pending feeds of the subscriber, they're held until
+// the end of the quiet hours.
+func (w *Worker) Digest(ctx context.Context) error {
+	// The digests of the same subscriber are serialized, so that the
+	// pending feeds are not sent twice.
+	w.digestMu.Lock()
+	defer w.digestMu.Unlock()
+	recordRun(ctx, func(run *JobRun) { run.Subscriber = w.subscriber.Name })
+	state, err := w.subscriptionState(ctx)
+	if err != nil || !state.Active(time.Now()) {
+		return err
+	}
+	if w.isQuiet(time.Now()) {
+		return nil
+	}
+	ses, err := w.storage.NewAutoSession(ctx)
+	if err != nil {
+		return err
+	}
+	pending, err := w.storage.GetPendingFeeds(ses, w.subscriber.Email)
+	if err != nil {
+		return err
+	}
+	names := siteNames(w.subscriber.Sites)
+	var feeds Feeds
+	for _, f := range pending {
+		f.SiteName = f.SiteURL
+		if name, ok := names[f.SiteURL]; ok {
+			f.SiteName = name
+		}
+		feeds.Append(f)
+	}
+	return w.notify(ctx, feeds, false)
+}
+
+// markUpdates marks the feeds whose items are sent before as updates,
+// the others start their own threads even if they're updated since they
+// are published.
+func (w *Worker) markUpdates(ctx context.Context, feeds Feeds) error {
+	ses, err := w.storage.NewAutoSession(ctx)
+	if err != nil {
+		return err
+	}
+	for _, feed := range feeds.List {
+		if feed.Update, err = w.storage.IsFeedSent(ses, feed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hold saves the feeds pending until the digest, unless the lease the
+// run is under is lost.
+func (w *Worker) hold(ctx context.Context, feeds Feeds) error {
+	if len(feeds.List) == 0 {
+		return nil
+	}
 	ses, err := w.storage.NewSession(ctx)
 	if err != nil {
 		return err
@@ -66,60 +206,237 @@ func (w *Worker) Run(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	if err = fence(ctx, w.storage, ses); err != nil {
+		_ = ses.Rollback()
+		return err
+	}
 	if err = w.storage.SaveFeeds(ses, feeds.List...); err != nil {
 		_ = ses.Rollback()
 		return err
 	}
-	if err = ses.Commit(); err != nil {
+	return ses.Commit()
+}
+
+// holdsFeeds reports whether the fetched feeds may be kept pending until
+// the digest.
+func (w *Worker) holdsFeeds() bool {
+	return w.subscriber.DigestSchedule != "" || w.quiet != nil
+}
+
+func (w *Worker) isQuiet(t time.Time) bool {
+	return w.quiet != nil && w.quiet.contains(t)
+}
+
+// subscriptionState returns the state of the subscription changed by the
+// subscriber, the feeds are neither fetched nor sent while it's paused
+// or unsubscribed.
+func (w *Worker) subscriptionState(ctx context.Context) (*SubscriptionState, error) {
+	ses, err := w.storage.NewAutoSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return w.storage.GetSubscriptionState(ses, w.subscriber.Email)
+}
+
+// siteNames returns the site names by the site urls.
+func siteNames(sites []Site) map[string]string {
+	names := make(map[string]string)
+	for _, site := range sites {
+		for _, endpoint := range append([]string{site.URL}, site.URLs...) {
+			if siteURL, ok := inboundSiteURL(endpoint); ok {
+				endpoint = siteURL
+			}
+			if endpoint != "" {
+				names[endpoint] = site.Name
+			}
+		}
+	}
+	return names
+}
+
+// notify composes the feeds into messages & delivers them through the
+// outbox, the feeds are saved along with the messages if save is set.
+func (w *Worker) notify(ctx context.Context, feeds Feeds, save bool) error {
+	if len(feeds.List) == 0 {
+		return nil
+	}
+	if err := w.markUpdates(ctx, feeds); err != nil {
+		return err
+	}
+	msgs, err := w.notifiers.Compose(Email(w.subscriber.Email), feeds)
+	if err != nil {
+		return err
+	}
+	// log feeds & enqueue the messages in one transaction,
+	// the outbox sends them & acks the feeds later
+	ses, err := w.storage.NewSession(ctx)
+	if err != nil {
+		return err
+	}
+	ses, err = ses.Begin()
+	if err != nil {
+		return err
+	}
+	if err = fence(ctx, w.storage, ses); err != nil {
+		_ = ses.Rollback()
+		return err
+	}
+	if save {
+		if err = w.storage.SaveFeeds(ses, feeds.List...); err != nil {
+			_ = ses.Rollback()
+			return err
+		}
+	}
+	if err = w.outbox.Enqueue(ses, msgs...); err != nil {
+		_ = ses.Rollback()
 		return err
 	}
-	// Send feeds
-	if err = w.mailbox.SendFeeds(feeds, w.ackFeeds); err != nil {
+	if err = ses.Commit(); err != nil {
 		return err
 	}
+	recordRun(ctx, func(run *JobRun) { run.Sent += len(feeds.List) })
+	// Send the messages right away, the failed ones are left to the
+	// outbox to retry.
+	deliveries, err := w.outbox.Deliver(ctx, msgs...)
+	if err != nil {
+		return errors.Wrapf(err, "ack delivered feeds failed")
+	}
+	var errs []error
+	for _, d := range deliveries {
+		if d.Err != nil {
+			errs = append(errs, errors.Newf(errors.Unavailable, d.Err, "deliver feeds to %s by %s failed", d.Email, d.Notifier))
+		}
+	}
+	return stderr.Join(errs...)
+}
 
-	return nil
+// DigestJob is the job to send the digest of the subscriber.
+type DigestJob struct {
+	*Worker
+}
+
+// digestJobSuffix is appended to the subscriber name to name the digest
+// job.
+const digestJobSuffix = " digest"
+
+func (j DigestJob) Name() string {
+	return j.subscriber.Name + digestJobSuffix
 }
 
-func (w *Worker) collectFeedsFromSite(ctx context.Context, site Site) ([]*Feed, error) {
+func (j DigestJob) Run(ctx context.Context) error {
+	return j.Digest(ctx)
+}
+
+// collectFeedsFromSite returns the feeds collected from the urls of the
+// site, along with the errors of the urls failed, which are recorded in
+// the run as well.
+func (w *Worker) collectFeedsFromSite(ctx context.Context, site Site, state *SubscriptionState) ([]*Feed, error) {
 	var feeds []*Feed
+	var errs []error
 	endpoints := []string{site.URL}
 	endpoints = append(endpoints, site.URLs...)
 	for _, endpoint := range endpoints {
 		if endpoint == "" {
 			continue
 		}
-		fs, err := w.collectFeedsByURL(ctx, site.Name, endpoint)
+		var fs []*Feed
+		var err error
+		siteURL, inbound := inboundSiteURL(endpoint)
+		if state.Muted(endpoint) || (inbound && state.Muted(siteURL)) {
+			continue
+		}
+		if !inbound && w.poller != nil && !w.poller.due(endpoint, time.Now()) {
+			continue
+		}
+		recordRun(ctx, func(run *JobRun) { run.Sites++ })
+		if inbound {
+			fs, err = w.collectInboundFeeds(ctx, site.Name, siteURL)
+		} else {
+			fs, err = w.collectFeedsByURL(ctx, site.Name, endpoint)
+		}
 		if err != nil {
-			return nil, err
+			recordSiteError(ctx, endpoint, err)
+			errs = append(errs, err)
+			continue
 		}
 		feeds = append(feeds, fs...)
 	}
+	return feeds, stderr.Join(errs...)
+}
+
+// collectInboundFeeds returns the feeds received by the smtp receiver
+// under the virtual site which are not saved for the subscriber yet.
+func (w *Worker) collectInboundFeeds(ctx context.Context, name, siteURL string) ([]*Feed, error) {
+	ses, err := w.storage.NewAutoSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	feeds, err := w.storage.GetInboundFeeds(ses, w.subscriber.Email, siteURL)
+	if err != nil {
+		return nil, err
+	}
+	recordRun(ctx, func(run *JobRun) { run.Found += len(feeds) })
+	now := time.Now()
+	for _, f := range feeds {
+		f.SiteName = name
+		f.FetchAt = now
+	}
 	return feeds, nil
 }
 
 func (w *Worker) collectFeedsByURL(ctx context.Context, name, endpoint string) ([]*Feed, error) {
+	feed, header, err := w.fetchFeed(ctx, endpoint)
+	if w.poller != nil {
+		w.poll(ctx, endpoint, feed, header, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return w.collectFeeds(ctx, name, endpoint, feed)
+}
+
+func (w *Worker) fetchFeed(ctx context.Context, endpoint string) (*gofeed.Feed, http.Header, error) {
 	client := http.DefaultClient
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
 	if err != nil {
-		return nil, errors.Newf(errors.Internal, err, "create get request to %v failed", endpoint)
+		return nil, nil, errors.Newf(errors.Internal, err, "create get request to %v failed", endpoint)
 	}
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, errors.Newf(errors.Internal, err, "request feeds to %v failed", endpoint)
+		return nil, nil, errors.Newf(errors.Internal, err, "request feeds to %v failed", endpoint)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return nil, errors.Newf(errors.Internal, nil, "invalid feed response: %v", resp.Status)
+		return nil, nil, errors.Newf(errors.Internal, nil, "invalid feed response: %v", resp.Status)
 	}
-	return w.collectFeeds(ctx, name, endpoint, resp.Body)
+	feed, err := w.fp.Parse(countingReader{ctx: ctx, r: resp.Body})
+	if err != nil {
+		return nil, nil, errors.Newf(errors.Internal, err, "parse feeds at %v failed", endpoint)
+	}
+	return feed, resp.Header, nil
 }
 
-func (w *Worker) collectFeeds(ctx context.Context, name, endpoint string, r io.Reader) ([]*Feed, error) {
-	feed, err := w.fp.Parse(r)
+// poll saves when the url is due next by the feed fetched, the interval
+// is kept if the fetch failed.
+func (w *Worker) poll(ctx context.Context, endpoint string, feed *gofeed.Feed, header http.Header, err error) {
+	now := time.Now()
+	var interval time.Duration
+	if err == nil {
+		interval = w.poller.interval(feed, header, now)
+	}
+	poll := w.poller.update(w.subscriber.Email, endpoint, interval, now)
+	ses, err := w.storage.NewAutoSession(ctx)
+	if err == nil {
+		err = w.storage.SaveEndpointPoll(ses, poll)
+	}
 	if err != nil {
-		return nil, errors.Newf(errors.Internal, err, "parse feeds at %v failed", endpoint)
+		// The state in memory is kept, it's saved by the next poll.
+		recordSiteError(ctx, endpoint, err)
 	}
+}
+
+func (w *Worker) collectFeeds(ctx context.Context, name, endpoint string, feed *gofeed.Feed) ([]*Feed, error) {
+	recordRun(ctx, func(run *JobRun) { run.Found += len(feed.Items) })
 	if len(feed.Items) == 0 {
 		return nil, nil
 	}
@@ -132,7 +449,13 @@ func (w *Worker) collectFeeds(ctx context.Context, name, endpoint string, r io.R
 
 	var feeds []*Feed
 	var cursor time.Time
-	cursor, err = w.storage.GetLatestFeedWaterMark(ses, w.subscriber.Email, endpoint)
+	// The pending feeds are counted in if they're sent by the digest,
+	// otherwise they would be saved again on every fetch.
+	if w.holdsFeeds() {
+		cursor, err = w.storage.GetLatestFetchWaterMark(ses, w.subscriber.Email, endpoint)
+	} else {
+		cursor, err = w.storage.GetLatestFeedWaterMark(ses, w.subscriber.Email, endpoint)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -143,6 +466,7 @@ func (w *Worker) collectFeeds(ctx context.Context, name, endpoint string, r io.R
 			tm = f.UpdatedParsed
 		}
 		if !tm.After(cursor) {
+			recordRun(ctx, func(run *JobRun) { run.Filtered++ })
 			continue
 		}
 		authors := make([]string, 0, len(f.Authors))
@@ -167,27 +491,3 @@ func (w *Worker) collectFeeds(ctx context.Context, name, endpoint string, r io.R
 	}
 	return feeds, nil
 }
-
-func (w *Worker) ackFeeds(feeds ...*Feed) error {
-	ses, err := w.storage.NewSession(context.Background())
-	if err != nil {
-		return err
-	}
-	ses, err = ses.Begin()
-	if err != nil {
-		return err
-	}
-	defer ses.Rollback()
-
-	ids := make([]string, 0, len(feeds))
-	for _, f := range feeds {
-		ids = append(ids, f.Id)
-	}
-	if err = w.storage.AckFeeds(ses, time.Now(), ids...); err != nil {
-		return err
-	}
-	if err = ses.Commit(); err != nil {
-		return err
-	}
-	return nil
-}
@@ -6,10 +6,13 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/http/httptest"
 	"net/textproto"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/maxnilz/feed/errors"
 	"github.com/mmcdole/gofeed"
@@ -41,13 +44,14 @@ func TestWorkerRun(t *testing.T) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	mailbox, err := NewMailbox(config, logger)
+	notifiers, err := NewNotifiers(config, logger)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	subscriber := config.Subscribers[0]
-	w, err := NewWorker(subscriber, storage, mailbox)
+	outbox := NewOutbox(config, storage, notifiers, logger)
+	w, err := NewWorker(subscriber, storage, notifiers, outbox)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -55,6 +59,134 @@ func TestWorkerRun(t *testing.T) {
 	if err = w.Run(ctx); err != nil {
 		t.Fatal(err)
 	}
+	if err = outbox.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWorkerDigest(t *testing.T) {
+	var items strings.Builder
+	for i := 0; i < 5; i++ {
+		items.WriteString(fmt.Sprintf(`<item><guid>%d</guid><title>post %d</title><link>https://foo.com/%d</link>
+<pubDate>Sat, 22 Jul 2023 07:0%d:00 +0000</pubDate></item>`, i, i, i, i))
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, `<?xml version="1.0"?><rss version="2.0"><channel><title>foo</title>%s</channel></rss>`, items.String())
+	}))
+	defer server.Close()
+
+	dir := filepath.Join(t.TempDir(), "Maildir")
+	subscriber := Subscriber{
+		Name:           "foo",
+		Email:          "foo@example.com",
+		Sites:          []Site{{Name: "Foo", URL: server.URL}},
+		DigestSchedule: "0 8 * * *",
+		DigestMaxItems: 3,
+		Notifiers:      []NotifierConfig{{Type: NotifierMaildir, Path: dir}},
+	}
+	cfg := Config{Subscribers: []Subscriber{subscriber}}
+	s := newTestSQLite(t)
+	notifiers, err := NewNotifiers(cfg, DiscardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewWorker(subscriber, s, notifiers, NewOutbox(cfg, s, notifiers, DiscardLogger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// The fetches only accumulate the feeds.
+	for i := 0; i < 2; i++ {
+		if err = w.Run(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ses, _ := s.NewAutoSession(ctx)
+	pending, err := s.GetPendingFeeds(ses, subscriber.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 5 {
+		t.Fatalf("expected 5 pending feeds, got %d", len(pending))
+	}
+	if entries, _ := os.ReadDir(filepath.Join(dir, "new")); len(entries) != 0 {
+		t.Fatalf("expected nothing sent before the digest, got %d", len(entries))
+	}
+
+	for i := 0; i < 2; i++ {
+		if err = (DigestJob{w}).Run(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, _ := os.ReadDir(filepath.Join(dir, "new"))
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 digest, got %d", len(entries))
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "new", entries[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := string(data)
+	if !strings.Contains(body, "New posts from Foo") || strings.Count(body, "<li>") != 3 ||
+		!strings.Contains(body, "and 2 more from Foo") {
+		t.Fatalf("unexpected digest:\n%s", body)
+	}
+	if got := countAckedFeeds(t, s); got != 5 {
+		t.Fatalf("expected 5 acked feeds, got %d", got)
+	}
+}
+
+func TestWorkerOutOfQuietHours(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `<?xml version="1.0"?><rss version="2.0"><channel><title>foo</title>
+<item><guid>0</guid><title>post 0</title><link>https://foo.com/0</link><pubDate>Sat, 22 Jul 2023 07:00:00 +0000</pubDate></item>
+</channel></rss>`)
+	}))
+	defer server.Close()
+
+	dir := filepath.Join(t.TempDir(), "Maildir")
+	// the quiet hours are tomorrow, the feeds are sent right away today.
+	tomorrow := time.Now().AddDate(0, 0, 1).Weekday().String()
+	subscriber := Subscriber{
+		Name:       "foo",
+		Email:      "foo@example.com",
+		Sites:      []Site{{Name: "Foo", URL: server.URL}},
+		QuietHours: &QuietHours{Days: []string{tomorrow}},
+		Notifiers:  []NotifierConfig{{Type: NotifierMaildir, Path: dir}},
+	}
+	cfg := Config{Subscribers: []Subscriber{subscriber}}
+	s := newTestSQLite(t)
+	notifiers, err := NewNotifiers(cfg, DiscardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewWorker(subscriber, s, notifiers, NewOutbox(cfg, s, notifiers, DiscardLogger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err = w.Run(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if entries, _ := os.ReadDir(filepath.Join(dir, "new")); len(entries) != 1 {
+		t.Fatalf("expected the feed sent once right away, got %d", len(entries))
+	}
+	ses, _ := s.NewAutoSession(ctx)
+	if pending, err := s.GetPendingFeeds(ses, subscriber.Email); err != nil || len(pending) != 0 {
+		t.Fatalf("expected no pending feeds, got %d %v", len(pending), err)
+	}
+}
+
+func TestGroupByDay(t *testing.T) {
+	day := func(s string) *Feed { return &Feed{Id: s, FetchAt: mustParseTime(s)} }
+	feeds := []*Feed{day("2023-07-22 07:00:00"), day("2023-07-22 09:00:00"), day("2023-07-23 07:00:00")}
+	days := groupByDay(feeds)
+	if len(days) != 2 || len(days[0]) != 2 || len(days[1]) != 1 {
+		t.Fatalf("unexpected groups: %v", days)
+	}
 }
 
 func TestErr(t *testing.T) {